@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// subnets the AP networks have always been NATed from, used unless the SKVS
+// configures another one
+var defaultSubnets = map[string]string{
+	"wl_private": "10.42.0.0/16",
+	"wl_public":  "10.43.0.0/16",
+}
+
+// dhcpRangeOffset is how many addresses after the network address the
+// default lease range starts, leaving room for the gateway and static hosts
+const dhcpRangeOffset = 10
+
+// readAddressing reads the 'subnet', 'gateway' and 'dhcp_range' ('start-end')
+// settings of a network. Missing settings default to the subnet the network
+// has always been NATed from, its first address as gateway and the rest of
+// the subnet as lease range.
+func readAddressing(dir string, n *network) error {
+	subnetStr, err := readOptionalValue(dir, "subnet", defaultSubnets[n.Name])
+	if err != nil {
+		return err
+	}
+	if subnetStr == "" {
+		return fmt.Errorf("No subnet configured for network '%s'", n.Name)
+	}
+
+	_, subnet, err := net.ParseCIDR(subnetStr)
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("Invalid IPv4 subnet '%s' for network '%s'", subnetStr, n.Name)
+	}
+	subnet.IP = subnet.IP.To4()
+
+	ones, _ := subnet.Mask.Size()
+	if ones > 29 {
+		return fmt.Errorf("Subnet '%s' of network '%s' is too small", subnetStr, n.Name)
+	}
+
+	gatewayStr, err := readOptionalValue(dir, "gateway", ipAdd(subnet.IP, 1).String())
+	if err != nil {
+		return err
+	}
+
+	gateway := net.ParseIP(gatewayStr).To4()
+	if gateway == nil || !subnet.Contains(gateway) {
+		return fmt.Errorf("Gateway '%s' of network '%s' is not an address in %s", gatewayStr, n.Name, subnet)
+	}
+
+	start := ipAdd(subnet.IP, dhcpRangeOffset)
+	if ones > 28 {
+		start = ipAdd(gateway, 1)
+	}
+	end := ipAdd(broadcastAddress(subnet), -1)
+
+	rangeStr, err := readOptionalValue(dir, "dhcp_range", start.String()+"-"+end.String())
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(rangeStr, "-")
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid DHCP range '%s' for network '%s', expected 'start-end'", rangeStr, n.Name)
+	}
+
+	start = net.ParseIP(strings.TrimSpace(parts[0])).To4()
+	end = net.ParseIP(strings.TrimSpace(parts[1])).To4()
+	if start == nil || end == nil || !subnet.Contains(start) || !subnet.Contains(end) || ipToUint32(start) > ipToUint32(end) {
+		return fmt.Errorf("DHCP range '%s' of network '%s' is not a range in %s", rangeStr, n.Name, subnet)
+	}
+
+	n.Subnet = subnet
+	n.Gateway = gateway
+	n.DHCPStart = start
+	n.DHCPEnd = end
+
+	return nil
+}
+
+// readOptionalValue returns the trimmed content of a SKVS key, or def if the
+// key doesn't exist
+func readOptionalValue(dir string, key string, def string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, key))
+	if os.IsNotExist(err) {
+		return def, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(string(data), " \n\r\t"), nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+func ipAdd(ip net.IP, n int) net.IP {
+	return uint32ToIP(uint32(int64(ipToUint32(ip)) + int64(n)))
+}
+
+func broadcastAddress(subnet *net.IPNet) net.IP {
+	return uint32ToIP(ipToUint32(subnet.IP) | ^binary.BigEndian.Uint32(subnet.Mask))
+}
+
+var interfaceIndexByName = func(name string) (int, error) {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return i.Index, nil
+}
+
+// ensureInterfaceAddress assigns the gateway address of a network to its
+// interface. Replacing an existing assignment is not an error.
+func ensureInterfaceAddress(n network) error {
+	index, err := interfaceIndexByName(n.Name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := newRouteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ones, _ := n.Subnet.Mask.Size()
+	ifa := make([]byte, syscall.SizeofIfAddrmsg)
+	ifa[0] = syscall.AF_INET
+	ifa[1] = byte(ones)
+	nativeEndian.PutUint32(ifa[4:8], uint32(index))
+
+	_, err = conn.Execute(nlRequest{
+		Type:  syscall.RTM_NEWADDR,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE,
+		Data: concatBytes(ifa,
+			nlAttr(syscall.IFA_LOCAL, n.Gateway.To4()),
+			nlAttr(syscall.IFA_ADDRESS, n.Gateway.To4()),
+			nlAttr(syscall.IFA_BROADCAST, broadcastAddress(n.Subnet))),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to assign %s/%d to %s: %s", n.Gateway, ones, n.Name, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAddressingDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readAddressing(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNets[1].Subnet, n.Subnet)
+	assert.Equal(t, expectedNets[1].Gateway, n.Gateway)
+	assert.Equal(t, expectedNets[1].DHCPStart, n.DHCPStart)
+	assert.Equal(t, expectedNets[1].DHCPEnd, n.DHCPEnd)
+
+	n = network{Name: "wl_other"}
+	err = readAddressing(dir, &n)
+	assert.NotNil(t, err, "networks without a default subnet must be configured")
+}
+
+func TestReadAddressing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "subnet"), []byte("192.168.7.0/24\n"), 0644)
+	assert.Nil(t, err)
+
+	n := network{Name: "wl_private"}
+	err = readAddressing(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, net.IP{192, 168, 7, 1}, n.Gateway)
+	assert.Equal(t, net.IP{192, 168, 7, 10}, n.DHCPStart)
+	assert.Equal(t, net.IP{192, 168, 7, 254}, n.DHCPEnd)
+
+	err = ioutil.WriteFile(path.Join(dir, "gateway"), []byte("192.168.7.254"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "dhcp_range"), []byte("192.168.7.100-192.168.7.200"), 0644)
+	assert.Nil(t, err)
+
+	err = readAddressing(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, net.IP{192, 168, 7, 254}, n.Gateway)
+	assert.Equal(t, net.IP{192, 168, 7, 100}, n.DHCPStart)
+	assert.Equal(t, net.IP{192, 168, 7, 200}, n.DHCPEnd)
+
+	for _, bad := range []string{"192.168.8.100-192.168.8.200", "192.168.7.200-192.168.7.100", "192.168.7.100"} {
+		err = ioutil.WriteFile(path.Join(dir, "dhcp_range"), []byte(bad), 0644)
+		assert.Nil(t, err)
+		assert.NotNil(t, readAddressing(dir, &n), bad)
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "gateway"), []byte("10.0.0.1"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readAddressing(dir, &n))
+}
+
+func TestEnsureInterfaceAddress(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockRoutes(conn, nil)()
+
+	orig := interfaceIndexByName
+	defer func() { interfaceIndexByName = orig }()
+	interfaceIndexByName = func(name string) (int, error) {
+		return 7, nil
+	}
+
+	err := ensureInterfaceAddress(expectedNets[0])
+	assert.Nil(t, err)
+
+	req := conn.Requests[0][0]
+	assert.Equal(t, uint16(syscall.RTM_NEWADDR), req.Type)
+	assert.NotZero(t, req.Flags&syscall.NLM_F_REPLACE)
+	assert.Equal(t, byte(16), req.Data[1])
+	assert.Equal(t, uint32(7), nativeEndian.Uint32(req.Data[4:8]))
+
+	attrs, err := parseNlAttrs(req.Data[syscall.SizeofIfAddrmsg:])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{10, 42, 0, 1}, attrs[0].Data)
+	assert.Equal(t, []byte{10, 42, 255, 255}, attrs[2].Data)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	iflaVLANID   = 1
+
+	maxVLANID = 4094
+)
+
+// readBridging reads the optional 'bridge', 'vlan' and 'vlan_interface' of a
+// network. A bridged network is switched onto the wired segment instead of
+// being routed and NATed, so it has no subnet, DHCP server or IPv6 prefix of
+// its own. A VLAN, like dynamic VLANs read before, needs the wired interface
+// to tag it on, which isn't necessarily the uplink.
+func readBridging(dir string, n *network) error {
+	vlan, err := readOptionalValue(dir, "vlan", "")
+	if err != nil {
+		return err
+	}
+
+	if vlan != "" {
+		n.VLAN, err = strconv.Atoi(vlan)
+		if err != nil || n.VLAN < 1 || n.VLAN > maxVLANID {
+			return fmt.Errorf("Invalid VLAN ID '%s' for network '%s'", vlan, n.Name)
+		}
+	}
+
+	def := ""
+	if n.VLAN != 0 {
+		def = fmt.Sprintf("br-vlan%d", n.VLAN)
+	}
+
+	n.Bridge, err = readOptionalValue(dir, "bridge", def)
+	if err != nil {
+		return err
+	}
+	if len(n.Bridge) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("Bridge name '%s' of network '%s' is too long", n.Bridge, n.Name)
+	}
+
+	n.VLANInterface, err = readOptionalValue(dir, "vlan_interface", "")
+	if err != nil {
+		return err
+	}
+	if n.VLAN != 0 && n.VLANInterface == "" {
+		return fmt.Errorf("VLAN %d of network '%s' needs the 'vlan_interface' to tag it on", n.VLAN, n.Name)
+	}
+	if n.DynamicVLAN != dynamicVLANOff && n.VLANInterface == "" {
+		return fmt.Errorf("Dynamic VLANs of network '%s' need the 'vlan_interface' to tag them on", n.Name)
+	}
+
+	if n.Bridge != "" && n.Isolate {
+		log.Warnf("Network '%s' is bridged, only client isolation applies, not the LAN isolation rules", n.Name)
+	}
+
+	return nil
+}
+
+// routedNetworks returns the networks that aren't bridged, i.e. those we
+// address, serve DHCP on and NAT
+func routedNetworks(networks []network) []network {
+	var routed []network
+	for _, n := range networks {
+		if n.Bridge == "" {
+			routed = append(routed, n)
+		}
+	}
+	return routed
+}
+
+// vlanInterfaceName follows the 'eth0.10' convention of vconfig
+func vlanInterfaceName(parent string, vlan int) (string, error) {
+	name := fmt.Sprintf("%s.%d", parent, vlan)
+	if len(name) >= syscall.IFNAMSIZ {
+		return "", fmt.Errorf("VLAN interface name '%s' is too long", name)
+	}
+	return name, nil
+}
+
+// ensureBridges creates the bridges of all bridged networks and, for networks
+// with a VLAN, the tagged subinterface of the wired interface as their port.
+// hostapd adds the wireless interface itself. Existing links are left as they
+// are, so this is safe to run on every start.
+func ensureBridges(networks []network) error {
+	for _, n := range networks {
+		if n.Bridge == "" {
+			continue
+		}
+
+		err := ensureBridge(n)
+		if err != nil {
+			return fmt.Errorf("Failed to set up bridge %s for network '%s': %s", n.Bridge, n.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func ensureBridge(n network) error {
+	conn, err := newRouteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Debugf("Setting up bridge %s", n.Bridge)
+	_, err = conn.Execute(newLinkRequest(
+		nlAttrString(syscall.IFLA_IFNAME, n.Bridge),
+		nlAttrNested(syscall.IFLA_LINKINFO, nlAttrString(iflaInfoKind, "bridge"))))
+	if err != nil {
+		return err
+	}
+
+	if n.VLAN == 0 {
+		return nil
+	}
+
+	parentIndex, err := interfaceIndexByName(n.VLANInterface)
+	if err != nil {
+		return err
+	}
+
+	bridgeIndex, err := interfaceIndexByName(n.Bridge)
+	if err != nil {
+		return err
+	}
+
+	name, err := vlanInterfaceName(n.VLANInterface, n.VLAN)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Setting up VLAN interface %s on bridge %s", name, n.Bridge)
+	_, err = conn.Execute(newLinkRequest(
+		nlAttrString(syscall.IFLA_IFNAME, name),
+		nlAttrU32(syscall.IFLA_LINK, uint32(parentIndex)),
+		nlAttrU32(syscall.IFLA_MASTER, uint32(bridgeIndex)),
+		nlAttrNested(syscall.IFLA_LINKINFO,
+			nlAttrString(iflaInfoKind, "vlan"),
+			nlAttrNested(iflaInfoData, nlAttrU16(iflaVLANID, uint16(n.VLAN))))))
+	return err
+}
+
+// newLinkRequest creates the link named in attrs, or updates it if it exists,
+// and brings it up
+func newLinkRequest(attrs ...[]byte) nlRequest {
+	ifi := make([]byte, syscall.SizeofIfInfomsg)
+	nativeEndian.PutUint32(ifi[8:12], syscall.IFF_UP)
+	nativeEndian.PutUint32(ifi[12:16], syscall.IFF_UP)
+
+	return nlRequest{
+		Type:  syscall.RTM_NEWLINK,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE,
+		Data:  concatBytes(ifi, concatBytes(attrs...)),
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBridging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_private"}
+	err = readBridging(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "", n.Bridge)
+	assert.Equal(t, 0, n.VLAN)
+	assert.NotNil(t, readBridging(dir, &network{Name: "wl_private", DynamicVLAN: dynamicVLANOptional}), "dynamic VLANs aren't tagged on the uplink")
+
+	err = ioutil.WriteFile(path.Join(dir, "vlan"), []byte("10\n"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readBridging(dir, &network{Name: "wl_private"}), "the uplink isn't taken for the wired LAN")
+
+	err = ioutil.WriteFile(path.Join(dir, "vlan_interface"), []byte("eth1"), 0644)
+	assert.Nil(t, err)
+	err = readBridging(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "br-vlan10", n.Bridge)
+	assert.Equal(t, 10, n.VLAN)
+
+	err = ioutil.WriteFile(path.Join(dir, "bridge"), []byte("br-staff"), 0644)
+	assert.Nil(t, err)
+	err = readBridging(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "br-staff", n.Bridge)
+	assert.Equal(t, "eth1", n.VLANInterface)
+
+	for _, bad := range []string{"0", "4095", "ten"} {
+		err = ioutil.WriteFile(path.Join(dir, "vlan"), []byte(bad), 0644)
+		assert.Nil(t, err)
+		assert.NotNil(t, readBridging(dir, &network{Name: "wl_private"}), bad)
+	}
+}
+
+func TestGetNeededNetworksBridged(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "vlan"), []byte("10"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "vlan_interface"), []byte("eth1"), 0644)
+	assert.Nil(t, err)
+
+	networks, err := getNeededNetworks(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "br-vlan10", networks[0].Bridge)
+	assert.Nil(t, networks[0].Subnet, "bridged networks aren't addressed")
+	assert.NotNil(t, networks[1].Subnet)
+
+	routed := routedNetworks(networks)
+	assert.Len(t, routed, 1)
+	assert.Equal(t, "wl_public", routed[0].Name)
+
+	cfg, err := buildFirewallConfig(networks, "eth0")
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Networks, 1)
+}
+
+func TestEnsureBridges(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockRoutes(conn, nil)()
+
+	orig := interfaceIndexByName
+	defer func() { interfaceIndexByName = orig }()
+	interfaceIndexByName = func(name string) (int, error) {
+		return map[string]int{"eth1": 2, "br-vlan10": 7}[name], nil
+	}
+
+	networks := []network{
+		{Name: "wl_private", Bridge: "br-vlan10", VLAN: 10, VLANInterface: "eth1"},
+		{Name: "wl_public"},
+	}
+	err := ensureBridges(networks)
+	assert.Nil(t, err)
+	assert.Len(t, conn.Requests, 2)
+
+	bridge := conn.Requests[0][0]
+	assert.Equal(t, uint16(syscall.RTM_NEWLINK), bridge.Type)
+	assert.Equal(t, uint32(syscall.IFF_UP), nativeEndian.Uint32(bridge.Data[8:12]))
+	attrs, err := parseNlAttrs(bridge.Data[syscall.SizeofIfInfomsg:])
+	assert.Nil(t, err)
+	assert.Equal(t, "br-vlan10\x00", string(attrs[0].Data))
+	info, err := parseNlAttrs(attrs[1].Data)
+	assert.Nil(t, err)
+	assert.Equal(t, "bridge\x00", string(info[0].Data))
+
+	vlan := conn.Requests[1][0]
+	attrs, err = parseNlAttrs(vlan.Data[syscall.SizeofIfInfomsg:])
+	assert.Nil(t, err)
+	assert.Equal(t, "eth1.10\x00", string(attrs[0].Data))
+	assert.Equal(t, uint32(2), nativeEndian.Uint32(attrs[1].Data))
+	assert.Equal(t, uint32(7), nativeEndian.Uint32(attrs[2].Data))
+	info, err = parseNlAttrs(attrs[3].Data)
+	assert.Nil(t, err)
+	assert.Equal(t, "vlan\x00", string(info[0].Data))
+	data, err := parseNlAttrs(info[1].Data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(10), nativeEndian.Uint16(data[0].Data))
+}
+
+func TestVLANInterfaceName(t *testing.T) {
+	name, err := vlanInterfaceName("eth0", 20)
+	assert.Nil(t, err)
+	assert.Equal(t, "eth0.20", name)
+
+	_, err = vlanInterfaceName("enp0s20f0u1u2", 4000)
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"syscall"
 
@@ -58,13 +61,13 @@ type htCapabilities struct {
 	RXSTBC       uint8
 }
 
-func (c *htCapabilities) AsConfigString(configPath string) string {
+func (c *htCapabilities) AsConfigString(channel uint) string {
 	var s string
 	if c.HT20 {
 		s = s + "[HT20]"
 	}
 	if c.HT40 {
-		if getConfiguredChannel(configPath) < 8 {
+		if channel < 8 {
 			s = s + "[HT40+]"
 		} else {
 			s = s + "[HT40-]"
@@ -180,3 +183,76 @@ func parseHTCapabilities(c nlgo.U16) *htCapabilities {
 		RXSTBC:       uint8((c >> 8) & 0x3),
 	}
 }
+
+// withoutHT40 returns a copy of c restricted to 20MHz channels
+func (c *htCapabilities) withoutHT40() *htCapabilities {
+	caps := *c
+	caps.HT40 = false
+	caps.HT40SGI = false
+	caps.DSSSCCKHT40 = false
+	return &caps
+}
+
+// capabilitySnapshot records what the config was generated for, so that it
+// can be rendered again without touching the radio
+type capabilitySnapshot struct {
+	Has5GHz        bool           `json:"has_5ghz"`
+	HTCapabilities htCapabilities `json:"ht_capabilities"`
+	// BSSID is the one the second BSS gets
+	BSSID string `json:"bssid,omitempty"`
+}
+
+// detectCapabilities asks the first radio for its capabilities. iface has to
+// exist already.
+func detectCapabilities(iface string) (*capabilitySnapshot, error) {
+	has5GHz, err := has5GHzSupport()
+	if err != nil {
+		return nil, err
+	}
+
+	phys, err := getPhysicalInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(phys) == 0 {
+		return nil, fmt.Errorf("No WiFi physical interfaces found")
+	}
+
+	htcaps, err := getHTCapabilities(phys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	bssid, err := getBSSID(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return &capabilitySnapshot{Has5GHz: has5GHz, HTCapabilities: *htcaps[0], BSSID: bssid}, nil
+}
+
+func saveCapabilitySnapshot(filename string, c *capabilitySnapshot) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data, 0644)
+}
+
+func loadCapabilitySnapshot(filename string) (*capabilitySnapshot, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No capability snapshot at %s, it is recorded when the daemon starts", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c capabilitySnapshot
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capability snapshot %s: %s", filename, err.Error())
+	}
+	return &c, nil
+}
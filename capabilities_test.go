@@ -1,8 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
 	"testing"
 
+	"github.com/hkwi/nlgo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,3 +37,100 @@ func TestGetHTCapabilities(t *testing.T) {
 	assert.Equal(t, expectedCaps, *caps[0])
 	assert.Equal(t, expectedCaps, *caps[1])
 }
+
+// has5GHzSupport reports NL80211_ATTR_SUPPORT_5_MHZ, the flag for 5MHz wide
+// channels, rather than whether there is a 5GHz band
+func TestHas5GHzWithout5MHzFlag(t *testing.T) {
+	f := &fakeNl80211{Phys: []fakePhy{{Index: 0, Name: "phy0", Bands: []fakeBand{{Band: nl80211Band2GHz, HTCapa: 0x11ef}}}}}
+	defer withFakeNl80211(f)()
+
+	has, err := has5GHzSupport()
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	f.Errors = map[uint8]syscall.Errno{nlgo.NL80211_CMD_GET_WIPHY: syscall.EBUSY}
+	_, err = has5GHzSupport()
+	assert.NotNil(t, err)
+}
+
+func TestHas5GHzOnlyPhy(t *testing.T) {
+	f := &fakeNl80211{Phys: []fakePhy{{Index: 0, Name: "phy0", Bands: []fakeBand{
+		{Band: nl80211Band5GHz, HTCapa: 0x0162, Freqs: fakeFrequencies(5180, 5320, 20)},
+	}}}}
+	defer withFakeNl80211(f)()
+
+	// TODO: has5GHzSupport looks at the 5MHz flag instead of the bands, so
+	// a card that only does 5GHz is taken for one without 5GHz
+	has, err := has5GHzSupport()
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	caps, err := getHTCapabilities("phy0")
+	assert.Nil(t, err)
+	assert.Len(t, caps, 1)
+	assert.True(t, caps[0].HT40)
+}
+
+func TestGetHTCapabilitiesLegacyBand(t *testing.T) {
+	f := &fakeNl80211{Phys: []fakePhy{{Index: 0, Name: "phy0", Bands: []fakeBand{
+		{Band: nl80211Band2GHz, Freqs: fakeFrequencies(2412, 2472, 5)},
+	}}}}
+	defer withFakeNl80211(f)()
+
+	// TODO: getHTCapabilitiesFromBand asserts NL80211_BAND_ATTR_HT_CAPA
+	// without checking, so a band without HT panics instead of failing
+	assert.Panics(t, func() { getHTCapabilities("phy0") })
+}
+
+func TestGetHTCapabilitiesMultiPhy(t *testing.T) {
+	f := &fakeNl80211{Phys: []fakePhy{
+		{Index: 0, Name: "phy0", Bands: []fakeBand{{Band: nl80211Band2GHz, HTCapa: 0x11ef}}},
+		{Index: 1, Name: "phy1", Bands: []fakeBand{{Band: nl80211Band5GHz, HTCapa: 0x0162}}},
+	}}
+	defer withFakeNl80211(f)()
+
+	caps, err := getHTCapabilities("phy1")
+	assert.Nil(t, err)
+	assert.Len(t, caps, 1)
+	assert.Equal(t, htCapabilities{HT40: true, HT20SGI: true, HT40SGI: true, MaxAMSDU3839: true, RXSTBC: 1}, *caps[0])
+
+	_, err = getHTCapabilities("phy2")
+	assert.NotNil(t, err)
+}
+
+func TestGetHTCapabilitiesErrorReply(t *testing.T) {
+	f := testNl80211()
+	f.Errors = map[uint8]syscall.Errno{nlgo.NL80211_CMD_GET_WIPHY: syscall.EPERM}
+	defer withFakeNl80211(f)()
+
+	_, err := getHTCapabilities("phy0")
+	assert.NotNil(t, err)
+
+	// TODO: getBandPolicies panics when the request fails rather than
+	// returning the error
+	f.Errors = nil
+	f.SyncErr = assert.AnError
+	assert.Panics(t, func() { getHTCapabilities("phy0") })
+}
+
+func TestCapabilitySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "capabilities.json")
+	_, err = loadCapabilitySnapshot(filename)
+	assert.NotNil(t, err)
+
+	caps := &capabilitySnapshot{Has5GHz: true, HTCapabilities: htCapabilities{HT20: true, HT40: true, RXSTBC: 1}, BSSID: "02:11:22:33:44:01"}
+	assert.Nil(t, saveCapabilitySnapshot(filename, caps))
+
+	loaded, err := loadCapabilitySnapshot(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, caps, loaded)
+}
+
+func TestWithoutHT40(t *testing.T) {
+	caps := &htCapabilities{HT20: true, HT40: true, HT20SGI: true, HT40SGI: true, DSSSCCKHT40: true}
+	assert.Equal(t, &htCapabilities{HT20: true, HT20SGI: true}, caps.withoutHT40())
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultSSID    = "Protonet-default"
+	defaultChannel = 1
+	maxChannel     = 13
+	maxSSIDBytes   = 32
+
+	guestSSIDSuffix = " (public)"
+)
+
+// Config is the WiFi configuration in the SKVS. All keys are files relative
+// to the SKVS root:
+//
+//	box_name                    SSID of wl_private, wl_public appends
+//	                            ' (public)', cut to fit. At most 32 bytes.
+//	                            Default 'Protonet-default'.
+//	system/wifi/channel         2.4GHz channel, 1-13. Default 1.
+//	system/wifi/enabled         turns wl_private on if it exists
+//	system/wifi/password        passphrase of wl_private, 8-63 printable
+//	                            ASCII characters or a PSK of 64 hex digits,
+//	                            optionally sealed with the host key. Easily
+//	                            guessed ones are rejected or warned about
+//	                            as --passphrase-policy says.
+//	system/wifi/guest/enabled   turns wl_public on if it exists
+//	system/wifi/guest/password  passphrase of wl_public, as above
+//
+// Each network directory may also hold the optional keys read by
+// readNetworkPolicies.
+type Config struct {
+	SSID     string
+	Channel  uint
+	Networks []network
+}
+
+// configError reports an invalid value of one field of the config
+type configError struct {
+	Field   string
+	Message string
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// configErrors are all field errors found while loading the config
+type configErrors []configError
+
+func (e configErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "Invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// loadConfig reads and validates the config. Invalid basic fields are
+// reported together as configErrors, invalid network policies on their own.
+func loadConfig(configPath string) (*Config, error) {
+	var errs configErrors
+
+	cfg := &Config{}
+
+	ssid, err := getSSID(configPath)
+	if e, ok := err.(configError); ok {
+		errs = append(errs, e)
+	} else if err != nil {
+		return nil, err
+	}
+	cfg.SSID = ssid
+
+	channel, err := getConfiguredChannel(configPath)
+	if e, ok := err.(configError); ok {
+		errs = append(errs, e)
+	} else if err != nil {
+		return nil, err
+	}
+	cfg.Channel = channel
+
+	for _, n := range []struct {
+		Name string
+		SSID string
+	}{
+		{"wl_private", cfg.SSID},
+		{"wl_public", trimSSIDTo32Bytes([]byte(cfg.SSID + guestSSIDSuffix))},
+	} {
+		dir := networkConfigDir(configPath, n.Name)
+
+		log.Debugf("Looking for network %s at %v", n.Name, path.Join(dir, "enabled"))
+		_, err := os.Stat(path.Join(dir, "enabled"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debugf("Network %s found, configuring...", n.Name)
+		passwdData, err := ioutil.ReadFile(path.Join(dir, "password"))
+		if err != nil {
+			return nil, err
+		}
+
+		net := network{
+			Name: n.Name,
+			SSID: n.SSID,
+		}
+
+		net.Password, err = openSecret(strings.Trim(string(passwdData), " \n\r\t"))
+		if err != nil {
+			errs = append(errs, configError{Field: n.Name + ".password", Message: err.Error()})
+		} else if err = validatePassphrase(net.Password); err != nil {
+			errs = append(errs, configError{Field: n.Name + ".password", Message: err.Error()})
+		} else if n.Name == "wl_private" {
+			err = checkPassphrasePolicy(net)
+			if e, ok := err.(configError); ok {
+				errs = append(errs, e)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		cfg.Networks = append(cfg.Networks, net)
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	for i := range cfg.Networks {
+		err = readNetworkPolicies(configPath, &cfg.Networks[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// getSSID returns the box name, which is 'Protonet-default' unless
+// configured otherwise
+func getSSID(configPath string) (string, error) {
+	filename := path.Join(configPath, "box_name")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return defaultSSID, nil
+	}
+
+	ssid := strings.Trim(string(data), " \n\r\t")
+	if ssid == "" {
+		return defaultSSID, nil
+	}
+	if len(ssid) > maxSSIDBytes {
+		return "", configError{Field: "box_name", Message: fmt.Sprintf("is %d bytes, an SSID has at most %d", len(ssid), maxSSIDBytes)}
+	}
+	return ssid, nil
+}
+
+// trimSSIDTo32Bytes trims an SSID to 32 bytes, making sure no UTF-8 rune is cut
+func trimSSIDTo32Bytes(input []byte) string {
+	for len(input) > maxSSIDBytes {
+		_, lastRuneLen := utf8.DecodeLastRune(input)
+		l := len(input)
+		input = input[0 : l-lastRuneLen]
+	}
+
+	return string(input)
+}
+
+// was 'network_config'
+func getNeededNetworks(configPath string) ([]network, error) {
+	log.Debugln("fetching networks")
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.Networks, nil
+}
+
+// getConfiguredChannel returns the channel, which is 1 unless configured
+// otherwise
+func getConfiguredChannel(configPath string) (uint, error) {
+	value, err := readOptionalValue(path.Join(configPath, "system", "wifi"), "channel", "")
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return defaultChannel, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, configError{Field: "channel", Message: fmt.Sprintf("'%s' is not a number", value)}
+	}
+	if i < 1 || i > maxChannel {
+		return 0, configError{Field: "channel", Message: fmt.Sprintf("%d is not a 2.4GHz channel between 1 and %d", i, maxChannel)}
+	}
+
+	return uint(i), nil
+}
+
+// validatePassphrase accepts what WPA2-PSK does: 8 to 63 printable ASCII
+// characters or the PSK itself as 64 hex digits
+func validatePassphrase(p string) error {
+	if isHexPSK(p) {
+		return nil
+	}
+
+	if len(p) < 8 || len(p) > 63 {
+		return fmt.Errorf("must be 8 to 63 characters or 64 hex digits, got %d characters", utf8.RuneCountInString(p))
+	}
+
+	for _, c := range p {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("must only contain printable ASCII characters")
+		}
+	}
+
+	return nil
+}
+
+func isHexPSK(p string) bool {
+	if len(p) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(p)
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSSID1(t *testing.T) {
+	configPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	gotSSID, err := getSSID(configPath)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "Protonet-default", gotSSID)
+}
+
+func TestGetSSID2(t *testing.T) {
+	testSSID := "This is a test of SSID trim:   ß"
+
+	configPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	err = ioutil.WriteFile(path.Join(configPath, "box_name"), []byte(testSSID), 0644)
+	assert.Nil(t, err)
+
+	_, err = getSSID(configPath)
+	assert.Equal(t, "box_name", err.(configError).Field, "names that don't fit aren't cut")
+
+	err = ioutil.WriteFile(path.Join(configPath, "box_name"), []byte(" 32 bytes, umlauts count twice ä\n"), 0644)
+	assert.Nil(t, err)
+
+	gotSSID, err := getSSID(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "32 bytes, umlauts count twice ä", gotSSID)
+}
+
+func TestLoadConfig(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	cfg, err := loadConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "example-SSID", cfg.SSID)
+	assert.Equal(t, uint(1), cfg.Channel)
+	assert.Equal(t, expectedNets, cfg.Networks)
+}
+
+func TestLoadConfigGuestSSIDTrimmed(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	err = ioutil.WriteFile(path.Join(configPath, "box_name"), []byte("A rather long name of a box"), 0644)
+	assert.Nil(t, err)
+
+	cfg, err := loadConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "A rather long name of a box (pub", cfg.Networks[1].SSID)
+}
+
+func TestLoadConfigFieldErrors(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	wifiDir := path.Join(configPath, "system", "wifi")
+	err = ioutil.WriteFile(path.Join(wifiDir, "channel"), []byte("14\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(wifiDir, "guest", "password"), []byte("short"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "box_name"), []byte(strings.Repeat("x", 33)), 0644)
+	assert.Nil(t, err)
+
+	_, err = loadConfig(configPath)
+	errs, ok := err.(configErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "box_name", errs[0].Field)
+	assert.Equal(t, "channel", errs[1].Field)
+	assert.Equal(t, "wl_public.password", errs[2].Field)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid configuration: box_name: is 33 bytes"))
+}
+
+func TestGetConfiguredChannel(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	channel, err := getConfiguredChannel(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), channel)
+
+	channelFile := path.Join(configPath, "system", "wifi", "channel")
+	for value, expected := range map[string]uint{"6\n": 6, "13": 13, "0": 0, "14": 0, "eleven": 0} {
+		err = ioutil.WriteFile(channelFile, []byte(value), 0644)
+		assert.Nil(t, err)
+
+		channel, err = getConfiguredChannel(configPath)
+		assert.Equal(t, expected, channel, value)
+		if expected == 0 {
+			assert.IsType(t, configError{}, err, value)
+		} else {
+			assert.Nil(t, err, value)
+		}
+	}
+}
+
+func TestValidatePassphrase(t *testing.T) {
+	assert.Nil(t, validatePassphrase("12345678"))
+	assert.Nil(t, validatePassphrase(strings.Repeat("a", 63)))
+	assert.Nil(t, validatePassphrase(strings.Repeat("0F", 32)))
+	assert.NotNil(t, validatePassphrase("1234567"))
+	assert.NotNil(t, validatePassphrase(strings.Repeat("a", 64)[:63]+"g"))
+	assert.NotNil(t, validatePassphrase("pass\tword"))
+	assert.NotNil(t, validatePassphrase("pässwörd"))
+}
+
+func TestWPAPassphraseHexPSK(t *testing.T) {
+	psk := strings.Repeat("0F", 32)
+	assert.Equal(t, strings.ToLower(psk), wpaPassphrase("example-SSID", psk))
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const configDocumentVersion = 1
+
+// configDocumentNetworks are the networks a document may configure
+var configDocumentNetworks = []string{"wl_private", "wl_public"}
+
+// secretSKVSKeys are only readable by root once imported
+var secretSKVSKeys = map[string]bool{"password": true, "radius_secret": true, "device_psks": true}
+
+// configDocument is the whole WiFi configuration in one versioned document,
+// for templating deployments. Values are kept in their SKVS form, so that
+// importing an export writes back the same keys.
+type configDocument struct {
+	Version  int                         `json:"version" yaml:"version"`
+	BoxName  string                      `json:"box_name,omitempty" yaml:"box_name,omitempty"`
+	Radio    radioDocument               `json:"radio" yaml:"radio"`
+	Networks map[string]*networkDocument `json:"networks" yaml:"networks"`
+}
+
+type radioDocument struct {
+	Channel string `json:"channel,omitempty" yaml:"channel,omitempty"`
+}
+
+// networkDocument holds the keys of a network directory. The json name of a
+// field is its key: bools are flag files, strings values and lists one entry
+// per line.
+type networkDocument struct {
+	Enabled          bool   `json:"enabled" yaml:"enabled"`
+	Password         string `json:"password,omitempty" yaml:"password,omitempty"`
+	PasswordRotation string `json:"password_rotation,omitempty" yaml:"password_rotation,omitempty"`
+
+	Isolate      bool     `json:"isolate,omitempty" yaml:"isolate,omitempty"`
+	LANAllowlist []string `json:"lan_allowlist,omitempty" yaml:"lan_allowlist,omitempty"`
+
+	Subnet     string `json:"subnet,omitempty" yaml:"subnet,omitempty"`
+	Gateway    string `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	DHCPRange  string `json:"dhcp_range,omitempty" yaml:"dhcp_range,omitempty"`
+	IPv6Prefix string `json:"ipv6_prefix,omitempty" yaml:"ipv6_prefix,omitempty"`
+
+	Bridge        string `json:"bridge,omitempty" yaml:"bridge,omitempty"`
+	VLAN          string `json:"vlan,omitempty" yaml:"vlan,omitempty"`
+	VLANInterface string `json:"vlan_interface,omitempty" yaml:"vlan_interface,omitempty"`
+
+	DynamicVLAN  string   `json:"dynamic_vlan,omitempty" yaml:"dynamic_vlan,omitempty"`
+	RADIUSServer string   `json:"radius_server,omitempty" yaml:"radius_server,omitempty"`
+	RADIUSSecret string   `json:"radius_secret,omitempty" yaml:"radius_secret,omitempty"`
+	DevicePSKs   []string `json:"device_psks,omitempty" yaml:"device_psks,omitempty"`
+
+	CaptivePortal        bool   `json:"captive_portal,omitempty" yaml:"captive_portal,omitempty"`
+	PortalSessionTimeout string `json:"portal_session_timeout,omitempty" yaml:"portal_session_timeout,omitempty"`
+	PortalTerms          string `json:"portal_terms,omitempty" yaml:"portal_terms,omitempty"`
+	Vouchers             string `json:"vouchers,omitempty" yaml:"vouchers,omitempty"`
+
+	Schedule         []string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	ScheduleTimezone string   `json:"schedule_timezone,omitempty" yaml:"schedule_timezone,omitempty"`
+
+	RateLimit       string `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	ClientRateLimit string `json:"client_rate_limit,omitempty" yaml:"client_rate_limit,omitempty"`
+}
+
+// skvsEntry is a key of a document and its file content, nil if the key is
+// unset
+type skvsEntry struct {
+	Key   string
+	Value []byte
+}
+
+// documentEntries flattens a document into the SKVS keys it manages, relative
+// to the SKVS root
+func documentEntries(doc *configDocument) []skvsEntry {
+	entries := []skvsEntry{
+		{"box_name", skvsValue(doc.BoxName)},
+		{path.Join("system", "wifi", "channel"), skvsValue(doc.Radio.Channel)},
+	}
+
+	for _, name := range configDocumentNetworks {
+		n := doc.Networks[name]
+		if n == nil {
+			n = &networkDocument{}
+		}
+
+		dir := networkConfigDir("", name)
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			key := path.Join(dir, skvsKeyName(v.Type().Field(i)))
+
+			var value []byte
+			switch f := v.Field(i).Interface().(type) {
+			case bool:
+				if f {
+					value = []byte{}
+				}
+			case string:
+				value = skvsValue(f)
+			case []string:
+				if len(f) != 0 {
+					value = []byte(strings.Join(f, "\n") + "\n")
+				}
+			}
+
+			entries = append(entries, skvsEntry{key, value})
+		}
+	}
+
+	return entries
+}
+
+func skvsValue(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s + "\n")
+}
+
+func skvsKeyName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// skvsLookup returns the trimmed value of a key relative to the SKVS root and
+// whether it is set
+type skvsLookup func(key string) (string, bool, error)
+
+// fileLookup looks keys up in the SKVS directory
+func fileLookup(configPath string) skvsLookup {
+	return func(key string) (string, bool, error) {
+		data, err := ioutil.ReadFile(path.Join(configPath, key))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		return strings.Trim(string(data), " \n\r\t"), true, nil
+	}
+}
+
+// exportConfig reads the keys managed by documents from the SKVS
+func exportConfig(configPath string) (*configDocument, error) {
+	return readConfigDocument(fileLookup(configPath))
+}
+
+// readConfigDocument reads the keys managed by documents through lookup
+func readConfigDocument(lookup skvsLookup) (*configDocument, error) {
+	doc := &configDocument{
+		Version:  configDocumentVersion,
+		Networks: make(map[string]*networkDocument),
+	}
+
+	var err error
+	doc.BoxName, _, err = lookup("box_name")
+	if err != nil {
+		return nil, err
+	}
+	doc.Radio.Channel, _, err = lookup(path.Join("system", "wifi", "channel"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range configDocumentNetworks {
+		dir := networkConfigDir("", name)
+		n := &networkDocument{}
+
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			value, set, err := lookup(path.Join(dir, skvsKeyName(v.Type().Field(i))))
+			if err != nil {
+				return nil, err
+			}
+
+			switch v.Field(i).Interface().(type) {
+			case bool:
+				v.Field(i).SetBool(set)
+			case string:
+				v.Field(i).SetString(value)
+			case []string:
+				if value != "" {
+					v.Field(i).Set(reflect.ValueOf(strings.Split(value, "\n")))
+				}
+			}
+		}
+
+		doc.Networks[name] = n
+	}
+
+	return doc, nil
+}
+
+// parseConfigDocument reads a JSON or YAML document, rejecting unknown keys,
+// versions and networks
+func parseConfigDocument(data []byte) (*configDocument, error) {
+	doc := &configDocument{}
+	err := yaml.UnmarshalStrict(data, doc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config document: %s", err.Error())
+	}
+
+	if doc.Version != configDocumentVersion {
+		return nil, fmt.Errorf("Unsupported config document version %d, expected %d", doc.Version, configDocumentVersion)
+	}
+
+	for name := range doc.Networks {
+		known := false
+		for _, n := range configDocumentNetworks {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown network '%s' in config document, expected %s", name, strings.Join(configDocumentNetworks, " or "))
+		}
+	}
+
+	return doc, nil
+}
+
+// validateConfigDocument loads the config a document results in without
+// touching the SKVS
+func validateConfigDocument(doc *configDocument) (*Config, error) {
+	dir, err := ioutil.TempDir("", "hostapd-import")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, e := range documentEntries(doc) {
+		if e.Value == nil {
+			continue
+		}
+
+		err = writeFileCreatingDir(path.Join(dir, e.Key), e.Value, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return loadConfig(dir)
+}
+
+// importConfig writes a document into the SKVS, removing the keys it leaves
+// unset, and returns the keys changed. Nothing is written with dryRun.
+func importConfig(configPath string, doc *configDocument, dryRun bool) ([]string, error) {
+	_, err := validateConfigDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, e := range documentEntries(doc) {
+		filename := path.Join(configPath, e.Key)
+
+		old, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		// values are compared as read, flag files only by their existence
+		exists := err == nil
+		if e.Value == nil && !exists {
+			continue
+		}
+		if e.Value != nil && exists && (len(e.Value) == 0 || strings.TrimSpace(string(old)) == strings.TrimSpace(string(e.Value))) {
+			continue
+		}
+		changed = append(changed, e.Key)
+
+		if dryRun {
+			continue
+		}
+
+		if e.Value == nil {
+			log.Debugf("Removing SKVS key '%s'", e.Key)
+			err = os.Remove(filename)
+		} else {
+			perm := os.FileMode(0644)
+			if secretSKVSKeys[path.Base(e.Key)] {
+				perm = 0600
+			}
+
+			log.Debugf("Writing SKVS key '%s'", e.Key)
+			err = os.MkdirAll(path.Dir(filename), 0755)
+			if err == nil {
+				err = writeFileAtomic(filename, e.Value, perm)
+			}
+		}
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, nil
+}
+
+type exportCommand struct {
+	Format string `long:"format" default:"yaml" choice:"yaml" choice:"json" description:"document format"`
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	setupLogging()
+
+	doc, err := exportConfig(opts.SKVSPath)
+	if err != nil {
+		return err
+	}
+
+	if c.Format == "json" {
+		return printJSON(doc)
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+type importCommand struct {
+	DryRun bool `long:"dry-run" description:"only validate the document and show the keys it would change"`
+	Args   struct {
+		File string `positional-arg-name:"file" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *importCommand) Execute(args []string) error {
+	setupLogging()
+
+	data, err := ioutil.ReadFile(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	doc, err := parseConfigDocument(data)
+	if err != nil {
+		return err
+	}
+
+	changed, err := importConfig(opts.SKVSPath, doc, c.DryRun)
+	if errs, ok := err.(configErrors); ok {
+		for _, e := range errs {
+			fmt.Println(e.Error())
+		}
+		return fmt.Errorf("Found %d invalid fields", len(errs))
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range changed {
+		fmt.Println(key)
+	}
+	return nil
+}
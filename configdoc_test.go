@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestExportConfig(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	guestDir := path.Join(configPath, "system", "wifi", "guest")
+	err = ioutil.WriteFile(path.Join(guestDir, "isolate"), nil, 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(guestDir, "lan_allowlist"), []byte("192.168.1.10\n10.1.0.0/16\n"), 0644)
+	assert.Nil(t, err)
+
+	doc, err := exportConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, configDocumentVersion, doc.Version)
+	assert.Equal(t, "example-SSID", doc.BoxName)
+	assert.Equal(t, "", doc.Radio.Channel)
+	assert.Equal(t, &networkDocument{Enabled: true, Password: "foobarpassprivate"}, doc.Networks["wl_private"])
+	assert.Equal(t, &networkDocument{
+		Enabled:      true,
+		Password:     "foobarpasspublic",
+		Isolate:      true,
+		LANAllowlist: []string{"192.168.1.10", "10.1.0.0/16"},
+	}, doc.Networks["wl_public"])
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	doc, err := exportConfig(configPath)
+	assert.Nil(t, err)
+	doc.Radio.Channel = "6"
+	doc.Networks["wl_public"].Schedule = []string{"mon-fri 08:00-18:00"}
+
+	out, err := yaml.Marshal(doc)
+	assert.Nil(t, err)
+	parsed, err := parseConfigDocument(out)
+	assert.Nil(t, err)
+	assert.Equal(t, doc, parsed)
+
+	changed, err := importConfig(configPath, parsed, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"system/wifi/channel", "system/wifi/guest/schedule"}, changed)
+	_, err = os.Stat(path.Join(configPath, "system", "wifi", "channel"))
+	assert.True(t, os.IsNotExist(err), "a dry run must not write anything")
+
+	changed, err = importConfig(configPath, parsed, false)
+	assert.Nil(t, err)
+	assert.Len(t, changed, 2)
+
+	channel, err := getConfiguredChannel(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(6), channel)
+
+	exported, err := exportConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, doc, exported)
+
+	changed, err = importConfig(configPath, parsed, false)
+	assert.Nil(t, err)
+	assert.Len(t, changed, 0)
+}
+
+func TestImportConfigRemovesUnsetKeys(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	doc, err := parseConfigDocument([]byte(`{"version": 1, "box_name": "example-SSID", "networks": {"wl_private": {"enabled": true, "password": "foobarpassprivate"}}}`))
+	assert.Nil(t, err)
+
+	changed, err := importConfig(configPath, doc, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"system/wifi/guest/enabled", "system/wifi/guest/password"}, changed)
+
+	networks, err := getNeededNetworks(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNets[:1], networks)
+}
+
+func TestImportConfigInvalid(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	doc, err := parseConfigDocument([]byte("version: 1\nradio:\n  channel: \"42\"\nnetworks:\n  wl_private:\n    enabled: true\n    password: short\n"))
+	assert.Nil(t, err)
+
+	_, err = importConfig(configPath, doc, false)
+	errs, ok := err.(configErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+
+	networks, err := getNeededNetworks(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNets, networks, "an invalid document must not be written")
+}
+
+func TestParseConfigDocumentErrors(t *testing.T) {
+	for _, data := range []string{
+		"version: 2\n",
+		"networks: {}\n",
+		"version: 1\nnetworks:\n  wl_other: {}\n",
+		"version: 1\nunknown: true\n",
+		"version: 1\nnetworks:\n  wl_private:\n    passphrase: foobarpass\n",
+	} {
+		_, err := parseConfigDocument([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
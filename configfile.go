@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// knownGoodSuffix names the copy of the last config hostapd came up with,
+// next to opts.ConfigFile
+const knownGoodSuffix = ".good"
+
+// hostapdConfigMode keeps the config readable by root only, as it holds the
+// PSKs and RADIUS secrets in plain text
+const hostapdConfigMode = 0600
+
+// writeFileAtomic replaces filename with data, so that readers and crashes
+// only ever see the old or the new content. The data is synced before the
+// rename and the rename before returning.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := path.Dir(filename)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+path.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func knownGoodConfigFile(configFile string) string {
+	return configFile + knownGoodSuffix
+}
+
+// saveHostapdConfig writes cfg to configFile and tells whether it changed
+func saveHostapdConfig(configFile string, cfg string) (bool, error) {
+	old, err := ioutil.ReadFile(configFile)
+	if err == nil && string(old) == cfg {
+		// configs written by older versions are world readable
+		return false, os.Chmod(configFile, hostapdConfigMode)
+	}
+
+	err = writeFileAtomic(configFile, []byte(cfg), hostapdConfigMode)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveKnownGoodConfig keeps the config hostapd just came up with, to roll
+// back to if a later one fails
+func saveKnownGoodConfig(configFile string) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(knownGoodConfigFile(configFile), data, hostapdConfigMode)
+}
+
+// restoreKnownGoodConfig puts the last known good config back in place of
+// configFile. It returns the names of the interfaces it configures, or nil
+// if there is none to roll back to or it is what failed.
+func restoreKnownGoodConfig(configFile string) ([]string, error) {
+	good, err := ioutil.ReadFile(knownGoodConfigFile(configFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if bytes.Equal(good, current) {
+		return nil, nil
+	}
+
+	names := configInterfaces(string(good))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("The known good config %s configures no interface", knownGoodConfigFile(configFile))
+	}
+
+	log.Warnf("Rolling back to the known good config %s", knownGoodConfigFile(configFile))
+	err = writeFileAtomic(configFile, good, hostapdConfigMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// configInterfaces returns the interfaces of the BSSes a hostapd config sets
+// up, in order
+func configInterfaces(cfg string) []string {
+	var names []string
+	for _, line := range strings.Split(cfg, "\n") {
+		if strings.HasPrefix(line, "interface=") {
+			names = append(names, strings.TrimPrefix(line, "interface="))
+		}
+		if strings.HasPrefix(line, "bss=") {
+			names = append(names, strings.TrimPrefix(line, "bss="))
+		}
+	}
+	return names
+}
+
+// networksNamed returns the networks with the given names in the order of
+// names, or nil if one of them isn't there
+func networksNamed(networks []network, names []string) []network {
+	var named []network
+	for _, name := range names {
+		found := false
+		for _, n := range networks {
+			if n.Name == name {
+				named = append(named, n)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return named
+}
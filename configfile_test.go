@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "hostapd", "hostapd.conf")
+	assert.Nil(t, writeFileAtomic(filename, []byte("old"), 0644))
+	assert.Nil(t, writeFileAtomic(filename, []byte("new"), 0600))
+
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+
+	info, err := os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	files, err := ioutil.ReadDir(path.Dir(filename))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1, "no temporary file is left behind")
+}
+
+func TestKnownGoodConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := path.Join(dir, "hostapd.conf")
+	good := "interface=wl_private\nchannel=6\n\nbss=wl_public\n"
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(good), 0644))
+
+	names, err := restoreKnownGoodConfig(configFile)
+	assert.Nil(t, err)
+	assert.Nil(t, names, "nothing to roll back to yet")
+
+	assert.Nil(t, saveKnownGoodConfig(configFile))
+	names, err = restoreKnownGoodConfig(configFile)
+	assert.Nil(t, err)
+	assert.Nil(t, names, "the known good config is in place already")
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("interface=wl_private\nchannel=13\n"), 0644))
+	names, err = restoreKnownGoodConfig(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wl_private", "wl_public"}, names)
+
+	data, err := ioutil.ReadFile(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, good, string(data))
+
+	info, err := os.Stat(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestSaveHostapdConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := path.Join(dir, "hostapd.conf")
+	cfg := "interface=wl_private\nwpa_psk=0123456789abcdef\n"
+
+	changed, err := saveHostapdConfig(configFile, cfg)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	info, err := os.Stat(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the config holds secrets")
+
+	assert.Nil(t, os.Chmod(configFile, 0644))
+	changed, err = saveHostapdConfig(configFile, cfg)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	info, err = os.Stat(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "an unchanged config of an older version")
+}
+
+func TestNetworksNamed(t *testing.T) {
+	networks := []network{{Name: "wl_private"}, {Name: "wl_public"}}
+	assert.Equal(t, networks[1:], networksNamed(networks, []string{"wl_public"}))
+	assert.Equal(t, networks, networksNamed(networks, []string{"wl_private", "wl_public"}))
+	assert.Nil(t, networksNamed(networks[:1], []string{"wl_private", "wl_public"}))
+}
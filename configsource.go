@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// skvsPollInterval is how often the SKVS directory is checked for changes
+	skvsPollInterval = 5 * time.Second
+
+	// configRetryInterval is how long to wait before a source that failed is
+	// tried again
+	configRetryInterval = 10 * time.Second
+)
+
+// configSource provides the keys the configuration is read from. Everything
+// reads them from the SKVS directory, sources other than the directory itself
+// mirror their keys into it after validating them.
+type configSource interface {
+	// Sync brings the SKVS directory up to date with the source
+	Sync() error
+	// Wait blocks until the source changed since the last Sync or stop is
+	// closed
+	Wait(stop <-chan struct{}) error
+}
+
+// newConfigSource returns the source chosen by --config-source
+func newConfigSource() (configSource, error) {
+	switch opts.ConfigSource {
+	case "etcd":
+		return newEtcdSource(opts.EtcdEndpoint, opts.EtcdPrefix, opts.SKVSPath, opts.ConfigSourceState)
+	case "env":
+		return newEnvSource(opts.ConfigValues, opts.SKVSPath, opts.ConfigSourceState)
+	default:
+		return &skvsSource{dir: opts.SKVSPath}, nil
+	}
+}
+
+// mirrorState records a hash of every key a source held when it was last
+// mirrored, by key relative to the SKVS root. Only keys that changed in the
+// source since are written, so keys it never held, like box_name, and local
+// changes, like rotated passwords, are left alone until the source changes
+// them.
+type mirrorState map[string]string
+
+func loadMirrorState(filename string) (mirrorState, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return mirrorState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := mirrorState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config source state %s: %s", filename, err.Error())
+	}
+	return state, nil
+}
+
+func saveMirrorState(filename string, state mirrorState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data, 0600)
+}
+
+func mirrorHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// mirrorConfig writes the keys that changed in a source into the SKVS
+// directory and removes those the source no longer holds. stateFile keeps
+// track of what the source held.
+func mirrorConfig(name string, lookup skvsLookup, dir string, stateFile string) error {
+	last, err := loadMirrorState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	held := mirrorState{}
+	local := fileLookup(dir)
+	merged := func(key string) (string, bool, error) {
+		value, set, err := lookup(key)
+		if err != nil {
+			return "", false, err
+		}
+		if set {
+			held[key] = mirrorHash(value)
+		}
+
+		lastHash, wasSet := last[key]
+		switch {
+		case set && lastHash != mirrorHash(value):
+			return value, true, nil
+		case !set && wasSet:
+			return "", false, nil
+		default:
+			return local(key)
+		}
+	}
+
+	doc, err := readConfigDocument(merged)
+	if err != nil {
+		return fmt.Errorf("Failed to read the configuration from %s: %s", name, err.Error())
+	}
+
+	changed, err := importConfig(dir, doc, false)
+	if err != nil {
+		return fmt.Errorf("Failed to mirror the configuration from %s: %s", name, err.Error())
+	}
+
+	for _, key := range changed {
+		log.Infof("Configuration key '%s' changed in %s", key, name)
+	}
+	return saveMirrorState(stateFile, held)
+}
+
+// skvsSource is the SKVS directory itself, which is polled for changes
+type skvsSource struct {
+	dir  string
+	last *configDocument
+}
+
+func (s *skvsSource) Sync() error {
+	doc, err := exportConfig(s.dir)
+	if err != nil {
+		return err
+	}
+
+	s.last = doc
+	return nil
+}
+
+func (s *skvsSource) Wait(stop <-chan struct{}) error {
+	ticker := time.NewTicker(skvsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		doc, err := exportConfig(s.dir)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(doc, s.last) {
+			return nil
+		}
+	}
+}
+
+// etcdNode is a key or directory of the etcd v2 keys API
+type etcdNode struct {
+	Key   string     `json:"key"`
+	Dir   bool       `json:"dir"`
+	Value string     `json:"value"`
+	Nodes []etcdNode `json:"nodes"`
+}
+
+type etcdResponse struct {
+	Node etcdNode `json:"node"`
+}
+
+// etcdError is what the etcd v2 keys API replies on errors
+type etcdError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+}
+
+func (e etcdError) Error() string {
+	return fmt.Sprintf("etcd error %d: %s (%s)", e.ErrorCode, e.Message, e.Cause)
+}
+
+const (
+	etcdErrorKeyNotFound       = 100
+	etcdErrorEventIndexCleared = 401
+)
+
+var etcdClient = http.DefaultClient
+
+// etcdSource reads the keys below a prefix through the etcd v2 keys API, in
+// the SKVS layout, and watches them for changes
+type etcdSource struct {
+	endpoint string
+	prefix   string
+	dir      string
+	state    string
+
+	// index is the etcd index the keys were last read at
+	index uint64
+}
+
+func newEtcdSource(endpoint string, prefix string, dir string, stateFile string) (*etcdSource, error) {
+	_, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid etcd endpoint '%s': %s", endpoint, err.Error())
+	}
+
+	return &etcdSource{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		prefix:   "/" + strings.Trim(prefix, "/"),
+		dir:      dir,
+		state:    stateFile,
+	}, nil
+}
+
+// get requests the keys below the prefix, blocking until they change after
+// waitIndex unless it is 0
+func (e *etcdSource) get(waitIndex uint64, stop <-chan struct{}) (*etcdResponse, uint64, error) {
+	query := url.Values{"recursive": {"true"}}
+	if waitIndex != 0 {
+		query.Set("wait", "true")
+		query.Set("waitIndex", strconv.FormatUint(waitIndex, 10))
+	}
+
+	req, err := http.NewRequest("GET", e.endpoint+"/v2/keys"+e.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the long poll is abandoned once stop is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+
+	resp, err := etcdClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		etcdErr := etcdError{}
+		err = json.NewDecoder(resp.Body).Decode(&etcdErr)
+		if err != nil {
+			return nil, 0, fmt.Errorf("etcd replied %s", resp.Status)
+		}
+		return nil, 0, etcdErr
+	}
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+
+	reply := &etcdResponse{}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid reply from etcd: %s", err.Error())
+	}
+
+	return reply, index, nil
+}
+
+// flattenEtcdNodes collects the values of the keys below node by their path
+// relative to prefix
+func flattenEtcdNodes(node etcdNode, prefix string, values map[string]string) {
+	if !node.Dir {
+		key := strings.TrimPrefix(strings.TrimPrefix(node.Key, prefix), "/")
+		values[key] = strings.Trim(node.Value, " \n\r\t")
+		return
+	}
+
+	for _, n := range node.Nodes {
+		flattenEtcdNodes(n, prefix, values)
+	}
+}
+
+func (e *etcdSource) Sync() error {
+	values := make(map[string]string)
+
+	reply, index, err := e.get(0, nil)
+	if etcdErr, ok := err.(etcdError); ok && etcdErr.ErrorCode == etcdErrorKeyNotFound {
+		return fmt.Errorf("There is no configuration below '%s' in etcd", e.prefix)
+	}
+	if err != nil {
+		return err
+	}
+	flattenEtcdNodes(reply.Node, e.prefix, values)
+
+	// an invalid configuration is only tried again once it changes
+	e.index = index
+
+	return mirrorConfig("etcd", func(key string) (string, bool, error) {
+		value, ok := values[key]
+		return value, ok, nil
+	}, e.dir, e.state)
+}
+
+func (e *etcdSource) Wait(stop <-chan struct{}) error {
+	_, _, err := e.get(e.index+1, stop)
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+
+	// the changes since our index are gone, reading everything again is all
+	// that is left
+	if etcdErr, ok := err.(etcdError); ok && etcdErr.ErrorCode == etcdErrorEventIndexCleared {
+		return nil
+	}
+	return err
+}
+
+// lookupEnv is os.LookupEnv, mockable for tests
+var lookupEnv = os.LookupEnv
+
+// envSource reads the keys from environment variables and --config-value, for
+// containers. Those can't change while we run, so it never reports changes.
+//
+// The variables are named after the keys: WIFI_BOX_NAME, WIFI_CHANNEL, and
+// WIFI_PRIVATE_ and WIFI_PUBLIC_ followed by the keys of wl_private and
+// wl_public, e.g. WIFI_PUBLIC_PASSWORD. Flags are set by any value besides
+// an empty one, '0' or 'false', lists are separated by newlines.
+type envSource struct {
+	values map[string]string
+	dir    string
+	state  string
+}
+
+func newEnvSource(configValues []string, dir string, stateFile string) (*envSource, error) {
+	values := make(map[string]string)
+	for _, v := range configValues {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "WIFI_") {
+			return nil, fmt.Errorf("Invalid configuration value '%s', expected WIFI_<KEY>=<VALUE>", v)
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	return &envSource{values: values, dir: dir, state: stateFile}, nil
+}
+
+// envName returns the variable a key relative to the SKVS root is read from
+func envName(key string) string {
+	name := key
+	switch {
+	case key == path.Join("system", "wifi", "channel"):
+		name = "channel"
+	case path.Dir(key) == networkConfigDir("", "wl_public"):
+		name = "public_" + path.Base(key)
+	case path.Dir(key) == networkConfigDir("", "wl_private"):
+		name = "private_" + path.Base(key)
+	}
+
+	return "WIFI_" + strings.ToUpper(name)
+}
+
+func (e *envSource) lookup(key string) (string, bool, error) {
+	name := envName(key)
+	value, ok := e.values[name]
+	if !ok {
+		value, ok = lookupEnv(name)
+	}
+
+	value = strings.Trim(value, " \n\r\t")
+	if !ok || value == "" || value == "0" || value == "false" {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+func (e *envSource) Sync() error {
+	return mirrorConfig("the environment", e.lookup, e.dir, e.state)
+}
+
+func (e *envSource) Wait(stop <-chan struct{}) error {
+	<-stop
+	return nil
+}
+
+// runConfigWatcher reloads the configuration whenever the source changes.
+// errRestart from reload is passed on to have the daemon start over.
+func runConfigWatcher(source configSource, reload func() error, stop <-chan struct{}) error {
+	for {
+		err := source.Wait(stop)
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err != nil {
+			log.Warnf("Failed to watch the configuration: %s", err.Error())
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(configRetryInterval):
+			}
+		}
+
+		err = source.Sync()
+		if err != nil {
+			log.Warnf("Keeping the current configuration: %s", err.Error())
+			continue
+		}
+
+		err = reload()
+		if err == errRestart {
+			return err
+		}
+		if err != nil {
+			log.Warnf("Failed to reload the configuration: %s", err.Error())
+		}
+	}
+}
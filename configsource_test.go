@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSKVSSourceWait(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	oldInterval := skvsPollInterval
+	skvsPollInterval = time.Millisecond
+	defer func() { skvsPollInterval = oldInterval }()
+
+	source := &skvsSource{dir: configPath}
+	assert.Nil(t, source.Sync())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ioutil.WriteFile(path.Join(configPath, "system", "wifi", "channel"), []byte("6"), 0644)
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- source.Wait(make(chan struct{}))
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the change of the channel wasn't noticed")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	assert.Nil(t, source.Sync())
+	assert.Nil(t, source.Wait(stop))
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "WIFI_BOX_NAME", envName("box_name"))
+	assert.Equal(t, "WIFI_CHANNEL", envName("system/wifi/channel"))
+	assert.Equal(t, "WIFI_PRIVATE_PASSWORD", envName("system/wifi/password"))
+	assert.Equal(t, "WIFI_PUBLIC_LAN_ALLOWLIST", envName("system/wifi/guest/lan_allowlist"))
+}
+
+func TestEnvSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Remove(dir + ".json")
+
+	env := map[string]string{
+		"WIFI_BOX_NAME":         "example-SSID",
+		"WIFI_PRIVATE_ENABLED":  "1",
+		"WIFI_PRIVATE_PASSWORD": "foobarpassprivate",
+		"WIFI_PUBLIC_ENABLED":   "false",
+		"WIFI_PUBLIC_PASSWORD":  "foobarpasspublic",
+		"WIFI_CHANNEL":          "1",
+	}
+	oldLookupEnv := lookupEnv
+	lookupEnv = func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	defer func() { lookupEnv = oldLookupEnv }()
+
+	source, err := newEnvSource([]string{"WIFI_PUBLIC_ENABLED=yes", "WIFI_CHANNEL=6"}, dir, dir+".json")
+	assert.Nil(t, err)
+	assert.Nil(t, source.Sync())
+
+	cfg, err := loadConfig(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(6), cfg.Channel)
+	assert.Equal(t, expectedNets, cfg.Networks)
+
+	_, err = newEnvSource([]string{"CHANNEL=6"}, dir, "")
+	assert.NotNil(t, err)
+}
+
+func TestEnvSourceInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Remove(dir + ".json")
+
+	oldLookupEnv := lookupEnv
+	lookupEnv = func(name string) (string, bool) { return "", false }
+	defer func() { lookupEnv = oldLookupEnv }()
+
+	source, err := newEnvSource([]string{"WIFI_PRIVATE_ENABLED=1", "WIFI_PRIVATE_PASSWORD=short"}, dir, dir+".json")
+	assert.Nil(t, err)
+	assert.NotNil(t, source.Sync())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0, "an invalid configuration must not be mirrored")
+}
+
+func TestMirrorConfig(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+	stateFile := configPath + ".json"
+	defer os.Remove(stateFile)
+
+	values := map[string]string{
+		"system/wifi/enabled":  "",
+		"system/wifi/password": "foobarpassprivate",
+	}
+	lookup := func(key string) (string, bool, error) {
+		value, ok := values[key]
+		return value, ok, nil
+	}
+	read := func(key string) string {
+		data, _ := ioutil.ReadFile(path.Join(configPath, key))
+		return strings.TrimSpace(string(data))
+	}
+
+	assert.Nil(t, mirrorConfig("test", lookup, configPath, stateFile))
+	assert.Equal(t, "example-SSID", read("box_name"), "keys the source doesn't hold are kept")
+	assert.Equal(t, "foobarpasspublic", read("system/wifi/guest/password"))
+
+	// a rotated password stays until the source changes it
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "password"), []byte("rotatedpassword"), 0600)
+	assert.Nil(t, err)
+	assert.Nil(t, mirrorConfig("test", lookup, configPath, stateFile))
+	assert.Equal(t, "rotatedpassword", read("system/wifi/password"))
+
+	values["system/wifi/password"] = "newpassprivate"
+	assert.Nil(t, mirrorConfig("test", lookup, configPath, stateFile))
+	assert.Equal(t, "newpassprivate", read("system/wifi/password"))
+
+	// keys the source stops holding are removed
+	delete(values, "system/wifi/enabled")
+	assert.Nil(t, mirrorConfig("test", lookup, configPath, stateFile))
+	_, err = os.Stat(path.Join(configPath, "system", "wifi", "enabled"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "example-SSID", read("box_name"))
+
+	data, err := ioutil.ReadFile(stateFile)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "newpassprivate", "the state only keeps hashes")
+}
+
+const testEtcdReply = `{"action": "get", "node": {"key": "/hostapd", "dir": true, "nodes": [
+	{"key": "/hostapd/box_name", "value": "example-SSID", "modifiedIndex": 4},
+	{"key": "/hostapd/system", "dir": true, "nodes": [
+		{"key": "/hostapd/system/wifi", "dir": true, "nodes": [
+			{"key": "/hostapd/system/wifi/enabled", "value": ""},
+			{"key": "/hostapd/system/wifi/password", "value": "foobarpassprivate\n"},
+			{"key": "/hostapd/system/wifi/guest", "dir": true, "nodes": [
+				{"key": "/hostapd/system/wifi/guest/enabled", "value": ""},
+				{"key": "/hostapd/system/wifi/guest/password", "value": "foobarpasspublic"}
+			]}
+		]}
+	]}
+]}}`
+
+func TestEtcdSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Remove(dir + ".json")
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+		if r.URL.Query().Get("waitIndex") == "43" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errorCode": 401, "message": "The event in requested index is outdated and cleared", "cause": "the requested history has been cleared [44/43]"}`)
+			return
+		}
+
+		w.Header().Set("X-Etcd-Index", "42")
+		fmt.Fprint(w, testEtcdReply)
+	}))
+	defer server.Close()
+
+	source, err := newEtcdSource(server.URL+"/", "hostapd/", dir, dir+".json")
+	assert.Nil(t, err)
+	assert.Nil(t, source.Sync())
+	assert.Equal(t, uint64(42), source.index)
+
+	networks, err := getNeededNetworks(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNets, networks)
+
+	assert.Nil(t, source.Wait(make(chan struct{})), "a cleared index calls for reading everything again")
+	assert.Equal(t, []string{
+		"/v2/keys/hostapd?recursive=true",
+		"/v2/keys/hostapd?recursive=true&wait=true&waitIndex=43",
+	}, requests)
+}
+
+func TestEtcdSourceWaitStopped(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a long poll nothing changes during
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	source, err := newEtcdSource(server.URL, "/hostapd", "/nonexistent", "/nonexistent.json")
+	assert.Nil(t, err)
+	source.index = 42
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- source.Wait(stop)
+	}()
+	close(stop)
+
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Wait didn't return after stop was closed")
+	}
+}
+
+func TestEtcdSourceMissingPrefix(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errorCode": 100, "message": "Key not found", "cause": "/hostapd"}`)
+	}))
+	defer server.Close()
+
+	source, err := newEtcdSource(server.URL, "/hostapd", "/nonexistent", "/nonexistent.json")
+	assert.Nil(t, err)
+	err = source.Sync()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no configuration below '/hostapd'")
+}
+
+// mockConfigSource reports a change on each Wait until it runs out of them
+type mockConfigSource struct {
+	Changes int
+	Syncs   int
+	SyncErr error
+}
+
+func (m *mockConfigSource) Sync() error {
+	m.Syncs++
+	return m.SyncErr
+}
+
+func (m *mockConfigSource) Wait(stop <-chan struct{}) error {
+	if m.Changes == 0 {
+		<-stop
+		return nil
+	}
+	m.Changes--
+	return nil
+}
+
+func TestRunConfigWatcher(t *testing.T) {
+	source := &mockConfigSource{Changes: 3}
+	reloads := 0
+	err := runConfigWatcher(source, func() error {
+		reloads++
+		if reloads == 2 {
+			return errRestart
+		}
+		return assert.AnError
+	}, make(chan struct{}))
+	assert.Equal(t, errRestart, err)
+	assert.Equal(t, 2, source.Syncs)
+	assert.Equal(t, 2, reloads, "failed reloads keep the watcher going")
+
+	source = &mockConfigSource{Changes: 2, SyncErr: assert.AnError}
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	err = runConfigWatcher(source, func() error {
+		t.Fatal("an invalid configuration must not be reloaded")
+		return nil
+	}, stop)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, source.Syncs)
+}
@@ -1,17 +1,114 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
 )
 
+const (
+	networkdBusName   = "org.freedesktop.network1"
+	networkdPath      = "/org/freedesktop/network1"
+	networkdManager   = "org.freedesktop.network1.Manager"
+	networkdLink      = "org.freedesktop.network1.Link"
+	networkdLinkPoll  = 200 * time.Millisecond
+	networkdLinkLimit = 30 * time.Second
+)
+
+// errNetworkdUnsupported is returned by the networkd methods on systemd
+// versions that don't have them yet (before 244)
+var errNetworkdUnsupported = errors.New("systemd-networkd doesn't support reloading over D-Bus")
+
 type dbusConnectioner interface {
 	RestartUnit(string, string, chan<- string) (int, error)
+	// ReloadNetworkd makes networkd read its units again
+	ReloadNetworkd() error
+	// ReconfigureLink applies the units to a link again
+	ReconfigureLink(index int) error
+	// LinkState returns the administrative state of a link, like
+	// 'configuring' or 'configured'
+	LinkState(index int) (string, error)
+	Close()
+}
+
+// systemdConnection talks to systemd through go-systemd and to networkd,
+// which go-systemd has no API for, directly. Close closes the private
+// go-systemd connection, the system bus is shared.
+type systemdConnection struct {
+	*dbus.Conn
+	bus *godbus.Conn
 }
 
 var newDBusConnection = func() (dbusConnectioner, error) {
-	return dbus.New()
+	conn, err := dbus.New()
+	if err != nil {
+		return nil, err
+	}
+
+	bus, err := godbus.SystemBus()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &systemdConnection{Conn: conn, bus: bus}, nil
+}
+
+func (c *systemdConnection) networkdCall(method string, args ...interface{}) *godbus.Call {
+	return c.bus.Object(networkdBusName, networkdPath).Call(networkdManager+"."+method, 0, args...)
+}
+
+func (c *systemdConnection) ReloadNetworkd() error {
+	return networkdError(c.networkdCall("Reload").Err)
+}
+
+func (c *systemdConnection) ReconfigureLink(index int) error {
+	return networkdError(c.networkdCall("ReconfigureLink", int32(index)).Err)
+}
+
+func (c *systemdConnection) LinkState(index int) (string, error) {
+	var name string
+	var link godbus.ObjectPath
+	err := c.networkdCall("GetLinkByIndex", int32(index)).Store(&name, &link)
+	if err != nil {
+		return "", networkdError(err)
+	}
+
+	var state godbus.Variant
+	err = c.bus.Object(networkdBusName, link).Call("org.freedesktop.DBus.Properties.Get", 0, networkdLink, "AdministrativeState").Store(&state)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := state.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("Unexpected state %s of link %s", state, name)
+	}
+	return s, nil
+}
+
+// networkdError maps the errors of a networkd without the methods we call,
+// or of a system without networkd, to errNetworkdUnsupported
+func networkdError(err error) error {
+	var name string
+	switch e := err.(type) {
+	case godbus.Error:
+		name = e.Name
+	case *godbus.Error:
+		name = e.Name
+	default:
+		return err
+	}
+
+	switch name {
+	case "org.freedesktop.DBus.Error.UnknownMethod", "org.freedesktop.DBus.Error.ServiceUnknown":
+		return errNetworkdUnsupported
+	}
+	return err
 }
 
 func restartNetworkD(maxRetries int) error {
@@ -20,6 +117,7 @@ func restartNetworkD(maxRetries int) error {
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
 	c := make(chan string)
 	var lastStatus string
@@ -37,3 +135,62 @@ func restartNetworkD(maxRetries int) error {
 
 	return fmt.Errorf("Failed to restart dbus - last attemt's status was '%s'", lastStatus)
 }
+
+// reconfigureNetworkD reloads the networkd units and applies them to the
+// links, waiting until networkd configured them. Links that don't exist yet
+// are configured by networkd once they appear. Returns errNetworkdUnsupported
+// if restarting networkd is the only way.
+func reconfigureNetworkD(links []string) error {
+	conn, err := newDBusConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.ReloadNetworkd()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range links {
+		index, err := interfaceIndexByName(name)
+		if err != nil {
+			log.Debugf("Not reconfiguring %s: %s", name, err.Error())
+			continue
+		}
+
+		err = conn.ReconfigureLink(index)
+		if err != nil {
+			return err
+		}
+
+		err = waitForLinkConfigured(conn, name, index, networkdLinkLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitForLinkConfigured(conn dbusConnectioner, name string, index int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := conn.LinkState(index)
+		if err != nil {
+			return err
+		}
+
+		switch state {
+		case "configured", "unmanaged":
+			return nil
+		case "failed", "linger":
+			return fmt.Errorf("systemd-networkd failed to configure %s, its state is '%s'", name, state)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("systemd-networkd didn't configure %s within %s, its state is '%s'", name, timeout, state)
+		}
+		time.Sleep(networkdLinkPoll)
+	}
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"errors"
 	"testing"
 
+	godbus "github.com/godbus/dbus"
 	"github.com/stretchr/testify/assert"
 )
 
 type testDBusConnectioner struct {
 	WorksNthTime int
 	triedNTimes  int
+
+	// Unsupported makes the networkd methods fail like on old systemd
+	Unsupported  bool
+	Reloads      int
+	Reconfigured []int
+	// States are returned by LinkState one after another
+	States []string
+	Closed bool
 }
 
 func (tdc *testDBusConnectioner) RestartUnit(unit string, mode string, c chan<- string) (int, error) {
@@ -23,14 +33,82 @@ func (tdc *testDBusConnectioner) RestartUnit(unit string, mode string, c chan<-
 	return 0, nil
 }
 
-func TestRestartNetworkD(t *testing.T) {
+func (tdc *testDBusConnectioner) ReloadNetworkd() error {
+	if tdc.Unsupported {
+		return errNetworkdUnsupported
+	}
+	tdc.Reloads++
+	return nil
+}
+
+func (tdc *testDBusConnectioner) ReconfigureLink(index int) error {
+	tdc.Reconfigured = append(tdc.Reconfigured, index)
+	return nil
+}
+
+func (tdc *testDBusConnectioner) LinkState(index int) (string, error) {
+	if len(tdc.States) == 0 {
+		return "", errors.New("no state")
+	}
+	state := tdc.States[0]
+	if len(tdc.States) > 1 {
+		tdc.States = tdc.States[1:]
+	}
+	return state, nil
+}
+
+func (tdc *testDBusConnectioner) Close() {
+	tdc.Closed = true
+}
+
+func withMockDBus(conn *testDBusConnectioner) func() {
+	orig := newDBusConnection
 	newDBusConnection = func() (dbusConnectioner, error) {
-		return &testDBusConnectioner{WorksNthTime: 5}, nil
+		return conn, nil
+	}
+	return func() {
+		newDBusConnection = orig
 	}
+}
+
+func TestRestartNetworkD(t *testing.T) {
+	conn := &testDBusConnectioner{WorksNthTime: 5}
+	defer withMockDBus(conn)()
 
 	err := restartNetworkD(6)
 	assert.Nil(t, err)
+	assert.True(t, conn.Closed)
+
+	defer withMockDBus(&testDBusConnectioner{WorksNthTime: 5})()
 
 	err = restartNetworkD(4)
 	assert.NotNil(t, err)
 }
+
+func TestReconfigureNetworkD(t *testing.T) {
+	defer withMockInterfaceIndexes(map[string]int{"wl_private": 3})()
+
+	conn := &testDBusConnectioner{States: []string{"configuring", "configured"}}
+	defer withMockDBus(conn)()
+
+	err := reconfigureNetworkD([]string{"wl_private", "wl_public"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, conn.Reloads)
+	assert.Equal(t, []int{3}, conn.Reconfigured, "links that don't exist yet are skipped")
+	assert.True(t, conn.Closed)
+
+	conn.States = []string{"failed"}
+	assert.NotNil(t, reconfigureNetworkD([]string{"wl_private"}))
+
+	conn.Unsupported = true
+	assert.Equal(t, errNetworkdUnsupported, reconfigureNetworkD([]string{"wl_private"}))
+}
+
+func TestNetworkdError(t *testing.T) {
+	assert.Equal(t, errNetworkdUnsupported, networkdError(godbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod"}))
+	assert.Equal(t, errNetworkdUnsupported, networkdError(&godbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}))
+
+	err := godbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}
+	assert.Equal(t, err, networkdError(err))
+	assert.Nil(t, networkdError(nil))
+}
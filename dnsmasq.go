@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const dnsmasqLeaseTime = "12h"
+
+func generateDnsmasqConfig(networks []network, leaseFile string) (string, error) {
+	type dhcpNetwork struct {
+		Name      string
+		Gateway   string
+		Netmask   string
+		DHCPStart string
+		DHCPEnd   string
+	}
+
+	var data struct {
+		LeaseFile string
+		LeaseTime string
+		Networks  []dhcpNetwork
+	}
+	data.LeaseFile = leaseFile
+	data.LeaseTime = dnsmasqLeaseTime
+
+	for _, n := range networks {
+		data.Networks = append(data.Networks, dhcpNetwork{
+			Name:      n.Name,
+			Gateway:   n.Gateway.String(),
+			Netmask:   net.IP(n.Subnet.Mask).String(),
+			DHCPStart: n.DHCPStart.String(),
+			DHCPEnd:   n.DHCPEnd.String(),
+		})
+	}
+
+	templateString := `# generated by platform-hostapd
+bind-dynamic
+except-interface=lo
+dhcp-authoritative
+dhcp-leasefile={{.LeaseFile}}
+{{range .Networks}}
+interface={{.Name}}
+dhcp-range=set:{{.Name}},{{.DHCPStart}},{{.DHCPEnd}},{{.Netmask}},{{$.LeaseTime}}
+dhcp-option=tag:{{.Name}},option:router,{{.Gateway}}
+dhcp-option=tag:{{.Name}},option:dns-server,{{.Gateway}}
+{{end}}`
+
+	tmpl, err := template.New("dnsmasq").Parse(templateString)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+type dhcpLease struct {
+	Expires  time.Time
+	MAC      string
+	IP       net.IP
+	Hostname string
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file, which has one
+// 'expiry mac ip hostname client-id' line per lease
+func parseDnsmasqLeases(data []byte) ([]dhcpLease, error) {
+	var leases []dhcpLease
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("Malformed lease on line %d: '%s'", i+1, line)
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed lease expiry on line %d: '%s'", i+1, fields[0])
+		}
+
+		lease := dhcpLease{
+			MAC: strings.ToLower(fields[1]),
+			IP:  net.ParseIP(fields[2]),
+		}
+		if expiry != 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateDnsmasqConfig(t *testing.T) {
+	expected := `# generated by platform-hostapd
+bind-dynamic
+except-interface=lo
+dhcp-authoritative
+dhcp-leasefile=/tmp/leases
+
+interface=wl_private
+dhcp-range=set:wl_private,10.42.0.10,10.42.255.254,255.255.0.0,12h
+dhcp-option=tag:wl_private,option:router,10.42.0.1
+dhcp-option=tag:wl_private,option:dns-server,10.42.0.1
+
+interface=wl_public
+dhcp-range=set:wl_public,10.43.0.10,10.43.255.254,255.255.0.0,12h
+dhcp-option=tag:wl_public,option:router,10.43.0.1
+dhcp-option=tag:wl_public,option:dns-server,10.43.0.1
+`
+
+	cfg, err := generateDnsmasqConfig(expectedNets, "/tmp/leases")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, cfg)
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	data := []byte("1480000000 AA:BB:CC:DD:EE:FF 10.42.0.23 laptop 01:aa:bb:cc:dd:ee:ff\n" +
+		"0 11:22:33:44:55:66 10.43.0.11 * *\n\n")
+
+	leases, err := parseDnsmasqLeases(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []dhcpLease{
+		{Expires: time.Unix(1480000000, 0), MAC: "aa:bb:cc:dd:ee:ff", IP: net.ParseIP("10.42.0.23"), Hostname: "laptop"},
+		{MAC: "11:22:33:44:55:66", IP: net.ParseIP("10.43.0.11")},
+	}, leases)
+
+	_, err = parseDnsmasqLeases([]byte("garbage\n"))
+	assert.NotNil(t, err)
+}
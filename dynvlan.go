@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	dynamicVLANOff      = 0
+	dynamicVLANOptional = 1
+	dynamicVLANRequired = 2
+
+	defaultRADIUSPort = 1812
+
+	// hostapd appends the VLAN ID, giving the same names as static VLANs
+	dynamicVLANBridgePrefix = "br-vlan"
+)
+
+type radiusServer struct {
+	Address string
+	Port    int
+	Secret  string
+}
+
+// devicePSK is an entry of the per-device PSK list. A nil MAC matches every
+// device, a VLAN of 0 leaves the device on the network itself.
+type devicePSK struct {
+	MAC        net.HardwareAddr
+	Passphrase string
+	VLAN       int
+}
+
+// readDynamicVLAN reads the optional 'dynamic_vlan' mode ('optional' or
+// 'required'), the 'radius_server' and the optionally sealed 'radius_secret'
+// used to authorize stations by MAC address and the per-device 'device_psks'
+// list. Stations are put into the VLAN returned by RADIUS as
+// Tunnel-Private-Group-ID or listed with their PSK.
+func readDynamicVLAN(dir string, n *network) error {
+	mode, err := readOptionalValue(dir, "dynamic_vlan", "")
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case "":
+		n.DynamicVLAN = dynamicVLANOff
+	case "optional":
+		n.DynamicVLAN = dynamicVLANOptional
+	case "required":
+		n.DynamicVLAN = dynamicVLANRequired
+	default:
+		return fmt.Errorf("Invalid dynamic VLAN mode '%s' for network '%s', expected optional or required", mode, n.Name)
+	}
+
+	server, err := readOptionalValue(dir, "radius_server", "")
+	if err != nil {
+		return err
+	}
+	if server != "" {
+		n.RADIUS, err = parseRADIUSServer(server)
+		if err != nil {
+			return fmt.Errorf("Invalid RADIUS server for network '%s': %s", n.Name, err.Error())
+		}
+
+		n.RADIUS.Secret, err = readOptionalValue(dir, "radius_secret", "")
+		if err != nil {
+			return err
+		}
+		if n.RADIUS.Secret == "" {
+			return fmt.Errorf("RADIUS server configured for network '%s' without 'radius_secret'", n.Name)
+		}
+		n.RADIUS.Secret, err = openSecret(n.RADIUS.Secret)
+		if err != nil {
+			return fmt.Errorf("Failed to open the RADIUS secret of network '%s': %s", n.Name, err.Error())
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "device_psks"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		n.DevicePSKs, err = parseDevicePSKs(data)
+		if err != nil {
+			return fmt.Errorf("Invalid entry in %s: %s", path.Join(dir, "device_psks"), err.Error())
+		}
+	}
+
+	if n.DynamicVLAN != dynamicVLANOff && n.RADIUS == nil && len(n.DevicePSKs) == 0 {
+		return fmt.Errorf("Dynamic VLANs on network '%s' need a RADIUS server or device PSKs", n.Name)
+	}
+
+	return nil
+}
+
+// parseRADIUSServer accepts 'host' and 'host:port'
+func parseRADIUSServer(s string) (*radiusServer, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return &radiusServer{Address: s, Port: defaultRADIUSPort}, nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid port in '%s'", s)
+	}
+
+	return &radiusServer{Address: host, Port: p}, nil
+}
+
+// parseDevicePSKs reads lines of 'MAC PASSPHRASE [VLAN]'. '*' as MAC applies
+// the passphrase to every device.
+func parseDevicePSKs(data []byte) ([]devicePSK, error) {
+	var psks []devicePSK
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("expected 'MAC PASSPHRASE [VLAN]', got '%s'", line)
+		}
+
+		var psk devicePSK
+		if fields[0] != "*" {
+			mac, err := net.ParseMAC(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			psk.MAC = mac
+		}
+
+		psk.Passphrase = fields[1]
+		err := validatePassphrase(psk.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase for %s %s", fields[0], err.Error())
+		}
+
+		if len(fields) == 3 {
+			vlan, err := strconv.Atoi(fields[2])
+			if err != nil || vlan < 1 || vlan > maxVLANID {
+				return nil, fmt.Errorf("invalid VLAN ID '%s'", fields[2])
+			}
+			psk.VLAN = vlan
+		}
+
+		psks = append(psks, psk)
+	}
+
+	return psks, nil
+}
+
+// knownVLANs are the VLANs we know of before any station connects
+func knownVLANs(n network) []int {
+	seen := make(map[int]bool)
+	var vlans []int
+	for _, psk := range n.DevicePSKs {
+		if psk.VLAN != 0 && !seen[psk.VLAN] {
+			seen[psk.VLAN] = true
+			vlans = append(vlans, psk.VLAN)
+		}
+	}
+
+	sort.Ints(vlans)
+	return vlans
+}
+
+// generateVLANFile maps the known VLANs to their interface and bridge. The
+// wildcard line lets hostapd create interfaces and bridges for any other VLAN
+// RADIUS hands out on demand.
+func generateVLANFile(n network) string {
+	var buf bytes.Buffer
+	for _, vlan := range knownVLANs(n) {
+		fmt.Fprintf(&buf, "%d %s.%d %s%d\n", vlan, n.Name, vlan, dynamicVLANBridgePrefix, vlan)
+	}
+	fmt.Fprintf(&buf, "* %s.#\n", n.Name)
+	return buf.String()
+}
+
+// generatePSKFile renders the device PSKs in the wpa_psk_file format
+func generatePSKFile(n network) string {
+	var buf bytes.Buffer
+	for _, psk := range n.DevicePSKs {
+		mac := "00:00:00:00:00:00"
+		if psk.MAC != nil {
+			mac = psk.MAC.String()
+		}
+
+		if psk.VLAN != 0 {
+			fmt.Fprintf(&buf, "vlanid=%d ", psk.VLAN)
+		}
+		fmt.Fprintf(&buf, "%s %s\n", mac, psk.Passphrase)
+	}
+	return buf.String()
+}
+
+// assignDynamicVLANFiles sets the paths of the vlan_file and wpa_psk_file of
+// each network in dir, without writing anything
+func assignDynamicVLANFiles(networks []network, dir string) {
+	for i := range networks {
+		n := &networks[i]
+
+		if n.DynamicVLAN != dynamicVLANOff {
+			n.VLANFile = path.Join(dir, n.Name+".vlan")
+		}
+
+		if len(n.DevicePSKs) != 0 || n.VoucherMode == voucherModePSK {
+			n.PSKFile = path.Join(dir, n.Name+".psk")
+		}
+	}
+}
+
+// writeDynamicVLANFiles writes the vlan_file and wpa_psk_file of each network
+// into dir
+func writeDynamicVLANFiles(networks []network, dir string) error {
+	assignDynamicVLANFiles(networks, dir)
+
+	for _, n := range networks {
+		if n.VLANFile != "" {
+			log.Debugf("Writing VLAN file '%s'", n.VLANFile)
+			err := writeFileCreatingDir(n.VLANFile, []byte(generateVLANFile(n)), 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		if n.PSKFile != "" {
+			_, err := writePSKFile(n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writePSKFile writes the device PSKs and the currently valid vouchers of a
+// network to its wpa_psk_file and tells whether that changed anything
+func writePSKFile(n network) (bool, error) {
+	content := generatePSKFile(n)
+	if n.VoucherMode == voucherModePSK {
+		vouchers, err := loadVouchers(n.VoucherDir)
+		if err != nil {
+			return false, err
+		}
+		content += generateVoucherPSKs(vouchers, time.Now())
+	}
+
+	old, err := ioutil.ReadFile(n.PSKFile)
+	if err == nil && string(old) == content {
+		return false, nil
+	}
+
+	log.Debugf("Writing PSK file '%s'", n.PSKFile)
+	return true, writeFileCreatingDir(n.PSKFile, []byte(content), 0600)
+}
+
+// ensureDynamicVLANBridges sets up the bridges of the known VLANs up front,
+// so that the wired side of them is there before the first station connects
+func ensureDynamicVLANBridges(networks []network) error {
+	for _, n := range networks {
+		if n.DynamicVLAN == dynamicVLANOff {
+			continue
+		}
+
+		for _, vlan := range knownVLANs(n) {
+			bridge := network{
+				Name:          n.Name,
+				Bridge:        fmt.Sprintf("%s%d", dynamicVLANBridgePrefix, vlan),
+				VLAN:          vlan,
+				VLANInterface: n.VLANInterface,
+			}
+
+			err := ensureBridge(bridge)
+			if err != nil {
+				return fmt.Errorf("Failed to set up bridge %s for VLAN %d: %s", bridge.Bridge, vlan, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
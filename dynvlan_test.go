@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDynamicVLAN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_private"}
+	err = readDynamicVLAN(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, dynamicVLANOff, n.DynamicVLAN)
+	assert.Nil(t, n.RADIUS)
+
+	err = ioutil.WriteFile(path.Join(dir, "dynamic_vlan"), []byte("optional\n"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readDynamicVLAN(dir, &n), "dynamic VLANs need a source")
+
+	err = ioutil.WriteFile(path.Join(dir, "radius_server"), []byte("192.168.1.5:1645"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readDynamicVLAN(dir, &n), "RADIUS needs a secret")
+
+	err = ioutil.WriteFile(path.Join(dir, "radius_secret"), []byte("s3cret\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "device_psks"), []byte("# staff\naa:bb:cc:dd:ee:ff camera-pass 20\n* shared-pass\n"), 0644)
+	assert.Nil(t, err)
+
+	n = network{Name: "wl_private"}
+	err = readDynamicVLAN(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, dynamicVLANOptional, n.DynamicVLAN)
+	assert.Equal(t, &radiusServer{Address: "192.168.1.5", Port: 1645, Secret: "s3cret"}, n.RADIUS)
+	assert.Len(t, n.DevicePSKs, 2)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", n.DevicePSKs[0].MAC.String())
+	assert.Equal(t, 20, n.DevicePSKs[0].VLAN)
+	assert.Nil(t, n.DevicePSKs[1].MAC)
+
+	err = ioutil.WriteFile(path.Join(dir, "dynamic_vlan"), []byte("sometimes"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readDynamicVLAN(dir, &n))
+}
+
+func TestParseDevicePSKs(t *testing.T) {
+	for _, bad := range []string{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:ff short", "aa:bb:cc:dd:ee:ff long-enough 5000", "nomac long-enough"} {
+		_, err := parseDevicePSKs([]byte(bad))
+		assert.NotNil(t, err, bad)
+	}
+
+	server, err := parseRADIUSServer("radius.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultRADIUSPort, server.Port)
+}
+
+func TestGenerateDynamicVLANFiles(t *testing.T) {
+	psks, err := parseDevicePSKs([]byte("aa:bb:cc:dd:ee:ff camera-pass 20\n11:22:33:44:55:66 printer-pass 10\n* shared-pass\n"))
+	assert.Nil(t, err)
+	n := network{Name: "wl_private", DynamicVLAN: dynamicVLANOptional, DevicePSKs: psks, VLANInterface: "eth1"}
+
+	assert.Equal(t, []int{10, 20}, knownVLANs(n))
+	assert.Equal(t, "10 wl_private.10 br-vlan10\n20 wl_private.20 br-vlan20\n* wl_private.#\n", generateVLANFile(n))
+	assert.Equal(t, "vlanid=20 aa:bb:cc:dd:ee:ff camera-pass\nvlanid=10 11:22:33:44:55:66 printer-pass\n00:00:00:00:00:00 shared-pass\n", generatePSKFile(n))
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	networks := []network{n, {Name: "wl_public"}}
+	err = writeDynamicVLANFiles(networks, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, path.Join(dir, "wl_private.vlan"), networks[0].VLANFile)
+	assert.Equal(t, path.Join(dir, "wl_private.psk"), networks[0].PSKFile)
+	assert.Equal(t, "", networks[1].VLANFile)
+
+	info, err := os.Stat(networks[0].PSKFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
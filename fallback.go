@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const hostapdStartPoll = 500 * time.Millisecond
+
+// fallbackChannels are tried last, as the non-overlapping 2.4GHz channels
+// every regulatory domain allows
+var fallbackChannels = []uint{1, 6, 11}
+
+// configFallback makes the generated config safer for radios and drivers
+// that reject it. Each level of the ladder keeps the degradations of the
+// previous ones.
+type configFallback struct {
+	Level int
+	Name  string
+	// NoHT40 restricts 802.11n to 20MHz channels
+	NoHT40 bool
+	// SingleBSS only runs the first network
+	SingleBSS bool
+	// Channel, if set, replaces the configured channel
+	Channel uint
+	// KnownGood runs the last config hostapd came up with instead of
+	// generating one
+	KnownGood bool
+}
+
+// fallbackRecord tells operators which degradation hostapd is running with
+// and why
+type fallbackRecord struct {
+	Level       int       `json:"level"`
+	Degradation string    `json:"degradation"`
+	Reason      string    `json:"reason,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// fallbackLadder returns the configs to try one after another, leaving out
+// steps that wouldn't change anything. If there is a known good config, it is
+// tried before degrading the new one, as a config change is more likely to
+// break hostapd than the hardware.
+func fallbackLadder(channel uint, networks int, knownGood bool) []configFallback {
+	ladder := []configFallback{{Name: "none"}}
+	if knownGood {
+		ladder = append(ladder, configFallback{Name: "last known good config", KnownGood: true})
+	}
+	ladder = append(ladder, configFallback{Name: "no HT40", NoHT40: true})
+	if networks > 1 {
+		ladder = append(ladder, configFallback{Name: "no HT40, single BSS", NoHT40: true, SingleBSS: true})
+	}
+
+	last := ladder[len(ladder)-1]
+	for _, c := range fallbackChannels {
+		if c == channel {
+			continue
+		}
+
+		f := last
+		f.Name = fmt.Sprintf("%s, channel %d", last.Name, c)
+		f.Channel = c
+		ladder = append(ladder, f)
+	}
+
+	for i := range ladder {
+		ladder[i].Level = i
+	}
+	return ladder
+}
+
+// networks returns the networks run at this fallback level
+func (f configFallback) networks(networks []network) []network {
+	if f.SingleBSS && len(networks) > 1 {
+		return networks[:1]
+	}
+	return networks
+}
+
+// waitForHostapd waits until hostapd enabled the BSSes of the networks and
+// fails early if it exits
+func waitForHostapd(s *supervisor, networks []network, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if s.Exited("hostapd") {
+			return fmt.Errorf("hostapd exited")
+		}
+		if hostapdInState(networks, "ENABLED") {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("hostapd didn't enable its BSSes within %s", timeout)
+		}
+		time.Sleep(hostapdStartPoll)
+	}
+}
+
+// startHostapd starts hostapd for the scheduled networks on the configured
+// channel, working down the fallback ladder until a config comes up. It
+// returns the supervisor running it and the networks that are actually on.
+func startHostapd(scheduled []network, channel uint) (*supervisor, []network, configFallback, error) {
+	_, err := os.Stat(knownGoodConfigFile(opts.ConfigFile))
+	ladder := fallbackLadder(channel, len(scheduled), err == nil)
+
+	var reason string
+	for _, f := range ladder {
+		running := f.networks(scheduled)
+		if f.Level > 0 {
+			log.Warnf("Retrying hostapd with fallback '%s'", f.Name)
+		}
+
+		var s *supervisor
+		if f.KnownGood {
+			running, err = restoreKnownGoodNetworks(scheduled)
+			if err != nil {
+				log.Errorf("Failed to roll back to the known good config: %s", err.Error())
+				continue
+			}
+			if running == nil {
+				continue
+			}
+			s, err = startConfiguredHostapd(running)
+		} else {
+			s, err = tryHostapdConfig(running, channel, f)
+		}
+		if err == nil {
+			err = saveFallbackRecord(opts.FallbackState, fallbackRecord{Level: f.Level, Degradation: f.Name, Reason: reason, Since: time.Now()})
+			if err != nil {
+				log.Warnf("Failed to record the config fallback: %s", err.Error())
+			}
+			return s, running, f, nil
+		}
+
+		reason = fmt.Sprintf("fallback '%s' failed: %s", f.Name, err.Error())
+		log.Errorf("hostapd failed to start with fallback '%s': %s", f.Name, err.Error())
+	}
+
+	return nil, nil, configFallback{}, fmt.Errorf("hostapd failed to start with every fallback, last %s", reason)
+}
+
+// restoreKnownGoodNetworks rolls back to the known good config and returns
+// the networks it runs, or nil if it can't serve the scheduled networks or
+// there is nothing to roll back to
+func restoreKnownGoodNetworks(scheduled []network) ([]network, error) {
+	names, err := restoreKnownGoodConfig(opts.ConfigFile)
+	if err != nil || names == nil {
+		return nil, err
+	}
+
+	running := networksNamed(scheduled, names)
+	if running == nil {
+		log.Warnf("The known good config runs %s, which aren't all scheduled", strings.Join(names, ", "))
+	}
+	return running, nil
+}
+
+func tryHostapdConfig(running []network, channel uint, f configFallback) (*supervisor, error) {
+	_, err := writeHostapdConfig(running, channel, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return startConfiguredHostapd(running)
+}
+
+// startConfiguredHostapd starts hostapd with the config in place and waits
+// for it to come up, which makes that config the known good one
+func startConfiguredHostapd(running []network) (*supervisor, error) {
+	err := ensureBridges(running)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ensureDynamicVLANBridges(running)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSupervisor()
+
+	log.Info("Starting hostapd")
+	err = s.Start("hostapd", opts.Binary, opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitForHostapd(s, running, opts.HostapdStartTimeout)
+	if err != nil {
+		s.Stop()
+		return nil, err
+	}
+
+	err = saveKnownGoodConfig(opts.ConfigFile)
+	if err != nil {
+		log.Warnf("Failed to keep the known good config: %s", err.Error())
+	}
+
+	return s, nil
+}
+
+func saveFallbackRecord(filename string, r fallbackRecord) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(filename, data, 0644)
+}
+
+// loadFallbackRecord returns nil if hostapd wasn't started yet
+func loadFallbackRecord(filename string) (*fallbackRecord, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r fallbackRecord
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fallback record %s: %s", filename, err.Error())
+	}
+	return &r, nil
+}
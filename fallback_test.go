@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackLadder(t *testing.T) {
+	ladder := fallbackLadder(6, 2, false)
+
+	var names []string
+	for i, f := range ladder {
+		assert.Equal(t, i, f.Level)
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{
+		"none",
+		"no HT40",
+		"no HT40, single BSS",
+		"no HT40, single BSS, channel 1",
+		"no HT40, single BSS, channel 11",
+	}, names, "the configured channel isn't tried again")
+	assert.Equal(t, configFallback{Level: 4, Name: "no HT40, single BSS, channel 11", NoHT40: true, SingleBSS: true, Channel: 11}, ladder[4])
+
+	ladder = fallbackLadder(3, 1, false)
+	assert.Len(t, ladder, 5)
+	assert.False(t, ladder[4].SingleBSS, "a single network has no BSS to drop")
+	assert.Equal(t, "no HT40, channel 11", ladder[4].Name)
+
+	ladder = fallbackLadder(6, 1, true)
+	assert.Equal(t, configFallback{Level: 1, Name: "last known good config", KnownGood: true}, ladder[1])
+	assert.Equal(t, configFallback{Level: 2, Name: "no HT40", NoHT40: true}, ladder[2])
+	assert.False(t, ladder[len(ladder)-1].KnownGood)
+}
+
+func TestConfigFallbackNetworks(t *testing.T) {
+	networks := []network{{Name: "wl_private"}, {Name: "wl_public"}}
+	assert.Equal(t, networks, configFallback{NoHT40: true}.networks(networks))
+	assert.Equal(t, networks[:1], configFallback{SingleBSS: true}.networks(networks))
+}
+
+func TestGenerateConfigFileFallback(t *testing.T) {
+	htcaps := &htCapabilities{HT20: true, HT40: true, HT20SGI: true, HT40SGI: true, DSSSCCKHT40: true}
+	cfgFile, err := generateConfigFile(expectedNets[:1], 1, true, htcaps, "", configFallback{NoHT40: true, Channel: 11})
+	assert.Nil(t, err)
+	assert.Contains(t, cfgFile, "\nchannel=11\nht_capab=[HT20][SHORT-GI-20]\n")
+	assert.True(t, htcaps.HT40, "the capabilities themselves are left alone")
+}
+
+func TestWaitForHostapd(t *testing.T) {
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{"STATUS": "state=COUNTRY_UPDATE\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": ctrl})()
+	networks := []network{{Name: "wl_private"}}
+
+	s := newSupervisor()
+	assert.Nil(t, s.Start("hostapd", "/bin/sh", "-c", "exit 1"))
+	err := waitForHostapd(s, networks, 5*time.Second)
+	assert.EqualError(t, err, "hostapd exited")
+	s.Stop()
+
+	s = newSupervisor()
+	defer s.Stop()
+	assert.Nil(t, s.Start("hostapd", "/bin/sleep", "60"))
+	err = waitForHostapd(s, networks, 100*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "hostapd didn't enable"))
+
+	ctrl.Replies["STATUS"] = "state=ENABLED\n"
+	assert.Nil(t, waitForHostapd(s, networks, time.Second))
+}
+
+func TestFallbackRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "fallback.json")
+	r, err := loadFallbackRecord(filename)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	since := time.Date(2017, 3, 15, 8, 0, 0, 0, time.UTC)
+	err = saveFallbackRecord(filename, fallbackRecord{Level: 1, Degradation: "no HT40", Reason: "fallback 'none' failed: hostapd exited", Since: since})
+	assert.Nil(t, err)
+
+	r, err = loadFallbackRecord(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, &fallbackRecord{Level: 1, Degradation: "no HT40", Reason: "fallback 'none' failed: hostapd exited", Since: since}, r)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type firewallNetwork struct {
+	Interface string
+	Subnet    *net.IPNet
+
+	// Isolate blocks the network from the LAN and the host itself, except
+	// for DHCP, DNS and the destinations on LANAllowlist
+	Isolate      bool
+	LANAllowlist []*net.IPNet
+
+	// IPv6Prefix enables forwarding rules for IPv6, which is never NATed
+	IPv6Prefix *net.IPNet
+
+	// Portal keeps clients off the uplink until they logged in on the
+	// captive portal listening on PortalPort. PortalClients are already
+	// logged in.
+	Portal        bool
+	PortalPort    uint16
+	PortalClients []portalClient
+
+	// ShapingMark tags forwarded traffic of the network, so that it can be
+	// rate limited on the uplink
+	ShapingMark uint32
+}
+
+// portalClient is allowed past the captive portal for the remaining Timeout
+type portalClient struct {
+	MAC     net.HardwareAddr
+	Timeout time.Duration
+}
+
+// isolationPorts are the host services isolated networks may still use
+var isolationPorts = []struct {
+	Proto string
+	Port  uint16
+}{
+	{"udp", 67},
+	{"udp", 53},
+	{"tcp", 53},
+}
+
+// icmpv6InboundTypes may come in from the uplink to the routed IPv6 prefixes
+// besides replies: destination unreachable, packet too big, time exceeded,
+// parameter problem and neighbor solicitations and advertisements
+var icmpv6InboundTypes = []uint8{1, 2, 3, 4, 135, 136}
+
+type firewallConfig struct {
+	Uplink   string
+	Networks []firewallNetwork
+}
+
+func (c *firewallConfig) hasPortal() bool {
+	for _, n := range c.Networks {
+		if n.Portal {
+			return true
+		}
+	}
+	return false
+}
+
+type firewaller interface {
+	Apply(*firewallConfig) error
+	Remove(*firewallConfig) error
+	// RemoveAll removes whatever we installed, no matter which config it
+	// came from
+	RemoveAll() error
+	// Update moves the installed rules from old to new, e.g. after an
+	// uplink failover
+	Update(old, new *firewallConfig) error
+	// AllowClient lets a client of a captive portal network through for
+	// timeout, restarting the timeout if it already was
+	AllowClient(iface string, mac net.HardwareAddr, timeout time.Duration) error
+	RevokeClient(iface string, mac net.HardwareAddr) error
+}
+
+// newFirewall returns the requested backend. 'auto' prefers nf_tables and
+// falls back to iptables on kernels that don't support it.
+func newFirewall(backend string) (firewaller, error) {
+	switch backend {
+	case "nftables":
+		return newNFTablesFirewall(), nil
+	case "iptables":
+		return newIPTablesFirewall(opts.FirewallState), nil
+	case "auto":
+		if nftablesSupported() {
+			log.Debugln("Using nftables firewall backend")
+			return newNFTablesFirewall(), nil
+		}
+		log.Debugln("nf_tables not supported by the kernel, using iptables firewall backend")
+		return newIPTablesFirewall(opts.FirewallState), nil
+	default:
+		return nil, fmt.Errorf("Unknown firewall backend '%s'", backend)
+	}
+}
+
+func buildFirewallConfig(networks []network, uplink string) (*firewallConfig, error) {
+	cfg := &firewallConfig{Uplink: uplink}
+	for _, n := range routedNetworks(networks) {
+		if n.Subnet == nil {
+			return nil, fmt.Errorf("No subnet known for network '%s'", n.Name)
+		}
+
+		fn := firewallNetwork{
+			Interface:    n.Name,
+			Subnet:       n.Subnet,
+			Isolate:      n.Isolate,
+			LANAllowlist: n.LANAllowlist,
+			IPv6Prefix:   n.IPv6Prefix,
+			Portal:       n.CaptivePortal,
+		}
+		if n.CaptivePortal {
+			fn.PortalPort = opts.PortalPort
+		}
+		if n.RateLimit != 0 {
+			fn.ShapingMark = shapingMark(n.Name)
+		}
+		cfg.Networks = append(cfg.Networks, fn)
+	}
+
+	return cfg, nil
+}
+
+// withPortalClients returns a copy of cfg with the clients currently logged
+// in on the captive portals, so that replacing the rules doesn't log them out
+func withPortalClients(cfg *firewallConfig, sessionsFile string) (*firewallConfig, error) {
+	newCfg := *cfg
+	newCfg.Networks = append([]firewallNetwork(nil), cfg.Networks...)
+	if !cfg.hasPortal() {
+		return &newCfg, nil
+	}
+
+	sessions, err := loadPortalSessions(sessionsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range newCfg.Networks {
+		n := &newCfg.Networks[i]
+		n.PortalClients = nil
+		for _, s := range sessions {
+			if s.Interface != n.Interface || !s.Expires.After(now) {
+				continue
+			}
+
+			mac, err := net.ParseMAC(s.MAC)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid portal session in %s: %s", sessionsFile, err.Error())
+			}
+			n.PortalClients = append(n.PortalClients, portalClient{MAC: mac, Timeout: s.Expires.Sub(now)})
+		}
+	}
+
+	return &newCfg, nil
+}
+
+type firewallCommand struct {
+	Args struct {
+		Action string `positional-arg-name:"start|stop|watch" required:"true"`
+	} `positional-args:"true"`
+}
+
+func (c *firewallCommand) Execute(args []string) error {
+	setupLogging()
+
+	if c.Args.Action != "start" && c.Args.Action != "stop" && c.Args.Action != "watch" {
+		return fmt.Errorf("Unknown firewall action '%s', expected start, stop or watch", c.Args.Action)
+	}
+
+	fw, err := newFirewall(opts.FirewallBackend)
+	if err != nil {
+		return err
+	}
+
+	// whatever start installed goes, even if the config or the uplink
+	// changed since
+	if c.Args.Action == "stop" {
+		log.Infoln("Disabling hostapd ip filter")
+		return fw.RemoveAll()
+	}
+
+	networks, err := getNeededNetworks(opts.SKVSPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get network list: %s", err.Error())
+	}
+
+	err = resolveIPv6Prefixes(networks)
+	if err != nil {
+		return err
+	}
+
+	uplink, err := getUplinkInterface()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := buildFirewallConfig(networks, uplink)
+	if err != nil {
+		return err
+	}
+
+	cfg, err = withPortalClients(cfg, opts.PortalSessions)
+	if err != nil {
+		return err
+	}
+
+	if c.Args.Action == "start" {
+		log.Infof("Enabling hostapd ip filter for %s", uplink)
+		return fw.Apply(cfg)
+	}
+
+	log.Infof("Enabling hostapd ip filter for %s", uplink)
+	err = fw.Apply(cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg, err = followUplink(fw, cfg, stopOnSignal())
+	if err != nil {
+		log.Errorf("Uplink watch failed: %s", err.Error())
+	}
+
+	log.Infof("Disabling hostapd ip filter for %s", cfg.Uplink)
+	return fw.Remove(cfg)
+}
+
+// followUplink moves the rules of cfg to the new uplink whenever the default
+// route moves to another interface, until stop is closed. It returns the
+// config last installed.
+func followUplink(fw firewaller, cfg *firewallConfig, stop <-chan struct{}) (*firewallConfig, error) {
+	err := watchUplink(cfg.Uplink, stop, func(newUplink string) error {
+		newCfg, err := withPortalClients(cfg, opts.PortalSessions)
+		if err != nil {
+			return err
+		}
+		newCfg.Uplink = newUplink
+
+		err = fw.Update(cfg, newCfg)
+		if err == nil {
+			cfg = newCfg
+		}
+		return err
+	})
+
+	return cfg, err
+}
+
+// stopOnSignal returns a channel that is closed on SIGINT or SIGTERM
+func stopOnSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		close(stop)
+	}()
+
+	return stop
+}
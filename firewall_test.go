@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildFirewallConfig(t *testing.T) {
+	cfg, err := buildFirewallConfig(expectedNets, "eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, testFirewallConfig(), cfg)
+
+	_, err = buildFirewallConfig([]network{{Name: "wl_unknown"}}, "eth0")
+	assert.NotNil(t, err)
+}
+
+func TestNewFirewallAuto(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	fw, err := newFirewall("auto")
+	assert.Nil(t, err)
+	assert.IsType(t, &nftablesFirewall{}, fw)
+
+	conn.Err = syscall.EPROTONOSUPPORT
+	fw, err = newFirewall("auto")
+	assert.Nil(t, err)
+	assert.IsType(t, &iptablesFirewall{}, fw)
+
+	_, err = newFirewall("pf")
+	assert.NotNil(t, err)
+}
+
+// testIPTablesFirewall records its state in a temporary directory, which
+// the returned function removes
+func testIPTablesFirewall() (*iptablesFirewall, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	return newIPTablesFirewall(path.Join(dir, "firewall.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestIPTablesApply(t *testing.T) {
+	var calls []string
+	existing := map[string]bool{
+		"-t filter -C FORWARD -i eth0 -o wl_private -j ACCEPT": true,
+	}
+
+	orig := runIPTables
+	defer func() { runIPTables = orig }()
+	runIPTables = func(args ...string) error {
+		cmd := strings.Join(args, " ")
+		calls = append(calls, cmd)
+		if args[2] == "-C" && !existing[cmd] {
+			return syscall.ENOENT
+		}
+		return nil
+	}
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(testFirewallConfig())
+	assert.Nil(t, err)
+
+	var appended []string
+	for _, c := range calls {
+		if strings.Contains(c, " -A ") {
+			appended = append(appended, c)
+		}
+	}
+
+	assert.Equal(t, []string{
+		"-t filter -A FORWARD -i wl_private -o eth0 -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-t filter -A FORWARD -i wl_public -o eth0 -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -j ACCEPT",
+		"-t nat -A POSTROUTING -o eth0 -s 10.42.0.0/16 -j MASQUERADE",
+		"-t nat -A POSTROUTING -o eth0 -s 10.43.0.0/16 -j MASQUERADE",
+	}, appended)
+}
+
+func TestIPTablesUpdate(t *testing.T) {
+	installed := make(map[string]bool)
+	for _, r := range iptablesRules(testFirewallConfig()) {
+		installed[strings.Join(r.command("-C"), " ")] = true
+	}
+
+	orig := runIPTables
+	defer func() { runIPTables = orig }()
+	runIPTables = func(args ...string) error {
+		op := args[2]
+		args[2] = "-C"
+		cmd := strings.Join(args, " ")
+		switch op {
+		case "-C":
+			if !installed[cmd] {
+				return syscall.ENOENT
+			}
+		case "-A":
+			installed[cmd] = true
+		case "-D":
+			delete(installed, cmd)
+		}
+		return nil
+	}
+
+	newCfg := testFirewallConfig()
+	newCfg.Uplink = "wwan0"
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Update(testFirewallConfig(), newCfg)
+	assert.Nil(t, err)
+	assert.Len(t, installed, 6)
+	for cmd := range installed {
+		assert.Contains(t, cmd, "wwan0")
+	}
+
+	assert.Nil(t, fw.RemoveAll())
+	assert.Len(t, installed, 0, "the rules for the uplink moved to are recorded")
+}
+
+func TestIPTablesRemoveAll(t *testing.T) {
+	installed := make(map[string]bool)
+
+	orig := runIPTables
+	defer func() { runIPTables = orig }()
+	runIPTables = func(args ...string) error {
+		op := args[2]
+		args[2] = "-C"
+		cmd := strings.Join(args, " ")
+		switch op {
+		case "-C":
+			if !installed[cmd] {
+				return syscall.ENOENT
+			}
+		case "-A", "-I":
+			installed[cmd] = true
+		case "-D":
+			delete(installed, cmd)
+		}
+		return nil
+	}
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	assert.Nil(t, fw.RemoveAll(), "nothing to remove before the first start")
+
+	err := fw.Apply(testFirewallConfig())
+	assert.Nil(t, err)
+	assert.Len(t, installed, 6)
+
+	// stop doesn't need the config start was run with
+	assert.Nil(t, fw.RemoveAll())
+	assert.Len(t, installed, 0)
+	_, err = os.Stat(fw.stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIPTablesIsolation(t *testing.T) {
+	var added []string
+
+	orig := runIPTables
+	defer func() { runIPTables = orig }()
+	runIPTables = func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		added = append(added, strings.Join(args, " "))
+		return nil
+	}
+
+	cfg := testFirewallConfig()
+	cfg.Networks = cfg.Networks[1:]
+	cfg.Networks[0].Isolate = true
+	cfg.Networks[0].LANAllowlist = mustParseCIDRs([]string{"192.168.1.0/24"})
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	// inserted in reverse, so that they end up in the listed order
+	assert.Equal(t, []string{
+		"-t filter -I INPUT -i wl_public -j DROP",
+		"-t filter -I INPUT -i wl_public -p tcp --dport 53 -j ACCEPT",
+		"-t filter -I INPUT -i wl_public -p udp --dport 53 -j ACCEPT",
+		"-t filter -I INPUT -i wl_public -p udp --dport 67 -j ACCEPT",
+		"-t filter -I FORWARD -i wl_public -d 169.254.0.0/16 -j DROP",
+		"-t filter -I FORWARD -i wl_public -d 192.168.0.0/16 -j DROP",
+		"-t filter -I FORWARD -i wl_public -d 172.16.0.0/12 -j DROP",
+		"-t filter -I FORWARD -i wl_public -d 10.0.0.0/8 -j DROP",
+		"-t filter -I FORWARD -i wl_public -d 192.168.1.0/24 -j ACCEPT",
+		"-t filter -A FORWARD -i wl_public -o eth0 -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -j ACCEPT",
+		"-t nat -A POSTROUTING -o eth0 -s 10.43.0.0/16 -j MASQUERADE",
+	}, added)
+}
+
+func TestIPTablesIPv6(t *testing.T) {
+	var added, added6 []string
+
+	orig, orig6 := runIPTables, runIP6Tables
+	defer func() { runIPTables, runIP6Tables = orig, orig6 }()
+	runIPTables = func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		added = append(added, strings.Join(args, " "))
+		return nil
+	}
+	runIP6Tables = func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		added6 = append(added6, strings.Join(args, " "))
+		return nil
+	}
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].Isolate = true
+	cfg.Networks[1].IPv6Prefix = mustParseCIDRs([]string{"2001:db8:0:2::/64"})[0]
+	cfg.Networks[1].LANAllowlist = mustParseCIDRs([]string{"192.168.1.0/24", "fd00::/64"})
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	assert.Contains(t, added, "-t filter -I FORWARD -i wl_public -o wl_private -j DROP")
+	assert.NotContains(t, added, "-t filter -I FORWARD -i wl_public -d fd00::/64 -j ACCEPT")
+
+	assert.Equal(t, []string{
+		"-t filter -I INPUT -i wl_public -j DROP",
+		"-t filter -I INPUT -i wl_public -p tcp --dport 53 -j ACCEPT",
+		"-t filter -I INPUT -i wl_public -p udp --dport 53 -j ACCEPT",
+		"-t filter -I INPUT -i wl_public -p udp --dport 67 -j ACCEPT",
+		"-t filter -I INPUT -i wl_public -p ipv6-icmp -j ACCEPT",
+		"-t filter -I FORWARD -i wl_public -d fc00::/7 -j DROP",
+		"-t filter -I FORWARD -i wl_public -o wl_private -j DROP",
+		"-t filter -I FORWARD -i wl_public -d fd00::/64 -j ACCEPT",
+		"-t filter -A FORWARD -i wl_public -o eth0 -s 2001:db8:0:2::/64 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -d 2001:db8:0:2::/64 -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 1 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 2 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 3 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 4 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 135 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -p ipv6-icmp --icmpv6-type 136 -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -j DROP",
+	}, added6)
+}
+
+func TestIPTablesPortal(t *testing.T) {
+	var added, ipset []string
+
+	orig, origSet := runIPTables, runIPSet
+	defer func() { runIPTables, runIPSet = orig, origSet }()
+	runIPTables = func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		added = append(added, strings.Join(args, " "))
+		return nil
+	}
+	runIPSet = func(args ...string) error {
+		ipset = append(ipset, strings.Join(args, " "))
+		return nil
+	}
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	cfg := testFirewallConfig()
+	cfg.Networks = cfg.Networks[1:]
+	cfg.Networks[0].Portal = true
+	cfg.Networks[0].PortalPort = 8880
+	cfg.Networks[0].PortalClients = []portalClient{{MAC: mac, Timeout: time.Hour}}
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"create hostapd_portal_wl_public hash:mac timeout 0 -exist",
+		"add hostapd_portal_wl_public aa:bb:cc:dd:ee:ff timeout 3600 -exist",
+	}, ipset)
+	assert.Equal(t, []string{
+		"-t filter -I INPUT -i wl_public -p tcp --dport 8880 -j ACCEPT",
+		"-t filter -I FORWARD -i wl_public -m set ! --match-set hostapd_portal_wl_public src -j DROP",
+		"-t nat -A PREROUTING -i wl_public -m set ! --match-set hostapd_portal_wl_public src -p tcp --dport 80 -j REDIRECT --to-ports 8880",
+		"-t nat -A PREROUTING -i wl_public -m set ! --match-set hostapd_portal_wl_public src -p udp --dport 53 -j REDIRECT --to-ports 53",
+		"-t nat -A PREROUTING -i wl_public -m set ! --match-set hostapd_portal_wl_public src -p tcp --dport 53 -j REDIRECT --to-ports 53",
+		"-t filter -A FORWARD -i wl_public -o eth0 -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-t filter -A FORWARD -i eth0 -o wl_public -j ACCEPT",
+		"-t nat -A POSTROUTING -o eth0 -s 10.43.0.0/16 -j MASQUERADE",
+	}, added)
+}
+
+func TestIPTablesPortalIPv6(t *testing.T) {
+	var added6 []string
+
+	orig, orig6, origSet := runIPTables, runIP6Tables, runIPSet
+	defer func() { runIPTables, runIP6Tables, runIPSet = orig, orig6, origSet }()
+	runIPTables = func(args ...string) error { return nil }
+	runIP6Tables = func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		added6 = append(added6, strings.Join(args, " "))
+		return nil
+	}
+	runIPSet = func(args ...string) error { return nil }
+
+	cfg := testFirewallConfig()
+	cfg.Networks = cfg.Networks[1:]
+	cfg.Networks[0].Portal = true
+	cfg.Networks[0].PortalPort = 8880
+	cfg.Networks[0].IPv6Prefix = mustParseCIDRs([]string{"2001:db8:0:2::/64"})[0]
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "-t filter -I FORWARD -i wl_public -m set ! --match-set hostapd_portal_wl_public src -j DROP", added6[0])
+}
+
+func TestIPTablesShapingMark(t *testing.T) {
+	var added []string
+
+	orig, orig6 := runIPTables, runIP6Tables
+	defer func() { runIPTables, runIP6Tables = orig, orig6 }()
+	record := func(args ...string) error {
+		if args[2] == "-C" {
+			return syscall.ENOENT
+		}
+		if args[1] == "mangle" {
+			added = append(added, strings.Join(args, " "))
+		}
+		return nil
+	}
+	runIPTables, runIP6Tables = record, record
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].ShapingMark = shapingMark("wl_public")
+
+	fw, cleanup := testIPTablesFirewall()
+	defer cleanup()
+
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	mark := fmt.Sprintf("0x%x", shapingMark("wl_public"))
+	assert.Equal(t, []string{
+		"-t mangle -A FORWARD -i wl_public -j MARK --set-mark " + mark,
+		"-t mangle -A FORWARD -i wl_public -j MARK --set-mark " + mark,
+	}, added)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// hostapdCtrlDir must match ctrl_interface in the generated config
+const hostapdCtrlDir = "/var/run/hostapd"
+
+const hostapdCtrlTimeout = 2 * time.Second
+
+type hostapdController interface {
+	Request(string) (string, error)
+	Close() error
+}
+
+var dialHostapdCtrl = func(iface string) (hostapdController, error) {
+	return newHostapdCtrl(hostapdCtrlDir, iface)
+}
+
+var hostapdCtrlCounter uint32
+
+// hostapdCtrl talks to the control interface socket hostapd opens for every
+// BSS, the same protocol hostapd_cli uses
+type hostapdCtrl struct {
+	conn  *net.UnixConn
+	local string
+}
+
+func newHostapdCtrl(ctrlDir string, iface string) (*hostapdCtrl, error) {
+	local := path.Join(os.TempDir(), fmt.Sprintf("platform-hostapd-%d-%d", os.Getpid(), atomic.AddUint32(&hostapdCtrlCounter, 1)))
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path.Join(ctrlDir, iface), Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostapdCtrl{conn: conn, local: local}, nil
+}
+
+func (c *hostapdCtrl) Close() error {
+	err := c.conn.Close()
+	os.Remove(c.local)
+	return err
+}
+
+// Request sends a command and returns hostapd's answer. Unsolicited event
+// messages, which start with '<', are skipped.
+func (c *hostapdCtrl) Request(cmd string) (string, error) {
+	err := c.conn.SetDeadline(time.Now().Add(hostapdCtrlTimeout))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.conn.Write([]byte(cmd))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		reply := string(buf[:n])
+		if !strings.HasPrefix(reply, "<") {
+			return reply, nil
+		}
+	}
+}
+
+// hostapdCommand runs a single command against the BSS on iface and fails
+// unless hostapd answers 'OK'
+func hostapdCommand(iface string, cmd string) error {
+	ctrl, err := dialHostapdCtrl(iface)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	reply, err := ctrl.Request(cmd)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("hostapd on %s answered '%s' to '%s'", iface, strings.TrimSpace(reply), cmd)
+	}
+
+	return nil
+}
+
+type hostapdStation struct {
+	MAC        string
+	Attributes map[string]string
+}
+
+// listHostapdStations walks the station table with STA-FIRST/STA-NEXT
+func listHostapdStations(ctrl hostapdController) ([]hostapdStation, error) {
+	var stations []hostapdStation
+
+	reply, err := ctrl.Request("STA-FIRST")
+	for {
+		if err != nil {
+			return nil, err
+		}
+
+		sta, ok := parseHostapdStation(reply)
+		if !ok {
+			return stations, nil
+		}
+		stations = append(stations, sta)
+
+		reply, err = ctrl.Request("STA-NEXT " + sta.MAC)
+	}
+}
+
+func parseHostapdStation(reply string) (hostapdStation, bool) {
+	lines := strings.Split(strings.TrimSpace(reply), "\n")
+	if len(lines) == 0 || lines[0] == "" || lines[0] == "FAIL" {
+		return hostapdStation{}, false
+	}
+
+	sta := hostapdStation{MAC: strings.ToLower(lines[0]), Attributes: make(map[string]string)}
+	for _, l := range lines[1:] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			sta.Attributes[kv[0]] = kv[1]
+		}
+	}
+
+	return sta, true
+}
+
+// hostapdStatus returns the 'key=value' lines hostapd answers STATUS with
+// for the BSS on iface, e.g. 'state' of the radio
+func hostapdStatus(iface string) (map[string]string, error) {
+	ctrl, err := dialHostapdCtrl(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+
+	reply, err := ctrl.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]string)
+	for _, l := range strings.Split(reply, "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			status[kv[0]] = kv[1]
+		}
+	}
+	if len(status) == 0 {
+		return nil, fmt.Errorf("hostapd on %s answered '%s' to 'STATUS'", iface, strings.TrimSpace(reply))
+	}
+
+	return status, nil
+}
+
+// hostapdPing tells whether hostapd answers on iface at all
+func hostapdPing(iface string) error {
+	ctrl, err := dialHostapdCtrl(iface)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	reply, err := ctrl.Request("PING")
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(reply) != "PONG" {
+		return fmt.Errorf("hostapd on %s answered '%s' to 'PING'", iface, strings.TrimSpace(reply))
+	}
+
+	return nil
+}
+
+// hostapdInState tells whether the radio of every network's BSS reports one
+// of states, like 'ENABLED'
+func hostapdInState(networks []network, states ...string) bool {
+	for _, n := range networks {
+		status, err := hostapdStatus(n.Name)
+		if err != nil {
+			log.Debugf("hostapd on %s isn't ready: %s", n.Name, err.Error())
+			return false
+		}
+
+		found := false
+		for _, s := range states {
+			if status["state"] == s {
+				found = true
+			}
+		}
+		if !found {
+			log.Debugf("hostapd on %s isn't ready, its state is '%s'", n.Name, status["state"])
+			return false
+		}
+	}
+
+	return true
+}
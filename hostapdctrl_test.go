@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockHostapdCtrl struct {
+	Replies  map[string]string
+	Requests []string
+}
+
+func (m *mockHostapdCtrl) Request(cmd string) (string, error) {
+	m.Requests = append(m.Requests, cmd)
+	if r, ok := m.Replies[cmd]; ok {
+		return r, nil
+	}
+	return "FAIL\n", nil
+}
+
+func (m *mockHostapdCtrl) Close() error {
+	return nil
+}
+
+func withMockHostapd(ctrls map[string]*mockHostapdCtrl) func() {
+	orig := dialHostapdCtrl
+	dialHostapdCtrl = func(iface string) (hostapdController, error) {
+		return ctrls[iface], nil
+	}
+	return func() { dialHostapdCtrl = orig }
+}
+
+func TestHostapdCtrl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "wl_private"), Net: "unixgram"})
+	assert.Nil(t, err)
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := server.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		if string(buf[:n]) == "PING" {
+			server.WriteToUnix([]byte("<3>AP-STA-CONNECTED aa:bb:cc:dd:ee:ff"), addr)
+			server.WriteToUnix([]byte("PONG\n"), addr)
+		}
+	}()
+
+	ctrl, err := newHostapdCtrl(dir, "wl_private")
+	assert.Nil(t, err)
+	defer ctrl.Close()
+
+	reply, err := ctrl.Request("PING")
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG\n", reply)
+}
+
+func TestListHostapdStations(t *testing.T) {
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{
+		"STA-FIRST":                  "AA:BB:CC:DD:EE:FF\nflags=[AUTH][ASSOC][AUTHORIZED]\nconnected_time=42\n",
+		"STA-NEXT aa:bb:cc:dd:ee:ff": "11:22:33:44:55:66\nconnected_time=7\n",
+	}}
+
+	stations, err := listHostapdStations(ctrl)
+	assert.Nil(t, err)
+	assert.Len(t, stations, 2)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", stations[0].MAC)
+	assert.Equal(t, "42", stations[0].Attributes["connected_time"])
+	assert.Equal(t, "11:22:33:44:55:66", stations[1].MAC)
+}
+
+func TestHostapdCommand(t *testing.T) {
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{"DISABLE": "OK\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_public": ctrl})()
+
+	assert.Nil(t, hostapdCommand("wl_public", "DISABLE"))
+	assert.NotNil(t, hostapdCommand("wl_public", "ENABLE"))
+}
+
+func TestHostapdStatus(t *testing.T) {
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{"STATUS": "state=ENABLED\nphy=phy0\nfreq=2412\n", "PING": "PONG\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": ctrl, "wl_public": {}})()
+
+	status, err := hostapdStatus("wl_private")
+	assert.Nil(t, err)
+	assert.Equal(t, "ENABLED", status["state"])
+	assert.Equal(t, "2412", status["freq"])
+	assert.Nil(t, hostapdPing("wl_private"))
+
+	_, err = hostapdStatus("wl_public")
+	assert.NotNil(t, err)
+	assert.NotNil(t, hostapdPing("wl_public"))
+}
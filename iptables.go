@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	iptablesBinary  = "/sbin/iptables"
+	ip6tablesBinary = "/sbin/ip6tables"
+	ipsetBinary     = "/sbin/ipset"
+)
+
+var runIPTables = func(args ...string) error {
+	return runFirewallTool(iptablesBinary, args)
+}
+
+var runIP6Tables = func(args ...string) error {
+	return runFirewallTool(ip6tablesBinary, args)
+}
+
+var runIPSet = func(args ...string) error {
+	return runFirewallTool(ipsetBinary, args)
+}
+
+func runFirewallTool(binary string, args []string) error {
+	out, err := exec.Command(binary, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", binary, strings.Join(args, " "), err.Error(), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+type iptablesRule struct {
+	Table string   `json:"table"`
+	Chain string   `json:"chain"`
+	Args  []string `json:"args"`
+	// Insert puts the rule in front of the chain instead of appending it
+	Insert bool `json:"insert,omitempty"`
+	// IPv6 rules are installed with ip6tables
+	IPv6 bool `json:"ipv6,omitempty"`
+}
+
+func (r iptablesRule) command(op string) []string {
+	return append([]string{"-t", r.Table, op, r.Chain}, r.Args...)
+}
+
+func (r iptablesRule) run(op string) error {
+	if r.IPv6 {
+		return runIP6Tables(r.command(op)...)
+	}
+	return runIPTables(r.command(op)...)
+}
+
+func (r iptablesRule) String() string {
+	binary := iptablesBinary
+	if r.IPv6 {
+		binary = ip6tablesBinary
+	}
+	return binary + " " + strings.Join(r.command("-D"), " ")
+}
+
+// iptablesRules returns the rules formerly installed by iptables.sh, in the
+// same order, plus the shaping marks and the captive portal, isolation and
+// IPv6 rules
+func iptablesRules(cfg *firewallConfig) []iptablesRule {
+	var rules []iptablesRule
+	for _, n := range cfg.Networks {
+		if n.ShapingMark != 0 {
+			rules = append(rules,
+				iptablesRule{Table: "mangle", Chain: "FORWARD", Args: []string{"-i", n.Interface, "-j", "MARK", "--set-mark", fmt.Sprintf("0x%x", n.ShapingMark)}},
+				iptablesRule{Table: "mangle", Chain: "FORWARD", IPv6: true, Args: []string{"-i", n.Interface, "-j", "MARK", "--set-mark", fmt.Sprintf("0x%x", n.ShapingMark)}},
+			)
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		rules = append(rules, iptablesPortalRules(n)...)
+	}
+
+	for _, n := range cfg.Networks {
+		rules = append(rules, iptablesIsolationRules(cfg, n, false)...)
+		if n.IPv6Prefix != nil {
+			rules = append(rules, iptablesIsolationRules(cfg, n, true)...)
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		rules = append(rules,
+			iptablesRule{Table: "filter", Chain: "FORWARD", Args: []string{"-i", n.Interface, "-o", cfg.Uplink, "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"}},
+			iptablesRule{Table: "filter", Chain: "FORWARD", Args: []string{"-i", cfg.Uplink, "-o", n.Interface, "-j", "ACCEPT"}},
+		)
+	}
+
+	for _, n := range cfg.Networks {
+		rules = append(rules,
+			iptablesRule{Table: "nat", Chain: "POSTROUTING", Args: []string{"-o", cfg.Uplink, "-s", n.Subnet.String(), "-j", "MASQUERADE"}},
+		)
+	}
+
+	// the same forwarding for IPv6, without NAT as the prefixes are routed.
+	// Without the masquerade hiding the clients, only replies and ICMPv6
+	// errors may come in from the uplink.
+	for _, n := range cfg.Networks {
+		if n.IPv6Prefix == nil {
+			continue
+		}
+		rules = append(rules,
+			iptablesRule{Table: "filter", Chain: "FORWARD", IPv6: true, Args: []string{"-i", n.Interface, "-o", cfg.Uplink, "-s", n.IPv6Prefix.String(), "-j", "ACCEPT"}},
+			iptablesRule{Table: "filter", Chain: "FORWARD", IPv6: true, Args: []string{"-i", cfg.Uplink, "-o", n.Interface, "-d", n.IPv6Prefix.String(), "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"}},
+		)
+		for _, typ := range icmpv6InboundTypes {
+			rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", IPv6: true, Args: []string{"-i", cfg.Uplink, "-o", n.Interface, "-p", "ipv6-icmp", "--icmpv6-type", fmt.Sprint(typ), "-j", "ACCEPT"}})
+		}
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", IPv6: true, Args: []string{"-i", cfg.Uplink, "-o", n.Interface, "-j", "DROP"}})
+	}
+
+	return rules
+}
+
+// iptablesIsolationRules must come before anything else accepting traffic,
+// so they are inserted at the top of FORWARD and INPUT
+func iptablesIsolationRules(cfg *firewallConfig, n firewallNetwork, ipv6 bool) []iptablesRule {
+	if !n.Isolate {
+		return nil
+	}
+
+	lan := lanSubnets
+	if ipv6 {
+		lan = lanSubnets6
+	}
+
+	var rules []iptablesRule
+	for _, allowed := range n.LANAllowlist {
+		if (allowed.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", Insert: true, IPv6: ipv6, Args: []string{"-i", n.Interface, "-d", allowed.String(), "-j", "ACCEPT"}})
+	}
+	for _, other := range cfg.Networks {
+		if other.Interface != n.Interface {
+			rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", Insert: true, IPv6: ipv6, Args: []string{"-i", n.Interface, "-o", other.Interface, "-j", "DROP"}})
+		}
+	}
+	for _, subnet := range mustParseCIDRs(lan) {
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", Insert: true, IPv6: ipv6, Args: []string{"-i", n.Interface, "-d", subnet.String(), "-j", "DROP"}})
+	}
+
+	if ipv6 {
+		// neighbor discovery and router solicitations
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "INPUT", Insert: true, IPv6: true, Args: []string{"-i", n.Interface, "-p", "ipv6-icmp", "-j", "ACCEPT"}})
+	}
+	for _, p := range isolationPorts {
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "INPUT", Insert: true, IPv6: ipv6, Args: []string{"-i", n.Interface, "-p", p.Proto, "--dport", fmt.Sprint(p.Port), "-j", "ACCEPT"}})
+	}
+	rules = append(rules, iptablesRule{Table: "filter", Chain: "INPUT", Insert: true, IPv6: ipv6, Args: []string{"-i", n.Interface, "-j", "DROP"}})
+
+	return rules
+}
+
+func ipsetPortalName(iface string) string {
+	return "hostapd_portal_" + iface
+}
+
+// iptablesPortalRules keep clients that haven't logged in on the captive
+// portal off the uplink, and send their DNS to our resolver and their HTTP to
+// the portal. The allowed clients are kept in an ipset with timeouts.
+func iptablesPortalRules(n firewallNetwork) []iptablesRule {
+	if !n.Portal {
+		return nil
+	}
+
+	notAllowed := []string{"-i", n.Interface, "-m", "set", "!", "--match-set", ipsetPortalName(n.Interface), "src"}
+	redirect := func(proto string, from, to uint16) iptablesRule {
+		args := append(append([]string{}, notAllowed...), "-p", proto, "--dport", fmt.Sprint(from), "-j", "REDIRECT", "--to-ports", fmt.Sprint(to))
+		return iptablesRule{Table: "nat", Chain: "PREROUTING", Args: args}
+	}
+
+	rules := []iptablesRule{
+		{Table: "filter", Chain: "FORWARD", Insert: true, Args: append(append([]string{}, notAllowed...), "-j", "DROP")},
+		{Table: "filter", Chain: "INPUT", Insert: true, Args: []string{"-i", n.Interface, "-p", "tcp", "--dport", fmt.Sprint(n.PortalPort), "-j", "ACCEPT"}},
+		redirect("tcp", 80, n.PortalPort),
+		redirect("udp", 53, 53),
+		redirect("tcp", 53, 53),
+	}
+
+	// the MAC set works for IPv6 as well, which would otherwise get past the
+	// portal on its routed prefix
+	if n.IPv6Prefix != nil {
+		rules = append(rules, iptablesRule{Table: "filter", Chain: "FORWARD", Insert: true, IPv6: true, Args: append(append([]string{}, notAllowed...), "-j", "DROP")})
+	}
+
+	return rules
+}
+
+// iptablesPortalSets returns the names of the ipsets of the captive portals
+func iptablesPortalSets(cfg *firewallConfig) []string {
+	var sets []string
+	for _, n := range cfg.Networks {
+		if n.Portal {
+			sets = append(sets, ipsetPortalName(n.Interface))
+		}
+	}
+	return sets
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesState records the rules and portal ipsets we installed, so that
+// they can be removed without the config they were built from
+type iptablesState struct {
+	Rules  []iptablesRule `json:"rules"`
+	IPSets []string       `json:"ipsets,omitempty"`
+}
+
+func loadIPTablesState(filename string) (*iptablesState, error) {
+	state := &iptablesState{}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse firewall state in %s: %s", filename, err.Error())
+	}
+
+	return state, nil
+}
+
+func saveIPTablesState(filename string, state *iptablesState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data, 0644)
+}
+
+// iptablesFirewall keeps track of what it installed in stateFile
+type iptablesFirewall struct {
+	stateFile string
+}
+
+func newIPTablesFirewall(stateFile string) *iptablesFirewall {
+	return &iptablesFirewall{stateFile: stateFile}
+}
+
+// record adds rules and sets to the state, before they are installed so that
+// whatever gets through is known
+func (f *iptablesFirewall) record(rules []iptablesRule, sets []string) error {
+	state, err := loadIPTablesState(f.stateFile)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, r := range state.Rules {
+		known[r.String()] = true
+	}
+	for _, r := range rules {
+		if !known[r.String()] {
+			state.Rules = append(state.Rules, r)
+			known[r.String()] = true
+		}
+	}
+
+	for _, set := range sets {
+		if !containsString(state.IPSets, set) {
+			state.IPSets = append(state.IPSets, set)
+		}
+	}
+
+	return saveIPTablesState(f.stateFile, state)
+}
+
+// forget removes rules and sets from the state once they are removed
+func (f *iptablesFirewall) forget(rules []iptablesRule, sets []string) error {
+	state, err := loadIPTablesState(f.stateFile)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, r := range rules {
+		removed[r.String()] = true
+	}
+
+	var kept []iptablesRule
+	for _, r := range state.Rules {
+		if !removed[r.String()] {
+			kept = append(kept, r)
+		}
+	}
+	state.Rules = kept
+
+	var keptSets []string
+	for _, set := range state.IPSets {
+		if !containsString(sets, set) {
+			keptSets = append(keptSets, set)
+		}
+	}
+	state.IPSets = keptSets
+
+	return saveIPTablesState(f.stateFile, state)
+}
+
+// Apply adds every rule that isn't there yet, so running it twice doesn't
+// duplicate rules. Rules to insert are added in reverse so they end up at the
+// top of their chain in the given order.
+func (f *iptablesFirewall) Apply(cfg *firewallConfig) error {
+	rules := iptablesRules(cfg)
+	err := f.record(rules, iptablesPortalSets(cfg))
+	if err != nil {
+		return err
+	}
+
+	for _, n := range cfg.Networks {
+		if !n.Portal {
+			continue
+		}
+
+		err := runIPSet("create", ipsetPortalName(n.Interface), "hash:mac", "timeout", "0", "-exist")
+		if err != nil {
+			return err
+		}
+		for _, c := range n.PortalClients {
+			err = f.AllowClient(n.Interface, c.MAC, c.Timeout)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].Insert {
+			err := addIPTablesRule(rules[i], "-I")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range rules {
+		if !r.Insert {
+			err := addIPTablesRule(r, "-A")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func addIPTablesRule(r iptablesRule, op string) error {
+	if r.run("-C") == nil {
+		return nil
+	}
+
+	return r.run(op)
+}
+
+func (f *iptablesFirewall) Remove(cfg *firewallConfig) error {
+	rules := iptablesRules(cfg)
+	sets := iptablesPortalSets(cfg)
+
+	err := removeIPTablesRules(rules)
+	if err != nil {
+		return err
+	}
+	destroyIPSets(sets)
+
+	return f.forget(rules, sets)
+}
+
+// RemoveAll removes the rules and sets recorded in the state
+func (f *iptablesFirewall) RemoveAll() error {
+	state, err := loadIPTablesState(f.stateFile)
+	if err != nil {
+		return err
+	}
+
+	err = removeIPTablesRules(state.Rules)
+	if err != nil {
+		return err
+	}
+	destroyIPSets(state.IPSets)
+
+	err = os.Remove(f.stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func destroyIPSets(sets []string) {
+	for _, set := range sets {
+		// the set is gone already if the rules were never applied
+		err := runIPSet("destroy", set)
+		if err != nil {
+			log.Debugf("Failed to destroy portal ipset: %s", err.Error())
+		}
+	}
+}
+
+func (f *iptablesFirewall) AllowClient(iface string, mac net.HardwareAddr, timeout time.Duration) error {
+	return runIPSet("add", ipsetPortalName(iface), mac.String(), "timeout", fmt.Sprint(int(timeout.Seconds())), "-exist")
+}
+
+func (f *iptablesFirewall) RevokeClient(iface string, mac net.HardwareAddr) error {
+	return runIPSet("del", ipsetPortalName(iface), mac.String(), "-exist")
+}
+
+// Update installs the new rules before removing the old ones that are no
+// longer needed, so forwarding keeps working in between.
+func (f *iptablesFirewall) Update(old, new *firewallConfig) error {
+	err := f.Apply(new)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, r := range iptablesRules(new) {
+		keep[r.String()] = true
+	}
+
+	var stale []iptablesRule
+	for _, r := range iptablesRules(old) {
+		if !keep[r.String()] {
+			stale = append(stale, r)
+		}
+	}
+
+	err = removeIPTablesRules(stale)
+	if err != nil {
+		return err
+	}
+
+	return f.forget(stale, nil)
+}
+
+func removeIPTablesRules(rules []iptablesRule) error {
+	for _, r := range rules {
+		if r.run("-C") != nil {
+			continue
+		}
+
+		err := r.run("-D")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
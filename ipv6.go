@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// default subnet IDs carved out of a prefix delegated to the uplink
+var defaultIPv6SubnetIDs = map[string]uint64{
+	"wl_private": 1,
+	"wl_public":  2,
+}
+
+var procSysPath = "/proc/sys"
+
+// readIPv6 reads the optional 'ipv6_prefix' of a network. It is either a
+// static /64 or 'uplink[:subnet-id]', which carves a /64 out of the shorter
+// prefix on the uplink once the daemon starts.
+func readIPv6(dir string, n *network) error {
+	value, err := readOptionalValue(dir, "ipv6_prefix", "")
+	if err != nil || value == "" {
+		return err
+	}
+
+	if value == "uplink" || strings.HasPrefix(value, "uplink:") {
+		n.IPv6FromUplink = true
+		n.IPv6SubnetID = defaultIPv6SubnetIDs[n.Name]
+		if value != "uplink" {
+			n.IPv6SubnetID, err = strconv.ParseUint(strings.TrimPrefix(value, "uplink:"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid IPv6 subnet ID in '%s' for network '%s'", value, n.Name)
+			}
+		}
+		return nil
+	}
+
+	_, prefix, err := net.ParseCIDR(value)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("Invalid IPv6 prefix '%s' for network '%s'", value, n.Name)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	if ones != 64 {
+		return fmt.Errorf("IPv6 prefix '%s' of network '%s' must be a /64 for SLAAC", value, n.Name)
+	}
+
+	n.IPv6Prefix = prefix
+	return nil
+}
+
+// resolveIPv6Prefixes fills in the prefixes of networks that take theirs from
+// the uplink
+func resolveIPv6Prefixes(networks []network) error {
+	var delegated *net.IPNet
+	for i := range networks {
+		n := &networks[i]
+		if !n.IPv6FromUplink {
+			continue
+		}
+
+		if delegated == nil {
+			uplink, err := getUplinkInterface()
+			if err != nil {
+				return err
+			}
+
+			delegated, err = getDelegatedPrefix(uplink)
+			if err != nil {
+				return err
+			}
+			log.Infof("Using IPv6 prefix %s from uplink %s", delegated, uplink)
+		}
+
+		prefix, err := carveIPv6Subnet(delegated, n.IPv6SubnetID)
+		if err != nil {
+			return fmt.Errorf("Network '%s': %s", n.Name, err.Error())
+		}
+		n.IPv6Prefix = prefix
+	}
+
+	return nil
+}
+
+// carveIPv6Subnet returns the /64 with the given subnet ID inside prefix
+func carveIPv6Subnet(prefix *net.IPNet, id uint64) (*net.IPNet, error) {
+	ones, _ := prefix.Mask.Size()
+	if ones >= 64 {
+		return nil, fmt.Errorf("Prefix %s is too long to carve a /64 out of it", prefix)
+	}
+	if ones > 0 && id >= uint64(1)<<uint(64-ones) {
+		return nil, fmt.Errorf("Subnet ID %d doesn't fit into %s", id, prefix)
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	binary.BigEndian.PutUint64(ip[:8], binary.BigEndian.Uint64(ip[:8])|id)
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}, nil
+}
+
+// ipv6Gateway is the router address on a /64, '::1'
+func ipv6Gateway(prefix *net.IPNet) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ip[15] = 1
+	return ip
+}
+
+// getDelegatedPrefix returns the first global address on the uplink with a
+// prefix shorter than /64, which is what a prefix delegated to the box looks
+// like
+func getDelegatedPrefix(uplink string) (*net.IPNet, error) {
+	index, err := interfaceIndexByName(uplink)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newRouteConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ifa := make([]byte, syscall.SizeofIfAddrmsg)
+	ifa[0] = syscall.AF_INET6
+	resp, err := conn.Execute(nlRequest{
+		Type:  syscall.RTM_GETADDR,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+		Data:  ifa,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range resp {
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+
+		prefixLen, scope := int(msg.Data[1]), msg.Data[3]
+		if int(nativeEndian.Uint32(msg.Data[4:8])) != index || scope != syscall.RT_SCOPE_UNIVERSE || prefixLen >= 64 {
+			continue
+		}
+
+		attrs, err := parseNlAttrs(msg.Data[syscall.SizeofIfAddrmsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range attrs {
+			if a.Type == syscall.IFA_ADDRESS && len(a.Data) == net.IPv6len {
+				mask := net.CIDRMask(prefixLen, 128)
+				return &net.IPNet{IP: net.IP(a.Data).Mask(mask), Mask: mask}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("No prefix shorter than /64 found on uplink %s", uplink)
+}
+
+// ensureInterfaceAddress6 assigns '::1' of the network's prefix to its
+// interface
+func ensureInterfaceAddress6(n network) error {
+	index, err := interfaceIndexByName(n.Name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := newRouteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ifa := make([]byte, syscall.SizeofIfAddrmsg)
+	ifa[0] = syscall.AF_INET6
+	ifa[1] = 64
+	nativeEndian.PutUint32(ifa[4:8], uint32(index))
+
+	gateway := ipv6Gateway(n.IPv6Prefix)
+	_, err = conn.Execute(nlRequest{
+		Type:  syscall.RTM_NEWADDR,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE,
+		Data:  concatBytes(ifa, nlAttr(syscall.IFA_LOCAL, gateway), nlAttr(syscall.IFA_ADDRESS, gateway)),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to assign %s/64 to %s: %s", gateway, n.Name, err.Error())
+	}
+
+	return nil
+}
+
+// writeSysctl takes the key in its path form, as interface names may
+// contain dots
+func writeSysctl(key string, value string) error {
+	return ioutil.WriteFile(path.Join(procSysPath, key), []byte(value), 0644)
+}
+
+// enableIPv6Forwarding turns on forwarding and keeps the uplink accepting
+// router advertisements, which the kernel stops doing on forwarding hosts
+func enableIPv6Forwarding() error {
+	uplink, err := getUplinkInterface()
+	if err == nil {
+		err = writeSysctl("net/ipv6/conf/"+uplink+"/accept_ra", "2")
+	}
+	if err != nil {
+		log.Warnf("Failed to keep accepting router advertisements on the uplink: %s", err.Error())
+	}
+
+	return writeSysctl("net/ipv6/conf/all/forwarding", "1")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadIPv6(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readIPv6(dir, &n)
+	assert.Nil(t, err)
+	assert.Nil(t, n.IPv6Prefix)
+	assert.False(t, n.IPv6FromUplink)
+
+	err = ioutil.WriteFile(path.Join(dir, "ipv6_prefix"), []byte("uplink\n"), 0644)
+	assert.Nil(t, err)
+	err = readIPv6(dir, &n)
+	assert.Nil(t, err)
+	assert.True(t, n.IPv6FromUplink)
+	assert.Equal(t, uint64(2), n.IPv6SubnetID)
+
+	err = ioutil.WriteFile(path.Join(dir, "ipv6_prefix"), []byte("uplink:7"), 0644)
+	assert.Nil(t, err)
+	err = readIPv6(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), n.IPv6SubnetID)
+
+	n = network{Name: "wl_public"}
+	err = ioutil.WriteFile(path.Join(dir, "ipv6_prefix"), []byte("2001:db8:0:5::/64"), 0644)
+	assert.Nil(t, err)
+	err = readIPv6(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:0:5::/64", n.IPv6Prefix.String())
+
+	for _, bad := range []string{"2001:db8::/48", "10.42.0.0/16", "uplink:x"} {
+		err = ioutil.WriteFile(path.Join(dir, "ipv6_prefix"), []byte(bad), 0644)
+		assert.Nil(t, err)
+		assert.NotNil(t, readIPv6(dir, &network{Name: "wl_public"}), bad)
+	}
+}
+
+func TestCarveIPv6Subnet(t *testing.T) {
+	_, delegated, _ := net.ParseCIDR("2001:db8:aa00::/56")
+
+	prefix, err := carveIPv6Subnet(delegated, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:aa00:2::/64", prefix.String())
+	assert.Equal(t, "2001:db8:aa00:2::1", ipv6Gateway(prefix).String())
+
+	_, err = carveIPv6Subnet(delegated, 256)
+	assert.NotNil(t, err)
+
+	_, err = carveIPv6Subnet(prefix, 1)
+	assert.NotNil(t, err)
+}
+
+func addrMessage(prefixLen, scope uint8, index uint32, ip net.IP) syscall.NetlinkMessage {
+	ifa := make([]byte, syscall.SizeofIfAddrmsg)
+	ifa[0] = syscall.AF_INET6
+	ifa[1] = prefixLen
+	ifa[3] = scope
+	nativeEndian.PutUint32(ifa[4:8], index)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR},
+		Data:   concatBytes(ifa, nlAttr(syscall.IFA_ADDRESS, ip.To16())),
+	}
+}
+
+func TestGetDelegatedPrefix(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			addrMessage(64, syscall.RT_SCOPE_LINK, 3, net.ParseIP("fe80::1")),
+			addrMessage(56, syscall.RT_SCOPE_UNIVERSE, 4, net.ParseIP("2001:db8:bb00::1")),
+			addrMessage(64, syscall.RT_SCOPE_UNIVERSE, 3, net.ParseIP("2001:db8:aa00:ff::1")),
+			addrMessage(56, syscall.RT_SCOPE_UNIVERSE, 3, net.ParseIP("2001:db8:aa00::1")),
+		},
+	}
+	defer withMockRoutes(conn, nil)()
+
+	orig := interfaceIndexByName
+	defer func() { interfaceIndexByName = orig }()
+	interfaceIndexByName = func(name string) (int, error) {
+		return 3, nil
+	}
+
+	prefix, err := getDelegatedPrefix("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:aa00::/56", prefix.String())
+
+	req := conn.Requests[0][0]
+	assert.Equal(t, uint16(syscall.RTM_GETADDR), req.Type)
+	assert.Equal(t, byte(syscall.AF_INET6), req.Data[0])
+
+	conn.Replies = conn.Replies[:3]
+	_, err = getDelegatedPrefix("eth0")
+	assert.NotNil(t, err)
+}
+
+func TestWriteSysctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	orig := procSysPath
+	defer func() { procSysPath = orig }()
+	procSysPath = dir
+
+	err = os.MkdirAll(path.Join(dir, "net/ipv6/conf/all"), 0755)
+	assert.Nil(t, err)
+
+	err = writeSysctl("net/ipv6/conf/all/forwarding", "1")
+	assert.Nil(t, err)
+
+	value, err := ioutil.ReadFile(path.Join(dir, "net/ipv6/conf/all/forwarding"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(value))
+}
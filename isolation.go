@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// lanSubnets are the destinations an isolated network is kept away from,
+// unless they are on its LAN allowlist
+var lanSubnets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16"}
+
+// lanSubnets6 are the unique local addresses, the IPv6 counterpart
+var lanSubnets6 = []string{"fc00::/7"}
+
+// readIsolationPolicy reads the 'isolate' flag file and the optional
+// 'lan_allowlist' (one address or CIDR per line) of a network
+func readIsolationPolicy(dir string, n *network) error {
+	_, err := os.Stat(path.Join(dir, "isolate"))
+	if err == nil {
+		n.Isolate = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "lan_allowlist"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.Trim(line, " \r\t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		subnet, err := parseCIDROrIP(line)
+		if err != nil {
+			return fmt.Errorf("Invalid entry in %s: %s", path.Join(dir, "lan_allowlist"), err.Error())
+		}
+		n.LANAllowlist = append(n.LANAllowlist, subnet)
+	}
+
+	return nil
+}
+
+// parseCIDROrIP accepts '192.168.1.10' as well as '192.168.1.0/24'
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, subnet, err := net.ParseCIDR(s)
+		return subnet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' is neither an IP address nor a CIDR", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, c := range cidrs {
+		_, subnet, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets
+}
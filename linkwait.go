@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// iflaOperState is IFLA_OPERSTATE, which the syscall package lacks
+const iflaOperState = 16
+
+// operStates are the RFC 2863 states of IFLA_OPERSTATE, as 'ip link' names
+// them
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+type linkState struct {
+	Index     int
+	Name      string
+	Flags     uint32
+	OperState string
+}
+
+var newLinkMonitor = func() (netlinkReceiver, error) {
+	conn, err := newNlConn(syscall.NETLINK_ROUTE, 1<<(syscall.RTNLGRP_LINK-1))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetReceiveTimeout(100 * time.Millisecond)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// linkExists accepts a link in any state
+func linkExists(l linkState) bool {
+	return true
+}
+
+// linkIsUp accepts links that are administratively up and whose device is
+// there. AP interfaces have no carrier before hostapd runs, so their
+// operstate stays 'down' until then.
+func linkIsUp(l linkState) bool {
+	return l.Flags&syscall.IFF_UP != 0 && l.OperState != "notpresent" && l.OperState != "lowerlayerdown"
+}
+
+func parseLinkMessage(m syscall.NetlinkMessage) (linkState, bool) {
+	if (m.Header.Type != syscall.RTM_NEWLINK && m.Header.Type != syscall.RTM_DELLINK) || len(m.Data) < syscall.SizeofIfInfomsg {
+		return linkState{}, false
+	}
+
+	l := linkState{
+		Index:     int(int32(nativeEndian.Uint32(m.Data[4:8]))),
+		Flags:     nativeEndian.Uint32(m.Data[8:12]),
+		OperState: "unknown",
+	}
+
+	attrs, err := parseNlAttrs(m.Data[syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return linkState{}, false
+	}
+
+	for _, a := range attrs {
+		switch a.Type {
+		case syscall.IFLA_IFNAME:
+			l.Name = string(trimNul(a.Data))
+		case iflaOperState:
+			if len(a.Data) == 1 && int(a.Data[0]) < len(operStates) {
+				l.OperState = operStates[a.Data[0]]
+			}
+		}
+	}
+
+	return l, l.Name != ""
+}
+
+func trimNul(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// updateLinks applies link messages to the links known by name. A link that
+// got renamed shows up under its new name only.
+func updateLinks(links map[string]linkState, msgs []syscall.NetlinkMessage) {
+	for _, m := range msgs {
+		l, ok := parseLinkMessage(m)
+		if !ok {
+			continue
+		}
+
+		for name, old := range links {
+			if old.Index == l.Index {
+				delete(links, name)
+			}
+		}
+		if m.Header.Type == syscall.RTM_NEWLINK {
+			links[l.Name] = l
+		}
+	}
+}
+
+func dumpLinks() (map[string]linkState, error) {
+	conn, err := newRouteConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	msgs, err := conn.Execute(nlRequest{
+		Type:  syscall.RTM_GETLINK,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+		Data:  make([]byte, syscall.SizeofIfInfomsg),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the network interfaces: %s", err.Error())
+	}
+
+	links := make(map[string]linkState)
+	updateLinks(links, msgs)
+	return links, nil
+}
+
+// waitForLinks follows the kernel's link events until every named interface
+// exists and is accepted by ready, e.g. after a rename or while hostapd
+// creates the interfaces of additional BSSes
+func waitForLinks(names []string, ready func(linkState) bool, timeout time.Duration) error {
+	// subscribe first so that no change between the dump and the first
+	// event gets lost
+	mon, err := newLinkMonitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	links, err := dumpLinks()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		waiting := ""
+		for _, name := range names {
+			l, ok := links[name]
+			if !ok || !ready(l) {
+				waiting = name
+				break
+			}
+		}
+		if waiting == "" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			l, ok := links[waiting]
+			if !ok {
+				return fmt.Errorf("Interface %s didn't appear within %s", waiting, timeout)
+			}
+			up := "down"
+			if l.Flags&syscall.IFF_UP != 0 {
+				up = "up"
+			}
+			return fmt.Errorf("Interface %s didn't get ready within %s, it is %s with operstate '%s'", waiting, timeout, up, l.OperState)
+		}
+
+		msgs, err := mon.Receive()
+		if err != nil {
+			return err
+		}
+		updateLinks(links, msgs)
+	}
+}
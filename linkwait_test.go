@@ -0,0 +1,113 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockLinkMonitor hands out one batch of link events per Receive and then
+// times out like the real socket
+type mockLinkMonitor struct {
+	batches [][]syscall.NetlinkMessage
+}
+
+func (m *mockLinkMonitor) Receive() ([]syscall.NetlinkMessage, error) {
+	if len(m.batches) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	}
+
+	b := m.batches[0]
+	m.batches = m.batches[1:]
+	return b, nil
+}
+
+func (m *mockLinkMonitor) Close() error {
+	return nil
+}
+
+func linkMessage(typ uint16, index int, name string, flags uint32, operState uint8) syscall.NetlinkMessage {
+	ifi := make([]byte, syscall.SizeofIfInfomsg)
+	nativeEndian.PutUint32(ifi[4:8], uint32(index))
+	nativeEndian.PutUint32(ifi[8:12], flags)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: typ},
+		Data:   concatBytes(ifi, nlAttrString(syscall.IFLA_IFNAME, name), nlAttrU8(iflaOperState, operState)),
+	}
+}
+
+func withMockLinks(dump []syscall.NetlinkMessage, events [][]syscall.NetlinkMessage) (*mockNetlinkConn, func()) {
+	conn := &mockNetlinkConn{Replies: dump}
+	restoreRoutes := withMockRoutes(conn, nil)
+
+	orig := newLinkMonitor
+	newLinkMonitor = func() (netlinkReceiver, error) {
+		return &mockLinkMonitor{batches: events}, nil
+	}
+
+	return conn, func() {
+		restoreRoutes()
+		newLinkMonitor = orig
+	}
+}
+
+func TestParseLinkMessage(t *testing.T) {
+	l, ok := parseLinkMessage(linkMessage(syscall.RTM_NEWLINK, 3, "wl_private", syscall.IFF_UP, 2))
+	assert.True(t, ok)
+	assert.Equal(t, linkState{Index: 3, Name: "wl_private", Flags: syscall.IFF_UP, OperState: "down"}, l)
+	assert.True(t, linkIsUp(l))
+
+	l.OperState = "notpresent"
+	assert.False(t, linkIsUp(l))
+
+	_, ok = parseLinkMessage(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWROUTE}})
+	assert.False(t, ok)
+}
+
+func TestUpdateLinks(t *testing.T) {
+	links := make(map[string]linkState)
+	updateLinks(links, []syscall.NetlinkMessage{
+		linkMessage(syscall.RTM_NEWLINK, 3, "wlan0", 0, 2),
+		linkMessage(syscall.RTM_NEWLINK, 4, "eth0", syscall.IFF_UP, 6),
+	})
+	assert.Len(t, links, 2)
+
+	updateLinks(links, []syscall.NetlinkMessage{
+		linkMessage(syscall.RTM_NEWLINK, 3, "wl_private", syscall.IFF_UP, 2),
+		linkMessage(syscall.RTM_DELLINK, 4, "eth0", 0, 2),
+	})
+	assert.Equal(t, map[string]linkState{
+		"wl_private": {Index: 3, Name: "wl_private", Flags: syscall.IFF_UP, OperState: "down"},
+	}, links)
+}
+
+func TestWaitForLinks(t *testing.T) {
+	conn, restore := withMockLinks(
+		[]syscall.NetlinkMessage{linkMessage(syscall.RTM_NEWLINK, 3, "wlan0", 0, 2)},
+		[][]syscall.NetlinkMessage{
+			{linkMessage(syscall.RTM_NEWLINK, 3, "wl_private", 0, 2)},
+			{linkMessage(syscall.RTM_NEWLINK, 3, "wl_private", syscall.IFF_UP, 2)},
+		})
+	defer restore()
+
+	assert.Nil(t, waitForLinks([]string{"wl_private"}, linkIsUp, time.Second))
+	assert.Len(t, conn.Requests, 1)
+	assert.Equal(t, uint16(syscall.RTM_GETLINK), conn.Requests[0][0].Type)
+}
+
+func TestWaitForLinksTimeout(t *testing.T) {
+	_, restore := withMockLinks([]syscall.NetlinkMessage{linkMessage(syscall.RTM_NEWLINK, 3, "wl_private", 0, 2)}, nil)
+	defer restore()
+
+	assert.Nil(t, waitForLinks([]string{"wl_private"}, linkExists, 0))
+
+	err := waitForLinks([]string{"wl_private"}, linkIsUp, 50*time.Millisecond)
+	assert.EqualError(t, err, "Interface wl_private didn't get ready within 50ms, it is down with operstate 'down'")
+
+	err = waitForLinks([]string{"wl_public"}, linkExists, 50*time.Millisecond)
+	assert.EqualError(t, err, "Interface wl_public didn't appear within 50ms")
+}
@@ -8,12 +8,11 @@ import (
 	"net"
 	"os"
 	"path"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
-	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/libcontainer/netlink"
@@ -25,79 +24,126 @@ type network struct {
 	Name     string
 	SSID     string
 	Password string
+
+	Isolate      bool
+	LANAllowlist []*net.IPNet
+
+	Subnet    *net.IPNet
+	Gateway   net.IP
+	DHCPStart net.IP
+	DHCPEnd   net.IP
+
+	IPv6Prefix     *net.IPNet
+	IPv6FromUplink bool
+	IPv6SubnetID   uint64
+
+	// Bridge, if set, switches the network onto a wired segment instead of
+	// routing it, optionally through VLAN on VLANInterface
+	Bridge        string
+	VLAN          int
+	VLANInterface string
+
+	// DynamicVLAN puts stations into the VLAN RADIUS or their device PSK
+	// assigns them. VLANFile and PSKFile are written before hostapd starts.
+	DynamicVLAN int
+	RADIUS      *radiusServer
+	DevicePSKs  []devicePSK
+	VLANFile    string
+	PSKFile     string
+
+	// CaptivePortal keeps clients off the uplink until they accepted the
+	// PortalTerms, for PortalTimeout each time
+	CaptivePortal bool
+	PortalTimeout time.Duration
+	PortalTerms   string
+
+	// VoucherMode is 'portal' or 'psk' if the vouchers in VoucherDir grant
+	// access to the network
+	VoucherMode string
+	VoucherDir  string
+
+	// Schedule limits the times the network is on, nil meaning always
+	Schedule *weeklySchedule
+
+	// RateLimit caps the whole network and ClientRateLimit each client, in
+	// kbit/s, 0 meaning unlimited
+	RateLimit       int
+	ClientRateLimit int
+
+	// PasswordRotation replaces the password 'daily' or 'weekly', empty
+	// meaning never
+	PasswordRotation string
 }
 
-func getSSID(configPath string) string {
-	filename := path.Join(configPath, "box_name")
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return "Protonet-default"
+// networkConfigDir returns the SKVS directory holding a network's settings
+func networkConfigDir(configPath string, name string) string {
+	if name == "wl_public" {
+		return path.Join(configPath, "system", "wifi", "guest")
 	}
 
-	return strings.Trim(trimSSIDTo32Bytes(data), " \n\r\t")
+	return path.Join(configPath, "system", "wifi")
 }
 
-// trimSSIDTo32Bytes trims an SSID to 32 bytes, making sure no UTF-8 rune is cut
-func trimSSIDTo32Bytes(input []byte) string {
-	for len(input) > 32 {
-		_, lastRuneLen := utf8.DecodeLastRune(input)
-		l := len(input)
-		input = input[0 : l-lastRuneLen]
+// readNetworkPolicies reads the optional per-network settings on top of the
+// SSID and password
+func readNetworkPolicies(configPath string, n *network) error {
+	dir := networkConfigDir(configPath, n.Name)
+
+	err := readIsolationPolicy(dir, n)
+	if err != nil {
+		return err
 	}
 
-	return string(input)
-}
+	err = readSchedule(dir, n)
+	if err != nil {
+		return err
+	}
 
-// was 'network_config'
-func getNeededNetworks(configPath string) ([]network, error) {
-	log.Debugln("fetching networks")
-	ssid := getSSID(configPath)
+	err = readPasswordRotation(dir, n)
+	if err != nil {
+		return err
+	}
 
-	var networks []network
+	err = readDynamicVLAN(dir, n)
+	if err != nil {
+		return err
+	}
 
-	log.Debugf("Looking for private network at %v", path.Join(configPath, "system", "wifi", "enabled"))
-	_, err := os.Stat(path.Join(configPath, "system", "wifi", "enabled"))
-	if err == nil {
-		log.Debugln("Private network found, configuring...")
-		passwdData, err2 := ioutil.ReadFile(path.Join(configPath, "system", "wifi", "password"))
-		if err2 != nil {
-			return nil, err2
-		}
+	err = readCaptivePortal(dir, n)
+	if err != nil {
+		return err
+	}
 
-		networks = append(networks,
-			network{
-				Name:     "wl_private",
-				SSID:     ssid,
-				Password: strings.Trim(string(passwdData), " \n\r\t"),
-			})
-	} else {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
+	err = readVoucherPolicy(dir, n)
+	if err != nil {
+		return err
 	}
 
-	log.Debugf("Looking for public network at %v\n", path.Join(configPath, "system", "wifi", "guest", "enabled"))
-	_, err = os.Stat(path.Join(configPath, "system", "wifi", "guest", "enabled"))
-	if err == nil {
-		log.Debugln("Public network found, configuring...")
-		passwdData, err2 := ioutil.ReadFile(path.Join(configPath, "system", "wifi", "guest", "password"))
-		if err2 != nil {
-			return nil, err2
-		}
+	err = readShapingPolicy(dir, n)
+	if err != nil {
+		return err
+	}
 
-		networks = append(networks,
-			network{
-				Name:     "wl_public",
-				SSID:     ssid + " (public)",
-				Password: strings.Trim(string(passwdData), " \n\r\t"),
-			})
-	} else {
-		if !os.IsNotExist(err) {
-			return nil, err
+	err = readBridging(dir, n)
+	if err != nil {
+		return err
+	}
+	if n.Bridge != "" {
+		if n.CaptivePortal {
+			return fmt.Errorf("The captive portal of network '%s' only works if it isn't bridged", n.Name)
+		}
+		if n.RateLimit != 0 || n.ClientRateLimit != 0 {
+			return fmt.Errorf("Rate limits of network '%s' only work if it isn't bridged", n.Name)
 		}
+		return nil
 	}
 
-	return networks, nil
+	err = readAddressing(dir, n)
+	if err != nil {
+		return err
+	}
+
+	return readIPv6(dir, n)
 }
 
 func getBSSID(ifName string) (string, error) {
@@ -114,9 +160,36 @@ func getBSSID(ifName string) (string, error) {
 	return mac.String(), nil
 }
 
-func generateConfigFile(networks []network, configPath string, has5GHz bool, htcaps *htCapabilities, bssid string) (string, error) {
+func generateConfigFile(networks []network, channel uint, has5GHz bool, htcaps *htCapabilities, bssid string, fallback configFallback) (string, error) {
 	log.Debugln("hostapd configure")
 
+	if fallback.Channel != 0 {
+		channel = fallback.Channel
+	}
+	if fallback.NoHT40 {
+		htcaps = htcaps.withoutHT40()
+	}
+
+	type authData struct {
+		RADIUS              *radiusServer
+		PSKFile             string
+		DynamicVLAN         int
+		VLANFile            string
+		VLANTaggedInterface string
+		VLANBridge          string
+	}
+
+	newAuthData := func(n network) authData {
+		return authData{
+			RADIUS:              n.RADIUS,
+			PSKFile:             n.PSKFile,
+			DynamicVLAN:         n.DynamicVLAN,
+			VLANFile:            n.VLANFile,
+			VLANTaggedInterface: n.VLANInterface,
+			VLANBridge:          dynamicVLANBridgePrefix,
+		}
+	}
+
 	type cfgData struct {
 		IEEE80211N bool
 		Channel    uint
@@ -124,20 +197,29 @@ func generateConfigFile(networks []network, configPath string, has5GHz bool, htc
 		Name       string
 		SSID       string
 		Pass       string
+		Isolate    bool
+		Bridge     string
+		Auth       authData
 
-		SecondName string
-		FirstBSSID string
-		SecondSSID string
-		SecondPass string
+		SecondName    string
+		FirstBSSID    string
+		SecondSSID    string
+		SecondPass    string
+		SecondIsolate bool
+		SecondBridge  string
+		SecondAuth    authData
 	}
 
 	cfg := cfgData{
 		IEEE80211N: has5GHz,
-		Channel:    getConfiguredChannel(configPath),
-		HTCap:      htcaps.AsConfigString(configPath),
+		Channel:    channel,
+		HTCap:      htcaps.AsConfigString(channel),
 		Name:       networks[0].Name,
 		SSID:       networks[0].SSID,
 		Pass:       wpaPassphrase(networks[0].SSID, networks[0].Password),
+		Isolate:    networks[0].Isolate,
+		Bridge:     networks[0].Bridge,
+		Auth:       newAuthData(networks[0]),
 	}
 
 	if len(networks) == 2 {
@@ -145,9 +227,21 @@ func generateConfigFile(networks []network, configPath string, has5GHz bool, htc
 		cfg.FirstBSSID = bssid
 		cfg.SecondSSID = networks[1].SSID
 		cfg.SecondPass = wpaPassphrase(networks[1].SSID, networks[1].Password)
-	}
-
-	templateString := `ctrl_interface=/var/run/hostapd
+		cfg.SecondIsolate = networks[1].Isolate
+		cfg.SecondBridge = networks[1].Bridge
+		cfg.SecondAuth = newAuthData(networks[1])
+	}
+
+	templateString := `{{define "auth"}}{{if .RADIUS}}auth_server_addr={{.RADIUS.Address}}
+auth_server_port={{.RADIUS.Port}}
+auth_server_shared_secret={{.RADIUS.Secret}}
+{{end}}{{if ne .PSKFile ""}}wpa_psk_file={{.PSKFile}}
+{{end}}{{if ne .DynamicVLAN 0}}dynamic_vlan={{.DynamicVLAN}}
+vlan_file={{.VLANFile}}
+vlan_naming=1
+vlan_tagged_interface={{.VLANTaggedInterface}}
+vlan_bridge={{.VLANBridge}}
+{{end}}{{end}}ctrl_interface=/var/run/hostapd
 driver=nl80211
 hw_mode=g
 ieee80211n={{if .IEEE80211N}}1{{else}}0{{end}}
@@ -159,29 +253,33 @@ wmm_enabled=1
 channel={{.Channel}}
 ht_capab={{.HTCap}}
 interface={{.Name}}
-logger_stdout=-1
+{{if ne .Bridge ""}}bridge={{.Bridge}}
+{{end}}logger_stdout=-1
 logger_stdout_level=2
 
 ssid={{.SSID}}
-macaddr_acl=0
+macaddr_acl={{if .Auth.RADIUS}}2{{else}}0{{end}}
 auth_algs=1
 ignore_broadcast_ssid=0
 wpa=2
 wpa_key_mgmt=WPA-PSK
 rsn_pairwise=CCMP
 wpa_psk={{.Pass}}
-{{if ne .SecondName ""}}
+{{template "auth" .Auth}}{{if .Isolate}}ap_isolate=1
+{{end}}{{if ne .SecondName ""}}
 bss={{.SecondName}}
 bssid={{.FirstBSSID}}
-ssid={{.SecondSSID}}
-macaddr_acl=0
+{{if ne .SecondBridge ""}}bridge={{.SecondBridge}}
+{{end}}ssid={{.SecondSSID}}
+macaddr_acl={{if .SecondAuth.RADIUS}}2{{else}}0{{end}}
 auth_algs=1
 ignore_broadcast_ssid=0
 wpa=2
 wpa_key_mgmt=WPA-PSK
 rsn_pairwise=CCMP
 wpa_psk={{.SecondPass}}
-{{end}}
+{{template "auth" .SecondAuth}}{{if .SecondIsolate}}ap_isolate=1
+{{end}}{{end}}
 `
 
 	tmpl, err := template.New("cfg").Parse(templateString)
@@ -200,57 +298,65 @@ wpa_psk={{.SecondPass}}
 	return buffer.String(), nil
 }
 
-func prepareAndGenerateConfigFile(configPath string, sleepTime int) (string, error) {
-	networks, err := getNeededNetworks(configPath)
+// prepareAndGenerateConfigFile sets up the interfaces and files hostapd needs
+// to run the given networks and returns their config
+func prepareAndGenerateConfigFile(networks []network, channel uint, fallback configFallback) (string, error) {
+	log.Infoln("Starting wifi networks:")
+	for _, n := range networks {
+		log.Infof(" - %s", n.Name)
+	}
+
+	renamed, err := ensureInterfaceExist(networks[0].Name)
 	if err != nil {
-		return "", fmt.Errorf("Failed to get network list: %v\n", err.Error())
+		return "", err
 	}
 
-	if len(networks) == 0 {
-		log.Println("No WiFi neworks are enabled. Exitting")
-		os.Exit(0)
+	changed, err := installNetworkdUnits(networks, opts.NetworkdDir)
+	if err != nil {
+		return "", err
 	}
 
-	if len(networks) != 0 {
-		log.Infoln("Found wifi networks:")
+	if renamed || changed {
+		var links []string
 		for _, n := range networks {
-			log.Infof(" - %s", n.Name)
+			links = append(links, n.Name)
 		}
-	}
 
-	err = ensureInterfaceExist(networks[0].Name, sleepTime)
-	if err != nil {
-		return "", err
+		err = reloadNetworkd(links)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	has5GHz, err := has5GHzSupport()
+	caps, err := detectCapabilities(networks[0].Name)
 	if err != nil {
 		return "", err
 	}
 
-	phys, err := getPhysicalInterfaces()
+	err = saveCapabilitySnapshot(opts.CapabilitiesFile, caps)
 	if err != nil {
-		return "", err
-	}
-	if len(phys) == 0 {
-		return "", fmt.Errorf("No WiFi physical interfaces found")
+		log.Warnf("Failed to record the capabilities: %s", err.Error())
 	}
 
-	htcaps, err := getHTCapabilities(phys[0])
+	err = writeDynamicVLANFiles(networks, path.Dir(opts.ConfigFile))
 	if err != nil {
 		return "", err
 	}
 
+	return generateConfigFromSnapshot(networks, channel, caps, fallback)
+}
+
+// generateConfigFromSnapshot generates the config for the recorded
+// capabilities of the radio
+func generateConfigFromSnapshot(networks []network, channel uint, caps *capabilitySnapshot, fallback configFallback) (string, error) {
 	var bssid string
 	if len(networks) == 2 {
-		var err2 error
-		bssid, err2 = getBSSID(networks[0].Name)
-		if err2 != nil {
-			return "", err2
-		}
+		bssid = caps.BSSID
 	}
 
-	cfg, err := generateConfigFile(networks, configPath, has5GHz, htcaps[0], bssid)
+	htcaps := caps.HTCapabilities
+
+	cfg, err := generateConfigFile(networks, channel, caps.Has5GHz, &htcaps, bssid, fallback)
 	if err != nil {
 		return "", fmt.Errorf("Failed to generate config file: %v", err.Error())
 	}
@@ -258,32 +364,19 @@ func prepareAndGenerateConfigFile(configPath string, sleepTime int) (string, err
 	return cfg, nil
 }
 
+// wpaPassphrase derives the PSK from a passphrase, unless it is the PSK
+// already
 func wpaPassphrase(ssid, passphrase string) string {
+	if isHexPSK(passphrase) {
+		return strings.ToLower(passphrase)
+	}
+
 	pass := []byte(passphrase)
 	salt := []byte(ssid)
 	keyData := pbkdf2.Key(pass, salt, 4096, 32, sha1.New)
 	return fmt.Sprintf("%x", keyData)
 }
 
-func getConfiguredChannel(configPath string) uint {
-	filename := path.Join(configPath, "system", "wifi", "channel")
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return 1
-	}
-
-	i, err := strconv.Atoi(string(data))
-	if err != nil {
-		panic(fmt.Sprintf("Channel %s is not an int", string(data)))
-	}
-
-	if i <= 0 {
-		panic(fmt.Sprintf("Channel %d is negative", i))
-	}
-
-	return uint(i)
-}
-
 func renameInterface(from string, to string) error {
 	i, err := net.InterfaceByName(from)
 	if err != nil {
@@ -306,78 +399,333 @@ func renameInterface(from string, to string) error {
 	return err
 }
 
-// was parts of 'interface_name'
-func ensureInterfaceExist(name string, sleepTime int) error {
+// was parts of 'interface_name'. Tells whether an interface had to be renamed.
+func ensureInterfaceExist(name string) (bool, error) {
 	interfaces, err := getLogicalInterfaces()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if len(interfaces) == 0 {
-		return fmt.Errorf("Found no WiFi interfaces")
+		return false, fmt.Errorf("Found no WiFi interfaces")
 	}
 
-	var interfaceIsThere = false
 	for _, i := range interfaces {
 		if i == name {
-			interfaceIsThere = true
-			break
+			return false, nil
 		}
 	}
 
-	if !interfaceIsThere {
-		log.Infof("Interface %s doesn't exist. Renaming %s -> %s", name, interfaces[0], name)
-		err = renameInterface(interfaces[0], name)
+	log.Infof("Interface %s doesn't exist. Renaming %s -> %s", name, interfaces[0], name)
+	err = renameInterface(interfaces[0], name)
+	if err != nil {
+		return false, err
+	}
+
+	return true, waitForLinks([]string{name}, linkIsUp, opts.LinkTimeout)
+}
+
+// reloadNetworkd has systemd-networkd apply its units to the links again,
+// after they changed or an interface got the name they match on. Networkd
+// versions that can't reload over D-Bus are restarted instead.
+func reloadNetworkd(links []string) error {
+	err := reconfigureNetworkD(links)
+	if err != errNetworkdUnsupported {
 		if err != nil {
-			return err
+			return fmt.Errorf("reloadNetworkd(): %s", err.Error())
 		}
+		return nil
+	}
 
-		time.Sleep(time.Second * time.Duration(sleepTime))
-		log.Debug("Restarting systemd-networkd.")
-		err = restartNetworkD(5)
-		if err != nil {
-			return fmt.Errorf("ensureInterfaceExist(): %s", err.Error())
+	log.Debug("Restarting systemd-networkd.")
+	err = restartNetworkD(5)
+	if err != nil {
+		return fmt.Errorf("reloadNetworkd(): %s", err.Error())
+	}
+
+	// the interfaces of additional BSSes only appear once hostapd runs
+	var existing []string
+	for _, name := range links {
+		_, err := interfaceIndexByName(name)
+		if err == nil {
+			existing = append(existing, name)
 		}
-		time.Sleep(time.Second * time.Duration(sleepTime))
 	}
 
-	return nil
+	return waitForLinks(existing, linkIsUp, opts.LinkTimeout)
+}
+
+var opts struct {
+	ConfigFile          string        `long:"config-file" description:"path to hostapd.conf"`
+	Binary              string        `long:"hostapd-binary" description:"path to hostapd binary"`
+	SKVSPath            string        `long:"skvs-dir" required:"true" decription:"path to SKVS root directory mountpoint"`
+	ConfigSource        string        `long:"config-source" default:"skvs" choice:"skvs" choice:"etcd" choice:"env" description:"where the daemon reads its configuration from, sources other than skvs are merged into --skvs-dir"`
+	EtcdEndpoint        string        `long:"etcd-endpoint" default:"http://127.0.0.1:2379" description:"etcd the configuration is read from with --config-source=etcd"`
+	EtcdPrefix          string        `long:"etcd-prefix" default:"/platform-hostapd" description:"etcd directory holding the configuration keys in the SKVS layout"`
+	ConfigValues        []string      `long:"config-value" description:"WIFI_<KEY>=<VALUE> with --config-source=env, overriding the environment variable"`
+	ConfigSourceState   string        `long:"config-source-state" default:"/var/lib/platform-hostapd/config-source.json" description:"path to the file recording which keys were mirrored from --config-source"`
+	Debug               bool          `long:"debug" description:"enable debug mode"`
+	SleepTime           int           `long:"sleep-time" description:"ignored, replaced by --link-timeout"`
+	LinkTimeout         time.Duration `long:"link-timeout" default:"30s" description:"how long to wait for network interfaces to appear and come up"`
+	FirewallBackend     string        `long:"firewall-backend" default:"auto" choice:"auto" choice:"nftables" choice:"iptables" description:"firewall backend used for the AP rules"`
+	DHCP                string        `long:"dhcp" default:"none" choice:"none" choice:"dnsmasq" choice:"networkd" description:"serve DHCP and DNS on the AP networks"`
+	DnsmasqBinary       string        `long:"dnsmasq-binary" default:"/usr/sbin/dnsmasq" description:"path to dnsmasq binary"`
+	DnsmasqConfig       string        `long:"dnsmasq-config" default:"/var/run/platform-hostapd/dnsmasq.conf" description:"path the generated dnsmasq config is written to"`
+	LeaseFile           string        `long:"lease-file" default:"/var/lib/misc/platform-hostapd.leases" description:"path to the DHCP lease file"`
+	PortalPort          uint16        `long:"portal-port" default:"8880" description:"port the captive portal listens on"`
+	PortalSessions      string        `long:"portal-sessions" default:"/var/lib/platform-hostapd/portal-sessions.json" description:"path to the file keeping the captive portal sessions"`
+	FirewallState       string        `long:"firewall-state" default:"/var/run/platform-hostapd/firewall.json" description:"path to the file recording the iptables rules in place"`
+	ShapingState        string        `long:"shaping-state" default:"/var/run/platform-hostapd/shaping.json" description:"path to the file describing the traffic shaping in place"`
+	NetworkdDir         string        `long:"networkd-dir" default:"/etc/systemd/network" description:"directory the systemd-networkd units of the AP interfaces are installed to"`
+	FallbackState       string        `long:"fallback-state" default:"/var/run/platform-hostapd/fallback.json" description:"path to the file recording the config fallback hostapd runs with"`
+	HostapdStartTimeout time.Duration `long:"hostapd-start-timeout" default:"30s" description:"how long hostapd gets to enable its BSSes before a safer config is tried"`
+	CapabilitiesFile    string        `long:"capabilities-file" default:"/var/lib/platform-hostapd/capabilities.json" description:"path the radio capabilities the config is generated for are recorded to"`
+	PassphrasePolicy    string        `long:"passphrase-policy" default:"warn" choice:"off" choice:"warn" choice:"enforce" description:"whether to reject or only warn about private network passphrases that are dictionary words or derived from the SSID"`
+	PassphraseDict      string        `long:"passphrase-dictionary" description:"file of further words, one per line, the private network passphrase must not be"`
+	SecretsKey          string        `long:"secrets-key" default:"/etc/platform-hostapd/secrets.key" description:"host key the sealed secrets in the SKVS are encrypted with"`
+	CredentialsDir      string        `long:"credentials-dir" default:"/var/lib/platform-hostapd/credentials" description:"directory the WIFI URIs and QR codes of rotated passwords are written to"`
+}
+
+func setupLogging() {
+	if opts.Debug {
+		log.SetLevel(log.DebugLevel)
+		log.Debugln("Debug mode enabled.")
+	}
 }
 
 func main() {
-	var opts struct {
-		ConfigFile string `long:"config-file" required:"true" description:"path to hostapd.conf"`
-		Binary     string `long:"hostapd-binary" required:"true" description:"path to hostapd binary"`
-		SKVSPath   string `long:"skvs-dir" required:"true" decription:"path to SKVS root directory mountpoint"`
-		Debug      bool   `long:"debug" description:"enable debug mode"`
-		SleepTime  int    `long:"sleep-time" default:"5" description:"sleep time when retrying a systemd-networkd restart"`
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("firewall", "Manage the AP firewall rules", "Installs or removes the forwarding and NAT rules for the AP networks.", &firewallCommand{})
+	parser.AddCommand("stations", "List associated stations", "Prints the stations associated to each network and their DHCP leases as JSON.", &stationsCommand{})
+	parser.AddCommand("render", "Print the hostapd config", "Prints the hostapd config the daemon would start with, without touching the system.", &renderCommand{})
+	parser.AddCommand("diff", "Compare the hostapd config", "Prints how the hostapd config the daemon would start with differs from --config-file, with secrets masked.", &diffCommand{})
+	parser.AddCommand("validate", "Validate the configuration", "Checks that a hostapd config can be generated from the SKVS.", &validateCommand{})
+	parser.AddCommand("export", "Export the WiFi configuration", "Prints the WiFi configuration in the SKVS as a versioned YAML or JSON document.", &exportCommand{})
+	parser.AddCommand("import", "Import the WiFi configuration", "Validates a YAML or JSON document from export and replaces the WiFi configuration in the SKVS with it, printing the keys it changed.", &importCommand{})
+	parser.AddCommand("credentials", "Show the credentials of a network", "Prints the SSID, password and WIFI URI of a network as JSON, optionally writing its QR code.", &credentialsCommand{})
+	parser.AddCommand("seal", "Seal a secret", "Encrypts the secret read from stdin with the host key and prints the value to store in the SKVS instead of it.", &sealCommand{})
+	parser.AddCommand("status", "Show the daemon status", "Prints the config fallback hostapd runs with and the traffic shaping in place as JSON.", &statusCommand{})
+
+	vouchers, err := parser.AddCommand("voucher", "Manage guest vouchers", "Creates, lists and revokes the vouchers granting access to a network.", &struct{}{})
+	if err != nil {
+		log.Fatal(err)
 	}
+	vouchers.AddCommand("create", "Create vouchers", "Creates vouchers and prints them as JSON.", &voucherCreateCommand{})
+	vouchers.AddCommand("list", "List vouchers", "Prints the vouchers of a network as JSON.", &voucherListCommand{})
+	vouchers.AddCommand("revoke", "Revoke a voucher", "Expires a voucher, disconnecting the devices using it.", &voucherRevokeCommand{})
 
-	_, err := flags.Parse(&opts)
+	_, err = parser.Parse()
 	if err != nil {
 		os.Exit(1)
 	}
 
-	if opts.Debug {
-		log.SetLevel(log.DebugLevel)
-		log.Debugln("Debug mode enabled.")
+	if parser.Active != nil {
+		// a subcommand already ran
+		return
+	}
+
+	setupLogging()
+
+	if opts.ConfigFile == "" || opts.Binary == "" {
+		log.Fatalln("--config-file and --hostapd-binary are required")
+	}
+
+	source, err := newConfigSource()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := stopOnSignal()
+	for {
+		err = runDaemon(source, stop)
+		if err != errRestart {
+			break
+		}
+		sdNotify("RELOADING=1")
+	}
+	sdNotify("STOPPING=1")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runDaemon runs hostapd and its helpers for the networks scheduled to be on
+// until stop is closed or one of them exits
+func runDaemon(source configSource, stop <-chan struct{}) error {
+	err := source.Sync()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(opts.SKVSPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get network list: %v", err.Error())
 	}
+	networks := cfg.Networks
 
-	cfg, err := prepareAndGenerateConfigFile(opts.SKVSPath, opts.SleepTime)
+	if len(networks) == 0 {
+		log.Println("No WiFi neworks are enabled. Exitting")
+		os.Exit(0)
+	}
+
+	// hostapd needs a network to start with, the scheduler disables the
+	// radio right away if none is scheduled
+	scheduled := scheduledNetworks(networks, time.Now())
+	if len(scheduled) == 0 {
+		scheduled = networks
+	}
+
+	s, running, fallback, err := startHostapd(scheduled, cfg.Channel)
+	if err != nil {
+		return err
+	}
+
+	err = startServices(s, networks, scheduled, running)
 	if err != nil {
-		log.Fatalln(err)
+		s.Stop()
+		return err
+	}
+
+	startSystemdNotifier(s, running)
+	reload := func() error {
+		return reloadHostapd(s, running, fallback)
+	}
+	startPasswordRotation(s, running, reload)
+	startConfigWatcher(s, source, reload)
+
+	return s.Wait(stop)
+}
+
+// writeHostapdConfig generates the hostapd config for the networks and saves
+// it to opts.ConfigFile, telling whether that changed it
+func writeHostapdConfig(networks []network, channel uint, fallback configFallback) (bool, error) {
+	cfg, err := prepareAndGenerateConfigFile(networks, channel, fallback)
+	if err != nil {
+		return false, err
 	}
 
 	log.Debugf("Generated config file:\n%s", cfg)
-	log.Infof("Writing hostapd config to '%s'", opts.ConfigFile)
-	err = ioutil.WriteFile(opts.ConfigFile, []byte(cfg), 0644)
+	changed, err := saveHostapdConfig(opts.ConfigFile, cfg)
+	if err != nil {
+		return false, fmt.Errorf("Failed to save config file: %s", err.Error())
+	}
+	if !changed {
+		log.Debugf("hostapd config '%s' is up to date", opts.ConfigFile)
+		return false, nil
+	}
+
+	log.Infof("Wrote hostapd config to '%s'", opts.ConfigFile)
+	return true, nil
+}
+
+// reloadMutex keeps the password rotations of several networks from writing
+// the config at the same time
+var reloadMutex sync.Mutex
+
+// reloadHostapd rewrites the config of the running networks from the SKVS
+// and has hostapd reload it, rolling back to the known good config if hostapd
+// doesn't come up with it. If the networks themselves changed errRestart is
+// returned instead.
+func reloadHostapd(s *supervisor, running []network, fallback configFallback) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// a rolled back config isn't generated, so a new one needs to be tried
+	// from scratch
+	if fallback.KnownGood {
+		return errRestart
+	}
+
+	cfg, err := loadConfig(opts.SKVSPath)
 	if err != nil {
-		log.Fatalf("Failed to save config file: %s", err.Error())
+		return fmt.Errorf("Failed to get network list: %v", err.Error())
 	}
 
-	log.Info("Starting hostapd")
-	err = syscall.Exec(opts.Binary, []string{opts.Binary, opts.ConfigFile}, []string{})
+	var current []network
+	for _, n := range cfg.Networks {
+		for _, r := range running {
+			if n.Name == r.Name {
+				current = append(current, n)
+			}
+		}
+	}
+	if !sameNetworks(current, running) {
+		return errRestart
+	}
+
+	changed, err := writeHostapdConfig(current, cfg.Channel, fallback)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Info("Reloading hostapd")
+	err = s.Signal("hostapd", syscall.SIGHUP)
+	if err != nil {
+		return err
+	}
+
+	err = waitForHostapd(s, current, opts.HostapdStartTimeout)
+	if err == nil {
+		return saveKnownGoodConfig(opts.ConfigFile)
+	}
+
+	names, rollbackErr := restoreKnownGoodConfig(opts.ConfigFile)
+	if rollbackErr != nil || names == nil {
+		return fmt.Errorf("hostapd failed to reload and there is no config to roll back to: %s", err.Error())
+	}
+
+	log.Warnf("hostapd failed to reload, rolling back: %s", err.Error())
+	rollbackErr = s.Signal("hostapd", syscall.SIGHUP)
+	if rollbackErr != nil {
+		return rollbackErr
+	}
+	return fmt.Errorf("Rolled back the hostapd config after it failed to reload: %s", err.Error())
+}
+
+// startServices starts everything besides hostapd serving the running
+// networks. Those are the scheduled ones, unless the config fallback dropped
+// some.
+func startServices(s *supervisor, networks []network, scheduled []network, running []network) error {
+	if opts.DHCP == "dnsmasq" {
+		err := startDHCP(s, running)
+		if err != nil {
+			return err
+		}
 	}
+
+	err := startIPv6(s, running)
+	if err != nil {
+		return err
+	}
+
+	portal, err := startCaptivePortal(s, running)
+	if err != nil {
+		return err
+	}
+
+	// the firewall command installs the rules for all networks
+	err = startUplinkWatch(s, networks)
+	if err != nil {
+		return err
+	}
+
+	startVoucherEnforcers(s, running, portal)
+	startShaping(s, running)
+	startScheduler(s, networks, scheduled)
+
+	return nil
+}
+
+// writeFileCreatingDir writes a file, creating its parent directories first
+func writeFileCreatingDir(filename string, data []byte, perm os.FileMode) error {
+	err := os.MkdirAll(path.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, perm)
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,14 +13,22 @@ import (
 
 var expectedNets = []network{
 	{
-		Name:     "wl_private",
-		Password: "foobarpassprivate",
-		SSID:     "example-SSID",
+		Name:      "wl_private",
+		Password:  "foobarpassprivate",
+		SSID:      "example-SSID",
+		Subnet:    mustParseCIDRs([]string{"10.42.0.0/16"})[0],
+		Gateway:   net.IP{10, 42, 0, 1},
+		DHCPStart: net.IP{10, 42, 0, 10},
+		DHCPEnd:   net.IP{10, 42, 255, 254},
 	},
 	{
-		Name:     "wl_public",
-		Password: "foobarpasspublic",
-		SSID:     "example-SSID (public)",
+		Name:      "wl_public",
+		Password:  "foobarpasspublic",
+		SSID:      "example-SSID (public)",
+		Subnet:    mustParseCIDRs([]string{"10.43.0.0/16"})[0],
+		Gateway:   net.IP{10, 43, 0, 1},
+		DHCPStart: net.IP{10, 43, 0, 10},
+		DHCPEnd:   net.IP{10, 43, 255, 254},
 	},
 }
 
@@ -69,32 +79,6 @@ func makeTestCfgDir() (string, error) {
 	return configPath, nil
 }
 
-func TestGetSSID1(t *testing.T) {
-	configPath, err := ioutil.TempDir("", "")
-	assert.Nil(t, err)
-	defer os.RemoveAll(configPath)
-
-	gotSSID := getSSID(configPath)
-
-	assert.Equal(t, "Protonet-default", gotSSID)
-}
-
-func TestGetSSID2(t *testing.T) {
-	testSSID := "This is a test of SSID trim:   ß"
-	trimmedSSID := "This is a test of SSID trim:"
-
-	configPath, err := ioutil.TempDir("", "")
-	assert.Nil(t, err)
-	defer os.RemoveAll(configPath)
-
-	err = ioutil.WriteFile(path.Join(configPath, "box_name"), []byte(testSSID), 0644)
-	assert.Nil(t, err)
-
-	gotSSID := getSSID(configPath)
-
-	assert.Equal(t, trimmedSSID, gotSSID)
-}
-
 func TestGetNeededNetworks(t *testing.T) {
 	configPath, err := makeTestCfgDir()
 	assert.Nil(t, err)
@@ -109,10 +93,6 @@ func TestGetNeededNetworks(t *testing.T) {
 }
 
 func TestGenerateConfigFile(t *testing.T) {
-	configPath, err := makeTestCfgDir()
-	assert.Nil(t, err)
-	defer os.RemoveAll(configPath)
-
 	htcaps := &htCapabilities{
 		DSSSCCKHT40:  true,
 		HT40:         true,
@@ -161,7 +141,73 @@ wpa_psk=46c0b02efacf5d5d077516a8bed48cbf4ee6e6de88308056c38b098d11a8edb1
 
 `
 
-	cfgFile, err := generateConfigFile(expectedNets, configPath, true, htcaps, "01:23:45:67:89:AB")
+	cfgFile, err := generateConfigFile(expectedNets, 1, true, htcaps, "01:23:45:67:89:AB", configFallback{})
 	assert.Nil(t, err)
 	assert.Equal(t, expectedConfigFile, cfgFile)
 }
+
+func TestReadIsolationPolicy(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	guestDir := path.Join(configPath, "system", "wifi", "guest")
+	err = ioutil.WriteFile(path.Join(guestDir, "isolate"), nil, 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(guestDir, "lan_allowlist"), []byte("# printer\n192.168.1.10\n\n10.1.0.0/16\n"), 0644)
+	assert.Nil(t, err)
+
+	networks, err := getNeededNetworks(configPath)
+	assert.Nil(t, err)
+	assert.False(t, networks[0].Isolate)
+	assert.True(t, networks[1].Isolate)
+	assert.Equal(t, mustParseCIDRs([]string{"192.168.1.10/32", "10.1.0.0/16"}), networks[1].LANAllowlist)
+
+	err = ioutil.WriteFile(path.Join(guestDir, "lan_allowlist"), []byte("printer.local\n"), 0644)
+	assert.Nil(t, err)
+	_, err = getNeededNetworks(configPath)
+	assert.NotNil(t, err)
+}
+
+func TestGenerateConfigFileIsolation(t *testing.T) {
+	nets := []network{expectedNets[0], expectedNets[1]}
+	nets[1].Isolate = true
+
+	cfgFile, err := generateConfigFile(nets, 1, false, &htCapabilities{HT20: true}, "01:23:45:67:89:AB", configFallback{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(cfgFile, "ap_isolate=1"))
+	assert.True(t, strings.HasSuffix(cfgFile, "wpa_psk=46c0b02efacf5d5d077516a8bed48cbf4ee6e6de88308056c38b098d11a8edb1\nap_isolate=1\n\n"))
+}
+
+func TestGenerateConfigFileBridge(t *testing.T) {
+	nets := []network{expectedNets[0], expectedNets[1]}
+	nets[0].Bridge = "br-vlan10"
+
+	cfgFile, err := generateConfigFile(nets, 1, false, &htCapabilities{HT20: true}, "01:23:45:67:89:AB", configFallback{})
+	assert.Nil(t, err)
+	assert.Contains(t, cfgFile, "interface=wl_private\nbridge=br-vlan10\n")
+	assert.Equal(t, 1, strings.Count(cfgFile, "bridge="))
+}
+
+func TestGenerateConfigFileDynamicVLAN(t *testing.T) {
+	nets := []network{expectedNets[0], expectedNets[1]}
+	nets[1].DynamicVLAN = dynamicVLANRequired
+	nets[1].RADIUS = &radiusServer{Address: "192.168.1.5", Port: 1812, Secret: "s3cret"}
+	nets[1].VLANFile = "/etc/hostapd/wl_public.vlan"
+	nets[1].PSKFile = "/etc/hostapd/wl_public.psk"
+	nets[1].VLANInterface = "eth0"
+
+	cfgFile, err := generateConfigFile(nets, 1, false, &htCapabilities{HT20: true}, "01:23:45:67:89:AB", configFallback{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(cfgFile, "macaddr_acl=2"))
+	assert.True(t, strings.HasSuffix(cfgFile, "wpa_psk=46c0b02efacf5d5d077516a8bed48cbf4ee6e6de88308056c38b098d11a8edb1\n"+
+		"auth_server_addr=192.168.1.5\n"+
+		"auth_server_port=1812\n"+
+		"auth_server_shared_secret=s3cret\n"+
+		"wpa_psk_file=/etc/hostapd/wl_public.psk\n"+
+		"dynamic_vlan=2\n"+
+		"vlan_file=/etc/hostapd/wl_public.vlan\n"+
+		"vlan_naming=1\n"+
+		"vlan_tagged_interface=eth0\n"+
+		"vlan_bridge=br-vlan\n\n"))
+}
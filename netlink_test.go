@@ -1,121 +1,272 @@
 package main
 
 import (
-	"fmt"
+	"net"
 	"os"
+	"sort"
 	"syscall"
 	"testing"
-	"unsafe"
 
 	"github.com/hkwi/nlgo"
 	"github.com/stretchr/testify/assert"
 )
 
-type mockGenlHub struct {
+const fakeNl80211FamilyID = 23
+
+// the indexes of the bands in NL80211_ATTR_WIPHY_BANDS
+const (
+	nl80211Band2GHz = 0
+	nl80211Band5GHz = 1
+)
+
+// fakeNl80211 stands in for the kernel: it answers nl80211 dumps from the
+// phys, interfaces and stations it models, encoded the way the kernel does
+type fakeNl80211 struct {
+	Phys       []fakePhy
+	Interfaces []fakeInterface
+	Stations   []fakeStation
+
+	// Errors makes commands fail with an error reply from the kernel,
+	// SyncErr makes every request fail before reaching it
+	Errors  map[uint8]syscall.Errno
+	SyncErr error
+
+	// Commands are the commands requested so far
+	Commands []uint8
 }
 
-func (mgh *mockGenlHub) Family(familyName string) nlgo.GenlFamily {
-	if familyName != "nl80211" {
-		panic("mockGenlHub supports only family 'nl80211'")
+type fakePhy struct {
+	Index uint32
+	Name  string
+	// Support5MHz sets NL80211_ATTR_SUPPORT_5_MHZ
+	Support5MHz bool
+	Bands       []fakeBand
+}
+
+// fakeBand is a band of a phy, nl80211Band2GHz or nl80211Band5GHz. Bands
+// with an HTCapa of 0 are legacy bands without HT.
+type fakeBand struct {
+	Band   uint16
+	HTCapa uint16
+	Freqs  []fakeFrequency
+}
+
+type fakeFrequency struct {
+	MHz      uint32
+	Disabled bool
+}
+
+type fakeInterface struct {
+	Index uint32
+	Name  string
+	Phy   uint32
+	Type  uint32
+	MAC   net.HardwareAddr
+}
+
+type fakeStation struct {
+	IfIndex uint32
+	MAC     net.HardwareAddr
+}
+
+// fakeFrequencies returns the channels from first to last MHz, step MHz apart
+func fakeFrequencies(first uint32, last uint32, step uint32) []fakeFrequency {
+	var freqs []fakeFrequency
+	for mhz := first; mhz <= last; mhz += step {
+		freqs = append(freqs, fakeFrequency{MHz: mhz})
 	}
-	return nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0}
+	return freqs
 }
 
-func (mgh *mockGenlHub) Sync(msg nlgo.GenlMessage) ([]nlgo.GenlMessage, error) {
-	msgHdr := (*nlgo.GenlMsghdr)(unsafe.Pointer(&msg.NetlinkMessage.Data[0]))
-	switch msgHdr.Cmd {
-	case nlgo.NL80211_CMD_GET_INTERFACE:
-		return []nlgo.GenlMessage{
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{
-						Len:   100,
-						Type:  23,
-						Flags: 2,
-						Seq:   1479991629,
-						Pid:   3553,
-					},
-					Data: []byte{7, 1, 0, 0, 8, 0, 3, 0, 4, 0, 0, 0, 15, 0, 4, 0, 119, 108, 95, 112, 114, 105, 118, 97, 116, 101, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 8, 0, 5, 0, 2, 0, 0, 0, 12, 0, 153, 0, 1, 0, 0, 0, 0, 0, 0, 0, 10, 0, 6, 0, 0, 14, 142, 100, 39, 108, 0, 0, 8, 0, 46, 0, 5, 0, 0, 0, 8, 0, 98, 0, 220, 5, 0, 0},
-				},
-				Family: nlgo.GenlFamily{
-					Id:      23,
-					Name:    "nl80211",
-					Version: 1,
-					Hdrsize: 0,
-				},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{
-						Len:   20,
-						Type:  3,
-						Flags: 2,
-						Seq:   1479991629,
-						Pid:   3553,
-					},
-					Data: []byte{0, 0, 0, 0},
-				},
-				Family: nlgo.GenlFamily{
-					Id:      0,
-					Name:    "",
-					Version: 0,
-					Hdrsize: 0,
-				},
+// testNl80211 models the host the tests were originally captured on: phy0
+// with HT on 2.4 and 5GHz, 5MHz channels and the interface wl_private
+func testNl80211() *fakeNl80211 {
+	return &fakeNl80211{
+		Phys: []fakePhy{{
+			Index:       0,
+			Name:        "phy0",
+			Support5MHz: true,
+			Bands: []fakeBand{
+				{Band: nl80211Band2GHz, HTCapa: 0x11ef, Freqs: fakeFrequencies(2412, 2472, 5)},
+				{Band: nl80211Band5GHz, HTCapa: 0x11ef, Freqs: fakeFrequencies(5180, 5320, 20)},
 			},
-		}, nil
+		}},
+		Interfaces: []fakeInterface{
+			{Index: 4, Name: "wl_private", Phy: 0, Type: nlgo.NL80211_IFTYPE_AP, MAC: net.HardwareAddr{0x00, 0x0e, 0x8e, 0x64, 0x27, 0x6c}},
+		},
+	}
+}
+
+// withFakeNl80211 has newGenHub return f until the returned function is
+// called
+func withFakeNl80211(f *fakeNl80211) func() {
+	oldNewGenHub := newGenHub
+	newGenHub = func() (genlHuber, error) {
+		return f, nil
+	}
+	return func() { newGenHub = oldNewGenHub }
+}
+
+func (f *fakeNl80211) Family(familyName string) nlgo.GenlFamily {
+	if familyName != "nl80211" {
+		return nlgo.GenlFamily{}
+	}
+	return nlgo.GenlFamily{Id: fakeNl80211FamilyID, Name: "nl80211", Version: 1, Hdrsize: 0}
+}
+
+func (f *fakeNl80211) Sync(msg nlgo.GenlMessage) ([]nlgo.GenlMessage, error) {
+	if f.SyncErr != nil {
+		return nil, f.SyncErr
+	}
+	if msg.Header.Type != fakeNl80211FamilyID || len(msg.Data) < 4 {
+		return []nlgo.GenlMessage{f.errorReply(msg, syscall.EINVAL)}, nil
+	}
+
+	cmd := msg.Data[0]
+	f.Commands = append(f.Commands, cmd)
+	if errno, ok := f.Errors[cmd]; ok {
+		return []nlgo.GenlMessage{f.errorReply(msg, errno)}, nil
+	}
+
+	var replyCmd uint8
+	var bodies [][]byte
+	switch cmd {
 	case nlgo.NL80211_CMD_GET_WIPHY:
-		return []nlgo.GenlMessage{
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 3528, Type: 23, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{3, 1, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 2, 0, 112, 104, 121, 48, 0, 0, 0, 0, 8, 0, 46, 0, 1, 0, 0, 0, 5, 0, 61, 0, 7, 0, 0, 0, 5, 0, 62, 0, 4, 0, 0, 0, 8, 0, 63, 0, 255, 255, 255, 255, 8, 0, 64, 0, 255, 255, 255, 255, 5, 0, 89, 0, 0, 0, 0, 0, 5, 0, 43, 0, 4, 0, 0, 0, 5, 0, 123, 0, 0, 0, 0, 0, 6, 0, 56, 0, 209, 8, 0, 0, 6, 0, 124, 0, 0, 0, 0, 0, 5, 0, 133, 0, 0, 0, 0, 0, 8, 0, 222, 0, 1, 0, 0, 0, 8, 0, 223, 0, 255, 255, 255, 255, 8, 0, 224, 0, 0, 0, 0, 0, 4, 0, 104, 0, 4, 0, 130, 0, 4, 0, 139, 0, 4, 0, 140, 0, 48, 0, 57, 0, 1, 172, 15, 0, 5, 172, 15, 0, 2, 172, 15, 0, 4, 172, 15, 0, 10, 172, 15, 0, 8, 172, 15, 0, 9, 172, 15, 0, 6, 172, 15, 0, 13, 172, 15, 0, 11, 172, 15, 0, 12, 172, 15, 0, 5, 0, 86, 0, 0, 0, 0, 0, 4, 0, 102, 0, 8, 0, 113, 0, 3, 0, 0, 0, 8, 0, 114, 0, 3, 0, 0, 0, 8, 0, 105, 0, 3, 0, 0, 0, 8, 0, 106, 0, 3, 0, 0, 0, 40, 0, 32, 0, 4, 0, 1, 0, 4, 0, 2, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 4, 0, 6, 0, 4, 0, 8, 0, 4, 0, 9, 0, 4, 0, 11, 0, 120, 5, 22, 0, 0, 2, 0, 0, 20, 0, 3, 0, 255, 255, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 6, 0, 4, 0, 239, 17, 0, 0, 5, 0, 5, 0, 3, 0, 0, 0, 5, 0, 6, 0, 6, 0, 0, 0, 160, 0, 2, 0, 12, 0, 0, 0, 8, 0, 1, 0, 10, 0, 0, 0, 16, 0, 1, 0, 8, 0, 1, 0, 20, 0, 0, 0, 4, 0, 2, 0, 16, 0, 2, 0, 8, 0, 1, 0, 55, 0, 0, 0, 4, 0, 2, 0, 16, 0, 3, 0, 8, 0, 1, 0, 110, 0, 0, 0, 4, 0, 2, 0, 12, 0, 4, 0, 8, 0, 1, 0, 60, 0, 0, 0, 12, 0, 5, 0, 8, 0, 1, 0, 90, 0, 0, 0, 12, 0, 6, 0, 8, 0, 1, 0, 120, 0, 0, 0, 12, 0, 7, 0, 8, 0, 1, 0, 180, 0, 0, 0, 12, 0, 8, 0, 8, 0, 1, 0, 240, 0, 0, 0, 12, 0, 9, 0, 8, 0, 1, 0, 104, 1, 0, 0, 12, 0, 10, 0, 8, 0, 1, 0, 224, 1, 0, 0, 12, 0, 11, 0, 8, 0, 1, 0, 28, 2, 0, 0, 48, 1, 1, 0, 20, 0, 0, 0, 8, 0, 1, 0, 108, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 1, 0, 8, 0, 1, 0, 113, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 2, 0, 8, 0, 1, 0, 118, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 3, 0, 8, 0, 1, 0, 123, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 4, 0, 8, 0, 1, 0, 128, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 5, 0, 8, 0, 1, 0, 133, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 6, 0, 8, 0, 1, 0, 138, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 7, 0, 8, 0, 1, 0, 143, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 8, 0, 8, 0, 1, 0, 148, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 9, 0, 8, 0, 1, 0, 153, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 20, 0, 10, 0, 8, 0, 1, 0, 158, 9, 0, 0, 8, 0, 6, 0, 64, 6, 0, 0, 28, 0, 11, 0, 8, 0, 1, 0, 163, 9, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 64, 6, 0, 0, 28, 0, 12, 0, 8, 0, 1, 0, 168, 9, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 64, 6, 0, 0, 24, 0, 13, 0, 8, 0, 1, 0, 180, 9, 0, 0, 4, 0, 2, 0, 8, 0, 6, 0, 208, 7, 0, 0, 116, 3, 1, 0, 20, 0, 3, 0, 255, 255, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 6, 0, 4, 0, 239, 17, 0, 0, 5, 0, 5, 0, 3, 0, 0, 0, 5, 0, 6, 0, 6, 0, 0, 0, 100, 0, 2, 0, 12, 0, 0, 0, 8, 0, 1, 0, 60, 0, 0, 0, 12, 0, 1, 0, 8, 0, 1, 0, 90, 0, 0, 0, 12, 0, 2, 0, 8, 0, 1, 0, 120, 0, 0, 0, 12, 0, 3, 0, 8, 0, 1, 0, 180, 0, 0, 0, 12, 0, 4, 0, 8, 0, 1, 0, 240, 0, 0, 0, 12, 0, 5, 0, 8, 0, 1, 0, 104, 1, 0, 0, 12, 0, 6, 0, 8, 0, 1, 0, 224, 1, 0, 0, 12, 0, 7, 0, 8, 0, 1, 0, 28, 2, 0, 0, 224, 2, 1, 0, 28, 0, 0, 0, 8, 0, 1, 0, 60, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 220, 5, 0, 0, 28, 0, 1, 0, 8, 0, 1, 0, 80, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 220, 5, 0, 0, 28, 0, 2, 0, 8, 0, 1, 0, 100, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 220, 5, 0, 0, 28, 0, 3, 0, 8, 0, 1, 0, 120, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 64, 6, 0, 0, 32, 0, 4, 0, 8, 0, 1, 0, 140, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 220, 5, 0, 0, 32, 0, 5, 0, 8, 0, 1, 0, 160, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 220, 5, 0, 0, 32, 0, 6, 0, 8, 0, 1, 0, 180, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 220, 5, 0, 0, 32, 0, 7, 0, 8, 0, 1, 0, 200, 20, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 220, 5, 0, 0, 32, 0, 8, 0, 8, 0, 1, 0, 124, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 9, 0, 8, 0, 1, 0, 144, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 10, 0, 8, 0, 1, 0, 164, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 11, 0, 8, 0, 1, 0, 184, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 12, 0, 8, 0, 1, 0, 204, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 13, 0, 8, 0, 1, 0, 224, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 14, 0, 8, 0, 1, 0, 244, 21, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 15, 0, 8, 0, 1, 0, 8, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 16, 0, 8, 0, 1, 0, 28, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 17, 0, 8, 0, 1, 0, 48, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 32, 0, 18, 0, 8, 0, 1, 0, 68, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 4, 0, 5, 0, 8, 0, 6, 0, 164, 6, 0, 0, 28, 0, 19, 0, 8, 0, 1, 0, 113, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 8, 7, 0, 0, 28, 0, 20, 0, 8, 0, 1, 0, 133, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 8, 7, 0, 0, 28, 0, 21, 0, 8, 0, 1, 0, 153, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 8, 7, 0, 0, 28, 0, 22, 0, 8, 0, 1, 0, 173, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 8, 7, 0, 0, 28, 0, 23, 0, 8, 0, 1, 0, 193, 22, 0, 0, 4, 0, 3, 0, 4, 0, 4, 0, 8, 0, 6, 0, 8, 7, 0, 0, 220, 0, 50, 0, 8, 0, 1, 0, 7, 0, 0, 0, 8, 0, 2, 0, 6, 0, 0, 0, 8, 0, 3, 0, 11, 0, 0, 0, 8, 0, 4, 0, 15, 0, 0, 0, 8, 0, 5, 0, 19, 0, 0, 0, 8, 0, 6, 0, 25, 0, 0, 0, 8, 0, 7, 0, 37, 0, 0, 0, 8, 0, 8, 0, 38, 0, 0, 0, 8, 0, 9, 0, 39, 0, 0, 0, 8, 0, 10, 0, 40, 0, 0, 0, 8, 0, 11, 0, 43, 0, 0, 0, 8, 0, 12, 0, 55, 0, 0, 0, 8, 0, 13, 0, 57, 0, 0, 0, 8, 0, 14, 0, 59, 0, 0, 0, 8, 0, 15, 0, 67, 0, 0, 0, 8, 0, 16, 0, 49, 0, 0, 0, 8, 0, 17, 0, 65, 0, 0, 0, 8, 0, 18, 0, 66, 0, 0, 0, 8, 0, 19, 0, 82, 0, 0, 0, 8, 0, 20, 0, 81, 0, 0, 0, 8, 0, 21, 0, 84, 0, 0, 0, 8, 0, 22, 0, 87, 0, 0, 0, 8, 0, 23, 0, 85, 0, 0, 0, 8, 0, 24, 0, 89, 0, 0, 0, 8, 0, 25, 0, 92, 0, 0, 0, 8, 0, 26, 0, 46, 0, 0, 0, 8, 0, 27, 0, 48, 0, 0, 0, 8, 0, 111, 0, 136, 19, 0, 0, 4, 0, 108, 0, 52, 4, 99, 0, 4, 0, 0, 0, 132, 0, 1, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 2, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 3, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 4, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 4, 0, 5, 0, 4, 0, 6, 0, 132, 0, 7, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 8, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 9, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 132, 0, 10, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 16, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 48, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 80, 0, 0, 0, 6, 0, 101, 0, 96, 0, 0, 0, 6, 0, 101, 0, 112, 0, 0, 0, 6, 0, 101, 0, 128, 0, 0, 0, 6, 0, 101, 0, 144, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 6, 0, 101, 0, 224, 0, 0, 0, 6, 0, 101, 0, 240, 0, 0, 0, 4, 0, 11, 0, 68, 1, 100, 0, 4, 0, 0, 0, 36, 0, 1, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 20, 0, 2, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 60, 0, 3, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 60, 0, 4, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 4, 0, 5, 0, 4, 0, 6, 0, 28, 0, 7, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 20, 0, 8, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 60, 0, 9, 0, 6, 0, 101, 0, 0, 0, 0, 0, 6, 0, 101, 0, 32, 0, 0, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 160, 0, 0, 0, 6, 0, 101, 0, 176, 0, 0, 0, 6, 0, 101, 0, 192, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 20, 0, 10, 0, 6, 0, 101, 0, 64, 0, 0, 0, 6, 0, 101, 0, 208, 0, 0, 0, 4, 0, 11, 0, 12, 0, 121, 0, 4, 0, 4, 0, 4, 0, 6, 0, 144, 0, 120, 0, 92, 0, 1, 0, 68, 0, 1, 0, 20, 0, 1, 0, 8, 0, 1, 0, 0, 8, 0, 0, 8, 0, 2, 0, 4, 0, 2, 0, 20, 0, 2, 0, 8, 0, 1, 0, 8, 0, 0, 0, 8, 0, 2, 0, 4, 0, 3, 0, 24, 0, 3, 0, 8, 0, 1, 0, 1, 0, 0, 0, 12, 0, 2, 0, 4, 0, 8, 0, 4, 0, 9, 0, 4, 0, 3, 0, 8, 0, 4, 0, 1, 0, 0, 0, 8, 0, 2, 0, 0, 8, 0, 0, 48, 0, 2, 0, 24, 0, 1, 0, 20, 0, 1, 0, 8, 0, 1, 0, 0, 8, 0, 0, 8, 0, 2, 0, 4, 0, 5, 0, 4, 0, 3, 0, 8, 0, 4, 0, 1, 0, 0, 0, 8, 0, 2, 0, 0, 8, 0, 0, 8, 0, 143, 0, 227, 139, 7, 8, 30, 0, 148, 0, 99, 72, 31, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 88, Type: 23, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{3, 1, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 2, 0, 112, 104, 121, 48, 0, 0, 0, 0, 8, 0, 46, 0, 1, 0, 0, 0, 12, 0, 169, 0, 0, 0, 0, 0, 0, 0, 0, 64, 12, 0, 170, 0, 0, 0, 0, 0, 0, 0, 0, 64, 16, 0, 176, 0, 240, 31, 128, 51, 255, 255, 0, 0, 255, 255, 0, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 56, Type: 23, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{3, 1, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 2, 0, 112, 104, 121, 48, 0, 0, 0, 0, 8, 0, 46, 0, 1, 0, 0, 0, 4, 0, 192, 0, 4, 0, 193, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 48, Type: 23, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{3, 1, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 2, 0, 112, 104, 121, 48, 0, 0, 0, 0, 8, 0, 46, 0, 1, 0, 0, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 64, Type: 23, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{3, 1, 0, 0, 8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 2, 0, 112, 104, 121, 48, 0, 0, 0, 0, 8, 0, 46, 0, 1, 0, 0, 0, 5, 0, 206, 0, 2, 0, 0, 0, 5, 0, 217, 0, 2, 0, 0, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 23, Name: "nl80211", Version: 1, Hdrsize: 0},
-			},
-			{
-				NetlinkMessage: syscall.NetlinkMessage{
-					Header: syscall.NlMsghdr{Len: 20, Type: 3, Flags: 2, Seq: 1479994075, Pid: 2489257296},
-					Data:   []byte{0, 0, 0, 0},
-				},
-				Family: nlgo.GenlFamily{Id: 0, Name: "", Version: 0, Hdrsize: 0},
-			},
-		}, nil
+		replyCmd = nlgo.NL80211_CMD_NEW_WIPHY
+		for _, phy := range f.Phys {
+			bodies = append(bodies, phy.attrs())
+		}
+	case nlgo.NL80211_CMD_GET_INTERFACE:
+		replyCmd = nlgo.NL80211_CMD_NEW_INTERFACE
+		for _, iface := range f.Interfaces {
+			bodies = append(bodies, iface.attrs())
+		}
+	case nlgo.NL80211_CMD_GET_STATION:
+		replyCmd = nlgo.NL80211_CMD_NEW_STATION
+		// like the kernel, stations are only dumped for a given interface
+		ifIndex, ok := requestIfIndex(msg.Data[4:])
+		if !ok {
+			return []nlgo.GenlMessage{f.errorReply(msg, syscall.EINVAL)}, nil
+		}
+		for _, sta := range f.Stations {
+			if sta.IfIndex == ifIndex {
+				bodies = append(bodies, sta.attrs())
+			}
+		}
 	default:
-		panic(fmt.Sprintf("unexpected message %+v", msg))
+		return []nlgo.GenlMessage{f.errorReply(msg, syscall.EOPNOTSUPP)}, nil
+	}
+
+	var replies []nlgo.GenlMessage
+	for _, body := range bodies {
+		data := concatBytes([]byte{replyCmd, 1, 0, 0}, body)
+		replies = append(replies, nlgo.GenlMessage{
+			NetlinkMessage: fakeNetlinkMessage(msg, fakeNl80211FamilyID, data),
+			Family:         f.Family("nl80211"),
+		})
+	}
+	replies = append(replies, nlgo.GenlMessage{NetlinkMessage: fakeNetlinkMessage(msg, syscall.NLMSG_DONE, []byte{0, 0, 0, 0})})
+
+	return replies, nil
+}
+
+// errorReply is the kernel's NLMSG_ERROR for req: the negative errno
+// followed by the header of the request
+func (f *fakeNl80211) errorReply(req nlgo.GenlMessage, errno syscall.Errno) nlgo.GenlMessage {
+	data := make([]byte, 4+syscall.NLMSG_HDRLEN)
+	nativeEndian.PutUint32(data[0:4], uint32(-int32(errno)))
+	nativeEndian.PutUint32(data[4:8], uint32(syscall.NLMSG_HDRLEN+len(req.Data)))
+	nativeEndian.PutUint16(data[8:10], req.Header.Type)
+	nativeEndian.PutUint16(data[10:12], req.Header.Flags)
+	nativeEndian.PutUint32(data[12:16], req.Header.Seq)
+	nativeEndian.PutUint32(data[16:20], req.Header.Pid)
+
+	return nlgo.GenlMessage{NetlinkMessage: fakeNetlinkMessage(req, syscall.NLMSG_ERROR, data)}
+}
+
+func fakeNetlinkMessage(req nlgo.GenlMessage, typ uint16, data []byte) syscall.NetlinkMessage {
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(syscall.NLMSG_HDRLEN + len(data)),
+			Type:  typ,
+			Flags: syscall.NLM_F_MULTI,
+			Seq:   req.Header.Seq,
+			Pid:   req.Header.Pid,
+		},
+		Data: data,
+	}
+}
+
+// requestIfIndex returns NL80211_ATTR_IFINDEX of a request body
+func requestIfIndex(body []byte) (uint32, bool) {
+	attrs, err := parseNlAttrs(body)
+	if err != nil {
+		return 0, false
 	}
+	for _, a := range attrs {
+		if a.Type == nlgo.NL80211_ATTR_IFINDEX && len(a.Data) == 4 {
+			return nativeEndian.Uint32(a.Data), true
+		}
+	}
+	return 0, false
+}
+
+// attrs encodes a phy like NL80211_CMD_NEW_WIPHY. Like the kernel, nested
+// attributes don't carry NLA_F_NESTED and bands and frequencies are indexed
+// by their position.
+func (p fakePhy) attrs() []byte {
+	var bands []byte
+	for _, b := range p.Bands {
+		var freqs []byte
+		for i, freq := range b.Freqs {
+			attrs := nlAttrU32(nlgo.NL80211_FREQUENCY_ATTR_FREQ, freq.MHz)
+			if freq.Disabled {
+				attrs = concatBytes(attrs, nlAttr(nlgo.NL80211_FREQUENCY_ATTR_DISABLED, nil))
+			}
+			freqs = concatBytes(freqs, nlAttr(uint16(i), attrs))
+		}
+
+		band := nlAttr(nlgo.NL80211_BAND_ATTR_FREQS, freqs)
+		if b.HTCapa != 0 {
+			band = concatBytes(band, nlAttrU16(nlgo.NL80211_BAND_ATTR_HT_CAPA, b.HTCapa))
+		}
+		bands = concatBytes(bands, nlAttr(b.Band, band))
+	}
+
+	attrs := concatBytes(
+		nlAttrU32(nlgo.NL80211_ATTR_WIPHY, p.Index),
+		nlAttrString(nlgo.NL80211_ATTR_WIPHY_NAME, p.Name),
+		nlAttr(nlgo.NL80211_ATTR_WIPHY_BANDS, bands),
+	)
+	if p.Support5MHz {
+		attrs = concatBytes(attrs, nlAttr(nlgo.NL80211_ATTR_SUPPORT_5_MHZ, nil))
+	}
+	return attrs
+}
+
+// attrs encodes an interface like NL80211_CMD_NEW_INTERFACE
+func (i fakeInterface) attrs() []byte {
+	return concatBytes(
+		nlAttrU32(nlgo.NL80211_ATTR_IFINDEX, i.Index),
+		nlAttrString(nlgo.NL80211_ATTR_IFNAME, i.Name),
+		nlAttrU32(nlgo.NL80211_ATTR_WIPHY, i.Phy),
+		nlAttrU32(nlgo.NL80211_ATTR_IFTYPE, i.Type),
+		nlAttr(nlgo.NL80211_ATTR_MAC, i.MAC),
+	)
+}
+
+// attrs encodes a station like NL80211_CMD_NEW_STATION, without statistics
+func (s fakeStation) attrs() []byte {
+	return concatBytes(
+		nlAttrU32(nlgo.NL80211_ATTR_IFINDEX, s.IfIndex),
+		nlAttr(nlgo.NL80211_ATTR_MAC, s.MAC),
+		nlAttr(nlgo.NL80211_ATTR_STA_INFO, nil),
+	)
 }
 
 func TestMain(m *testing.M) {
 	newGenHub = func() (genlHuber, error) {
-		return &mockGenlHub{}, nil
+		return testNl80211(), nil
 	}
 
 	os.Exit(m.Run())
@@ -136,3 +287,108 @@ func TestGetPhysicalInterfaces(t *testing.T) {
 	assert.Len(t, ifs, 1)
 	assert.Equal(t, "phy0", ifs[0])
 }
+
+func TestGetInterfacesMultiPhy(t *testing.T) {
+	f := &fakeNl80211{
+		Phys: []fakePhy{
+			{Index: 1, Name: "phy1", Bands: []fakeBand{{Band: nl80211Band5GHz, HTCapa: 0x0162}}},
+			{Index: 0, Name: "phy0", Bands: []fakeBand{{Band: nl80211Band2GHz, HTCapa: 0x11ef}}},
+		},
+		Interfaces: []fakeInterface{
+			{Index: 5, Name: "wl_public", Phy: 1, Type: nlgo.NL80211_IFTYPE_AP},
+			{Index: 4, Name: "wl_private", Phy: 0, Type: nlgo.NL80211_IFTYPE_AP},
+		},
+	}
+	defer withFakeNl80211(f)()
+
+	phys, err := getPhysicalInterfaces()
+	assert.Nil(t, err)
+	sort.Strings(phys)
+	assert.Equal(t, []string{"phy0", "phy1"}, phys)
+
+	ifs, err := getLogicalInterfaces()
+	assert.Nil(t, err)
+	sort.Strings(ifs)
+	assert.Equal(t, []string{"wl_private", "wl_public"}, ifs)
+
+	assert.Equal(t, []uint8{nlgo.NL80211_CMD_GET_WIPHY, nlgo.NL80211_CMD_GET_INTERFACE}, f.Commands)
+}
+
+func TestGetInterfacesErrorReply(t *testing.T) {
+	f := testNl80211()
+	f.Errors = map[uint8]syscall.Errno{
+		nlgo.NL80211_CMD_GET_WIPHY:     syscall.EPERM,
+		nlgo.NL80211_CMD_GET_INTERFACE: syscall.ENODEV,
+	}
+	defer withFakeNl80211(f)()
+
+	_, err := getPhysicalInterfaces()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), syscall.EPERM.Error())
+
+	_, err = getLogicalInterfaces()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), syscall.ENODEV.Error())
+
+	f.Errors = nil
+	f.SyncErr = assert.AnError
+	_, err = getLogicalInterfaces()
+	assert.Equal(t, assert.AnError, err)
+
+	// TODO: getPhysicalInterfaces panics when the request fails rather
+	// than returning the error
+	assert.Panics(t, func() { getPhysicalInterfaces() })
+}
+
+func TestFakeNl80211Stations(t *testing.T) {
+	f := testNl80211()
+	f.Stations = []fakeStation{
+		{IfIndex: 4, MAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		{IfIndex: 5, MAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2}},
+	}
+
+	family := f.Family("nl80211")
+	req := family.DumpRequest(nlgo.NL80211_CMD_GET_STATION)
+	resp, err := f.Sync(req)
+	assert.Nil(t, err)
+	assert.Len(t, resp, 1)
+	assert.Equal(t, uint16(syscall.NLMSG_ERROR), resp[0].Header.Type, "stations are only dumped per interface")
+
+	req.Data = concatBytes(req.Data, nlAttrU32(nlgo.NL80211_ATTR_IFINDEX, 4))
+	resp, err = f.Sync(req)
+	assert.Nil(t, err)
+	assert.Len(t, resp, 2)
+	assert.Equal(t, uint16(syscall.NLMSG_DONE), resp[1].Header.Type)
+
+	attrs, err := nlgo.Nl80211Policy.Parse(resp[0].Body())
+	assert.Nil(t, err)
+	assert.Equal(t, nlgo.U32(4), attrs.(nlgo.AttrMap).Get(nlgo.NL80211_ATTR_IFINDEX))
+}
+
+func TestFakeNl80211Bands(t *testing.T) {
+	f := &fakeNl80211{Phys: []fakePhy{{Index: 0, Name: "phy0", Bands: []fakeBand{
+		{Band: nl80211Band2GHz, Freqs: []fakeFrequency{{MHz: 2412}, {MHz: 2484, Disabled: true}}},
+		{Band: nl80211Band5GHz, HTCapa: 0x11ef},
+	}}}}
+
+	family := f.Family("nl80211")
+	resp, err := f.Sync(family.DumpRequest(nlgo.NL80211_CMD_GET_WIPHY))
+	assert.Nil(t, err)
+	assert.Len(t, resp, 2)
+
+	attrs, err := nlgo.Nl80211Policy.Parse(resp[0].Body())
+	assert.Nil(t, err)
+	assert.Nil(t, attrs.(nlgo.AttrMap).Get(nlgo.NL80211_ATTR_SUPPORT_5_MHZ))
+
+	bands := attrs.(nlgo.AttrMap).Get(nlgo.NL80211_ATTR_WIPHY_BANDS).(nlgo.AttrSlice)
+	assert.Len(t, bands, 2)
+
+	legacy := bands[0].Value.(nlgo.AttrMap)
+	assert.Nil(t, legacy.Get(nlgo.NL80211_BAND_ATTR_HT_CAPA), "legacy bands have no HT capabilities")
+	freqs := legacy.Get(nlgo.NL80211_BAND_ATTR_FREQS).(nlgo.AttrSlice)
+	assert.Len(t, freqs, 2)
+	assert.Equal(t, nlgo.U32(2484), freqs[1].Value.(nlgo.AttrMap).Get(nlgo.NL80211_FREQUENCY_ATTR_FREQ))
+	assert.NotNil(t, freqs[1].Value.(nlgo.AttrMap).Get(nlgo.NL80211_FREQUENCY_ATTR_DISABLED))
+
+	assert.Equal(t, nlgo.U16(0x11ef), bands[1].Value.(nlgo.AttrMap).Get(nlgo.NL80211_BAND_ATTR_HT_CAPA))
+}
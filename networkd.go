@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// networkdUnitPrefix starts the names of the units we install, so that stale
+// ones can be told apart from those of other components
+const networkdUnitPrefix = "50-platform-hostapd-"
+
+type networkdUnit struct {
+	Name       string
+	Addresses  []string
+	IPForward  string
+	Masquerade bool
+	Bridge     string
+	DHCPServer bool
+	PoolOffset uint32
+	PoolSize   uint32
+	NetDevKind string
+	NetDevVLAN int
+}
+
+// networkdNetworkTemplate has networkd's DHCP server hand out the DNS servers
+// of the uplink, as only dnsmasq serves DNS on the gateway
+var networkdNetworkTemplate = template.Must(template.New("network").Parse(`# generated by platform-hostapd
+[Match]
+Name={{.Name}}
+
+[Network]
+ConfigureWithoutCarrier=yes
+{{- range .Addresses}}
+Address={{.}}
+{{- end}}
+{{- if .Bridge}}
+Bridge={{.Bridge}}
+{{- end}}
+{{- if .IPForward}}
+IPForward={{.IPForward}}
+{{- end}}
+{{- if .Masquerade}}
+IPMasquerade=yes
+{{- end}}
+{{- if .DHCPServer}}
+DHCPServer=yes
+
+[DHCPServer]
+PoolOffset={{.PoolOffset}}
+PoolSize={{.PoolSize}}
+EmitDNS=yes
+{{- end}}
+`))
+
+var networkdNetDevTemplate = template.Must(template.New("netdev").Parse(`# generated by platform-hostapd
+[NetDev]
+Name={{.Name}}
+Kind={{.NetDevKind}}
+{{- if .NetDevVLAN}}
+
+[VLAN]
+Id={{.NetDevVLAN}}
+{{- end}}
+`))
+
+// generateNetworkdUnits renders the systemd-networkd units for the AP
+// interfaces, keyed by file name. Routed networks get their gateway addresses,
+// forwarding and masquerading, and with dhcpServer networkd's DHCP server.
+// Bridged networks are put on their bridge, which gets a .netdev like the VLAN
+// interface tagging it. The AP
+// interfaces have no carrier until hostapd runs, so networkd mustn't wait for
+// one.
+func generateNetworkdUnits(networks []network, dhcpServer bool) (map[string]string, error) {
+	units := make(map[string]string)
+
+	render := func(filename string, tmpl *template.Template, u networkdUnit) error {
+		var buffer bytes.Buffer
+		err := tmpl.Execute(&buffer, u)
+		if err != nil {
+			return err
+		}
+		units[networkdUnitPrefix+filename] = buffer.String()
+		return nil
+	}
+
+	for _, n := range networks {
+		if n.Bridge != "" {
+			err := render(n.Name+".network", networkdNetworkTemplate, networkdUnit{Name: n.Name, Bridge: n.Bridge})
+			if err != nil {
+				return nil, err
+			}
+
+			err = render(n.Bridge+".netdev", networkdNetDevTemplate, networkdUnit{Name: n.Bridge, NetDevKind: "bridge"})
+			if err != nil {
+				return nil, err
+			}
+
+			if n.VLAN == 0 {
+				continue
+			}
+
+			vlanName, err := vlanInterfaceName(n.VLANInterface, n.VLAN)
+			if err != nil {
+				return nil, err
+			}
+
+			err = render(vlanName+".netdev", networkdNetDevTemplate, networkdUnit{Name: vlanName, NetDevKind: "vlan", NetDevVLAN: n.VLAN})
+			if err != nil {
+				return nil, err
+			}
+
+			err = render(vlanName+".network", networkdNetworkTemplate, networkdUnit{Name: vlanName, Bridge: n.Bridge})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if n.Subnet == nil {
+			return nil, fmt.Errorf("No subnet known for network '%s'", n.Name)
+		}
+
+		ones, _ := n.Subnet.Mask.Size()
+		u := networkdUnit{
+			Name:       n.Name,
+			Addresses:  []string{fmt.Sprintf("%s/%d", n.Gateway, ones)},
+			IPForward:  "ipv4",
+			Masquerade: true,
+		}
+
+		// prefixes from the uplink are only known at runtime and assigned
+		// by ensureInterfaceAddress6
+		if n.IPv6Prefix != nil && !n.IPv6FromUplink {
+			u.Addresses = append(u.Addresses, ipv6Gateway(n.IPv6Prefix).String()+"/64")
+			u.IPForward = "yes"
+		}
+
+		if dhcpServer {
+			u.DHCPServer = true
+			u.PoolOffset = ipToUint32(n.DHCPStart) - ipToUint32(n.Subnet.IP)
+			u.PoolSize = ipToUint32(n.DHCPEnd) - ipToUint32(n.DHCPStart) + 1
+		}
+
+		err := render(n.Name+".network", networkdNetworkTemplate, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return units, nil
+}
+
+// installNetworkdUnits writes the units of the networks to dir and removes
+// the ones we installed before for other networks. It tells whether anything
+// changed, as only then networkd needs to reload them.
+func installNetworkdUnits(networks []network, dir string) (bool, error) {
+	units, err := generateNetworkdUnits(networks, opts.DHCP == "networkd")
+	if err != nil {
+		return false, fmt.Errorf("Failed to generate systemd-networkd units: %s", err.Error())
+	}
+
+	changed := false
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, f := range files {
+		_, ok := units[f.Name()]
+		if ok || !strings.HasPrefix(f.Name(), networkdUnitPrefix) {
+			continue
+		}
+
+		log.Debugf("Removing systemd-networkd unit '%s'", f.Name())
+		err = os.Remove(path.Join(dir, f.Name()))
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	var names []string
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		filename := path.Join(dir, name)
+		old, err := ioutil.ReadFile(filename)
+		if err == nil && string(old) == units[name] {
+			continue
+		}
+
+		log.Debugf("Writing systemd-networkd unit '%s'", filename)
+		err = writeFileCreatingDir(filename, []byte(units[name]), 0644)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNetworkdNetworks() []network {
+	_, subnet, _ := net.ParseCIDR("10.42.0.0/16")
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:1::/64")
+	return []network{
+		{
+			Name:       "wl_private",
+			Subnet:     subnet,
+			Gateway:    net.ParseIP("10.42.0.1").To4(),
+			DHCPStart:  net.ParseIP("10.42.0.10").To4(),
+			DHCPEnd:    net.ParseIP("10.42.255.254").To4(),
+			IPv6Prefix: prefix,
+		},
+		{Name: "wl_public", Bridge: "br-vlan20", VLAN: 20, VLANInterface: "eth0"},
+	}
+}
+
+func TestGenerateNetworkdUnits(t *testing.T) {
+	units, err := generateNetworkdUnits(testNetworkdNetworks(), true)
+	assert.Nil(t, err)
+	assert.Len(t, units, 5)
+
+	assert.Equal(t, `# generated by platform-hostapd
+[Match]
+Name=wl_private
+
+[Network]
+ConfigureWithoutCarrier=yes
+Address=10.42.0.1/16
+Address=2001:db8:0:1::1/64
+IPForward=yes
+IPMasquerade=yes
+DHCPServer=yes
+
+[DHCPServer]
+PoolOffset=10
+PoolSize=65525
+EmitDNS=yes
+`, units["50-platform-hostapd-wl_private.network"])
+
+	assert.Equal(t, `# generated by platform-hostapd
+[Match]
+Name=wl_public
+
+[Network]
+ConfigureWithoutCarrier=yes
+Bridge=br-vlan20
+`, units["50-platform-hostapd-wl_public.network"])
+
+	assert.Equal(t, `# generated by platform-hostapd
+[NetDev]
+Name=br-vlan20
+Kind=bridge
+`, units["50-platform-hostapd-br-vlan20.netdev"])
+
+	assert.Equal(t, `# generated by platform-hostapd
+[NetDev]
+Name=eth0.20
+Kind=vlan
+
+[VLAN]
+Id=20
+`, units["50-platform-hostapd-eth0.20.netdev"])
+
+	assert.Equal(t, `# generated by platform-hostapd
+[Match]
+Name=eth0.20
+
+[Network]
+ConfigureWithoutCarrier=yes
+Bridge=br-vlan20
+`, units["50-platform-hostapd-eth0.20.network"])
+}
+
+func TestGenerateNetworkdUnitsWithoutDHCPServer(t *testing.T) {
+	networks := testNetworkdNetworks()[:1]
+	networks[0].IPv6FromUplink = true
+
+	units, err := generateNetworkdUnits(networks, false)
+	assert.Nil(t, err)
+	assert.Equal(t, `# generated by platform-hostapd
+[Match]
+Name=wl_private
+
+[Network]
+ConfigureWithoutCarrier=yes
+Address=10.42.0.1/16
+IPForward=ipv4
+IPMasquerade=yes
+`, units["50-platform-hostapd-wl_private.network"])
+
+	_, err = generateNetworkdUnits([]network{{Name: "wl_private"}}, false)
+	assert.NotNil(t, err, "routed networks need a subnet")
+}
+
+func TestInstallNetworkdUnits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "10-eth0.network"), []byte("[Match]\nName=eth0\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "50-platform-hostapd-wl_old.network"), []byte("[Match]\nName=wl_old\n"), 0644)
+	assert.Nil(t, err)
+
+	networks := testNetworkdNetworks()
+	changed, err := installNetworkdUnits(networks, dir)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal(t, []string{
+		"10-eth0.network",
+		"50-platform-hostapd-br-vlan20.netdev",
+		"50-platform-hostapd-eth0.20.netdev",
+		"50-platform-hostapd-eth0.20.network",
+		"50-platform-hostapd-wl_private.network",
+		"50-platform-hostapd-wl_public.network",
+	}, names)
+
+	changed, err = installNetworkdUnits(networks, dir)
+	assert.Nil(t, err)
+	assert.False(t, changed, "unchanged units don't need a reload")
+
+	changed, err = installNetworkdUnits(networks[:1], dir)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	_, err = os.Stat(path.Join(dir, "50-platform-hostapd-wl_public.network"))
+	assert.True(t, os.IsNotExist(err))
+}
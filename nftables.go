@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+)
+
+// nftTableName is the table platform-hostapd owns in every family it uses.
+// Replacing or deleting it never touches rules of other platform components.
+const nftTableName = "platform_hostapd"
+
+const (
+	nfnlSubsysNFTables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+
+	nftMsgNewTable = 0
+	nftMsgGetTable = 1
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+	nftMsgNewSet   = 9
+	nftMsgNewElem  = 12
+	nftMsgDelElem  = 14
+
+	nfprotoInet = 1
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+
+	nfInetPreRouting  = 0
+	nfInetLocalIn     = 1
+	nfInetForward     = 2
+	nfInetPostRouting = 4
+)
+
+const (
+	nftaTableName = 1
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+
+	nftaListElem = 1
+	nftaExprName = 1
+	nftaExprData = 2
+
+	nftaDataValue   = 1
+	nftaDataVerdict = 2
+	nftaVerdictCode = 1
+
+	nftaMetaDreg = 1
+	nftaMetaKey  = 2
+	nftaMetaSreg = 3
+
+	nftaCmpSreg = 1
+	nftaCmpOp   = 2
+	nftaCmpData = 3
+
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+
+	nftaBitwiseSreg = 1
+	nftaBitwiseDreg = 2
+	nftaBitwiseLen  = 3
+	nftaBitwiseMask = 4
+	nftaBitwiseXor  = 5
+
+	nftaCtDreg = 1
+	nftaCtKey  = 2
+
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+
+	nftaSetTable   = 1
+	nftaSetName    = 2
+	nftaSetFlags   = 3
+	nftaSetKeyType = 4
+	nftaSetKeyLen  = 5
+	nftaSetID      = 10
+
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaSetElemListSetID    = 4
+
+	nftaSetElemKey     = 1
+	nftaSetElemTimeout = 4
+
+	nftaLookupSet   = 1
+	nftaLookupSreg  = 2
+	nftaLookupSetID = 4
+	nftaLookupFlags = 5
+
+	nftaRedirRegProtoMin = 1
+)
+
+const (
+	nftRegVerdict = 0
+	nftReg1       = 1
+
+	nftMetaMark    = 3
+	nftMetaIIFName = 6
+	nftMetaOIFName = 7
+	nftMetaNFProto = 15
+	nftMetaL4Proto = 16
+
+	nftCmpEq  = 0
+	nftCmpNeq = 1
+
+	nftPayloadLinkHeader      = 0
+	nftPayloadNetworkHeader   = 1
+	nftPayloadTransportHeader = 2
+
+	nftCtState = 0
+
+	ctStateEstablished = 0x2
+	ctStateRelated     = 0x4
+
+	nfDrop   = 0
+	nfAccept = 1
+
+	nftSetTimeout    = 0x10
+	nftLookupInverse = 1
+
+	// nft's own type ID for ether_addr, which 'nft list' uses to print keys
+	nftTypeEtherAddr = 9
+)
+
+var newNetfilterConn = func() (netlinkExecuter, error) {
+	return newNlConn(syscall.NETLINK_NETFILTER, 0)
+}
+
+// nftablesSupported checks whether the kernel answers nf_tables requests at all
+func nftablesSupported() bool {
+	conn, err := newNetfilterConn()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_, err = conn.Execute(nlRequest{
+		Type:  nfnlSubsysNFTables<<8 | nftMsgGetTable,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+		Data:  nfgenmsg(syscall.AF_UNSPEC, 0),
+	})
+	return err == nil
+}
+
+type nftablesFirewall struct{}
+
+func newNFTablesFirewall() *nftablesFirewall {
+	return &nftablesFirewall{}
+}
+
+func (f *nftablesFirewall) Apply(cfg *firewallConfig) error {
+	b := &nftBatch{}
+	b.replaceTable(nfprotoInet)
+	b.replaceTable(nfprotoIPv4)
+
+	b.addBaseChain(nfprotoInet, "input", "filter", nfInetLocalIn, 0)
+	b.addBaseChain(nfprotoInet, "forward", "filter", nfInetForward, 0)
+	b.addBaseChain(nfprotoIPv4, "postrouting", "nat", nfInetPostRouting, 100)
+	if cfg.hasPortal() {
+		b.addBaseChain(nfprotoIPv4, "prerouting", "nat", nfInetPreRouting, -100)
+	}
+
+	for _, n := range cfg.Networks {
+		if n.ShapingMark != 0 {
+			b.addRule(nfprotoInet, "forward",
+				nftMatchIfName(nftMetaIIFName, n.Interface),
+				nftSetMark(n.ShapingMark))
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		if n.Portal {
+			b.addPortalRules(n)
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		if n.Isolate {
+			b.addIsolationRules(cfg, n)
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchIfName(nftMetaOIFName, cfg.Uplink),
+			nftMatchCtState(ctStateEstablished|ctStateRelated),
+			nftVerdict(nfAccept))
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, cfg.Uplink),
+			nftMatchIfName(nftMetaOIFName, n.Interface),
+			nftMatchNFProto(nfprotoIPv4),
+			nftVerdict(nfAccept))
+		if n.IPv6Prefix != nil {
+			b.addInboundIPv6Rules(cfg, n)
+		}
+	}
+
+	for _, n := range cfg.Networks {
+		b.addRule(nfprotoIPv4, "postrouting",
+			nftMatchIfName(nftMetaOIFName, cfg.Uplink),
+			nftMatchIPv4Net(12, n.Subnet),
+			nftExpr("masq", nil))
+	}
+
+	return b.commit()
+}
+
+func (f *nftablesFirewall) Remove(cfg *firewallConfig) error {
+	return f.RemoveAll()
+}
+
+// RemoveAll deletes our tables, which hold all of our rules and sets
+func (f *nftablesFirewall) RemoveAll() error {
+	b := &nftBatch{}
+	b.deleteTable(nfprotoInet)
+	b.deleteTable(nfprotoIPv4)
+	return b.commit()
+}
+
+// addInboundIPv6Rules only lets replies and ICMPv6 errors in from the uplink,
+// as the routed IPv6 prefixes aren't hidden behind the masquerade
+func (b *nftBatch) addInboundIPv6Rules(cfg *firewallConfig, n firewallNetwork) {
+	b.addRule(nfprotoInet, "forward",
+		nftMatchIfName(nftMetaIIFName, cfg.Uplink),
+		nftMatchIfName(nftMetaOIFName, n.Interface),
+		nftMatchNFProto(nfprotoIPv6),
+		nftMatchCtState(ctStateEstablished|ctStateRelated),
+		nftVerdict(nfAccept))
+
+	for _, typ := range icmpv6InboundTypes {
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, cfg.Uplink),
+			nftMatchIfName(nftMetaOIFName, n.Interface),
+			nftMatchNFProto(nfprotoIPv6),
+			nftMatchICMPv6Type(typ),
+			nftVerdict(nfAccept))
+	}
+
+	b.addRule(nfprotoInet, "forward",
+		nftMatchIfName(nftMetaIIFName, cfg.Uplink),
+		nftMatchIfName(nftMetaOIFName, n.Interface),
+		nftMatchNFProto(nfprotoIPv6),
+		nftVerdict(nfDrop))
+}
+
+// addIsolationRules keeps an isolated network away from the LAN and the other
+// AP networks, apart from its allowlist, and from the host, apart from DHCP,
+// DNS and, with IPv6, neighbor discovery
+func (b *nftBatch) addIsolationRules(cfg *firewallConfig, n firewallNetwork) {
+	for _, allowed := range n.LANAllowlist {
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchDestination(allowed),
+			nftVerdict(nfAccept))
+	}
+
+	for _, other := range cfg.Networks {
+		if other.Interface == n.Interface {
+			continue
+		}
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchIfName(nftMetaOIFName, other.Interface),
+			nftVerdict(nfDrop))
+	}
+
+	for _, lan := range mustParseCIDRs(append(lanSubnets, lanSubnets6...)) {
+		b.addRule(nfprotoInet, "forward",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchDestination(lan),
+			nftVerdict(nfDrop))
+	}
+
+	if n.IPv6Prefix != nil {
+		b.addRule(nfprotoInet, "input",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchL4Proto(syscall.IPPROTO_ICMPV6),
+			nftVerdict(nfAccept))
+	}
+
+	for _, p := range isolationPorts {
+		b.addRule(nfprotoInet, "input",
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchDport(p.Proto, p.Port),
+			nftVerdict(nfAccept))
+	}
+
+	b.addRule(nfprotoInet, "input",
+		nftMatchIfName(nftMetaIIFName, n.Interface),
+		nftVerdict(nfDrop))
+}
+
+// Update simply replaces the whole table, which nf_tables does atomically
+func (f *nftablesFirewall) Update(old, new *firewallConfig) error {
+	return f.Apply(new)
+}
+
+// nftPortalSetID identifies the portal set of a network in the batch creating
+// it, which rules added in the same batch refer to
+func nftPortalSetID(family uint8, iface string) uint32 {
+	id := uint32(family) << 24
+	for _, c := range iface {
+		id = id*31 + uint32(c)
+	}
+	return id & 0x7fffffff
+}
+
+func nftPortalSetName(iface string) string {
+	return "portal_" + iface
+}
+
+// addPortalRules keeps clients of a captive portal network that haven't
+// logged in yet off the uplink. Their DNS goes to our resolver and their HTTP
+// to the portal. The allowed clients are kept in a set per table, whose
+// elements expire when the session does.
+func (b *nftBatch) addPortalRules(n firewallNetwork) {
+	for _, family := range []uint8{nfprotoInet, nfprotoIPv4} {
+		b.addSet(family, nftPortalSetName(n.Interface), nftPortalSetID(family, n.Interface))
+		if len(n.PortalClients) > 0 {
+			b.addSetElems(nftMsgNewElem, family, n.Interface, n.PortalClients, syscall.NLM_F_CREATE)
+		}
+	}
+
+	notAllowed := func(family uint8) []byte {
+		return concatBytes(
+			nftMatchIfName(nftMetaIIFName, n.Interface),
+			nftMatchEtherSaddrNotIn(nftPortalSetName(n.Interface), nftPortalSetID(family, n.Interface)))
+	}
+
+	b.addRule(nfprotoInet, "forward", notAllowed(nfprotoInet), nftVerdict(nfDrop))
+	b.addRule(nfprotoInet, "input",
+		nftMatchIfName(nftMetaIIFName, n.Interface),
+		nftMatchDport("tcp", n.PortalPort),
+		nftVerdict(nfAccept))
+
+	b.addRule(nfprotoIPv4, "prerouting", notAllowed(nfprotoIPv4), nftMatchDport("tcp", 80), nftRedirect(n.PortalPort))
+	b.addRule(nfprotoIPv4, "prerouting", notAllowed(nfprotoIPv4), nftMatchDport("udp", 53), nftRedirect(53))
+	b.addRule(nfprotoIPv4, "prerouting", notAllowed(nfprotoIPv4), nftMatchDport("tcp", 53), nftRedirect(53))
+}
+
+func (b *nftBatch) addSet(family uint8, name string, id uint32) {
+	b.add(nftMsgNewSet, family, syscall.NLM_F_CREATE,
+		nlAttrString(nftaSetTable, nftTableName),
+		nlAttrString(nftaSetName, name),
+		nlAttrBE32(nftaSetFlags, nftSetTimeout),
+		nlAttrBE32(nftaSetKeyType, nftTypeEtherAddr),
+		nlAttrBE32(nftaSetKeyLen, 6),
+		nlAttrBE32(nftaSetID, id))
+}
+
+func (b *nftBatch) addSetElems(msgType uint16, family uint8, iface string, clients []portalClient, flags uint16) {
+	var elems [][]byte
+	for _, c := range clients {
+		attrs := [][]byte{nlAttrNested(nftaSetElemKey, nlAttr(nftaDataValue, c.MAC))}
+		if msgType == nftMsgNewElem {
+			timeout := make([]byte, 8)
+			binary.BigEndian.PutUint64(timeout, uint64(c.Timeout/time.Millisecond))
+			attrs = append(attrs, nlAttr(nftaSetElemTimeout, timeout))
+		}
+		elems = append(elems, nlAttrNested(nftaListElem, attrs...))
+	}
+
+	b.add(msgType, family, flags,
+		nlAttrString(nftaSetElemListTable, nftTableName),
+		nlAttrString(nftaSetElemListSet, nftPortalSetName(iface)),
+		nlAttrBE32(nftaSetElemListSetID, nftPortalSetID(family, iface)),
+		nlAttrNested(nftaSetElemListElements, elems...))
+}
+
+// AllowClient lets a client past the captive portal of iface for timeout.
+// The element is added before it is deleted and added again, so the timeout
+// of a client that is already allowed starts over.
+func (f *nftablesFirewall) AllowClient(iface string, mac net.HardwareAddr, timeout time.Duration) error {
+	clients := []portalClient{{MAC: mac, Timeout: timeout}}
+
+	b := &nftBatch{}
+	for _, family := range []uint8{nfprotoInet, nfprotoIPv4} {
+		b.addSetElems(nftMsgNewElem, family, iface, clients, syscall.NLM_F_CREATE)
+		b.addSetElems(nftMsgDelElem, family, iface, clients, 0)
+		b.addSetElems(nftMsgNewElem, family, iface, clients, syscall.NLM_F_CREATE)
+	}
+	return b.commit()
+}
+
+// RevokeClient removes a client from the portal sets, adding it first so that
+// removing a client that isn't there doesn't fail
+func (f *nftablesFirewall) RevokeClient(iface string, mac net.HardwareAddr) error {
+	clients := []portalClient{{MAC: mac, Timeout: time.Second}}
+
+	b := &nftBatch{}
+	for _, family := range []uint8{nfprotoInet, nfprotoIPv4} {
+		b.addSetElems(nftMsgNewElem, family, iface, clients, syscall.NLM_F_CREATE)
+		b.addSetElems(nftMsgDelElem, family, iface, clients, 0)
+	}
+	return b.commit()
+}
+
+func nfgenmsg(family uint8, resID uint16) []byte {
+	return []byte{family, 0, byte(resID >> 8), byte(resID)}
+}
+
+// nftBatch collects nf_tables messages which the kernel applies as one
+// transaction, so a half-applied rule set is never visible.
+type nftBatch struct {
+	reqs []nlRequest
+}
+
+func (b *nftBatch) add(msgType uint16, family uint8, flags uint16, attrs ...[]byte) {
+	b.reqs = append(b.reqs, nlRequest{
+		Type:  nfnlSubsysNFTables<<8 | msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Data:  append(nfgenmsg(family, 0), concatBytes(attrs...)...),
+	})
+}
+
+// replaceTable creates our table empty, dropping whatever an earlier run left
+// behind. Adding it before deleting keeps the delete from failing on a clean
+// system.
+func (b *nftBatch) replaceTable(family uint8) {
+	b.deleteTable(family)
+	b.add(nftMsgNewTable, family, syscall.NLM_F_CREATE, nlAttrString(nftaTableName, nftTableName))
+}
+
+func (b *nftBatch) deleteTable(family uint8) {
+	b.add(nftMsgNewTable, family, syscall.NLM_F_CREATE, nlAttrString(nftaTableName, nftTableName))
+	b.add(nftMsgDelTable, family, 0, nlAttrString(nftaTableName, nftTableName))
+}
+
+func (b *nftBatch) addBaseChain(family uint8, name, chainType string, hook uint32, priority int32) {
+	b.add(nftMsgNewChain, family, syscall.NLM_F_CREATE,
+		nlAttrString(nftaChainTable, nftTableName),
+		nlAttrString(nftaChainName, name),
+		nlAttrNested(nftaChainHook,
+			nlAttrBE32(nftaHookHooknum, hook),
+			nlAttrBE32(nftaHookPriority, uint32(priority))),
+		nlAttrBE32(nftaChainPolicy, nfAccept),
+		nlAttrString(nftaChainType, chainType))
+}
+
+func (b *nftBatch) addRule(family uint8, chain string, exprs ...[]byte) {
+	b.add(nftMsgNewRule, family, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND,
+		nlAttrString(nftaRuleTable, nftTableName),
+		nlAttrString(nftaRuleChain, chain),
+		nlAttrNested(nftaRuleExpressions, exprs...))
+}
+
+func (b *nftBatch) requests() []nlRequest {
+	begin := nlRequest{
+		Type:  nfnlMsgBatchBegin,
+		Flags: syscall.NLM_F_REQUEST,
+		Data:  nfgenmsg(syscall.AF_UNSPEC, nfnlSubsysNFTables),
+	}
+	end := nlRequest{
+		Type:  nfnlMsgBatchEnd,
+		Flags: syscall.NLM_F_REQUEST,
+		Data:  nfgenmsg(syscall.AF_UNSPEC, nfnlSubsysNFTables),
+	}
+
+	reqs := append([]nlRequest{begin}, b.reqs...)
+	return append(reqs, end)
+}
+
+func (b *nftBatch) commit() error {
+	conn, err := newNetfilterConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Execute(b.requests()...)
+	return err
+}
+
+// nftExpr wraps already encoded expression attributes into a list element.
+// Each helper below returns the concatenation of one or more such elements.
+func nftExpr(name string, data []byte) []byte {
+	attrs := [][]byte{nlAttrString(nftaExprName, name)}
+	if data != nil {
+		attrs = append(attrs, nlAttrNested(nftaExprData, data))
+	}
+	return nlAttrNested(nftaListElem, attrs...)
+}
+
+func nftCmp(op uint32, value []byte) []byte {
+	return nftExpr("cmp", concatBytes(
+		nlAttrBE32(nftaCmpSreg, nftReg1),
+		nlAttrBE32(nftaCmpOp, op),
+		nlAttrNested(nftaCmpData, nlAttr(nftaDataValue, value))))
+}
+
+// nftMatchIfName matches the in- or outgoing interface name exactly
+func nftMatchIfName(key uint32, name string) []byte {
+	ifname := make([]byte, syscall.IFNAMSIZ)
+	copy(ifname, name)
+
+	return concatBytes(
+		nftExpr("meta", concatBytes(
+			nlAttrBE32(nftaMetaKey, key),
+			nlAttrBE32(nftaMetaDreg, nftReg1))),
+		nftCmp(nftCmpEq, ifname))
+}
+
+func nftMatchNFProto(proto uint8) []byte {
+	return concatBytes(
+		nftExpr("meta", concatBytes(
+			nlAttrBE32(nftaMetaKey, nftMetaNFProto),
+			nlAttrBE32(nftaMetaDreg, nftReg1))),
+		nftCmp(nftCmpEq, []byte{proto}))
+}
+
+func nftMatchL4Proto(proto uint8) []byte {
+	return concatBytes(
+		nftExpr("meta", concatBytes(
+			nlAttrBE32(nftaMetaKey, nftMetaL4Proto),
+			nlAttrBE32(nftaMetaDreg, nftReg1))),
+		nftCmp(nftCmpEq, []byte{proto}))
+}
+
+// nftMatchDport matches the destination port of 'tcp' or 'udp' traffic
+func nftMatchDport(proto string, port uint16) []byte {
+	l4proto := uint8(syscall.IPPROTO_UDP)
+	if proto == "tcp" {
+		l4proto = syscall.IPPROTO_TCP
+	}
+
+	return concatBytes(
+		nftMatchL4Proto(l4proto),
+		nftExpr("payload", concatBytes(
+			nlAttrBE32(nftaPayloadDreg, nftReg1),
+			nlAttrBE32(nftaPayloadBase, nftPayloadTransportHeader),
+			nlAttrBE32(nftaPayloadOffset, 2),
+			nlAttrBE32(nftaPayloadLen, 2))),
+		nftCmp(nftCmpEq, []byte{byte(port >> 8), byte(port)}))
+}
+
+// nftMatchICMPv6Type matches ICMPv6 messages of the given type
+func nftMatchICMPv6Type(typ uint8) []byte {
+	return concatBytes(
+		nftMatchL4Proto(syscall.IPPROTO_ICMPV6),
+		nftExpr("payload", concatBytes(
+			nlAttrBE32(nftaPayloadDreg, nftReg1),
+			nlAttrBE32(nftaPayloadBase, nftPayloadTransportHeader),
+			nlAttrBE32(nftaPayloadOffset, 0),
+			nlAttrBE32(nftaPayloadLen, 1))),
+		nftCmp(nftCmpEq, []byte{typ}))
+}
+
+func nftMatchCtState(mask uint32) []byte {
+	maskData := make([]byte, 4)
+	nativeEndian.PutUint32(maskData, mask)
+
+	return concatBytes(
+		nftExpr("ct", concatBytes(
+			nlAttrBE32(nftaCtKey, nftCtState),
+			nlAttrBE32(nftaCtDreg, nftReg1))),
+		nftBitwise(maskData),
+		nftCmp(nftCmpNeq, make([]byte, 4)))
+}
+
+// nftMatchIPv4Net matches the IPv4 address at the given network header offset
+// (12 for the source, 16 for the destination) against a subnet.
+func nftMatchIPv4Net(offset uint32, subnet *net.IPNet) []byte {
+	return concatBytes(
+		nftExpr("payload", concatBytes(
+			nlAttrBE32(nftaPayloadDreg, nftReg1),
+			nlAttrBE32(nftaPayloadBase, nftPayloadNetworkHeader),
+			nlAttrBE32(nftaPayloadOffset, offset),
+			nlAttrBE32(nftaPayloadLen, 4))),
+		nftBitwise([]byte(net.IP(subnet.Mask).To4())),
+		nftCmp(nftCmpEq, []byte(subnet.IP.Mask(subnet.Mask).To4())))
+}
+
+// nftMatchIPv6Net matches the IPv6 destination address against a subnet
+func nftMatchIPv6Net(subnet *net.IPNet) []byte {
+	return concatBytes(
+		nftExpr("payload", concatBytes(
+			nlAttrBE32(nftaPayloadDreg, nftReg1),
+			nlAttrBE32(nftaPayloadBase, nftPayloadNetworkHeader),
+			nlAttrBE32(nftaPayloadOffset, 24),
+			nlAttrBE32(nftaPayloadLen, 16))),
+		nftBitwise([]byte(net.IP(subnet.Mask).To16())),
+		nftCmp(nftCmpEq, []byte(subnet.IP.Mask(subnet.Mask).To16())))
+}
+
+// nftMatchDestination matches the destination of traffic of the subnet's
+// address family, which the inet tables have to check first
+func nftMatchDestination(subnet *net.IPNet) []byte {
+	if subnet.IP.To4() != nil {
+		return concatBytes(nftMatchNFProto(nfprotoIPv4), nftMatchIPv4Net(16, subnet))
+	}
+	return concatBytes(nftMatchNFProto(nfprotoIPv6), nftMatchIPv6Net(subnet))
+}
+
+// nftMatchEtherSaddrNotIn matches frames whose source MAC isn't in the set
+func nftMatchEtherSaddrNotIn(set string, setID uint32) []byte {
+	return concatBytes(
+		nftExpr("payload", concatBytes(
+			nlAttrBE32(nftaPayloadDreg, nftReg1),
+			nlAttrBE32(nftaPayloadBase, nftPayloadLinkHeader),
+			nlAttrBE32(nftaPayloadOffset, 6),
+			nlAttrBE32(nftaPayloadLen, 6))),
+		nftExpr("lookup", concatBytes(
+			nlAttrString(nftaLookupSet, set),
+			nlAttrBE32(nftaLookupSreg, nftReg1),
+			nlAttrBE32(nftaLookupSetID, setID),
+			nlAttrBE32(nftaLookupFlags, nftLookupInverse))))
+}
+
+// nftSetMark sets the packet mark and goes on with the next rule
+func nftSetMark(mark uint32) []byte {
+	value := make([]byte, 4)
+	nativeEndian.PutUint32(value, mark)
+
+	return concatBytes(
+		nftExpr("immediate", concatBytes(
+			nlAttrBE32(nftaImmediateDreg, nftReg1),
+			nlAttrNested(nftaImmediateData, nlAttr(nftaDataValue, value)))),
+		nftExpr("meta", concatBytes(
+			nlAttrBE32(nftaMetaKey, nftMetaMark),
+			nlAttrBE32(nftaMetaSreg, nftReg1))))
+}
+
+// nftRedirect sends the packet to the given port on the host
+func nftRedirect(port uint16) []byte {
+	return concatBytes(
+		nftExpr("immediate", concatBytes(
+			nlAttrBE32(nftaImmediateDreg, nftReg1),
+			nlAttrNested(nftaImmediateData, nlAttr(nftaDataValue, []byte{byte(port >> 8), byte(port)})))),
+		nftExpr("redir", nlAttrBE32(nftaRedirRegProtoMin, nftReg1)))
+}
+
+func nftBitwise(mask []byte) []byte {
+	return nftExpr("bitwise", concatBytes(
+		nlAttrBE32(nftaBitwiseSreg, nftReg1),
+		nlAttrBE32(nftaBitwiseDreg, nftReg1),
+		nlAttrBE32(nftaBitwiseLen, uint32(len(mask))),
+		nlAttrNested(nftaBitwiseMask, nlAttr(nftaDataValue, mask)),
+		nlAttrNested(nftaBitwiseXor, nlAttr(nftaDataValue, make([]byte, len(mask))))))
+}
+
+func nftVerdict(code uint32) []byte {
+	return nftExpr("immediate", concatBytes(
+		nlAttrBE32(nftaImmediateDreg, nftRegVerdict),
+		nlAttrNested(nftaImmediateData,
+			nlAttrNested(nftaDataVerdict, nlAttrBE32(nftaVerdictCode, code)))))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withMockNetfilter(conn *mockNetlinkConn) func() {
+	orig := newNetfilterConn
+	newNetfilterConn = func() (netlinkExecuter, error) {
+		return conn, nil
+	}
+	return func() { newNetfilterConn = orig }
+}
+
+func testFirewallConfig() *firewallConfig {
+	_, private, _ := net.ParseCIDR("10.42.0.0/16")
+	_, public, _ := net.ParseCIDR("10.43.0.0/16")
+	return &firewallConfig{
+		Uplink: "eth0",
+		Networks: []firewallNetwork{
+			{Interface: "wl_private", Subnet: private},
+			{Interface: "wl_public", Subnet: public},
+		},
+	}
+}
+
+func nftMsgTypes(reqs []nlRequest) []uint16 {
+	var types []uint16
+	for _, r := range reqs {
+		types = append(types, r.Type)
+	}
+	return types
+}
+
+func TestNFTablesApply(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	err := newNFTablesFirewall().Apply(testFirewallConfig())
+	assert.Nil(t, err)
+	assert.Len(t, conn.Requests, 1, "everything must be sent as one batch")
+
+	const sub = nfnlSubsysNFTables << 8
+	reqs := conn.Requests[0]
+	assert.Equal(t, []uint16{
+		nfnlMsgBatchBegin,
+		sub | nftMsgNewTable, sub | nftMsgDelTable, sub | nftMsgNewTable,
+		sub | nftMsgNewTable, sub | nftMsgDelTable, sub | nftMsgNewTable,
+		sub | nftMsgNewChain, sub | nftMsgNewChain, sub | nftMsgNewChain,
+		sub | nftMsgNewRule, sub | nftMsgNewRule, sub | nftMsgNewRule, sub | nftMsgNewRule,
+		sub | nftMsgNewRule, sub | nftMsgNewRule,
+		nfnlMsgBatchEnd,
+	}, nftMsgTypes(reqs))
+
+	assert.Equal(t, []byte{syscall.AF_UNSPEC, 0, 0, nfnlSubsysNFTables}, reqs[0].Data)
+	assert.Equal(t, byte(nfprotoInet), reqs[1].Data[0])
+	assert.Equal(t, byte(nfprotoIPv4), reqs[4].Data[0])
+
+	attrs, err := parseNlAttrs(reqs[1].Data[4:])
+	assert.Nil(t, err)
+	assert.Equal(t, nftTableName+"\x00", string(attrs[0].Data))
+
+	// the masquerade rule for the public network
+	rule := reqs[15]
+	assert.Equal(t, byte(nfprotoIPv4), rule.Data[0])
+	assert.True(t, bytes.Contains(rule.Data, []byte("postrouting\x00")))
+	assert.True(t, bytes.Contains(rule.Data, []byte("masq\x00")))
+	assert.True(t, bytes.Contains(rule.Data, []byte{10, 43, 0, 0}))
+	assert.True(t, bytes.Contains(rule.Data, []byte("eth0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")))
+}
+
+func TestNFTablesRemove(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	err := newNFTablesFirewall().Remove(testFirewallConfig())
+	assert.Nil(t, err)
+
+	const sub = nfnlSubsysNFTables << 8
+	assert.Equal(t, []uint16{
+		nfnlMsgBatchBegin,
+		sub | nftMsgNewTable, sub | nftMsgDelTable,
+		sub | nftMsgNewTable, sub | nftMsgDelTable,
+		nfnlMsgBatchEnd,
+	}, nftMsgTypes(conn.Requests[0]))
+}
+
+func TestNFTablesSupported(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	assert.True(t, nftablesSupported())
+
+	conn.Err = syscall.EOPNOTSUPP
+	assert.False(t, nftablesSupported())
+}
+
+func TestNFTablesIsolation(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].Isolate = true
+	cfg.Networks[1].LANAllowlist = mustParseCIDRs([]string{"192.168.1.10/32"})
+
+	err := newNFTablesFirewall().Apply(cfg)
+	assert.Nil(t, err)
+
+	var forward, input [][]byte
+	for _, r := range conn.Requests[0] {
+		if r.Type != nfnlSubsysNFTables<<8|nftMsgNewRule {
+			continue
+		}
+		if bytes.Contains(r.Data, []byte("forward\x00")) {
+			forward = append(forward, r.Data)
+		} else if bytes.Contains(r.Data, []byte("input\x00")) {
+			input = append(input, r.Data)
+		}
+	}
+
+	// allowlist, the other AP network, four IPv4 and one IPv6 LAN range,
+	// then the two regular rules per network
+	assert.Len(t, forward, 1+1+4+1+4)
+	assert.True(t, bytes.Contains(forward[0], []byte{192, 168, 1, 10}))
+	assert.True(t, bytes.Contains(forward[1], []byte("wl_private\x00")))
+	assert.True(t, bytes.Contains(forward[2], []byte{10, 0, 0, 0}))
+	assert.True(t, bytes.Contains(forward[6], []byte{0xfc}))
+
+	// DHCP, DNS over UDP and TCP, then drop
+	assert.Len(t, input, 4)
+	assert.True(t, bytes.Contains(input[0], []byte{0, 67}))
+	assert.True(t, bytes.Contains(input[2], []byte{syscall.IPPROTO_TCP}))
+	for _, r := range append(forward[:7], input...) {
+		assert.True(t, bytes.Contains(r, []byte("wl_public\x00")))
+	}
+}
+
+func TestNFTablesIsolationIPv6(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].Isolate = true
+	cfg.Networks[1].IPv6Prefix = mustParseCIDRs([]string{"2001:db8:0:2::/64"})[0]
+	cfg.Networks[1].LANAllowlist = mustParseCIDRs([]string{"fd00::10/128"})
+
+	err := newNFTablesFirewall().Apply(cfg)
+	assert.Nil(t, err)
+
+	var input [][]byte
+	for _, r := range conn.Requests[0] {
+		if r.Type == nfnlSubsysNFTables<<8|nftMsgNewRule && bytes.Contains(r.Data, []byte("input\x00")) {
+			input = append(input, r.Data)
+		}
+	}
+
+	// ICMPv6 first, then DHCP, DNS over UDP and TCP and drop
+	assert.Len(t, input, 5)
+	assert.True(t, bytes.Contains(input[0], []byte{syscall.IPPROTO_ICMPV6}))
+
+	allowed := net.ParseIP("fd00::10")
+	found := false
+	for _, r := range conn.Requests[0] {
+		if bytes.Contains(r.Data, allowed) && bytes.Contains(r.Data, []byte{nfprotoIPv6}) {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestNFTablesInboundIPv6(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].IPv6Prefix = mustParseCIDRs([]string{"2001:db8:0:2::/64"})[0]
+
+	err := newNFTablesFirewall().Apply(cfg)
+	assert.Nil(t, err)
+
+	var forward [][]byte
+	for _, r := range conn.Requests[0] {
+		if r.Type == nfnlSubsysNFTables<<8|nftMsgNewRule && bytes.Contains(r.Data, []byte("forward\x00")) &&
+			bytes.Contains(r.Data, []byte("wl_public\x00")) {
+			forward = append(forward, r.Data)
+		}
+	}
+
+	// out with state, IPv4 in, IPv6 replies, the ICMPv6 types and the drop
+	assert.Len(t, forward, 3+len(icmpv6InboundTypes)+1)
+	assert.False(t, bytes.Contains(forward[1], []byte("ct\x00")))
+	assert.True(t, bytes.Contains(forward[2], []byte("ct\x00")), "only replies may come in over IPv6")
+	for i, typ := range icmpv6InboundTypes {
+		assert.True(t, bytes.Contains(forward[3+i], []byte("payload\x00")))
+		assert.True(t, bytes.Contains(forward[3+i], []byte{typ}))
+	}
+	assert.False(t, bytes.Contains(forward[len(forward)-1], []byte("ct\x00")))
+}
+
+func TestNFTablesPortal(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	cfg := testFirewallConfig()
+	cfg.Networks[1].Portal = true
+	cfg.Networks[1].PortalPort = 8880
+	cfg.Networks[1].PortalClients = []portalClient{{MAC: mac, Timeout: time.Hour}}
+
+	fw := newNFTablesFirewall()
+	err := fw.Apply(cfg)
+	assert.Nil(t, err)
+
+	types := nftMsgTypes(conn.Requests[0])
+	count := func(msgType uint16) int {
+		n := 0
+		for _, typ := range types {
+			if typ == nfnlSubsysNFTables<<8|msgType {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 4, count(nftMsgNewChain), "prerouting is only added for portals")
+	assert.Equal(t, 2, count(nftMsgNewSet))
+	assert.Equal(t, 2, count(nftMsgNewElem))
+
+	var redirects int
+	for _, r := range conn.Requests[0] {
+		if bytes.Contains(r.Data, []byte("redir\x00")) {
+			redirects++
+			assert.True(t, bytes.Contains(r.Data, []byte("portal_wl_public\x00")))
+		}
+	}
+	assert.Equal(t, 3, redirects)
+
+	err = fw.AllowClient("wl_public", mac, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{
+		nfnlMsgBatchBegin,
+		nfnlSubsysNFTables<<8 | nftMsgNewElem, nfnlSubsysNFTables<<8 | nftMsgDelElem, nfnlSubsysNFTables<<8 | nftMsgNewElem,
+		nfnlSubsysNFTables<<8 | nftMsgNewElem, nfnlSubsysNFTables<<8 | nftMsgDelElem, nfnlSubsysNFTables<<8 | nftMsgNewElem,
+		nfnlMsgBatchEnd,
+	}, nftMsgTypes(conn.Requests[1]))
+}
+
+func TestNFTablesShapingMark(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockNetfilter(conn)()
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].ShapingMark = shapingMark("wl_public")
+
+	err := newNFTablesFirewall().Apply(cfg)
+	assert.Nil(t, err)
+
+	mark := make([]byte, 4)
+	nativeEndian.PutUint32(mark, shapingMark("wl_public"))
+
+	var marked int
+	for _, r := range conn.Requests[0] {
+		if bytes.Contains(r.Data, mark) {
+			marked++
+			assert.True(t, bytes.Contains(r.Data, []byte("forward\x00")))
+			assert.True(t, bytes.Contains(r.Data, []byte("wl_public\x00")))
+		}
+	}
+	assert.Equal(t, 1, marked)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// nlgo only gives us generic netlink, so the netlink families we need beyond
+// nl80211 (nf_tables, rtnetlink) are spoken through this small raw socket
+// wrapper.
+
+const (
+	nlaHeaderLen = 4
+	nlaTypeMask  = ^uint16(syscall.NLA_F_NESTED | 0x4000)
+)
+
+// nativeEndian is the byte order of the host, which netlink uses for every
+// header and for most attribute payloads.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func nlaAlign(l int) int {
+	return (l + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
+
+func nlmsgAlign(l int) int {
+	return (l + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+// nlAttr encodes a single netlink attribute including its padding
+func nlAttr(typ uint16, data []byte) []byte {
+	l := nlaHeaderLen + len(data)
+	b := make([]byte, nlaAlign(l))
+	nativeEndian.PutUint16(b[0:2], uint16(l))
+	nativeEndian.PutUint16(b[2:4], typ)
+	copy(b[nlaHeaderLen:], data)
+	return b
+}
+
+func nlAttrNested(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ|syscall.NLA_F_NESTED, concatBytes(attrs...))
+}
+
+func nlAttrString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+func nlAttrU8(typ uint16, v uint8) []byte {
+	return nlAttr(typ, []byte{v})
+}
+
+func nlAttrU16(typ uint16, v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return nlAttr(typ, b)
+}
+
+func nlAttrU32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return nlAttr(typ, b)
+}
+
+func nlAttrBE32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return nlAttr(typ, b)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+type nlAttribute struct {
+	Type uint16
+	Data []byte
+}
+
+func parseNlAttrs(b []byte) ([]nlAttribute, error) {
+	var attrs []nlAttribute
+	for len(b) >= nlaHeaderLen {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < nlaHeaderLen || l > len(b) {
+			return nil, fmt.Errorf("malformed netlink attribute of length %d", l)
+		}
+		attrs = append(attrs, nlAttribute{
+			Type: nativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			Data: b[nlaHeaderLen:l],
+		})
+
+		next := nlaAlign(l)
+		if next > len(b) {
+			next = len(b)
+		}
+		b = b[next:]
+	}
+
+	return attrs, nil
+}
+
+type nlRequest struct {
+	Type  uint16
+	Flags uint16
+	Data  []byte
+}
+
+type netlinkExecuter interface {
+	Execute(...nlRequest) ([]syscall.NetlinkMessage, error)
+	Close() error
+}
+
+type netlinkReceiver interface {
+	Receive() ([]syscall.NetlinkMessage, error)
+	Close() error
+}
+
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func newNlConn(protocol int, groups uint32) (*nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	return &nlConn{fd: fd, seq: uint32(time.Now().Unix())}, nil
+}
+
+func (c *nlConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// Execute sends all requests in a single datagram, which is what nf_tables
+// needs for its batches, and collects the replies. Every request carrying
+// NLM_F_ACK or NLM_F_DUMP is waited for; the first error reply is returned.
+func (c *nlConn) Execute(reqs ...nlRequest) ([]syscall.NetlinkMessage, error) {
+	var buf []byte
+	pending := make(map[uint32]bool)
+
+	for _, r := range reqs {
+		c.seq++
+		l := syscall.NLMSG_HDRLEN + len(r.Data)
+		msg := make([]byte, nlmsgAlign(l))
+		nativeEndian.PutUint32(msg[0:4], uint32(l))
+		nativeEndian.PutUint16(msg[4:6], r.Type)
+		nativeEndian.PutUint16(msg[6:8], r.Flags)
+		nativeEndian.PutUint32(msg[8:12], c.seq)
+		copy(msg[syscall.NLMSG_HDRLEN:], r.Data)
+		buf = append(buf, msg...)
+
+		if r.Flags&(syscall.NLM_F_ACK|syscall.NLM_F_DUMP) != 0 {
+			pending[c.seq] = true
+		}
+	}
+
+	err := syscall.Sendto(c.fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var replies []syscall.NetlinkMessage
+	for len(pending) > 0 {
+		msgs, err := c.Receive()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if !pending[m.Header.Seq] {
+				continue
+			}
+
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				delete(pending, m.Header.Seq)
+				if err := nlErrno(m); err != nil {
+					return nil, err
+				}
+			case syscall.NLMSG_DONE:
+				delete(pending, m.Header.Seq)
+			default:
+				replies = append(replies, m)
+			}
+		}
+	}
+
+	return replies, nil
+}
+
+// SetReceiveTimeout makes Receive return without messages after d, so that
+// monitoring loops get a chance to notice they should stop.
+func (c *nlConn) SetReceiveTimeout(d time.Duration) error {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv))
+}
+
+// Receive reads one datagram from the socket. It is used directly for
+// multicast notifications.
+func (c *nlConn) Receive() ([]syscall.NetlinkMessage, error) {
+	rb := make([]byte, os.Getpagesize()*8)
+	n, _, err := syscall.Recvfrom(c.fd, rb, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("recvfrom", err)
+	}
+
+	return syscall.ParseNetlinkMessage(rb[:n])
+}
+
+func nlErrno(m syscall.NetlinkMessage) error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("truncated netlink error message")
+	}
+
+	errno := int32(nativeEndian.Uint32(m.Data[0:4]))
+	if errno == 0 {
+		return nil
+	}
+
+	return syscall.Errno(-errno)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNetlinkConn struct {
+	Requests [][]nlRequest
+	Replies  []syscall.NetlinkMessage
+	Err      error
+}
+
+func (m *mockNetlinkConn) Execute(reqs ...nlRequest) ([]syscall.NetlinkMessage, error) {
+	m.Requests = append(m.Requests, reqs)
+	return m.Replies, m.Err
+}
+
+func (m *mockNetlinkConn) Close() error {
+	return nil
+}
+
+func TestNlAttrPadding(t *testing.T) {
+	attr := nlAttrString(3, "wl0")
+	assert.Len(t, attr, 8)
+	assert.Equal(t, uint16(8), nativeEndian.Uint16(attr[0:2]))
+
+	attr = nlAttrU8(1, 7)
+	assert.Len(t, attr, 8)
+	assert.Equal(t, uint16(5), nativeEndian.Uint16(attr[0:2]))
+}
+
+func TestParseNlAttrs(t *testing.T) {
+	data := concatBytes(
+		nlAttrString(1, "wl_private"),
+		nlAttrNested(2, nlAttrU32(1, 42), nlAttrU16(2, 7)),
+		nlAttrBE32(3, 0x0a2a0000),
+	)
+
+	attrs, err := parseNlAttrs(data)
+	assert.Nil(t, err)
+	assert.Len(t, attrs, 3)
+	assert.Equal(t, uint16(1), attrs[0].Type)
+	assert.Equal(t, "wl_private\x00", string(attrs[0].Data))
+	assert.Equal(t, uint16(2), attrs[1].Type, "nested flag must be masked out")
+	assert.Equal(t, []byte{10, 42, 0, 0}, attrs[2].Data)
+
+	nested, err := parseNlAttrs(attrs[1].Data)
+	assert.Nil(t, err)
+	assert.Len(t, nested, 2)
+	assert.Equal(t, uint32(42), nativeEndian.Uint32(nested[0].Data))
+	assert.Equal(t, uint16(7), nativeEndian.Uint16(nested[1].Data))
+}
+
+func TestParseNlAttrsMalformed(t *testing.T) {
+	_, err := parseNlAttrs([]byte{42, 0, 1, 0, 0, 0, 0, 0})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	passphrasePolicyOff     = "off"
+	passphrasePolicyWarn    = "warn"
+	passphrasePolicyEnforce = "enforce"
+
+	// minDistinctPassphraseChars is how many different characters a
+	// passphrase needs to not count as a repetition
+	minDistinctPassphraseChars = 4
+
+	// minGuessableLength keeps short SSIDs and dictionary words from matching
+	// parts of unrelated passphrases
+	minGuessableLength = 4
+)
+
+// commonPassphrases are guessed first by anyone attacking a network. They are
+// compared after normalizePassphrase.
+var commonPassphrases = []string{
+	"12345678", "123456789", "1234567890", "87654321", "11111111", "00000000", "88888888",
+	"password", "passwort", "qwerty", "qwertz", "qwertyuiop", "azerty", "asdfghjkl",
+	"abcdefgh", "letmein", "welcome", "iloveyou", "admin", "administrator",
+	"football", "baseball", "dragon", "monkey", "sunshine", "princess", "trustno",
+	"master", "shadow", "superman", "starwars", "internet", "wireless", "wlan", "wifi",
+	"wifipassword", "changeme", "default", "secret", "guest", "homewifi", "hotspot",
+}
+
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// normalizePassphrase reduces a passphrase to the word it is most likely
+// built from: lower case, without the digits and symbols commonly appended,
+// with leetspeak spelled out and only letters left
+func normalizePassphrase(p string) string {
+	p = strings.TrimRightFunc(strings.ToLower(p), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	p = leetReplacer.Replace(p)
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, p)
+}
+
+// normalizeSSID keeps only the letters and digits of an SSID
+func normalizeSSID(ssid string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, strings.ToLower(ssid))
+}
+
+// passphraseWeakness tells why a passphrase is easy to guess, or returns ""
+// if it isn't
+func passphraseWeakness(passphrase string, ssid string, dictionary map[string]bool) string {
+	distinct := make(map[rune]bool)
+	for _, r := range passphrase {
+		distinct[r] = true
+	}
+	if len(distinct) < minDistinctPassphraseChars {
+		return "it repeats too few different characters"
+	}
+
+	lower := strings.ToLower(passphrase)
+	word := normalizePassphrase(passphrase)
+	if dictionary[lower] || dictionary[word] {
+		return "it is a dictionary word or common password"
+	}
+
+	s := normalizeSSID(ssid)
+	plain := normalizeSSID(lower)
+	if len(s) >= minGuessableLength && (strings.Contains(plain, s) || strings.Contains(s, plain) || len(word) >= minGuessableLength && strings.Contains(s, word)) {
+		return "it is derived from the SSID"
+	}
+
+	return ""
+}
+
+// loadPassphraseDictionary returns the common passphrases and the words of
+// the optional dictionary file, one per line
+func loadPassphraseDictionary(filename string) (map[string]bool, error) {
+	dictionary := make(map[string]bool)
+	for _, p := range commonPassphrases {
+		dictionary[p] = true
+	}
+
+	if filename == "" {
+		return dictionary, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the passphrase dictionary: %s", err.Error())
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		word := strings.ToLower(strings.TrimSpace(line))
+		if len(word) >= minGuessableLength {
+			dictionary[word] = true
+		}
+	}
+
+	return dictionary, nil
+}
+
+// checkPassphrasePolicy applies --passphrase-policy to the passphrase of the
+// private network. Weak passphrases are only warned about unless the policy
+// is enforced, raw PSKs can't be judged.
+func checkPassphrasePolicy(n network) error {
+	passphrase := n.Password
+	if opts.PassphrasePolicy == passphrasePolicyOff || isHexPSK(passphrase) {
+		return nil
+	}
+
+	dictionary, err := loadPassphraseDictionary(opts.PassphraseDict)
+	if err != nil {
+		return err
+	}
+
+	weakness := passphraseWeakness(passphrase, n.SSID, dictionary)
+	if weakness == "" {
+		return nil
+	}
+
+	if opts.PassphrasePolicy == passphrasePolicyEnforce {
+		return configError{Field: n.Name + ".password", Message: "too easy to guess, " + weakness}
+	}
+
+	log.Warnf("The passphrase of %s is too easy to guess, %s", n.Name, weakness)
+	return nil
+}
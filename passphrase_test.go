@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePassphrase(t *testing.T) {
+	assert.Equal(t, "password", normalizePassphrase("P4ssw0rd!"))
+	assert.Equal(t, "password", normalizePassphrase("password123"))
+	assert.Equal(t, "trustno", normalizePassphrase("trustno1"))
+	assert.Equal(t, "", normalizePassphrase("12345678"))
+}
+
+func TestPassphraseWeakness(t *testing.T) {
+	dictionary, err := loadPassphraseDictionary("")
+	assert.Nil(t, err)
+
+	for _, p := range []string{"12345678", "P4ssw0rd!", "Qwertyuiop2017", "aaaaaaaa", "abababab"} {
+		assert.NotEqual(t, "", passphraseWeakness(p, "example-SSID", dictionary), p)
+	}
+	for _, p := range []string{"Example-SSID", "examplessid2017", "Ex4mple!!"} {
+		assert.Equal(t, "it is derived from the SSID", passphraseWeakness(p, "example-SSID", dictionary), p)
+	}
+	for _, p := range []string{"foobarpassprivate", "correct horse battery staple", "stone-river-apple-cloud-42"} {
+		assert.Equal(t, "", passphraseWeakness(p, "example-SSID", dictionary), p)
+	}
+	assert.Equal(t, "", passphraseWeakness("absolutely-fine-2017", "Ab", dictionary), "too short SSIDs don't count")
+}
+
+func TestLoadPassphraseDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "words")
+	err = ioutil.WriteFile(filename, []byte("Foobarpassprivate\nab\n\n"), 0644)
+	assert.Nil(t, err)
+
+	dictionary, err := loadPassphraseDictionary(filename)
+	assert.Nil(t, err)
+	assert.True(t, dictionary["foobarpassprivate"])
+	assert.True(t, dictionary["password"])
+	assert.False(t, dictionary["ab"])
+
+	_, err = loadPassphraseDictionary(path.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestCheckPassphrasePolicy(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "password"), []byte("example-ssid-2017"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "guest", "password"), []byte("password"), 0644)
+	assert.Nil(t, err)
+
+	oldPolicy := opts.PassphrasePolicy
+	defer func() { opts.PassphrasePolicy = oldPolicy }()
+
+	opts.PassphrasePolicy = passphrasePolicyWarn
+	_, err = loadConfig(configPath)
+	assert.Nil(t, err)
+
+	opts.PassphrasePolicy = passphrasePolicyEnforce
+	_, err = loadConfig(configPath)
+	errs, ok := err.(configErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1, "only the private network's passphrase is judged")
+	assert.Equal(t, "wl_private.password", errs[0].Field)
+
+	assert.Nil(t, checkPassphrasePolicy(network{Name: "wl_private", SSID: "example-SSID", Password: "0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f0f"}))
+
+	opts.PassphrasePolicy = passphrasePolicyOff
+	_, err = loadConfig(configPath)
+	assert.Nil(t, err)
+}
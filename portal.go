@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultPortalTimeout = 24 * time.Hour
+	portalLoginPath      = "/portal/login"
+
+	defaultPortalTerms = "By using this network you agree not to use it for anything illegal and that your traffic may be logged."
+)
+
+var procNetARPPath = "/proc/net/arp"
+
+// readCaptivePortal reads the 'captive_portal' flag file of a network, the
+// optional 'portal_session_timeout' (e.g. '8h') and the 'portal_terms' shown
+// on the splash page
+func readCaptivePortal(dir string, n *network) error {
+	_, err := os.Stat(path.Join(dir, "captive_portal"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n.CaptivePortal = true
+
+	timeout, err := readOptionalValue(dir, "portal_session_timeout", defaultPortalTimeout.String())
+	if err != nil {
+		return err
+	}
+	n.PortalTimeout, err = time.ParseDuration(timeout)
+	if err != nil || n.PortalTimeout < time.Minute {
+		return fmt.Errorf("Invalid portal session timeout '%s' for network '%s'", timeout, n.Name)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "portal_terms"))
+	if os.IsNotExist(err) {
+		n.PortalTerms = defaultPortalTerms
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n.PortalTerms = strings.TrimSpace(string(data))
+
+	return nil
+}
+
+// portalSession is a client logged in on a captive portal. The sessions are
+// kept in a file, so that the firewall can restore them when it replaces its
+// rules.
+type portalSession struct {
+	Interface string    `json:"interface"`
+	MAC       string    `json:"mac"`
+	Expires   time.Time `json:"expires"`
+}
+
+func loadPortalSessions(filename string) ([]portalSession, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []portalSession
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse portal sessions in %s: %s", filename, err.Error())
+	}
+
+	return sessions, nil
+}
+
+func savePortalSessions(filename string, sessions []portalSession) error {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(filename, data, 0644)
+}
+
+// lookupNeighbor finds the MAC address and interface of a client in the ARP
+// table, which is how the portal tells clients apart
+var lookupNeighbor = func(ip net.IP) (net.HardwareAddr, string, error) {
+	f, err := os.Open(procNetARPPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || !ip.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			continue
+		}
+		return mac, fields[5], nil
+	}
+
+	return nil, "", fmt.Errorf("No neighbor entry for %s", ip)
+}
+
+type portalServer struct {
+	networks     map[string]network
+	fw           firewaller
+	sessionsFile string
+
+	mu       sync.Mutex
+	sessions []portalSession
+}
+
+func newPortalServer(networks []network, fw firewaller, sessionsFile string) (*portalServer, error) {
+	sessions, err := loadPortalSessions(sessionsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &portalServer{
+		networks:     make(map[string]network),
+		fw:           fw,
+		sessionsFile: sessionsFile,
+		sessions:     sessions,
+	}
+	for _, n := range networks {
+		if n.CaptivePortal {
+			p.networks[n.Name] = n
+		}
+	}
+
+	return p, nil
+}
+
+// login lets the client through the firewall for timeout and records its
+// session
+func (p *portalServer) login(n network, mac net.HardwareAddr, timeout time.Duration) error {
+	err := p.fw.AllowClient(n.Name, mac, timeout)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropSession(n.Name, mac.String())
+	p.sessions = append(p.sessions, portalSession{Interface: n.Name, MAC: mac.String(), Expires: time.Now().Add(timeout)})
+
+	log.Infof("Client %s logged in on the captive portal of %s", mac, n.Name)
+	return savePortalSessions(p.sessionsFile, p.sessions)
+}
+
+// revoke ends the session of a client before it expires
+func (p *portalServer) revoke(iface string, mac net.HardwareAddr) error {
+	err := p.fw.RevokeClient(iface, mac)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropSession(iface, mac.String())
+	return savePortalSessions(p.sessionsFile, p.sessions)
+}
+
+// dropSession removes the session of a client along with the expired ones
+func (p *portalServer) dropSession(iface string, mac string) {
+	now := time.Now()
+	sessions := []portalSession{}
+	for _, s := range p.sessions {
+		if s.Expires.After(now) && !(s.Interface == iface && s.MAC == mac) {
+			sessions = append(sessions, s)
+		}
+	}
+	p.sessions = sessions
+}
+
+type portalPage struct {
+	SSID     string
+	Terms    string
+	URL      string
+	Error    string
+	LoggedIn bool
+	Voucher  bool
+}
+
+var portalTemplate = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.SSID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 30em; margin: 2em auto; padding: 0 1em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.SSID}}</h1>
+{{if .LoggedIn}}<p>You are connected.</p>
+{{if .URL}}<p><a href="{{.URL}}">Continue to {{.URL}}</a></p>
+{{end}}{{else}}{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}<form method="post" action="` + portalLoginPath + `">
+{{if .Voucher}}<p><label>Voucher <input type="text" name="voucher" autocapitalize="characters" autocomplete="off"></label></p>
+{{end}}<p>{{.Terms}}</p>
+<p><label><input type="checkbox" name="accept"> I accept the terms of use</label></p>
+<input type="hidden" name="url" value="{{.URL}}">
+<p><button type="submit">Connect</button></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// ServeHTTP answers every request with the splash page, as the firewall
+// redirects all HTTP of clients that aren't logged in to us
+func (p *portalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	mac, iface, err := lookupNeighbor(net.ParseIP(host))
+	n, ok := p.networks[iface]
+	if err != nil || !ok {
+		log.Debugf("Portal request from unknown client %s", host)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	page := portalPage{SSID: n.SSID, Terms: n.PortalTerms, Voucher: n.VoucherMode == voucherModePortal}
+	if r.Method == "POST" && r.URL.Path == portalLoginPath {
+		page.URL = r.PostFormValue("url")
+		page.Error = p.handleLogin(n, mac, r.PostFormValue("accept") != "", r.PostFormValue("voucher"))
+		page.LoggedIn = page.Error == ""
+	} else if r.Host != "" {
+		page.URL = "http://" + r.Host + r.URL.RequestURI()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = portalTemplate.Execute(w, page)
+	if err != nil {
+		log.Errorf("Failed to render the portal page: %s", err.Error())
+	}
+}
+
+// handleLogin logs the client in if it accepted the terms and, on networks
+// with vouchers, entered a valid one. The returned error is shown to the user.
+func (p *portalServer) handleLogin(n network, mac net.HardwareAddr, accepted bool, code string) string {
+	if !accepted {
+		return "Please accept the terms of use."
+	}
+
+	timeout := n.PortalTimeout
+	if n.VoucherMode == voucherModePortal {
+		_, remaining, err := redeemVoucher(n.VoucherDir, code, mac.String(), time.Now())
+		if err != nil {
+			log.Infof("Client %s failed to redeem voucher '%s' on %s: %s", mac, code, n.Name, err.Error())
+			return err.Error() + "."
+		}
+		if remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	err := p.login(n, mac, timeout)
+	if err != nil {
+		log.Errorf("Failed to log in %s on %s: %s", mac, n.Name, err.Error())
+		return "Connecting failed, please try again."
+	}
+
+	return ""
+}
+
+// runCaptivePortal serves the portal of all networks having one until stop
+// is closed
+func runCaptivePortal(p *portalServer, port uint16, stop <-chan struct{}) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+
+	err = http.Serve(ln, p)
+	select {
+	case <-stop:
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFirewall struct {
+	Allowed map[string]time.Duration
+	Revoked []string
+	// Uplinks are the uplinks the rules were moved to by Update
+	Uplinks []string
+	Err     error
+}
+
+func (m *mockFirewall) Apply(*firewallConfig) error  { return m.Err }
+func (m *mockFirewall) Remove(*firewallConfig) error { return m.Err }
+func (m *mockFirewall) RemoveAll() error             { return m.Err }
+
+func (m *mockFirewall) Update(old, new *firewallConfig) error {
+	m.Uplinks = append(m.Uplinks, new.Uplink)
+	return m.Err
+}
+
+func (m *mockFirewall) AllowClient(iface string, mac net.HardwareAddr, timeout time.Duration) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Allowed[iface+" "+mac.String()] = timeout
+	return nil
+}
+
+func (m *mockFirewall) RevokeClient(iface string, mac net.HardwareAddr) error {
+	m.Revoked = append(m.Revoked, iface+" "+mac.String())
+	return m.Err
+}
+
+func TestReadCaptivePortal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readCaptivePortal(dir, &n)
+	assert.Nil(t, err)
+	assert.False(t, n.CaptivePortal)
+
+	err = ioutil.WriteFile(path.Join(dir, "captive_portal"), nil, 0644)
+	assert.Nil(t, err)
+	err = readCaptivePortal(dir, &n)
+	assert.Nil(t, err)
+	assert.True(t, n.CaptivePortal)
+	assert.Equal(t, defaultPortalTimeout, n.PortalTimeout)
+	assert.Equal(t, defaultPortalTerms, n.PortalTerms)
+
+	err = ioutil.WriteFile(path.Join(dir, "portal_session_timeout"), []byte("8h\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "portal_terms"), []byte("Be nice.\n"), 0644)
+	assert.Nil(t, err)
+	err = readCaptivePortal(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, 8*time.Hour, n.PortalTimeout)
+	assert.Equal(t, "Be nice.", n.PortalTerms)
+
+	err = ioutil.WriteFile(path.Join(dir, "portal_session_timeout"), []byte("forever"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readCaptivePortal(dir, &n))
+}
+
+func TestLookupNeighbor(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("IP address       HW type     Flags       HW address            Mask     Device\n" +
+		"10.43.0.23       0x1         0x2         aa:bb:cc:dd:ee:ff     *        wl_public\n")
+	assert.Nil(t, err)
+	f.Close()
+
+	orig := procNetARPPath
+	defer func() { procNetARPPath = orig }()
+	procNetARPPath = f.Name()
+
+	mac, iface, err := lookupNeighbor(net.ParseIP("10.43.0.23"))
+	assert.Nil(t, err)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", mac.String())
+	assert.Equal(t, "wl_public", iface)
+
+	_, _, err = lookupNeighbor(net.ParseIP("10.43.0.24"))
+	assert.NotNil(t, err)
+}
+
+func withMockNeighbor(macs map[string]string, iface string) func() {
+	orig := lookupNeighbor
+	lookupNeighbor = func(ip net.IP) (net.HardwareAddr, string, error) {
+		mac, err := net.ParseMAC(macs[ip.String()])
+		return mac, iface, err
+	}
+	return func() { lookupNeighbor = orig }
+}
+
+func TestPortalLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer withMockNeighbor(map[string]string{"10.43.0.23": "aa:bb:cc:dd:ee:ff"}, "wl_public")()
+
+	fw := &mockFirewall{Allowed: make(map[string]time.Duration)}
+	nets := []network{expectedNets[0], expectedNets[1]}
+	nets[1].CaptivePortal = true
+	nets[1].PortalTimeout = time.Hour
+	nets[1].PortalTerms = "Be nice."
+
+	sessionsFile := path.Join(dir, "sessions.json")
+	p, err := newPortalServer(nets, fw, sessionsFile)
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest("GET", "http://captive.apple.com/hotspot-detect.html", nil)
+	req.RemoteAddr = "10.43.0.23:51000"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Be nice.")
+	assert.Contains(t, rec.Body.String(), `value="http://captive.apple.com/hotspot-detect.html"`)
+
+	req = httptest.NewRequest("POST", portalLoginPath, strings.NewReader(url.Values{"url": {"http://example.com/"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "10.43.0.23:51000"
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), "Please accept")
+	assert.Len(t, fw.Allowed, 0)
+
+	req = httptest.NewRequest("POST", portalLoginPath, strings.NewReader(url.Values{"accept": {"on"}, "url": {"http://example.com/"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "10.43.0.23:51000"
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), "You are connected")
+	assert.Equal(t, map[string]time.Duration{"wl_public aa:bb:cc:dd:ee:ff": time.Hour}, fw.Allowed)
+
+	sessions, err := loadPortalSessions(sessionsFile)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", sessions[0].MAC)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.42.0.99:51000"
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestWithPortalClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sessionsFile := path.Join(dir, "sessions.json")
+	err = savePortalSessions(sessionsFile, []portalSession{
+		{Interface: "wl_public", MAC: "aa:bb:cc:dd:ee:ff", Expires: time.Now().Add(time.Hour)},
+		{Interface: "wl_public", MAC: "11:22:33:44:55:66", Expires: time.Now().Add(-time.Hour)},
+	})
+	assert.Nil(t, err)
+
+	cfg := testFirewallConfig()
+	cfg.Networks[1].Portal = true
+
+	newCfg, err := withPortalClients(cfg, sessionsFile)
+	assert.Nil(t, err)
+	assert.Len(t, newCfg.Networks[1].PortalClients, 1)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", newCfg.Networks[1].PortalClients[0].MAC.String())
+	assert.True(t, newCfg.Networks[1].PortalClients[0].Timeout > 59*time.Minute)
+	assert.Nil(t, cfg.Networks[1].PortalClients, "the original config is left alone")
+}
+
+func TestPortalVoucherLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer withMockNeighbor(map[string]string{"10.43.0.23": "aa:bb:cc:dd:ee:ff"}, "wl_public")()
+
+	now := time.Now()
+	err = saveVoucher(dir, &voucher{Code: "ABCDEFGHJK", ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(30 * time.Minute), MaxDevices: 1})
+	assert.Nil(t, err)
+
+	fw := &mockFirewall{Allowed: make(map[string]time.Duration)}
+	n := expectedNets[1]
+	n.CaptivePortal = true
+	n.PortalTimeout = time.Hour
+	n.VoucherMode = voucherModePortal
+	n.VoucherDir = dir
+
+	p, err := newPortalServer([]network{n}, fw, path.Join(dir, ".sessions"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "Unknown voucher.", p.handleLogin(n, mustParseMAC("aa:bb:cc:dd:ee:ff"), true, "WRONG"))
+	assert.Equal(t, "", p.handleLogin(n, mustParseMAC("aa:bb:cc:dd:ee:ff"), true, "abcdefghjk"))
+
+	timeout := fw.Allowed["wl_public aa:bb:cc:dd:ee:ff"]
+	assert.True(t, timeout <= 30*time.Minute && timeout > 29*time.Minute, "the session ends with the voucher")
+
+	err = p.revoke("wl_public", mustParseMAC("aa:bb:cc:dd:ee:ff"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wl_public aa:bb:cc:dd:ee:ff"}, fw.Revoked)
+	sessions, err := loadPortalSessions(path.Join(dir, ".sessions"))
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 0)
+}
+
+func mustParseMAC(s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// the 1-M example of ISO/IEC 18004 annex I
+	data := []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	assert.Equal(t,
+		[]byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55},
+		reedSolomonRemainder(data, reedSolomonDivisor(10)))
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	assert.Equal(t, 0x5412, qrFormatBits(0))
+	assert.Equal(t, 0x5125, qrFormatBits(1))
+	assert.Equal(t, 0x07c94, qrVersionBits(7))
+	assert.Equal(t, 0x0a4d3, qrVersionBits(10))
+}
+
+func TestQRDataCodewords(t *testing.T) {
+	data := qrDataCodewords([]byte("A"), 1)
+	assert.Len(t, data, 16)
+	assert.Equal(t, []byte{0x40, 0x14, 0x10, 0xec, 0x11, 0xec}, data[:6])
+
+	for v := 1; v <= qrMaxVersion; v++ {
+		b := qrVersionsM[v]
+		total := b.dataCodewords() + (b.Group1+b.Group2)*b.ECPerBlock
+		size := 17 + 4*v
+		q := newQRCode(v)
+		q.drawFunctionPatterns(v)
+
+		free := 0
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				if !q.function[y][x] {
+					free++
+				}
+			}
+		}
+		// what is left over are the remainder bits
+		assert.True(t, free >= total*8 && free < total*8+8, "version %d", v)
+	}
+}
+
+// readQRCode undoes what encodeQRCode did and returns the data codewords
+func readQRCode(t *testing.T, q *qrCode) []byte {
+	version := (q.Size - 17) / 4
+
+	var format int
+	for i := 0; i <= 5; i++ {
+		if q.Modules[i][8] {
+			format |= 1 << uint(i)
+		}
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if qrFormatBits(m)&0x3f == format {
+			mask = m
+		}
+	}
+	assert.NotEqual(t, -1, mask)
+
+	plain := newQRCode(version)
+	plain.drawFunctionPatterns(version)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if plain.function[y][x] {
+				continue
+			}
+			plain.Modules[y][x] = q.Modules[y][x] != qrMasked(mask, x, y)
+		}
+	}
+
+	b := qrVersionsM[version]
+	var codewords []byte
+	var bits int
+	var current byte
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if plain.function[y][x] {
+					continue
+				}
+				current <<= 1
+				if plain.Modules[y][x] {
+					current |= 1
+				}
+				bits++
+				if bits%8 == 0 {
+					codewords = append(codewords, current)
+				}
+			}
+		}
+	}
+
+	blocks := make([][]byte, b.Group1+b.Group2)
+	i := 0
+	for c := 0; c <= b.Group1Data; c++ {
+		for n := range blocks {
+			if c < b.Group1Data || n >= b.Group1 {
+				blocks[n] = append(blocks[n], codewords[i])
+				i++
+			}
+		}
+	}
+
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	return data
+}
+
+func TestEncodeQRCode(t *testing.T) {
+	for _, text := range []string{
+		"A",
+		"WIFI:T:WPA;S:Protonet;P:maple-river-cloud-tiger-17;;",
+		strings.Repeat("x", 150),
+		strings.Repeat("y", 213),
+	} {
+		q, err := encodeQRCode([]byte(text))
+		assert.Nil(t, err)
+
+		version := (q.Size - 17) / 4
+		assert.Equal(t, qrDataCodewords([]byte(text), version), readQRCode(t, q), text)
+
+		// the finder in the top left corner
+		assert.True(t, q.Modules[0][0])
+		assert.False(t, q.Modules[1][1])
+		assert.True(t, q.Modules[3][3])
+		assert.False(t, q.Modules[7][7])
+	}
+
+	q, err := encodeQRCode([]byte("A"))
+	assert.Nil(t, err)
+	assert.Equal(t, 21, q.Size)
+
+	_, err = encodeQRCode([]byte(strings.Repeat("z", 214)))
+	assert.NotNil(t, err)
+}
+
+func TestQRCodePNG(t *testing.T) {
+	q, err := encodeQRCode([]byte("A"))
+	assert.Nil(t, err)
+
+	data, err := q.PNG(4)
+	assert.Nil(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, (21+2*qrQuietZone)*4, img.Bounds().Dx())
+
+	r, _, _, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), r, "the quiet zone is white")
+	r, _, _, _ = img.At(qrQuietZone*4, qrQuietZone*4).RGBA()
+	assert.Equal(t, uint32(0), r)
+}
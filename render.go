@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// secretConfigKeys are masked when showing configs
+var secretConfigKeys = []string{"wpa_psk", "wpa_passphrase", "auth_server_shared_secret"}
+
+const secretMask = "********"
+
+// renderConfig generates the hostapd config the daemon would start with now,
+// for the radio recorded in capsFile, without touching the system
+func renderConfig(capsFile string) (string, error) {
+	cfg, err := loadConfig(opts.SKVSPath)
+	if err != nil {
+		return "", err
+	}
+
+	networks := cfg.Networks
+	if len(networks) == 0 {
+		return "", fmt.Errorf("No WiFi networks are enabled")
+	}
+
+	scheduled := scheduledNetworks(networks, time.Now())
+	if len(scheduled) == 0 {
+		scheduled = networks
+	}
+
+	caps, err := loadCapabilitySnapshot(capsFile)
+	if err != nil {
+		return "", err
+	}
+
+	configFile := opts.ConfigFile
+	if configFile == "" {
+		configFile = "/etc/hostapd/hostapd.conf"
+	}
+
+	assignDynamicVLANFiles(scheduled, path.Dir(configFile))
+	return generateConfigFromSnapshot(scheduled, cfg.Channel, caps, configFallback{})
+}
+
+// maskSecrets replaces the values of secretConfigKeys in a hostapd config
+func maskSecrets(cfg string) string {
+	lines := strings.Split(cfg, "\n")
+	for i, l := range lines {
+		for _, key := range secretConfigKeys {
+			if strings.HasPrefix(l, key+"=") {
+				lines[i] = key + "=" + secretMask
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffLines returns the lines only in a prefixed with '-' and those only in
+// b prefixed with '+', in order, based on their longest common subsequence
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = maxInt(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+type renderCommand struct {
+	Capabilities string `long:"capabilities" description:"capability snapshot to render for, defaults to --capabilities-file"`
+	ShowSecrets  bool   `long:"show-secrets" description:"don't mask passphrases and RADIUS secrets"`
+}
+
+func (c *renderCommand) Execute(args []string) error {
+	setupLogging()
+
+	cfg, err := renderConfig(capabilitiesFile(c.Capabilities))
+	if err != nil {
+		return err
+	}
+
+	if !c.ShowSecrets {
+		cfg = maskSecrets(cfg)
+	}
+	fmt.Print(cfg)
+	return nil
+}
+
+type diffCommand struct {
+	Capabilities string `long:"capabilities" description:"capability snapshot to render for, defaults to --capabilities-file"`
+}
+
+func (c *diffCommand) Execute(args []string) error {
+	setupLogging()
+
+	if opts.ConfigFile == "" {
+		return fmt.Errorf("--config-file is required to diff against it")
+	}
+
+	cfg, err := renderConfig(capabilitiesFile(c.Capabilities))
+	if err != nil {
+		return err
+	}
+
+	old, err := ioutil.ReadFile(opts.ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	diff := diffLines(strings.Split(maskSecrets(string(old)), "\n"), strings.Split(maskSecrets(cfg), "\n"))
+	if len(diff) == 0 {
+		return nil
+	}
+
+	fmt.Printf("--- %s\n+++ rendered\n%s\n", opts.ConfigFile, strings.Join(diff, "\n"))
+	return nil
+}
+
+type validateCommand struct {
+	Capabilities string `long:"capabilities" description:"capability snapshot to validate for, defaults to --capabilities-file"`
+}
+
+func (c *validateCommand) Execute(args []string) error {
+	setupLogging()
+
+	_, err := renderConfig(capabilitiesFile(c.Capabilities))
+	if errs, ok := err.(configErrors); ok {
+		for _, e := range errs {
+			fmt.Println(e.Error())
+		}
+		return fmt.Errorf("Found %d invalid fields", len(errs))
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %s", err.Error())
+	}
+
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func capabilitiesFile(override string) string {
+	if override != "" {
+		return override
+	}
+	return opts.CapabilitiesFile
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	cfg := "ssid=Office\nwpa_psk=7190fee2\nauth_server_shared_secret=s3cret\nwpa_psk_file=/etc/hostapd/wl_public.psk\n"
+	assert.Equal(t, "ssid=Office\nwpa_psk=********\nauth_server_shared_secret=********\nwpa_psk_file=/etc/hostapd/wl_public.psk\n", maskSecrets(cfg))
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Nil(t, diffLines([]string{"a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{"-channel=1", "+channel=6", "+ap_isolate=1"},
+		diffLines([]string{"ssid=x", "channel=1", "hw_mode=g"}, []string{"ssid=x", "channel=6", "hw_mode=g", "ap_isolate=1"}))
+	assert.Equal(t, []string{"-a"}, diffLines([]string{"a"}, nil))
+}
+
+func TestRenderConfig(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	origSKVS, origConfig := opts.SKVSPath, opts.ConfigFile
+	defer func() { opts.SKVSPath, opts.ConfigFile = origSKVS, origConfig }()
+	opts.SKVSPath = configPath
+	opts.ConfigFile = ""
+
+	capsFile := path.Join(configPath, "capabilities.json")
+	_, err = renderConfig(capsFile)
+	assert.NotNil(t, err, "rendering needs a capability snapshot")
+
+	caps := &capabilitySnapshot{HTCapabilities: htCapabilities{HT20: true}, BSSID: "01:23:45:67:89:ab"}
+	assert.Nil(t, saveCapabilitySnapshot(capsFile, caps))
+
+	cfg, err := renderConfig(capsFile)
+	assert.Nil(t, err)
+
+	expected, err := generateConfigFile(expectedNets, 1, false, &htCapabilities{HT20: true}, "01:23:45:67:89:ab", configFallback{})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, cfg)
+	assert.Equal(t, 2, strings.Count(maskSecrets(cfg), "wpa_psk="+secretMask))
+}
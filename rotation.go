@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	rotationDaily  = "daily"
+	rotationWeekly = "weekly"
+
+	rotationCheckInterval = time.Minute
+
+	passphraseWords = 4
+	qrCodeScale     = 8
+)
+
+// passphraseWordList has 256 short words that are easy to read out and type
+// on a phone, so each word adds 8 bits
+var passphraseWordList = []string{
+	"acorn", "amber", "anchor", "apple", "apron", "arrow", "aspen", "atlas",
+	"autumn", "badge", "bagel", "bamboo", "banjo", "barley", "basil", "beach",
+	"beacon", "berry", "birch", "biscuit", "blanket", "blossom", "bonbon",
+	"breeze", "brick", "bridge", "brook", "bubble", "bucket", "butter",
+	"button", "cabin", "cactus", "camel", "candle", "canoe", "canyon", "carrot",
+	"castle", "cedar", "cello", "cherry", "chess", "cider", "cinema", "citrus",
+	"clover", "cobalt", "cocoa", "comet", "copper", "coral", "cotton", "cradle",
+	"crane", "crayon", "cricket", "crystal", "cupcake", "dahlia", "daisy",
+	"delta", "desert", "dolphin", "donkey", "dragon", "dream", "drum", "eagle",
+	"earth", "echo", "eclipse", "elbow", "ember", "falcon", "feather", "fennel",
+	"fern", "fiddle", "field", "flame", "flute", "forest", "fossil", "fox",
+	"galaxy", "garden", "garlic", "gecko", "ginger", "glacier", "globe",
+	"goose", "grape", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "hedge", "helmet", "heron", "honey", "horizon", "island", "ivory",
+	"jacket", "jasmine", "jelly", "jungle", "kettle", "kiwi", "koala", "ladder",
+	"lagoon", "lantern", "lemon", "lily", "linen", "lizard", "lobster", "lotus",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mint",
+	"mirror", "mitten", "monkey", "moose", "mosaic", "muffin", "nectar",
+	"needle", "nest", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion",
+	"orbit", "orchid", "otter", "owl", "paddle", "panda", "paper", "parrot",
+	"peach", "pebble", "pepper", "piano", "pickle", "pigeon", "pillow", "pine",
+	"planet", "plum", "pocket", "pony", "poppy", "prism", "pumpkin", "puzzle",
+	"quail", "quartz", "quill", "rabbit", "radish", "rain", "raven", "reef",
+	"ribbon", "river", "robin", "rocket", "rose", "saddle", "saffron", "salmon",
+	"sandal", "satin", "season", "sesame", "shadow", "shell", "silver",
+	"sketch", "sloth", "snow", "sparrow", "spice", "spruce", "squash", "star",
+	"stone", "storm", "sugar", "summit", "sunset", "swan", "tablet", "tango",
+	"teapot", "thistle", "thunder", "tiger", "timber", "toast", "tomato",
+	"topaz", "torch", "tulip", "tunnel", "turtle", "velvet", "violet", "violin",
+	"wafer", "walnut", "walrus", "willow", "window", "winter", "wizard",
+	"wombat", "yogurt", "zebra", "zephyr", "acacia", "badger", "bison",
+	"cabbage", "canary", "cinnamon", "cobra", "coconut", "cookie", "cosmos",
+	"cyan", "dune", "fable", "fig", "flint", "gazelle", "harp", "igloo", "iris",
+	"jade", "kayak",
+}
+
+// readPasswordRotation reads the optional 'password_rotation' of a network,
+// 'daily' or 'weekly'. The time of the last rotation is kept next to it in
+// 'password_rotated'.
+func readPasswordRotation(dir string, n *network) error {
+	policy, err := readOptionalValue(dir, "password_rotation", "")
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case "", rotationDaily, rotationWeekly:
+		n.PasswordRotation = policy
+		return nil
+	default:
+		return fmt.Errorf("Invalid password rotation '%s' for network '%s', expected daily or weekly", policy, n.Name)
+	}
+}
+
+// generatePassphrase joins random words and a number, like
+// 'maple-river-comet-tiger-17'
+func generatePassphrase() (string, error) {
+	var parts []string
+	for i := 0; i <= passphraseWords; i++ {
+		max := len(passphraseWordList)
+		if i == passphraseWords {
+			max = 100
+		}
+
+		r, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+		if err != nil {
+			return "", err
+		}
+
+		if i == passphraseWords {
+			parts = append(parts, fmt.Sprintf("%02d", r.Int64()))
+		} else {
+			parts = append(parts, passphraseWordList[r.Int64()])
+		}
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// rotationDue tells whether the password rotated at last needs to be
+// replaced at now: daily after midnight, weekly after midnight on Monday
+func rotationDue(policy string, last time.Time, now time.Time) bool {
+	last, now = last.Local(), now.Local()
+	switch policy {
+	case rotationDaily:
+		return last.YearDay() != now.YearDay() || last.Year() != now.Year()
+	case rotationWeekly:
+		lastYear, lastWeek := last.ISOWeek()
+		year, week := now.ISOWeek()
+		return lastWeek != week || lastYear != year
+	default:
+		return false
+	}
+}
+
+func readLastRotation(dir string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "password_rotated"))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time of the last password rotation in %s: %s", dir, err.Error())
+	}
+	return last, nil
+}
+
+func writeLastRotation(dir string, t time.Time) error {
+	return writeFileAtomic(path.Join(dir, "password_rotated"), []byte(t.Format(time.RFC3339)+"\n"), 0644)
+}
+
+// rotatePassword writes a new passphrase to the SKVS, keeping the mode of
+// the password file and sealing it if the old one was
+func rotatePassword(dir string, now time.Time) (string, error) {
+	password, err := generatePassphrase()
+	if err != nil {
+		return "", err
+	}
+
+	filename := path.Join(dir, "password")
+	mode := os.FileMode(0644)
+	info, err := os.Stat(filename)
+	if err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	value := password
+	old, err := readOptionalValue(dir, "password", "")
+	if err != nil {
+		return "", err
+	}
+	if isSealedSecret(old) {
+		key, err := loadSecretsKey(opts.SecretsKey)
+		if err != nil {
+			return "", err
+		}
+
+		value, err = sealSecret(password, key)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// replaced atomically, as the config watcher may read it any time and a
+	// truncated password keeps the daemon from starting
+	err = writeFileAtomic(filename, []byte(value+"\n"), mode)
+	if err != nil {
+		return "", err
+	}
+
+	return password, writeLastRotation(dir, now)
+}
+
+// wifiURI returns the URI phones join a network with when scanning its QR
+// code
+func wifiURI(ssid string, password string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`)
+	return fmt.Sprintf("WIFI:T:WPA;S:%s;P:%s;;", escape.Replace(ssid), escape.Replace(password))
+}
+
+// writeCredentials puts the WIFI: URI of a network and its QR code as PNG
+// into dir, for displaying them to guests
+func writeCredentials(n network, dir string) error {
+	uri := wifiURI(n.SSID, n.Password)
+	err := writeFileCreatingDir(path.Join(dir, n.Name+".uri"), []byte(uri+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	return writeQRCodePNG(path.Join(dir, n.Name+".png"), uri)
+}
+
+func writeQRCodePNG(filename string, text string) error {
+	q, err := encodeQRCode([]byte(text))
+	if err != nil {
+		return err
+	}
+
+	data, err := q.PNG(qrCodeScale)
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(filename, data, 0600)
+}
+
+// runPasswordRotation replaces the password of a network as its policy
+// demands and has reload apply it, until stop is closed. The credentials are
+// kept up to date in credentialsDir.
+func runPasswordRotation(n network, configPath string, credentialsDir string, reload func() error, stop <-chan struct{}) error {
+	dir := networkConfigDir(configPath, n.Name)
+
+	err := writeCredentials(n, credentialsDir)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		err := rotateIfDue(&n, dir, credentialsDir, reload, time.Now())
+		if err == errRestart {
+			return err
+		}
+		if err != nil {
+			log.Errorf("Failed to rotate the password of %s: %s", n.Name, err.Error())
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func rotateIfDue(n *network, dir string, credentialsDir string, reload func() error, now time.Time) error {
+	last, err := readLastRotation(dir)
+	if err != nil {
+		return err
+	}
+
+	// the password set before the policy counts as fresh
+	if last.IsZero() {
+		return writeLastRotation(dir, now)
+	}
+	if !rotationDue(n.PasswordRotation, last, now) {
+		return nil
+	}
+
+	log.Infof("Rotating the password of %s", n.Name)
+	n.Password, err = rotatePassword(dir, now)
+	if err != nil {
+		return err
+	}
+
+	err = reload()
+	if err != nil {
+		return err
+	}
+
+	return writeCredentials(*n, credentialsDir)
+}
+
+type credentialsCommand struct {
+	Network string `long:"network" default:"wl_public" description:"network to show the credentials of"`
+	QRCode  string `long:"qr-code" description:"write the QR code as PNG to this file"`
+}
+
+type credentials struct {
+	Network  string `json:"network"`
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+	URI      string `json:"uri"`
+	Rotated  string `json:"rotated,omitempty"`
+}
+
+func (c *credentialsCommand) Execute(args []string) error {
+	setupLogging()
+
+	networks, err := getNeededNetworks(opts.SKVSPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get network list: %s", err.Error())
+	}
+
+	for _, n := range networks {
+		if n.Name != c.Network {
+			continue
+		}
+
+		creds := credentials{Network: n.Name, SSID: n.SSID, Password: n.Password, URI: wifiURI(n.SSID, n.Password)}
+		if n.PasswordRotation != "" {
+			last, err := readLastRotation(networkConfigDir(opts.SKVSPath, n.Name))
+			if err != nil {
+				return err
+			}
+			if !last.IsZero() {
+				creds.Rotated = last.Format(time.RFC3339)
+			}
+		}
+
+		if c.QRCode != "" {
+			err = writeQRCodePNG(c.QRCode, creds.URI)
+			if err != nil {
+				return err
+			}
+		}
+
+		return printJSON(creds)
+	}
+
+	return fmt.Errorf("Network '%s' is not enabled", c.Network)
+}
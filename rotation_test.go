@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPasswordRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readPasswordRotation(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "", n.PasswordRotation)
+
+	err = ioutil.WriteFile(path.Join(dir, "password_rotation"), []byte("weekly\n"), 0644)
+	assert.Nil(t, err)
+	err = readPasswordRotation(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, rotationWeekly, n.PasswordRotation)
+
+	err = ioutil.WriteFile(path.Join(dir, "password_rotation"), []byte("hourly"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readPasswordRotation(dir, &n))
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	assert.Len(t, passphraseWordList, 256)
+
+	words := make(map[string]bool)
+	for _, w := range passphraseWordList {
+		words[w] = true
+	}
+	assert.Len(t, words, 256, "words are unique")
+
+	p, err := generatePassphrase()
+	assert.Nil(t, err)
+
+	parts := strings.Split(p, "-")
+	assert.Len(t, parts, passphraseWords+1)
+	for _, w := range parts[:passphraseWords] {
+		assert.True(t, words[w], w)
+	}
+	assert.Len(t, parts[passphraseWords], 2)
+	assert.True(t, len(p) >= 8 && len(p) <= 63, "valid WPA passphrase")
+}
+
+func TestRotationDue(t *testing.T) {
+	// a Wednesday
+	last := time.Date(2017, 3, 15, 23, 0, 0, 0, time.Local)
+
+	assert.False(t, rotationDue(rotationDaily, last, last.Add(30*time.Minute)))
+	assert.True(t, rotationDue(rotationDaily, last, last.Add(90*time.Minute)))
+	assert.True(t, rotationDue(rotationDaily, last, last.AddDate(1, 0, 0)))
+
+	assert.False(t, rotationDue(rotationWeekly, last, last.AddDate(0, 0, 4)))
+	assert.True(t, rotationDue(rotationWeekly, last, last.AddDate(0, 0, 5)))
+
+	assert.False(t, rotationDue("", last, last.AddDate(1, 0, 0)))
+}
+
+func TestRotatePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "password"), []byte("old password"), 0600)
+	assert.Nil(t, err)
+
+	now := time.Date(2017, 3, 15, 8, 0, 0, 0, time.UTC)
+	password, err := rotatePassword(dir, now)
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "password"))
+	assert.Nil(t, err)
+	assert.Equal(t, password+"\n", string(data))
+
+	info, err := os.Stat(path.Join(dir, "password"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	last, err := readLastRotation(dir)
+	assert.Nil(t, err)
+	assert.True(t, now.Equal(last))
+}
+
+func TestRotateIfDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public", SSID: "Guests", Password: "old password", PasswordRotation: rotationDaily}
+	reloads := 0
+	reload := func() error {
+		reloads++
+		return nil
+	}
+
+	now := time.Date(2017, 3, 15, 8, 0, 0, 0, time.Local)
+	err = rotateIfDue(&n, dir, dir, reload, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reloads, "the first check only records the time")
+	assert.Equal(t, "old password", n.Password)
+
+	err = rotateIfDue(&n, dir, dir, reload, now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reloads)
+
+	err = rotateIfDue(&n, dir, dir, reload, now.AddDate(0, 0, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reloads)
+	assert.NotEqual(t, "old password", n.Password)
+
+	uri, err := ioutil.ReadFile(path.Join(dir, "wl_public.uri"))
+	assert.Nil(t, err)
+	assert.Equal(t, wifiURI("Guests", n.Password)+"\n", string(uri))
+
+	_, err = os.Stat(path.Join(dir, "wl_public.png"))
+	assert.Nil(t, err)
+
+	reload = func() error {
+		return errRestart
+	}
+	err = rotateIfDue(&n, dir, dir, reload, now.AddDate(0, 0, 2))
+	assert.Equal(t, errRestart, err)
+}
+
+func TestWifiURI(t *testing.T) {
+	assert.Equal(t, "WIFI:T:WPA;S:Guests;P:maple-river;;", wifiURI("Guests", "maple-river"))
+	assert.Equal(t, `WIFI:T:WPA;S:Caf\\e\;\,\:\";P:a\;b;;`, wifiURI(`Caf\e;,:"`, "a;b"))
+}
+
+func TestWriteCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = writeCredentials(network{Name: "wl_public", SSID: "Guests", Password: "maple-river-cloud-tiger-17"}, path.Join(dir, "credentials"))
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "credentials", "wl_public.png"))
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, img.Bounds().Dx(), img.Bounds().Dy())
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptRDNSS          = 25
+
+	// timings from RFC 4861, section 10
+	raInterval           = 200 * time.Second
+	raInitialInterval    = 16 * time.Second
+	raInitialCount       = 3
+	raMinDelayBetweenRAs = 3 * time.Second
+
+	raRouterLifetime    = 1800
+	raValidLifetime     = 86400
+	raPreferredLifetime = 14400
+	raRDNSSLifetime     = 3 * 200
+)
+
+// buildRouterAdvertisement returns the ICMPv6 message announcing prefix for
+// SLAAC and dns, unless it is nil, as recursive DNS server. A router lifetime
+// of 0 tells clients to stop using us, which is sent on shutdown. The kernel
+// fills in the checksum.
+func buildRouterAdvertisement(mac net.HardwareAddr, prefix *net.IPNet, dns net.IP, routerLifetime uint16) []byte {
+	ra := make([]byte, 16)
+	ra[0] = icmpv6RouterAdvertisement
+	ra[4] = 64 // current hop limit
+	binary.BigEndian.PutUint16(ra[6:8], routerLifetime)
+
+	if len(mac) == 6 {
+		ra = append(ra, ndOptSourceLinkAddr, 1)
+		ra = append(ra, mac...)
+	}
+
+	pi := make([]byte, 32)
+	pi[0] = ndOptPrefixInfo
+	pi[1] = 4
+	pi[2] = 64
+	pi[3] = 0xc0 // on-link, autonomous
+	binary.BigEndian.PutUint32(pi[4:8], raValidLifetime)
+	if routerLifetime != 0 {
+		binary.BigEndian.PutUint32(pi[8:12], raPreferredLifetime)
+	}
+	copy(pi[16:], prefix.IP.To16())
+	ra = append(ra, pi...)
+
+	if dns == nil {
+		return ra
+	}
+
+	rdnss := make([]byte, 24)
+	rdnss[0] = ndOptRDNSS
+	rdnss[1] = 3
+	if routerLifetime != 0 {
+		binary.BigEndian.PutUint32(rdnss[4:8], raRDNSSLifetime)
+	}
+	copy(rdnss[8:], dns.To16())
+
+	return append(ra, rdnss...)
+}
+
+type raSocketer interface {
+	Send(msg []byte, dst net.IP) error
+	// Receive returns nil without error when nothing arrived for a second
+	Receive() ([]byte, error)
+	Close() error
+}
+
+var newRASocket = func(iface *net.Interface) (raSocketer, error) {
+	return newICMPv6Socket(iface)
+}
+
+type icmpv6Socket struct {
+	fd    int
+	index int
+}
+
+func newICMPv6Socket(iface *net.Interface) (*icmpv6Socket, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	mreq := &syscall.IPv6Mreq{Interface: uint32(iface.Index)}
+	copy(mreq.Multiaddr[:], net.ParseIP("ff02::2"))
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+
+	for _, err = range []error{
+		syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface.Name),
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255),
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 255),
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index),
+		syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq),
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv),
+	} {
+		if err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	return &icmpv6Socket{fd: fd, index: iface.Index}, nil
+}
+
+func (s *icmpv6Socket) Send(msg []byte, dst net.IP) error {
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(s.index)}
+	copy(sa.Addr[:], dst.To16())
+	return os.NewSyscallError("sendto", syscall.Sendto(s.fd, msg, 0, sa))
+}
+
+func (s *icmpv6Socket) Receive() ([]byte, error) {
+	buf := make([]byte, 1500)
+	n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("recvfrom", err)
+	}
+
+	return buf[:n], nil
+}
+
+func (s *icmpv6Socket) Close() error {
+	return syscall.Close(s.fd)
+}
+
+// runRouterAdvertisements announces the network's prefix until stop is
+// closed, periodically and in answer to router solicitations
+func runRouterAdvertisements(n network, stop <-chan struct{}) error {
+	iface, err := net.InterfaceByName(n.Name)
+	if err != nil {
+		return err
+	}
+
+	sock, err := newRASocket(iface)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	return advertise(sock, iface.HardwareAddr, n.IPv6Prefix, raDNSServer(n), stop)
+}
+
+// raDNSServer returns the DNS server to announce on a network: its gateway if
+// dnsmasq serves DNS there, otherwise none, leaving clients with the servers
+// they learn elsewhere
+func raDNSServer(n network) net.IP {
+	if opts.DHCP != "dnsmasq" {
+		return nil
+	}
+	return ipv6Gateway(n.IPv6Prefix)
+}
+
+func advertise(sock raSocketer, mac net.HardwareAddr, prefix *net.IPNet, dns net.IP, stop <-chan struct{}) error {
+	allNodes := net.ParseIP("ff02::1")
+	ra := buildRouterAdvertisement(mac, prefix, dns, raRouterLifetime)
+
+	var lastSent time.Time
+	next := time.Now()
+	initial := raInitialCount
+
+	for {
+		select {
+		case <-stop:
+			log.Debugf("Withdrawing IPv6 prefix %s", prefix)
+			return sock.Send(buildRouterAdvertisement(mac, prefix, dns, 0), allNodes)
+		default:
+		}
+
+		if !time.Now().Before(next) {
+			err := sock.Send(ra, allNodes)
+			if err != nil {
+				return err
+			}
+			lastSent = time.Now()
+
+			if initial > 1 {
+				initial--
+				next = lastSent.Add(raInitialInterval)
+			} else {
+				next = lastSent.Add(raInterval)
+			}
+		}
+
+		msg, err := sock.Receive()
+		if err != nil {
+			return err
+		}
+
+		if len(msg) > 0 && msg[0] == icmpv6RouterSolicitation && time.Since(lastSent) >= raMinDelayBetweenRAs {
+			err = sock.Send(ra, allNodes)
+			if err != nil {
+				return err
+			}
+			lastSent = time.Now()
+		}
+	}
+}
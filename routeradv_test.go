@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildRouterAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:2::/64")
+	dns := ipv6Gateway(prefix)
+
+	ra := buildRouterAdvertisement(mac, prefix, dns, raRouterLifetime)
+	assert.Len(t, ra, 16+8+32+24)
+	assert.Equal(t, byte(icmpv6RouterAdvertisement), ra[0])
+	assert.Equal(t, uint16(raRouterLifetime), binary.BigEndian.Uint16(ra[6:8]))
+
+	assert.Equal(t, []byte{ndOptSourceLinkAddr, 1}, ra[16:18])
+	assert.Equal(t, []byte(mac), ra[18:24])
+
+	pi := ra[24:56]
+	assert.Equal(t, []byte{ndOptPrefixInfo, 4, 64, 0xc0}, pi[0:4])
+	assert.Equal(t, uint32(raPreferredLifetime), binary.BigEndian.Uint32(pi[8:12]))
+	assert.Equal(t, []byte(prefix.IP.To16()), pi[16:32])
+
+	rdnss := ra[56:]
+	assert.Equal(t, byte(ndOptRDNSS), rdnss[0])
+	assert.Equal(t, []byte(dns), rdnss[8:24])
+
+	withdraw := buildRouterAdvertisement(mac, prefix, dns, 0)
+	assert.Equal(t, uint16(0), binary.BigEndian.Uint16(withdraw[6:8]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(withdraw[24+8:24+12]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(withdraw[56+4:56+8]))
+
+	assert.Len(t, buildRouterAdvertisement(mac, prefix, nil, raRouterLifetime), 16+8+32, "no RDNSS without a DNS server")
+}
+
+func TestRADNSServer(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:2::/64")
+	n := network{Name: "wl_private", IPv6Prefix: prefix}
+
+	orig := opts.DHCP
+	defer func() { opts.DHCP = orig }()
+
+	opts.DHCP = "none"
+	assert.Nil(t, raDNSServer(n), "nothing serves DNS on the host")
+	opts.DHCP = "networkd"
+	assert.Nil(t, raDNSServer(n))
+	opts.DHCP = "dnsmasq"
+	assert.Equal(t, ipv6Gateway(prefix), raDNSServer(n))
+}
+
+type mockRASocket struct {
+	Sent     [][]byte
+	Received [][]byte
+	OnEmpty  func()
+}
+
+func (m *mockRASocket) Send(msg []byte, dst net.IP) error {
+	m.Sent = append(m.Sent, msg)
+	return nil
+}
+
+func (m *mockRASocket) Receive() ([]byte, error) {
+	if len(m.Received) == 0 {
+		m.OnEmpty()
+		return nil, nil
+	}
+
+	msg := m.Received[0]
+	m.Received = m.Received[1:]
+	return msg, nil
+}
+
+func (m *mockRASocket) Close() error {
+	return nil
+}
+
+func TestAdvertise(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:2::/64")
+	stop := make(chan struct{})
+
+	sock := &mockRASocket{
+		// a solicitation right after the first advertisement is rate limited
+		Received: [][]byte{{icmpv6RouterSolicitation, 0, 0, 0}},
+		OnEmpty:  func() { close(stop) },
+	}
+
+	err := advertise(sock, nil, prefix, ipv6Gateway(prefix), stop)
+	assert.Nil(t, err)
+
+	assert.Len(t, sock.Sent, 2)
+	assert.Equal(t, uint16(raRouterLifetime), binary.BigEndian.Uint16(sock.Sent[0][6:8]))
+	assert.Equal(t, uint16(0), binary.BigEndian.Uint16(sock.Sent[1][6:8]))
+}
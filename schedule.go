@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const scheduleCheckInterval = 30 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// weeklySchedule lists the times a network is available, in the wall clock
+// time of Location
+type weeklySchedule struct {
+	Location *time.Location
+	Ranges   []scheduleRange
+}
+
+// scheduleRange starts on each of Days at Start and lasts until End, which
+// is on the next day if it isn't after Start. Both are offsets from midnight.
+type scheduleRange struct {
+	Days  [7]bool
+	Start time.Duration
+	End   time.Duration
+}
+
+// readSchedule reads the optional 'schedule' of a network, one weekly time
+// range per line like 'mon-fri 08:00-18:00', and the 'schedule_timezone' it
+// is in, e.g. 'Europe/Berlin'. Without a schedule the network is always on.
+func readSchedule(dir string, n *network) error {
+	n.Schedule = nil
+
+	data, err := ioutil.ReadFile(path.Join(dir, "schedule"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	zone, err := readOptionalValue(dir, "schedule_timezone", "")
+	if err != nil {
+		return err
+	}
+
+	loc := time.Local
+	if zone != "" {
+		loc, err = time.LoadLocation(zone)
+		if err != nil {
+			return fmt.Errorf("Invalid schedule timezone '%s' for network '%s': %s", zone, n.Name, err.Error())
+		}
+	}
+
+	n.Schedule, err = parseSchedule(string(data), loc)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule for network '%s': %s", n.Name, err.Error())
+	}
+
+	return nil
+}
+
+// parseSchedule reads lines of 'DAYS HH:MM-HH:MM'. DAYS is a comma separated
+// list of days ('mon') and day ranges ('mon-fri'), or 'daily'. '24:00' ends a
+// range at midnight, a range ending before it starts lasts over midnight.
+func parseSchedule(s string, loc *time.Location) (*weeklySchedule, error) {
+	schedule := &weeklySchedule{Location: loc}
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected 'DAYS HH:MM-HH:MM', got '%s'", line)
+		}
+
+		var r scheduleRange
+		err := parseScheduleDays(strings.ToLower(fields[0]), &r.Days)
+		if err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range '%s'", fields[1])
+		}
+		r.Start, err = parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		r.End, err = parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if r.Start == r.End {
+			return nil, fmt.Errorf("empty time range '%s'", fields[1])
+		}
+
+		schedule.Ranges = append(schedule.Ranges, r)
+	}
+
+	if len(schedule.Ranges) == 0 {
+		return nil, fmt.Errorf("no time ranges")
+	}
+
+	return schedule, nil
+}
+
+func parseScheduleDays(s string, days *[7]bool) error {
+	if s == "daily" || s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid day range '%s'", part)
+		}
+
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("unknown day '%s'", bounds[0])
+		}
+		last, ok := weekdays[bounds[len(bounds)-1]]
+		if !ok {
+			return fmt.Errorf("unknown day '%s'", bounds[len(bounds)-1])
+		}
+
+		// ranges may wrap around the end of the week, like 'fri-mon'
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	_, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || len(s) != 5 || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", s)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// activeAt tells whether t falls into one of the ranges
+func (s *weeklySchedule) activeAt(t time.Time) bool {
+	t = t.In(s.Location)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	for _, r := range s.Ranges {
+		if r.Start < r.End {
+			if r.Days[day] && offset >= r.Start && offset < r.End {
+				return true
+			}
+			continue
+		}
+
+		if (r.Days[day] && offset >= r.Start) || (r.Days[yesterday] && offset < r.End) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduledNetworks returns the networks that are to be on at t
+func scheduledNetworks(networks []network, t time.Time) []network {
+	var scheduled []network
+	for _, n := range networks {
+		if n.Schedule == nil || n.Schedule.activeAt(t) {
+			scheduled = append(scheduled, n)
+		}
+	}
+	return scheduled
+}
+
+func sameNetworks(a, b []network) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// runScheduler follows the schedules of the networks while hostapd runs
+// those in running. When no network is to be on the radio is disabled, and
+// enabled again once the running networks are. Any other change needs a new
+// config, so errRestart is returned.
+func runScheduler(networks []network, running []network, stop <-chan struct{}) error {
+	enabled := true
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		wanted := scheduledNetworks(networks, time.Now())
+
+		switch {
+		case len(wanted) == 0 && enabled:
+			log.Infoln("No network is scheduled to be on, disabling the radio")
+			err := hostapdCommand(running[0].Name, "DISABLE")
+			if err != nil {
+				log.Errorf("Failed to disable the radio: %s", err.Error())
+			} else {
+				enabled = false
+			}
+		case len(wanted) == 0:
+		case !sameNetworks(wanted, running):
+			log.Infoln("The scheduled networks changed, restarting with a new config")
+			return errRestart
+		case !enabled:
+			log.Infoln("Networks are scheduled to be on, enabling the radio")
+			err := hostapdCommand(running[0].Name, "ENABLE")
+			if err != nil {
+				log.Errorf("Failed to enable the radio: %s", err.Error())
+			} else {
+				enabled = true
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := parseSchedule("# office hours\nmon-fri 08:00-18:00\nsat,sun 10:00-14:00\n\nfri-mon 22:00-02:00\n", time.UTC)
+	assert.Nil(t, err)
+	assert.Len(t, s.Ranges, 3)
+	assert.Equal(t, [7]bool{false, true, true, true, true, true, false}, s.Ranges[0].Days)
+	assert.Equal(t, 8*time.Hour, s.Ranges[0].Start)
+	assert.Equal(t, 18*time.Hour, s.Ranges[0].End)
+	assert.Equal(t, [7]bool{true, false, false, false, false, false, true}, s.Ranges[1].Days)
+	assert.Equal(t, [7]bool{true, true, false, false, false, true, true}, s.Ranges[2].Days)
+
+	s, err = parseSchedule("daily 07:30-24:00", time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, 7*time.Hour+30*time.Minute, s.Ranges[0].Start)
+	assert.Equal(t, 24*time.Hour, s.Ranges[0].End)
+
+	for _, bad := range []string{
+		"",
+		"# nothing",
+		"mon-fri",
+		"monday 08:00-18:00",
+		"mon-fri-sat 08:00-18:00",
+		"mon 8:00-18:00",
+		"mon 08:00-25:00",
+		"mon 08:60-18:00",
+		"mon 08:00-08:00",
+		"mon 08:00",
+	} {
+		_, err = parseSchedule(bad, time.UTC)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestScheduleActiveAt(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+
+	s, err := parseSchedule("mon-fri 08:00-18:00\nfri 22:00-02:00", berlin)
+	assert.Nil(t, err)
+
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	// 2017-03-06 is a Monday
+	assert.False(t, s.activeAt(at("2017-03-06 07:59")))
+	assert.True(t, s.activeAt(at("2017-03-06 08:00")))
+	assert.True(t, s.activeAt(at("2017-03-06 17:59")))
+	assert.False(t, s.activeAt(at("2017-03-06 18:00")))
+	assert.True(t, s.activeAt(at("2017-03-10 23:00")))
+	assert.True(t, s.activeAt(at("2017-03-11 01:59")), "the friday range lasts into saturday")
+	assert.False(t, s.activeAt(at("2017-03-11 02:00")))
+	assert.False(t, s.activeAt(at("2017-03-12 12:00")))
+
+	// the schedule is in Berlin time, 08:30 there is 07:30 UTC in winter
+	assert.True(t, s.activeAt(time.Date(2017, 3, 6, 7, 30, 0, 0, time.UTC)))
+	assert.False(t, s.activeAt(time.Date(2017, 3, 6, 17, 30, 0, 0, time.UTC)))
+}
+
+func TestReadSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readSchedule(dir, &n)
+	assert.Nil(t, err)
+	assert.Nil(t, n.Schedule)
+
+	err = ioutil.WriteFile(path.Join(dir, "schedule"), []byte("mon-fri 08:00-18:00\n"), 0644)
+	assert.Nil(t, err)
+	err = readSchedule(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Local, n.Schedule.Location)
+
+	err = ioutil.WriteFile(path.Join(dir, "schedule_timezone"), []byte("Mars/Olympus_Mons"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readSchedule(dir, &n))
+}
+
+func TestScheduledNetworks(t *testing.T) {
+	office, err := parseSchedule("mon-fri 08:00-18:00", time.UTC)
+	assert.Nil(t, err)
+
+	networks := []network{{Name: "wl_private"}, {Name: "wl_public", Schedule: office}}
+	monday := time.Date(2017, 3, 6, 12, 0, 0, 0, time.UTC)
+
+	assert.Len(t, scheduledNetworks(networks, monday), 2)
+	assert.Equal(t, "wl_private", scheduledNetworks(networks, monday.Add(12*time.Hour))[0].Name)
+	assert.True(t, sameNetworks(networks, scheduledNetworks(networks, monday)))
+	assert.False(t, sameNetworks(networks, scheduledNetworks(networks, monday.Add(12*time.Hour))))
+}
+
+func TestRunScheduler(t *testing.T) {
+	never, err := parseSchedule("mon 00:00-00:01", time.UTC)
+	assert.Nil(t, err)
+	always, err := parseSchedule("daily 00:00-24:00", time.UTC)
+	assert.Nil(t, err)
+
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{"DISABLE": "OK\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": ctrl})()
+
+	stop := make(chan struct{})
+	close(stop)
+
+	// nothing scheduled, the radio goes off
+	networks := []network{{Name: "wl_private", Schedule: never}}
+	if never.activeAt(time.Now()) {
+		t.Skip("running during the only scheduled minute")
+	}
+	err = runScheduler(networks, networks, stop)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DISABLE"}, ctrl.Requests)
+
+	// the guest network needs to be added to the config
+	networks = []network{{Name: "wl_private"}, {Name: "wl_public", Schedule: always}}
+	err = runScheduler(networks, networks[:1], stop)
+	assert.Equal(t, errRestart, err)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	sdNotifyPoll   = time.Second
+	sdStatusPeriod = 30 * time.Second
+)
+
+// sdNotify sends a state like 'READY=1' to systemd. Without a NOTIFY_SOCKET,
+// i.e. when not run as a notify service, it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// abstract sockets are given with a leading '@'
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often systemd expects WATCHDOG=1, or 0 if
+// the watchdog isn't enabled for us
+func sdWatchdogInterval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// hostapdReady tells whether hostapd brought up the BSSes of all networks.
+// A disabled radio counts too, as the scheduler disables it when no network
+// is scheduled to be on.
+func hostapdReady(networks []network) bool {
+	return hostapdInState(networks, "ENABLED", "DISABLED")
+}
+
+// describeNetworks sums up the networks and their stations for STATUS=
+func describeNetworks(networks []network) string {
+	stations, err := getStationInventory(networks, opts.LeaseFile)
+	if err != nil {
+		log.Debugf("Failed to count the stations: %s", err.Error())
+	}
+
+	counts := make(map[string]int)
+	for _, s := range stations {
+		counts[s.Interface]++
+	}
+
+	var parts []string
+	for _, n := range networks {
+		if err != nil {
+			parts = append(parts, n.Name)
+			continue
+		}
+
+		noun := "stations"
+		if counts[n.Name] == 1 {
+			noun = "station"
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s) with %d %s", n.Name, n.SSID, counts[n.Name], noun))
+	}
+
+	return "Serving " + strings.Join(parts, ", ")
+}
+
+// runSystemdNotifier reports readiness once hostapd is up, keeps the status
+// systemd shows current and pings the watchdog as long as hostapd answers
+func runSystemdNotifier(networks []network, stop <-chan struct{}) error {
+	watchdog := sdWatchdogInterval()
+	ready := false
+	var lastStatus, lastPing time.Time
+
+	ticker := time.NewTicker(sdNotifyPoll)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+
+		if !ready && hostapdReady(networks) {
+			log.Infoln("hostapd is ready, notifying systemd")
+			err := sdNotify("READY=1\nSTATUS=" + describeNetworks(networks))
+			if err != nil {
+				log.Warnf("Failed to notify systemd: %s", err.Error())
+			}
+			ready = true
+			lastStatus = now
+		}
+
+		if ready && now.Sub(lastStatus) >= sdStatusPeriod {
+			err := sdNotify("STATUS=" + describeNetworks(networks))
+			if err != nil {
+				log.Warnf("Failed to notify systemd: %s", err.Error())
+			}
+			lastStatus = now
+		}
+
+		// all BSSes are served by the same hostapd process
+		if watchdog != 0 && now.Sub(lastPing) >= watchdog/2 {
+			err := hostapdPing(networks[0].Name)
+			if err != nil {
+				log.Warnf("hostapd doesn't respond, not pinging the watchdog: %s", err.Error())
+			} else {
+				err = sdNotify("WATCHDOG=1")
+				if err != nil {
+					log.Warnf("Failed to ping the watchdog: %s", err.Error())
+				}
+				lastPing = now
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
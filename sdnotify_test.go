@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenNotifySocket points NOTIFY_SOCKET to a socket in dir and returns it
+func listenNotifySocket(t *testing.T, dir string) (*net.UnixConn, func()) {
+	socket := path.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.Nil(t, err)
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.Nil(t, sdNotify("READY=1"), "not run by systemd")
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conn, cleanup := listenNotifySocket(t, dir)
+	defer cleanup()
+
+	assert.Nil(t, sdNotify("READY=1"))
+	assert.Equal(t, "READY=1", readNotification(t, conn))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval(), "meant for another process")
+}
+
+func TestHostapdReady(t *testing.T) {
+	private := &mockHostapdCtrl{Replies: map[string]string{"STATUS": "state=ENABLED\nphy=phy0\n"}}
+	public := &mockHostapdCtrl{Replies: map[string]string{"STATUS": "state=HT_SCAN\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": private, "wl_public": public})()
+
+	networks := []network{{Name: "wl_private"}, {Name: "wl_public"}}
+	assert.False(t, hostapdReady(networks))
+
+	public.Replies["STATUS"] = "state=ENABLED\n"
+	assert.True(t, hostapdReady(networks))
+}
+
+func TestDescribeNetworks(t *testing.T) {
+	opts.LeaseFile = "/nonexistent"
+	private := &mockHostapdCtrl{Replies: map[string]string{
+		"STA-FIRST": "aa:bb:cc:dd:ee:ff\nconnected_time=42\n",
+	}}
+	public := &mockHostapdCtrl{}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": private, "wl_public": public})()
+
+	networks := []network{{Name: "wl_private", SSID: "Office"}, {Name: "wl_public", SSID: "Guests"}}
+	assert.Equal(t, "Serving wl_private (Office) with 1 station, wl_public (Guests) with 0 stations", describeNetworks(networks))
+}
+
+func TestRunSystemdNotifier(t *testing.T) {
+	opts.LeaseFile = "/nonexistent"
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{"STATUS": "state=ENABLED\n", "PING": "PONG\n"}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_private": ctrl})()
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conn, cleanup := listenNotifySocket(t, dir)
+	defer cleanup()
+
+	os.Setenv("WATCHDOG_USEC", "10000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	stop := make(chan struct{})
+	close(stop)
+	err = runSystemdNotifier([]network{{Name: "wl_private", SSID: "Office"}}, stop)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "READY=1\nSTATUS=Serving wl_private (Office) with 0 stations", readNotification(t, conn))
+	assert.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+
+	ctrl.Replies["PING"] = "FAIL\n"
+	err = runSystemdNotifier([]network{{Name: "wl_private", SSID: "Office"}}, stop)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "READY=1\nSTATUS=Serving wl_private (Office) with 0 stations", readNotification(t, conn))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1024))
+	assert.NotNil(t, err, "no watchdog ping for an unresponsive hostapd")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// sealedSecretPrefix marks SKVS values sealed with the host key. It is
+// followed by the base64 encoded nonce and NaCl secretbox.
+const sealedSecretPrefix = "secretbox:"
+
+const secretsNonceSize = 24
+
+// isSealedSecret tells whether a value from the SKVS is sealed
+func isSealedSecret(value string) bool {
+	return strings.HasPrefix(value, sealedSecretPrefix)
+}
+
+// loadSecretsKey reads the host key, 32 bytes as hex digits
+func loadSecretsKey(filename string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the secrets key: %s", err.Error())
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("Invalid secrets key in '%s', expected 64 hex digits", filename)
+	}
+
+	key := &[32]byte{}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// generateSecretsKey writes a new random host key, refusing to replace one
+// that secrets may already be sealed with
+func generateSecretsKey(filename string) error {
+	_, err := os.Stat(filename)
+	if err == nil {
+		return fmt.Errorf("There already is a secrets key in '%s'", filename)
+	}
+
+	raw := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, raw)
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(filename, []byte(hex.EncodeToString(raw)+"\n"), 0600)
+}
+
+// sealSecret encrypts a secret for storing it in the SKVS
+func sealSecret(secret string, key *[32]byte) (string, error) {
+	var nonce [secretsNonceSize]byte
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return "", err
+	}
+
+	box := secretbox.Seal(nonce[:], []byte(secret), &nonce, key)
+	return sealedSecretPrefix + base64.StdEncoding.EncodeToString(box), nil
+}
+
+// unsealSecret decrypts a value sealed by sealSecret
+func unsealSecret(value string, key *[32]byte) (string, error) {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedSecretPrefix))
+	if err != nil || len(box) < secretsNonceSize+secretbox.Overhead {
+		return "", fmt.Errorf("malformed sealed secret")
+	}
+
+	var nonce [secretsNonceSize]byte
+	copy(nonce[:], box)
+	secret, ok := secretbox.Open(nil, box[secretsNonceSize:], &nonce, key)
+	if !ok {
+		return "", fmt.Errorf("the secret wasn't sealed with this host's key")
+	}
+
+	return string(secret), nil
+}
+
+// openSecret returns a secret read from the SKVS, decrypting it in memory
+// with the key in opts.SecretsKey if it is sealed
+func openSecret(value string) (string, error) {
+	if !isSealedSecret(value) {
+		return value, nil
+	}
+
+	key, err := loadSecretsKey(opts.SecretsKey)
+	if err != nil {
+		return "", err
+	}
+
+	return unsealSecret(value, key)
+}
+
+type sealCommand struct {
+	GenerateKey bool `long:"generate-key" description:"create the secrets key first"`
+}
+
+func (c *sealCommand) Execute(args []string) error {
+	setupLogging()
+
+	if c.GenerateKey {
+		err := generateSecretsKey(opts.SecretsKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := loadSecretsKey(opts.SecretsKey)
+	if err != nil {
+		return err
+	}
+
+	// the secret is read from stdin to keep it out of the shell history
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	secret := strings.Trim(line, " \n\r\t")
+	if secret == "" {
+		return fmt.Errorf("Expected the secret to seal on stdin")
+	}
+
+	sealed, err := sealSecret(secret, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(sealed)
+	return nil
+}
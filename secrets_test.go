@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withTestSecretsKey points opts.SecretsKey to a new key in dir
+func withTestSecretsKey(t *testing.T, dir string) (*[32]byte, func()) {
+	oldKey := opts.SecretsKey
+	opts.SecretsKey = path.Join(dir, "secrets.key")
+
+	assert.Nil(t, generateSecretsKey(opts.SecretsKey))
+	key, err := loadSecretsKey(opts.SecretsKey)
+	assert.Nil(t, err)
+
+	return key, func() { opts.SecretsKey = oldKey }
+}
+
+func TestSealSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, restore := withTestSecretsKey(t, dir)
+	defer restore()
+
+	info, err := os.Stat(opts.SecretsKey)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NotNil(t, generateSecretsKey(opts.SecretsKey), "an existing key must not be replaced")
+
+	sealed, err := sealSecret("foobarpassprivate", key)
+	assert.Nil(t, err)
+	assert.True(t, isSealedSecret(sealed))
+	assert.NotContains(t, sealed, "foobarpassprivate")
+
+	secret, err := openSecret(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "foobarpassprivate", secret)
+
+	secret, err = openSecret("plaintext")
+	assert.Nil(t, err)
+	assert.Equal(t, "plaintext", secret)
+
+	_, err = openSecret(sealed[:len(sealed)-4] + "AAA=")
+	assert.NotNil(t, err)
+	_, err = openSecret(sealedSecretPrefix + "not base64")
+	assert.NotNil(t, err)
+
+	otherKey := &[32]byte{}
+	_, err = unsealSecret(sealed, otherKey)
+	assert.NotNil(t, err)
+}
+
+func TestLoadSecretsKeyInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "secrets.key")
+	_, err = loadSecretsKey(filename)
+	assert.NotNil(t, err)
+
+	err = ioutil.WriteFile(filename, []byte("abcd\n"), 0600)
+	assert.Nil(t, err)
+	_, err = loadSecretsKey(filename)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigSealedPassword(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	key, restore := withTestSecretsKey(t, configPath)
+	defer restore()
+
+	sealed, err := sealSecret("foobarpasspublic", key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "guest", "password"), []byte(sealed+"\n"), 0600)
+	assert.Nil(t, err)
+
+	networks, err := getNeededNetworks(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedNets, networks)
+
+	opts.SecretsKey = path.Join(configPath, "missing.key")
+	_, err = loadConfig(configPath)
+	errs, ok := err.(configErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "wl_public.password", errs[0].Field)
+}
+
+func TestRotatePasswordSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, restore := withTestSecretsKey(t, dir)
+	defer restore()
+
+	sealed, err := sealSecret("foobarpasspublic", key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "password"), []byte(sealed+"\n"), 0600)
+	assert.Nil(t, err)
+
+	password, err := rotatePassword(dir, time.Now())
+	assert.Nil(t, err)
+
+	value, err := readOptionalValue(dir, "password", "")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(value, sealedSecretPrefix), "a sealed password must stay sealed")
+
+	opened, err := openSecret(value)
+	assert.Nil(t, err)
+	assert.Equal(t, password, opened)
+}
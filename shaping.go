@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	shapingInterval = 15 * time.Second
+
+	// shapingMarkBase tags the packets of rate limited networks in the
+	// firewall, so that the uplink can still tell them apart after NAT
+	shapingMarkBase = 0x48500000
+
+	// the minor of the default class of every HTB qdisc we install
+	shapingDefaultClass = 0xffff
+
+	minRateKbit = 8
+)
+
+// readShapingPolicy reads the optional 'rate_limit' of the whole network and
+// the 'client_rate_limit' of each of its clients, e.g. '20mbit'. Both apply
+// in either direction.
+func readShapingPolicy(dir string, n *network) error {
+	for _, limit := range []struct {
+		Key  string
+		Rate *int
+	}{
+		{"rate_limit", &n.RateLimit},
+		{"client_rate_limit", &n.ClientRateLimit},
+	} {
+		value, err := readOptionalValue(dir, limit.Key, "")
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			*limit.Rate = 0
+			continue
+		}
+
+		*limit.Rate, err = parseRate(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s '%s' for network '%s': %s", limit.Key, value, n.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// parseRate returns a rate in kbit/s given with a 'kbit', 'mbit' or 'gbit'
+// suffix, or without one in kbit/s
+func parseRate(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	factor := 1
+	for suffix, f := range map[string]int{"kbit": 1, "mbit": 1000, "gbit": 1000000} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			factor = f
+			break
+		}
+	}
+
+	rate, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number with an optional kbit, mbit or gbit unit")
+	}
+
+	rate *= factor
+	if rate < minRateKbit || rate > tcUnlimitedRate*8/1000 {
+		return 0, fmt.Errorf("must be between %dkbit and 10gbit", minRateKbit)
+	}
+
+	return rate, nil
+}
+
+// shapingMark is the firewall mark of a rate limited network
+func shapingMark(iface string) uint32 {
+	var h uint32
+	for _, c := range iface {
+		h = h*31 + uint32(c)
+	}
+	return shapingMarkBase | h&0xffff
+}
+
+// shapingState is what is shaped. The shaping task keeps it in a file for
+// the status command.
+type shapingState struct {
+	Uplink   string          `json:"uplink,omitempty"`
+	Networks []shapedNetwork `json:"networks"`
+}
+
+type shapedNetwork struct {
+	Interface string         `json:"interface"`
+	RateKbit  int            `json:"rate_kbit,omitempty"`
+	Mark      uint32         `json:"mark,omitempty"`
+	Clients   []shapedClient `json:"clients,omitempty"`
+
+	// the counters, only filled in by the status command
+	Download *tcClassStats `json:"download,omitempty"`
+	Upload   *tcClassStats `json:"upload,omitempty"`
+}
+
+type shapedClient struct {
+	MAC      string        `json:"mac"`
+	IP       string        `json:"ip"`
+	RateKbit int           `json:"rate_kbit"`
+	Download *tcClassStats `json:"download,omitempty"`
+}
+
+// networkClass, clientClass and uplinkClass are the HTB classes of a shaped
+// network: on its interface 1:1 holds the whole network and 1:2 onwards its
+// clients. On the uplink each network gets a class after its position.
+func networkClass() uint32 {
+	return tcHandle(1, 1)
+}
+
+func clientClass(i int) uint32 {
+	return tcHandle(1, uint16(i+2))
+}
+
+func uplinkClass(i int) uint32 {
+	return tcHandle(1, uint16(i+1))
+}
+
+func kbitToBytes(kbit int) uint32 {
+	return uint32(kbit * 1000 / 8)
+}
+
+// planShaping works out the classes needed for the networks with rate
+// limits and their current stations. Clients get the lower of the network's
+// client limit and the bandwidth of the voucher they used. Per-client limits
+// only apply to IPv4, IPv6 traffic shares the limit of the network.
+func planShaping(networks []network, stations []station, uplink string, now time.Time) (*shapingState, error) {
+	state := &shapingState{Networks: []shapedNetwork{}}
+
+	for _, n := range routedNetworks(networks) {
+		if n.RateLimit == 0 && n.ClientRateLimit == 0 && n.VoucherMode == "" {
+			continue
+		}
+
+		var vouchers []voucher
+		if n.VoucherMode != "" {
+			var err error
+			vouchers, err = loadVouchers(n.VoucherDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sn := shapedNetwork{Interface: n.Name, RateKbit: n.RateLimit}
+		if n.RateLimit != 0 {
+			sn.Mark = shapingMark(n.Name)
+			state.Uplink = uplink
+		}
+
+		for _, s := range stations {
+			ip := net.ParseIP(s.IP)
+			if s.Interface != n.Name || ip == nil || ip.To4() == nil {
+				continue
+			}
+
+			rate := n.ClientRateLimit
+			for _, v := range vouchers {
+				if v.BandwidthKbit != 0 && v.validAt(now) && v.hasDevice(s.MAC) && (rate == 0 || v.BandwidthKbit < rate) {
+					rate = v.BandwidthKbit
+				}
+			}
+			if rate != 0 {
+				sn.Clients = append(sn.Clients, shapedClient{MAC: s.MAC, IP: s.IP, RateKbit: rate})
+			}
+		}
+		sort.Sort(shapedClientsByMAC(sn.Clients))
+
+		if sn.RateKbit != 0 || len(sn.Clients) != 0 {
+			state.Networks = append(state.Networks, sn)
+		}
+	}
+
+	return state, nil
+}
+
+type shapedClientsByMAC []shapedClient
+
+func (c shapedClientsByMAC) Len() int           { return len(c) }
+func (c shapedClientsByMAC) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c shapedClientsByMAC) Less(i, j int) bool { return c[i].MAC < c[j].MAC }
+
+// applyShaping installs the qdiscs of a plan. Downloads are shaped by HTB on
+// the AP interfaces, uploads of single clients are policed on their ingress
+// and uploads of whole networks shaped by HTB on the uplink, going by the
+// firewall mark. The interfaces must not be shaped yet.
+func applyShaping(state *shapingState) error {
+	conn, err := newRouteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, n := range state.Networks {
+		index, err := interfaceIndexByName(n.Interface)
+		if err != nil {
+			return err
+		}
+
+		rate := uint32(tcUnlimitedRate)
+		if n.RateKbit != 0 {
+			rate = kbitToBytes(n.RateKbit)
+		}
+
+		reqs := []nlRequest{
+			tcHTBQdiscRequest(index, tcHandle(1, 0), shapingDefaultClass),
+			tcHTBClassRequest(index, networkClass(), tcHandle(1, 0), rate, rate),
+			tcHTBClassRequest(index, tcHandle(1, shapingDefaultClass), networkClass(), rate, rate),
+		}
+		if len(n.Clients) != 0 {
+			reqs = append(reqs, tcIngressQdiscRequest(index))
+		}
+		for i, c := range n.Clients {
+			ip := net.ParseIP(c.IP)
+			clientRate := kbitToBytes(c.RateKbit)
+			reqs = append(reqs,
+				tcHTBClassRequest(index, clientClass(i), networkClass(), clientRate, clientRate),
+				tcU32ClassifyRequest(index, tcHandle(1, 0), 1, ip, clientClass(i)),
+				tcU32PoliceRequest(index, 1, ip, clientRate))
+		}
+
+		log.Debugf("Shaping %s to %s with %d client limits", n.Interface, formatRate(n.RateKbit), len(n.Clients))
+		_, err = conn.Execute(reqs...)
+		if err != nil {
+			return fmt.Errorf("Failed to shape %s: %s", n.Interface, err.Error())
+		}
+	}
+
+	if state.Uplink == "" {
+		return nil
+	}
+
+	index, err := interfaceIndexByName(state.Uplink)
+	if err != nil {
+		return err
+	}
+
+	reqs := []nlRequest{
+		tcHTBQdiscRequest(index, tcHandle(1, 0), shapingDefaultClass),
+		tcHTBClassRequest(index, tcHandle(1, shapingDefaultClass), tcHandle(1, 0), tcUnlimitedRate, tcUnlimitedRate),
+	}
+	for i, n := range state.Networks {
+		if n.Mark == 0 {
+			continue
+		}
+		rate := kbitToBytes(n.RateKbit)
+		reqs = append(reqs,
+			tcHTBClassRequest(index, uplinkClass(i), tcHandle(1, 0), rate, rate),
+			tcFWClassifyRequest(index, tcHandle(1, 0), 1, n.Mark, uplinkClass(i)))
+	}
+
+	log.Debugf("Shaping uploads on %s", state.Uplink)
+	_, err = conn.Execute(reqs...)
+	if err != nil {
+		return fmt.Errorf("Failed to shape %s: %s", state.Uplink, err.Error())
+	}
+
+	return nil
+}
+
+// clearShaping removes our qdiscs, giving the interfaces their default one
+// back. Interfaces that are gone or weren't shaped are skipped.
+func clearShaping(state *shapingState) error {
+	conn, err := newRouteConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	type qdisc struct {
+		Interface string
+		Parent    uint32
+	}
+	var qdiscs []qdisc
+	for _, n := range state.Networks {
+		qdiscs = append(qdiscs, qdisc{n.Interface, tcHRoot}, qdisc{n.Interface, tcHIngress})
+	}
+	if state.Uplink != "" {
+		qdiscs = append(qdiscs, qdisc{state.Uplink, tcHRoot})
+	}
+
+	for _, q := range qdiscs {
+		index, err := interfaceIndexByName(q.Interface)
+		if err != nil {
+			continue
+		}
+
+		_, err = conn.Execute(tcDeleteQdiscRequest(index, q.Parent))
+		if err != nil && err != syscall.ENOENT && err != syscall.EINVAL {
+			return fmt.Errorf("Failed to remove qdisc from %s: %s", q.Interface, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func formatRate(kbit int) string {
+	if kbit == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%dkbit", kbit)
+}
+
+func loadShapingState(filename string) (*shapingState, error) {
+	state := &shapingState{Networks: []shapedNetwork{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse shaping state in %s: %s", filename, err.Error())
+	}
+
+	return state, nil
+}
+
+func saveShapingState(filename string, state *shapingState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(filename, data, 0644)
+}
+
+// shaper installs shaping states one after another. Besides what it
+// applied it keeps track of what may be installed still, as the qdiscs are
+// added exclusively and anything left over blocks applying again: what a
+// previous instance left, recorded in stateFile, and what a failed apply got
+// through.
+type shaper struct {
+	stateFile string
+	applied   *shapingState
+	stale     []*shapingState
+}
+
+func newShaper(stateFile string) *shaper {
+	previous, err := loadShapingState(stateFile)
+	if err != nil {
+		log.Warnf("Not removing the traffic shaping of a previous run: %s", err.Error())
+	}
+	return &shaper{stateFile: stateFile, stale: []*shapingState{previous}}
+}
+
+// update replaces whatever is installed with state, unless it is in place
+// already
+func (s *shaper) update(state *shapingState) error {
+	if reflect.DeepEqual(state, s.applied) {
+		return nil
+	}
+
+	err := clearShapingStates(append(s.stale, s.applied, state)...)
+	if err != nil {
+		return err
+	}
+	s.stale = nil
+	s.applied = nil
+
+	// saved first, so that the next instance clears what we get through if
+	// we die applying it
+	err = saveShapingState(s.stateFile, state)
+	if err != nil {
+		return err
+	}
+
+	err = applyShaping(state)
+	if err != nil {
+		s.stale = []*shapingState{state}
+		return err
+	}
+	s.applied = state
+
+	return nil
+}
+
+// clear removes all shaping that may be installed along with stateFile
+func (s *shaper) clear() error {
+	os.Remove(s.stateFile)
+	return clearShapingStates(append(s.stale, s.applied)...)
+}
+
+// clearShapingStates runs clearShaping once for each of states that isn't nil
+func clearShapingStates(states ...*shapingState) error {
+	var cleared []*shapingState
+	for _, state := range states {
+		if state == nil || containsShapingState(cleared, state) {
+			continue
+		}
+		cleared = append(cleared, state)
+
+		err := clearShaping(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsShapingState(states []*shapingState, state *shapingState) bool {
+	for _, s := range states {
+		if reflect.DeepEqual(s, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// runShaper keeps the shaping in line with the stations connected, their
+// vouchers and the uplink until stop is closed, and removes it then
+func runShaper(networks []network, stateFile string, stop <-chan struct{}) error {
+	sh := newShaper(stateFile)
+
+	reconcile := func() error {
+		stations, err := getStationInventory(routedNetworks(networks), opts.LeaseFile)
+		if err != nil {
+			return err
+		}
+
+		uplink, err := getUplinkInterface()
+		if err != nil {
+			return err
+		}
+
+		state, err := planShaping(networks, stations, uplink, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return sh.update(state)
+	}
+
+	ticker := time.NewTicker(shapingInterval)
+	defer ticker.Stop()
+
+	for {
+		err := reconcile()
+		if err != nil {
+			log.Errorf("Failed to update traffic shaping: %s", err.Error())
+		}
+
+		select {
+		case <-stop:
+			return sh.clear()
+		case <-ticker.C:
+		}
+	}
+}
+
+// getShapingStatus returns the shaping in place along with the counters of
+// its classes
+func getShapingStatus(stateFile string) (*shapingState, error) {
+	state, err := loadShapingState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newRouteConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dumpClasses := func(iface string) (map[uint32]tcClassStats, error) {
+		index, err := interfaceIndexByName(iface)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err := conn.Execute(tcDumpClassesRequest(index))
+		if err != nil {
+			return nil, err
+		}
+		return parseTcClasses(msgs)
+	}
+
+	statsOf := func(classes map[uint32]tcClassStats, class uint32) *tcClassStats {
+		stats, ok := classes[class]
+		if !ok {
+			return nil
+		}
+		return &stats
+	}
+
+	var uplinkClasses map[uint32]tcClassStats
+	if state.Uplink != "" {
+		uplinkClasses, err = dumpClasses(state.Uplink)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range state.Networks {
+		n := &state.Networks[i]
+		classes, err := dumpClasses(n.Interface)
+		if err != nil {
+			return nil, err
+		}
+
+		n.Download = statsOf(classes, networkClass())
+		if n.Mark != 0 {
+			n.Upload = statsOf(uplinkClasses, uplinkClass(i))
+		}
+		for j := range n.Clients {
+			n.Clients[j].Download = statsOf(classes, clientClass(j))
+		}
+	}
+
+	return state, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]int{
+		"512":     512,
+		"512kbit": 512,
+		"20mbit":  20000,
+		"1Gbit\n": 1000000,
+	} {
+		rate, err := parseRate(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, rate, s)
+	}
+
+	for _, bad := range []string{"", "fast", "20mb", "4kbit", "11gbit", "-1mbit"} {
+		_, err := parseRate(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestReadShapingPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readShapingPolicy(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n.RateLimit)
+	assert.Equal(t, 0, n.ClientRateLimit)
+
+	err = ioutil.WriteFile(path.Join(dir, "rate_limit"), []byte("50mbit\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "client_rate_limit"), []byte("5mbit"), 0644)
+	assert.Nil(t, err)
+	err = readShapingPolicy(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, 50000, n.RateLimit)
+	assert.Equal(t, 5000, n.ClientRateLimit)
+
+	err = ioutil.WriteFile(path.Join(dir, "client_rate_limit"), []byte("lots"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readShapingPolicy(dir, &n))
+}
+
+func TestGetNeededNetworksBridgedRateLimit(t *testing.T) {
+	configPath, err := makeTestCfgDir()
+	assert.Nil(t, err)
+	defer os.RemoveAll(configPath)
+
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "vlan"), []byte("10"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "vlan_interface"), []byte("eth1"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(configPath, "system", "wifi", "rate_limit"), []byte("10mbit"), 0644)
+	assert.Nil(t, err)
+
+	_, err = getNeededNetworks(configPath)
+	assert.NotNil(t, err)
+}
+
+func TestPlanShaping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	err = saveVoucher(dir, &voucher{Code: "SLOW234567", ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(time.Hour), BandwidthKbit: 1000, MaxDevices: 1, Devices: []string{"22:22:22:22:22:22"}})
+	assert.Nil(t, err)
+
+	networks := []network{
+		{Name: "wl_private", Subnet: expectedNets[0].Subnet},
+		{Name: "wl_public", Subnet: expectedNets[1].Subnet, RateLimit: 50000, ClientRateLimit: 5000, VoucherMode: voucherModePortal, VoucherDir: dir},
+		{Name: "wl_bridged", Bridge: "br-vlan10", ClientRateLimit: 5000},
+	}
+	stations := []station{
+		{Interface: "wl_private", MAC: "00:00:00:00:00:01", IP: "10.42.0.10"},
+		{Interface: "wl_public", MAC: "33:33:33:33:33:33", IP: "10.43.0.11"},
+		{Interface: "wl_public", MAC: "22:22:22:22:22:22", IP: "10.43.0.10"},
+		{Interface: "wl_public", MAC: "44:44:44:44:44:44"},
+	}
+
+	state, err := planShaping(networks, stations, "eth0", now)
+	assert.Nil(t, err)
+	assert.Equal(t, &shapingState{
+		Uplink: "eth0",
+		Networks: []shapedNetwork{{
+			Interface: "wl_public",
+			RateKbit:  50000,
+			Mark:      shapingMark("wl_public"),
+			Clients: []shapedClient{
+				{MAC: "22:22:22:22:22:22", IP: "10.43.0.10", RateKbit: 1000},
+				{MAC: "33:33:33:33:33:33", IP: "10.43.0.11", RateKbit: 5000},
+			},
+		}},
+	}, state)
+
+	// without limits of its own, only voucher clients are shaped
+	networks[1].RateLimit, networks[1].ClientRateLimit = 0, 0
+	state, err = planShaping(networks, stations, "eth0", now)
+	assert.Nil(t, err)
+	assert.Equal(t, "", state.Uplink)
+	assert.Len(t, state.Networks, 1)
+	assert.Equal(t, []shapedClient{{MAC: "22:22:22:22:22:22", IP: "10.43.0.10", RateKbit: 1000}}, state.Networks[0].Clients)
+
+	state, err = planShaping(networks, stations, "eth0", now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, state.Networks, 0, "expired vouchers don't limit anyone")
+}
+
+func withMockInterfaceIndexes(indexes map[string]int) func() {
+	orig := interfaceIndexByName
+	interfaceIndexByName = func(name string) (int, error) {
+		index, ok := indexes[name]
+		if !ok {
+			return 0, syscall.ENODEV
+		}
+		return index, nil
+	}
+	return func() {
+		interfaceIndexByName = orig
+	}
+}
+
+func testShapingState() *shapingState {
+	return &shapingState{
+		Uplink: "eth0",
+		Networks: []shapedNetwork{{
+			Interface: "wl_public",
+			RateKbit:  50000,
+			Mark:      shapingMark("wl_public"),
+			Clients:   []shapedClient{{MAC: "22:22:22:22:22:22", IP: "10.43.0.10", RateKbit: 1000}},
+		}},
+	}
+}
+
+func TestApplyShaping(t *testing.T) {
+	conn := &mockNetlinkConn{}
+	defer withMockRoutes(conn, nil)()
+	defer withMockInterfaceIndexes(map[string]int{"eth0": 2, "wl_public": 5})()
+
+	err := applyShaping(testShapingState())
+	assert.Nil(t, err)
+	assert.Len(t, conn.Requests, 2)
+
+	var types []uint16
+	for _, r := range conn.Requests[0] {
+		types = append(types, r.Type)
+		assert.Equal(t, uint32(5), nativeEndian.Uint32(r.Data[4:8]))
+	}
+	assert.Equal(t, []uint16{
+		syscall.RTM_NEWQDISC, syscall.RTM_NEWTCLASS, syscall.RTM_NEWTCLASS,
+		syscall.RTM_NEWQDISC,
+		syscall.RTM_NEWTCLASS, syscall.RTM_NEWTFILTER, syscall.RTM_NEWTFILTER,
+	}, types)
+	assert.Equal(t, clientClass(0), nativeEndian.Uint32(conn.Requests[0][4].Data[8:12]))
+
+	// the uplink class of the network, picked by its firewall mark
+	uplink := conn.Requests[1]
+	assert.Len(t, uplink, 4)
+	assert.Equal(t, uint32(2), nativeEndian.Uint32(uplink[0].Data[4:8]))
+	assert.Equal(t, uplinkClass(0), nativeEndian.Uint32(uplink[2].Data[8:12]))
+	assert.Equal(t, shapingMark("wl_public"), nativeEndian.Uint32(uplink[3].Data[8:12]))
+
+	conn.Err = syscall.EEXIST
+	assert.NotNil(t, applyShaping(testShapingState()))
+}
+
+func TestClearShaping(t *testing.T) {
+	conn := &mockNetlinkConn{Err: syscall.ENOENT}
+	defer withMockRoutes(conn, nil)()
+	defer withMockInterfaceIndexes(map[string]int{"eth0": 2, "wl_public": 5})()
+
+	err := clearShaping(testShapingState())
+	assert.Nil(t, err, "interfaces without our qdiscs are fine")
+	assert.Len(t, conn.Requests, 3)
+	for _, reqs := range conn.Requests {
+		assert.Equal(t, uint16(syscall.RTM_DELQDISC), reqs[0].Type)
+	}
+	assert.Equal(t, uint32(tcHIngress), nativeEndian.Uint32(conn.Requests[1][0].Data[12:16]))
+
+	conn.Err = syscall.EPERM
+	assert.NotNil(t, clearShaping(testShapingState()))
+}
+
+func TestRunShaperClearsLeftovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a previous instance shaped wl_old, which is gone from the config
+	stateFile := path.Join(dir, "shaping.json")
+	err = saveShapingState(stateFile, &shapingState{Networks: []shapedNetwork{{Interface: "wl_old"}}})
+	assert.Nil(t, err)
+
+	conn := &mockNetlinkConn{}
+	defer withMockRoutes(conn, map[int]string{2: "eth0"})()
+	defer withMockInterfaceIndexes(map[string]int{"eth0": 2, "wl_public": 5, "wl_old": 7})()
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_public": {Replies: map[string]string{}}})()
+
+	conn.Replies = []syscall.NetlinkMessage{
+		routeMessage(syscall.RTM_NEWROUTE, 32, nlAttr(syscall.RTA_DST, []byte{8, 8, 8, 8}), nlAttrU32(syscall.RTA_OIF, 2)),
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	err = runShaper([]network{{Name: "wl_public", RateLimit: 50000}}, stateFile, stop)
+	assert.Nil(t, err)
+
+	// what the previous instance left and what is in the way of the new
+	// qdiscs is removed first
+	assert.Equal(t, []uint32{7, 7, 5, 5, 2}, deletedBeforeAdding(conn.Requests))
+
+	_, err = os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// deletedBeforeAdding returns the interfaces of the qdiscs deleted before the
+// first one is added
+func deletedBeforeAdding(requests [][]nlRequest) []uint32 {
+	var deleted []uint32
+	for _, reqs := range requests {
+		if reqs[0].Type == syscall.RTM_NEWQDISC {
+			break
+		}
+		if reqs[0].Type == syscall.RTM_DELQDISC {
+			deleted = append(deleted, nativeEndian.Uint32(reqs[0].Data[4:8]))
+		}
+	}
+	return deleted
+}
+
+// failingAddNetlinkConn fails the FailAdd-th batch adding a qdisc
+type failingAddNetlinkConn struct {
+	mockNetlinkConn
+	FailAdd int
+	adds    int
+}
+
+func (m *failingAddNetlinkConn) Execute(reqs ...nlRequest) ([]syscall.NetlinkMessage, error) {
+	replies, err := m.mockNetlinkConn.Execute(reqs...)
+	if reqs[0].Type == syscall.RTM_NEWQDISC {
+		m.adds++
+		if m.adds == m.FailAdd {
+			return nil, syscall.ENOBUFS
+		}
+	}
+	return replies, err
+}
+
+func TestShaperRetriesFailedApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conn := &failingAddNetlinkConn{FailAdd: 2}
+	orig := newRouteConn
+	newRouteConn = func() (netlinkExecuter, error) {
+		return conn, nil
+	}
+	defer func() { newRouteConn = orig }()
+	defer withMockInterfaceIndexes(map[string]int{"eth0": 2, "wl_public": 5})()
+
+	stateFile := path.Join(dir, "shaping.json")
+	sh := newShaper(stateFile)
+
+	// wl_public gets shaped, the uplink doesn't
+	assert.NotNil(t, sh.update(testShapingState()))
+	assert.Nil(t, sh.applied)
+
+	saved, err := loadShapingState(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, testShapingState(), saved, "the next instance knows what to clear")
+
+	// the qdiscs of wl_public are removed again before retrying
+	conn.Requests = nil
+	assert.Nil(t, sh.update(testShapingState()))
+	assert.Equal(t, []uint32{5, 5, 2}, deletedBeforeAdding(conn.Requests))
+	assert.Equal(t, testShapingState(), sh.applied)
+
+	conn.Requests = nil
+	assert.Nil(t, sh.update(testShapingState()))
+	assert.Len(t, conn.Requests, 0, "nothing to do when in place")
+
+	assert.Nil(t, sh.clear())
+	assert.Equal(t, []uint32{5, 5, 2}, deletedBeforeAdding(conn.Requests))
+	_, err = os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetShapingStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conn := &mockNetlinkConn{}
+	defer withMockRoutes(conn, nil)()
+	defer withMockInterfaceIndexes(map[string]int{"eth0": 2, "wl_public": 5})()
+
+	stateFile := path.Join(dir, "shaping.json")
+	state, err := getShapingStatus(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, &shapingState{Networks: []shapedNetwork{}}, state, "nothing is shaped without a state")
+
+	err = saveShapingState(stateFile, testShapingState())
+	assert.Nil(t, err)
+
+	// class 1:1 on the AP interface and on the uplink look alike to the mock
+	conn.Replies = []syscall.NetlinkMessage{
+		classMessage(tcHandle(1, 1), 4096, 3, 1),
+		classMessage(tcHandle(1, 2), 1024, 1, 0),
+	}
+	state, err = getShapingStatus(stateFile)
+	assert.Nil(t, err)
+	assert.Len(t, conn.Requests, 2)
+	assert.Equal(t, uint64(4096), state.Networks[0].Download.SentBytes)
+	assert.Equal(t, uint64(4096), state.Networks[0].Upload.SentBytes)
+	assert.Equal(t, uint64(1024), state.Networks[0].Clients[0].Download.SentBytes)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type station struct {
+	Interface        string `json:"interface"`
+	MAC              string `json:"mac"`
+	ConnectedSeconds int    `json:"connected_seconds"`
+	VLAN             int    `json:"vlan,omitempty"`
+	IP               string `json:"ip,omitempty"`
+	Hostname         string `json:"hostname,omitempty"`
+	LeaseExpires     string `json:"lease_expires,omitempty"`
+}
+
+// getStationInventory lists the stations associated to each network together
+// with their DHCP lease, if any
+func getStationInventory(networks []network, leaseFile string) ([]station, error) {
+	leases := make(map[string]dhcpLease)
+	data, err := ioutil.ReadFile(leaseFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		parsed, err := parseDnsmasqLeases(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range parsed {
+			leases[l.MAC] = l
+		}
+	}
+
+	inventory := []station{}
+	for _, n := range networks {
+		ctrl, err := dialHostapdCtrl(n.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to hostapd on %s: %s", n.Name, err.Error())
+		}
+
+		stations, err := listHostapdStations(ctrl)
+		ctrl.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sta := range stations {
+			s := station{Interface: n.Name, MAC: sta.MAC}
+			s.ConnectedSeconds, _ = strconv.Atoi(sta.Attributes["connected_time"])
+			// only reported for stations put into a VLAN dynamically
+			s.VLAN, _ = strconv.Atoi(sta.Attributes["vlan_id"])
+
+			if l, ok := leases[sta.MAC]; ok {
+				s.IP = l.IP.String()
+				s.Hostname = l.Hostname
+				if !l.Expires.IsZero() {
+					s.LeaseExpires = l.Expires.UTC().Format(time.RFC3339)
+				}
+			}
+
+			inventory = append(inventory, s)
+		}
+	}
+
+	return inventory, nil
+}
+
+type stationsCommand struct{}
+
+func (c *stationsCommand) Execute(args []string) error {
+	setupLogging()
+
+	networks, err := getNeededNetworks(opts.SKVSPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get network list: %s", err.Error())
+	}
+
+	// networks off schedule have no BSS to ask
+	inventory, err := getStationInventory(scheduledNetworks(networks, time.Now()), opts.LeaseFile)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Found %d stations", len(inventory))
+	return printJSON(inventory)
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStationInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	leaseFile := path.Join(dir, "leases")
+	err = ioutil.WriteFile(leaseFile, []byte("1480000000 aa:bb:cc:dd:ee:ff 10.42.0.23 laptop *\n"), 0644)
+	assert.Nil(t, err)
+
+	defer withMockHostapd(map[string]*mockHostapdCtrl{
+		"wl_private": {Replies: map[string]string{
+			"STA-FIRST": "aa:bb:cc:dd:ee:ff\nconnected_time=42\n",
+		}},
+		"wl_public": {Replies: map[string]string{
+			"STA-FIRST": "11:22:33:44:55:66\nconnected_time=7\nvlan_id=20\n",
+		}},
+	})()
+
+	inventory, err := getStationInventory(expectedNets, leaseFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []station{
+		{Interface: "wl_private", MAC: "aa:bb:cc:dd:ee:ff", ConnectedSeconds: 42, IP: "10.42.0.23", Hostname: "laptop", LeaseExpires: "2016-11-24T15:06:40Z"},
+		{Interface: "wl_public", MAC: "11:22:33:44:55:66", ConnectedSeconds: 7, VLAN: 20},
+	}, inventory)
+}
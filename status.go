@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+)
+
+// status is what the status command reports about the running daemon
+type status struct {
+	Fallback *fallbackRecord `json:"fallback"`
+	Shaping  *shapingState   `json:"shaping"`
+}
+
+type statusCommand struct{}
+
+func (c *statusCommand) Execute(args []string) error {
+	setupLogging()
+
+	fallback, err := loadFallbackRecord(opts.FallbackState)
+	if err != nil {
+		return err
+	}
+
+	shaping, err := getShapingStatus(opts.ShapingState)
+	if err != nil {
+		return fmt.Errorf("Failed to get shaping status: %s", err.Error())
+	}
+
+	return printJSON(status{Fallback: fallback, Shaping: shaping})
+}
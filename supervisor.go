@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// terminateTimeout is how long children get to exit after SIGTERM
+const terminateTimeout = 5 * time.Second
+
+// errRestart is returned by tasks that need everything restarted with a new
+// config
+var errRestart = errors.New("restart requested")
+
+type processExit struct {
+	Name string
+	Err  error
+}
+
+// supervisor runs hostapd, its helper processes and background tasks. As
+// soon as one of them exits all others are stopped, so the container restarts
+// as a whole.
+type supervisor struct {
+	// mutex guards running and finished, which are read from other
+	// goroutines by Signal and Exited
+	mutex     sync.Mutex
+	running   map[string]*exec.Cmd
+	finished  map[string]bool
+	tasks     map[string]bool
+	exited    chan processExit
+	stopTasks chan struct{}
+	stopped   bool
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		running:   make(map[string]*exec.Cmd),
+		finished:  make(map[string]bool),
+		tasks:     make(map[string]bool),
+		exited:    make(chan processExit, 8),
+		stopTasks: make(chan struct{}),
+	}
+}
+
+func (s *supervisor) Start(name string, binary string, args ...string) error {
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = []string{}
+
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start %s: %s", name, err.Error())
+	}
+
+	log.Debugf("Started %s with pid %d", name, cmd.Process.Pid)
+	s.mutex.Lock()
+	s.running[name] = cmd
+	s.mutex.Unlock()
+	go func() {
+		err := cmd.Wait()
+		s.mutex.Lock()
+		s.finished[name] = true
+		s.mutex.Unlock()
+		s.exited <- processExit{Name: name, Err: err}
+	}()
+
+	return nil
+}
+
+// Exited tells whether a started process already exited, before Wait got to
+// handle that
+func (s *supervisor) Exited(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.finished[name]
+}
+
+// Go runs a task in the background. The task must return once the channel
+// it gets is closed.
+func (s *supervisor) Go(name string, task func(stop <-chan struct{}) error) {
+	s.tasks[name] = true
+	go func() {
+		s.exited <- processExit{Name: name, Err: task(s.stopTasks)}
+	}()
+}
+
+// Wait blocks until a process or task exits or stop is closed and then stops
+// the remaining ones. Only an unexpected exit is reported as error, apart
+// from errRestart, which is passed on as is.
+func (s *supervisor) Wait(stop <-chan struct{}) error {
+	var result error
+
+	select {
+	case e := <-s.exited:
+		s.remove(e.Name)
+		if e.Err == errRestart {
+			result = errRestart
+		} else if e.Err != nil {
+			result = fmt.Errorf("%s exited: %s", e.Name, e.Err.Error())
+		} else {
+			result = fmt.Errorf("%s exited", e.Name)
+		}
+	case <-stop:
+		log.Infoln("Shutting down")
+	}
+
+	s.Stop()
+	return result
+}
+
+// Signal sends sig to a running process
+func (s *supervisor) Signal(name string, sig os.Signal) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cmd, ok := s.running[name]
+	if !ok {
+		return fmt.Errorf("%s is not running", name)
+	}
+
+	return cmd.Process.Signal(sig)
+}
+
+func (s *supervisor) remove(name string) {
+	s.mutex.Lock()
+	delete(s.running, name)
+	s.mutex.Unlock()
+	delete(s.tasks, name)
+}
+
+// Stop ends all tasks and sends SIGTERM to every running process, killing
+// those that don't exit within terminateTimeout
+func (s *supervisor) Stop() {
+	if !s.stopped {
+		close(s.stopTasks)
+		s.stopped = true
+	}
+
+	for name, cmd := range s.running {
+		log.Debugf("Stopping %s", name)
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	timeout := time.After(terminateTimeout)
+	for len(s.running)+len(s.tasks) > 0 {
+		select {
+		case e := <-s.exited:
+			s.remove(e.Name)
+		case <-timeout:
+			for name, cmd := range s.running {
+				log.Warnf("%s didn't stop in time, killing it", name)
+				cmd.Process.Kill()
+			}
+			for name := range s.tasks {
+				log.Warnf("%s didn't stop in time, leaving it behind", name)
+				delete(s.tasks, name)
+			}
+			timeout = time.After(terminateTimeout)
+		}
+	}
+}
+
+// startDHCP assigns the gateway addresses and starts dnsmasq serving DHCP and
+// DNS on all networks
+func startDHCP(s *supervisor, networks []network) error {
+	networks = routedNetworks(networks)
+	if len(networks) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, n := range networks {
+		names = append(names, n.Name)
+	}
+
+	err := waitForLinks(names, linkExists, opts.LinkTimeout)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range networks {
+		err = ensureInterfaceAddress(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg, err := generateDnsmasqConfig(networks, opts.LeaseFile)
+	if err != nil {
+		return fmt.Errorf("Failed to generate dnsmasq config: %s", err.Error())
+	}
+
+	log.Debugf("Generated dnsmasq config:\n%s", cfg)
+	err = writeFileCreatingDir(opts.DnsmasqConfig, []byte(cfg), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to save dnsmasq config: %s", err.Error())
+	}
+
+	log.Info("Starting dnsmasq")
+	return s.Start("dnsmasq", opts.DnsmasqBinary, "--keep-in-foreground", "--conf-file="+opts.DnsmasqConfig)
+}
+
+// startIPv6 assigns the IPv6 prefixes and starts announcing them on every
+// network that has one
+func startIPv6(s *supervisor, networks []network) error {
+	err := resolveIPv6Prefixes(networks)
+	if err != nil {
+		return err
+	}
+
+	var v6networks []network
+	var names []string
+	for _, n := range networks {
+		if n.IPv6Prefix != nil {
+			v6networks = append(v6networks, n)
+			names = append(names, n.Name)
+		}
+	}
+	if len(v6networks) == 0 {
+		return nil
+	}
+
+	err = waitForLinks(names, linkExists, opts.LinkTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = enableIPv6Forwarding()
+	if err != nil {
+		return fmt.Errorf("Failed to enable IPv6 forwarding: %s", err.Error())
+	}
+
+	for _, n := range v6networks {
+		err = ensureInterfaceAddress6(n)
+		if err != nil {
+			return err
+		}
+
+		n := n
+		log.Infof("Announcing IPv6 prefix %s on %s", n.IPv6Prefix, n.Name)
+		s.Go("router advertisements on "+n.Name, func(stop <-chan struct{}) error {
+			return runRouterAdvertisements(n, stop)
+		})
+	}
+
+	return nil
+}
+
+// startCaptivePortal serves the splash page for all networks with a captive
+// portal. The firewall rules sending clients there are installed by the
+// firewall command.
+func startCaptivePortal(s *supervisor, networks []network) (*portalServer, error) {
+	var names []string
+	for _, n := range networks {
+		if n.CaptivePortal {
+			names = append(names, n.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	if opts.DHCP != "dnsmasq" {
+		log.Warnln("The captive portal redirects DNS to the host, which needs --dhcp=dnsmasq")
+	}
+
+	fw, err := newFirewall(opts.FirewallBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPortalServer(networks, fw, opts.PortalSessions)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Starting captive portal on port %d for %s", opts.PortalPort, strings.Join(names, ", "))
+	s.Go("captive portal", func(stop <-chan struct{}) error {
+		return runCaptivePortal(p, opts.PortalPort, stop)
+	})
+
+	return p, nil
+}
+
+// startUplinkWatch moves the rules installed by the firewall command to the
+// new uplink when the default route moves, e.g. on failover to LTE. Without a
+// default route yet the rules follow the first one that shows up.
+func startUplinkWatch(s *supervisor, networks []network) error {
+	networks = append([]network(nil), networks...)
+	err := resolveIPv6Prefixes(networks)
+	if err != nil {
+		return err
+	}
+
+	uplink, err := getUplinkInterface()
+	if err != nil {
+		log.Warnf("No uplink yet: %s", err.Error())
+		uplink = ""
+	}
+
+	cfg, err := buildFirewallConfig(networks, uplink)
+	if err != nil {
+		return err
+	}
+
+	fw, err := newFirewall(opts.FirewallBackend)
+	if err != nil {
+		return err
+	}
+
+	log.Infoln("Following uplink changes")
+	s.Go("uplink watch", func(stop <-chan struct{}) error {
+		_, err := followUplink(fw, cfg, stop)
+		return err
+	})
+	return nil
+}
+
+// startVoucherEnforcers expires the vouchers of every network using them.
+// Portal vouchers need the portal p.
+func startVoucherEnforcers(s *supervisor, networks []network, p *portalServer) {
+	for _, n := range networks {
+		if n.VoucherMode == "" {
+			continue
+		}
+
+		var revoke func(mac net.HardwareAddr) error
+		if n.VoucherMode == voucherModePortal {
+			iface := n.Name
+			revoke = func(mac net.HardwareAddr) error {
+				return p.revoke(iface, mac)
+			}
+		}
+
+		n := n
+		s.Go("vouchers of "+n.Name, func(stop <-chan struct{}) error {
+			return runVoucherEnforcer(n, revoke, stop)
+		})
+	}
+}
+
+// startShaping rate limits the networks that have limits or hand out vouchers
+// with a bandwidth. The firewall command marks their traffic for the uplink.
+func startShaping(s *supervisor, networks []network) {
+	for _, n := range routedNetworks(networks) {
+		if n.RateLimit != 0 || n.ClientRateLimit != 0 || n.VoucherMode != "" {
+			log.Info("Starting traffic shaping")
+			s.Go("traffic shaping", func(stop <-chan struct{}) error {
+				return runShaper(networks, opts.ShapingState, stop)
+			})
+			return
+		}
+	}
+}
+
+// startScheduler turns the radio off and on and restarts hostapd as the
+// schedules of the networks demand
+func startScheduler(s *supervisor, networks []network, running []network) {
+	for _, n := range networks {
+		if n.Schedule != nil {
+			s.Go("scheduler", func(stop <-chan struct{}) error {
+				return runScheduler(networks, running, stop)
+			})
+			return
+		}
+	}
+}
+
+// startPasswordRotation replaces the passwords of the networks with a
+// rotation policy when due, having hostapd pick them up through reload
+func startPasswordRotation(s *supervisor, networks []network, reload func() error) {
+	for _, n := range networks {
+		if n.PasswordRotation == "" {
+			continue
+		}
+
+		n := n
+		log.Infof("Rotating the password of %s %s", n.Name, n.PasswordRotation)
+		s.Go("password rotation of "+n.Name, func(stop <-chan struct{}) error {
+			return runPasswordRotation(n, opts.SKVSPath, opts.CredentialsDir, reload, stop)
+		})
+	}
+}
+
+// startConfigWatcher has hostapd pick up changes of the configuration source
+// through reload
+func startConfigWatcher(s *supervisor, source configSource, reload func() error) {
+	s.Go("config watcher", func(stop <-chan struct{}) error {
+		return runConfigWatcher(source, reload, stop)
+	})
+}
+
+// startSystemdNotifier keeps systemd informed when run as a notify service
+func startSystemdNotifier(s *supervisor, running []network) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	s.Go("systemd notifier", func(stop <-chan struct{}) error {
+		return runSystemdNotifier(running, stop)
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisorChildExit(t *testing.T) {
+	s := newSupervisor()
+	assert.Nil(t, s.Start("sleeper", "/bin/sleep", "60"))
+	assert.Nil(t, s.Start("failing", "/bin/sh", "-c", "exit 3"))
+
+	err := s.Wait(make(chan struct{}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failing exited")
+	assert.Len(t, s.running, 0, "the remaining processes must be stopped")
+}
+
+func TestSupervisorStop(t *testing.T) {
+	s := newSupervisor()
+	assert.Nil(t, s.Start("sleeper", "/bin/sleep", "60"))
+
+	stop := make(chan struct{})
+	close(stop)
+
+	start := time.Now()
+	err := s.Wait(stop)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < terminateTimeout)
+	assert.Len(t, s.running, 0)
+}
+
+func TestSupervisorTask(t *testing.T) {
+	s := newSupervisor()
+	assert.Nil(t, s.Start("sleeper", "/bin/sleep", "60"))
+
+	taskStopped := false
+	s.Go("task", func(stop <-chan struct{}) error {
+		<-stop
+		taskStopped = true
+		return nil
+	})
+	s.Go("failing task", func(stop <-chan struct{}) error {
+		return assert.AnError
+	})
+
+	err := s.Wait(make(chan struct{}))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failing task exited")
+	assert.True(t, taskStopped)
+	assert.Len(t, s.running, 0)
+	assert.Len(t, s.tasks, 0)
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	s := newSupervisor()
+	s.Go("scheduler", func(stop <-chan struct{}) error {
+		return errRestart
+	})
+
+	assert.Equal(t, errRestart, s.Wait(make(chan struct{})))
+}
+
+func TestSupervisorStartFailure(t *testing.T) {
+	s := newSupervisor()
+	assert.NotNil(t, s.Start("missing", "/nonexistent/binary"))
+}
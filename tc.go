@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// Traffic control over rtnetlink: just enough of HTB, the ingress qdisc and
+// the u32 and fw classifiers to shape the AP networks.
+
+const (
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaStats2  = 7
+
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+
+	tcaHTBParms = 1
+	tcaHTBInit  = 2
+	tcaHTBCtab  = 3
+	tcaHTBRtab  = 4
+
+	tcaU32ClassID = 1
+	tcaU32Sel     = 5
+	tcaU32Police  = 6
+	tcU32Terminal = 1
+
+	tcaFWClassID = 1
+
+	tcaPoliceTBF  = 1
+	tcaPoliceRate = 2
+	tcActShot     = 2
+
+	tcHRoot    = 0xffffffff
+	tcHIngress = 0xfffffff1
+
+	sizeofTcMsg       = 20
+	tcLinkLayerEther  = 1
+	tcRateCellLog     = 3
+	tcRateTableLength = 256
+
+	// the kernel counts time in 64ns ticks
+	tcTicksPerSecond = 1000000000 / 64
+
+	// tcUnlimitedRate is what classes without a limit get, 10 GBit/s
+	tcUnlimitedRate = 10000000 * 1000 / 8
+)
+
+// tcHandle builds a 'major:minor' handle
+func tcHandle(major, minor uint16) uint32 {
+	return uint32(major)<<16 | uint32(minor)
+}
+
+func tcMsg(ifindex int, handle, parent, info uint32) []byte {
+	b := make([]byte, sizeofTcMsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:8], uint32(ifindex))
+	nativeEndian.PutUint32(b[8:12], handle)
+	nativeEndian.PutUint32(b[12:16], parent)
+	nativeEndian.PutUint32(b[16:20], info)
+	return b
+}
+
+// tcTicks is the time it takes to send size bytes at rate bytes per second
+func tcTicks(rate uint32, size uint32) uint32 {
+	return uint32(uint64(size) * tcTicksPerSecond / uint64(rate))
+}
+
+// tcBurst allows 10ms worth of traffic, but at least two full frames
+func tcBurst(rate uint32) uint32 {
+	burst := rate / 100
+	if burst < 3028 {
+		burst = 3028
+	}
+	return burst
+}
+
+func tcRateSpec(rate uint32) []byte {
+	b := make([]byte, 12)
+	b[0] = tcRateCellLog
+	b[1] = tcLinkLayerEther
+	nativeEndian.PutUint16(b[4:6], 0xffff) // cell_align -1
+	nativeEndian.PutUint32(b[8:12], rate)
+	return b
+}
+
+// tcRateTable holds the transmit time for each packet size, in steps of
+// 1<<tcRateCellLog bytes. Recent kernels compute it themselves but still
+// insist on getting one for policers.
+func tcRateTable(rate uint32) []byte {
+	b := make([]byte, tcRateTableLength*4)
+	for i := 0; i < tcRateTableLength; i++ {
+		nativeEndian.PutUint32(b[i*4:], tcTicks(rate, uint32(i+1)<<tcRateCellLog))
+	}
+	return b
+}
+
+func tcRequest(typ uint16, flags uint16, msg []byte, attrs ...[]byte) nlRequest {
+	return nlRequest{
+		Type:  typ,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Data:  concatBytes(msg, concatBytes(attrs...)),
+	}
+}
+
+// tcDeleteQdiscRequest removes the root or ingress qdisc along with all
+// classes and filters below it
+func tcDeleteQdiscRequest(ifindex int, parent uint32) nlRequest {
+	return tcRequest(syscall.RTM_DELQDISC, 0, tcMsg(ifindex, 0, parent, 0))
+}
+
+// tcHTBQdiscRequest installs HTB as root qdisc, sending unclassified
+// traffic to the class with minor defaultClass
+func tcHTBQdiscRequest(ifindex int, handle uint32, defaultClass uint16) nlRequest {
+	glob := make([]byte, 20)
+	nativeEndian.PutUint32(glob[0:4], 3)  // version
+	nativeEndian.PutUint32(glob[4:8], 10) // rate2quantum
+	nativeEndian.PutUint32(glob[8:12], uint32(defaultClass))
+
+	return tcRequest(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, handle, tcHRoot, 0),
+		nlAttrString(tcaKind, "htb"),
+		nlAttrNested(tcaOptions, nlAttr(tcaHTBInit, glob)))
+}
+
+func tcIngressQdiscRequest(ifindex int) nlRequest {
+	return tcRequest(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, tcHandle(0xffff, 0), tcHIngress, 0),
+		nlAttrString(tcaKind, "ingress"))
+}
+
+// tcHTBClassRequest adds a class guaranteed rate bytes per second, which
+// may borrow from its parent up to ceil
+func tcHTBClassRequest(ifindex int, classID, parent uint32, rate, ceil uint32) nlRequest {
+	opt := make([]byte, 44)
+	copy(opt[0:12], tcRateSpec(rate))
+	copy(opt[12:24], tcRateSpec(ceil))
+	nativeEndian.PutUint32(opt[24:28], tcTicks(rate, tcBurst(rate)))
+	nativeEndian.PutUint32(opt[28:32], tcTicks(ceil, tcBurst(ceil)))
+
+	return tcRequest(syscall.RTM_NEWTCLASS, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, classID, parent, 0),
+		nlAttrString(tcaKind, "htb"),
+		nlAttrNested(tcaOptions,
+			nlAttr(tcaHTBParms, opt),
+			nlAttr(tcaHTBRtab, tcRateTable(rate)),
+			nlAttr(tcaHTBCtab, tcRateTable(ceil))))
+}
+
+// tcFilterInfo combines the priority and protocol of a filter
+func tcFilterInfo(prio uint16, protocol uint16) uint32 {
+	proto := make([]byte, 2)
+	binary.BigEndian.PutUint16(proto, protocol)
+	return uint32(prio)<<16 | uint32(nativeEndian.Uint16(proto))
+}
+
+// tcU32IPv4Selector matches the IPv4 address at the given network header
+// offset, 12 for the source and 16 for the destination
+func tcU32IPv4Selector(offset int32, ip net.IP) []byte {
+	sel := make([]byte, 32)
+	sel[0] = tcU32Terminal
+	sel[2] = 1 // nkeys
+	binary.BigEndian.PutUint32(sel[16:20], 0xffffffff)
+	copy(sel[20:24], ip.To4())
+	nativeEndian.PutUint32(sel[24:28], uint32(offset))
+	return sel
+}
+
+// tcU32ClassifyRequest sends IPv4 traffic to dst into classID
+func tcU32ClassifyRequest(ifindex int, parent uint32, prio uint16, dst net.IP, classID uint32) nlRequest {
+	return tcRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, 0, parent, tcFilterInfo(prio, syscall.ETH_P_IP)),
+		nlAttrString(tcaKind, "u32"),
+		nlAttrNested(tcaOptions,
+			nlAttrU32(tcaU32ClassID, classID),
+			nlAttr(tcaU32Sel, tcU32IPv4Selector(16, dst))))
+}
+
+// tcU32PoliceRequest drops IPv4 traffic from src exceeding rate bytes per
+// second. It is meant for the ingress qdisc, which can't queue.
+func tcU32PoliceRequest(ifindex int, prio uint16, src net.IP, rate uint32) nlRequest {
+	police := make([]byte, 56)
+	nativeEndian.PutUint32(police[4:8], tcActShot)
+	nativeEndian.PutUint32(police[12:16], tcTicks(rate, tcBurst(rate)))
+	copy(police[20:32], tcRateSpec(rate))
+
+	return tcRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, 0, tcHandle(0xffff, 0), tcFilterInfo(prio, syscall.ETH_P_IP)),
+		nlAttrString(tcaKind, "u32"),
+		nlAttrNested(tcaOptions,
+			nlAttrU32(tcaU32ClassID, tcHandle(0xffff, 1)),
+			nlAttr(tcaU32Sel, tcU32IPv4Selector(12, src)),
+			nlAttrNested(tcaU32Police,
+				nlAttr(tcaPoliceTBF, police),
+				nlAttr(tcaPoliceRate, tcRateTable(rate)))))
+}
+
+// tcFWClassifyRequest sends traffic carrying the firewall mark into classID
+func tcFWClassifyRequest(ifindex int, parent uint32, prio uint16, mark uint32, classID uint32) nlRequest {
+	return tcRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		tcMsg(ifindex, mark, parent, tcFilterInfo(prio, syscall.ETH_P_ALL)),
+		nlAttrString(tcaKind, "fw"),
+		nlAttrNested(tcaOptions, nlAttrU32(tcaFWClassID, classID)))
+}
+
+func tcDumpClassesRequest(ifindex int) nlRequest {
+	return nlRequest{
+		Type:  syscall.RTM_GETTCLASS,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+		Data:  tcMsg(ifindex, 0, 0, 0),
+	}
+}
+
+// tcClassStats are the counters of a class
+type tcClassStats struct {
+	SentBytes   uint64 `json:"sent_bytes"`
+	SentPackets uint32 `json:"sent_packets"`
+	Drops       uint32 `json:"drops"`
+	Overlimits  uint32 `json:"overlimits"`
+}
+
+// parseTcClasses returns the counters of each class in a class dump by
+// handle
+func parseTcClasses(msgs []syscall.NetlinkMessage) (map[uint32]tcClassStats, error) {
+	classes := make(map[uint32]tcClassStats)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWTCLASS || len(m.Data) < sizeofTcMsg {
+			continue
+		}
+
+		attrs, err := parseNlAttrs(m.Data[sizeofTcMsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		var stats tcClassStats
+		for _, a := range attrs {
+			if a.Type != tcaStats2 {
+				continue
+			}
+
+			nested, err := parseNlAttrs(a.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range nested {
+				switch {
+				case s.Type == tcaStatsBasic && len(s.Data) >= 12:
+					stats.SentBytes = nativeEndian.Uint64(s.Data[0:8])
+					stats.SentPackets = nativeEndian.Uint32(s.Data[8:12])
+				case s.Type == tcaStatsQueue && len(s.Data) >= 20:
+					stats.Drops = nativeEndian.Uint32(s.Data[8:12])
+					stats.Overlimits = nativeEndian.Uint32(s.Data[16:20])
+				}
+			}
+		}
+
+		classes[nativeEndian.Uint32(m.Data[8:12])] = stats
+	}
+
+	return classes, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTcHandle(t *testing.T) {
+	assert.Equal(t, uint32(0x10002), tcHandle(1, 2))
+	assert.Equal(t, uint32(0xffff0000), tcHandle(0xffff, 0))
+}
+
+func TestTcTicks(t *testing.T) {
+	// 1500 bytes at 1 MByte/s take 1.5ms
+	assert.Equal(t, uint32(1500000/64), tcTicks(1000000, 1500))
+	assert.Equal(t, uint32(3028), tcBurst(100000))
+	assert.Equal(t, uint32(125000), tcBurst(12500000))
+
+	table := tcRateTable(1000000)
+	assert.Len(t, table, 1024)
+	assert.Equal(t, tcTicks(1000000, 8), nativeEndian.Uint32(table[0:4]))
+	assert.Equal(t, tcTicks(1000000, 2048), nativeEndian.Uint32(table[1020:1024]))
+}
+
+func TestTcFilterInfo(t *testing.T) {
+	info := tcFilterInfo(1, syscall.ETH_P_IP)
+	assert.Equal(t, uint32(1), info>>16)
+
+	proto := make([]byte, 2)
+	nativeEndian.PutUint16(proto, uint16(info))
+	assert.Equal(t, []byte{0x08, 0x00}, proto, "the protocol is in network byte order")
+}
+
+func TestTcU32IPv4Selector(t *testing.T) {
+	sel := tcU32IPv4Selector(16, net.ParseIP("10.42.0.23"))
+	assert.Len(t, sel, 32)
+	assert.Equal(t, byte(tcU32Terminal), sel[0])
+	assert.Equal(t, byte(1), sel[2])
+	assert.Equal(t, uint32(0xffffffff), binary.BigEndian.Uint32(sel[16:20]))
+	assert.Equal(t, []byte{10, 42, 0, 23}, sel[20:24])
+	assert.Equal(t, uint32(16), nativeEndian.Uint32(sel[24:28]))
+}
+
+func TestTcHTBClassRequest(t *testing.T) {
+	req := tcHTBClassRequest(4, tcHandle(1, 2), tcHandle(1, 1), 125000, 250000)
+	assert.Equal(t, uint16(syscall.RTM_NEWTCLASS), req.Type)
+	assert.Equal(t, uint32(4), nativeEndian.Uint32(req.Data[4:8]))
+	assert.Equal(t, tcHandle(1, 2), nativeEndian.Uint32(req.Data[8:12]))
+	assert.Equal(t, tcHandle(1, 1), nativeEndian.Uint32(req.Data[12:16]))
+
+	attrs, err := parseNlAttrs(req.Data[sizeofTcMsg:])
+	assert.Nil(t, err)
+	assert.Equal(t, "htb\x00", string(attrs[0].Data))
+
+	options, err := parseNlAttrs(attrs[1].Data)
+	assert.Nil(t, err)
+	assert.Len(t, options, 3)
+	assert.Equal(t, uint16(tcaHTBParms), options[0].Type)
+	assert.Equal(t, uint32(125000), nativeEndian.Uint32(options[0].Data[8:12]))
+	assert.Equal(t, uint32(250000), nativeEndian.Uint32(options[0].Data[20:24]))
+}
+
+func classMessage(handle uint32, bytes uint64, packets uint32, drops uint32) syscall.NetlinkMessage {
+	basic := make([]byte, 16)
+	nativeEndian.PutUint64(basic[0:8], bytes)
+	nativeEndian.PutUint32(basic[8:12], packets)
+	queue := make([]byte, 20)
+	nativeEndian.PutUint32(queue[8:12], drops)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: syscall.RTM_NEWTCLASS},
+		Data: concatBytes(
+			tcMsg(4, handle, tcHandle(1, 0), 0),
+			nlAttrString(tcaKind, "htb"),
+			nlAttrNested(tcaStats2, nlAttr(tcaStatsBasic, basic), nlAttr(tcaStatsQueue, queue))),
+	}
+}
+
+func TestParseTcClasses(t *testing.T) {
+	classes, err := parseTcClasses([]syscall.NetlinkMessage{
+		classMessage(tcHandle(1, 1), 4096, 3, 1),
+		classMessage(tcHandle(1, 2), 1024, 1, 0),
+		{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWQDISC}, Data: tcMsg(4, 0, 0, 0)},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, classes, 2)
+	assert.Equal(t, tcClassStats{SentBytes: 4096, SentPackets: 3, Drops: 1}, classes[tcHandle(1, 1)])
+	assert.Equal(t, uint64(1024), classes[tcHandle(1, 2)].SentBytes)
+}
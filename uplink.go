@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// uplinkRetryDelay is how long to wait before receiving route events again
+// after it failed
+const uplinkRetryDelay = time.Second
+
+// uplinkProbeAddress is the destination whose route decides which interface
+// is the uplink
+var uplinkProbeAddress = net.IPv4(8, 8, 8, 8)
+
+var newRouteConn = func() (netlinkExecuter, error) {
+	return newNlConn(syscall.NETLINK_ROUTE, 0)
+}
+
+var newRouteMonitor = func() (netlinkReceiver, error) {
+	conn, err := newNlConn(syscall.NETLINK_ROUTE, 1<<(syscall.RTNLGRP_IPV4_ROUTE-1))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetReceiveTimeout(time.Second)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+var interfaceNameByIndex = func(index int) (string, error) {
+	i, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return "", err
+	}
+
+	return i.Name, nil
+}
+
+// getUplinkInterface asks the kernel which interface it would route
+// uplinkProbeAddress through. Unlike the old 'ip route get' scraping this
+// works for any kind of uplink, be it wwan, bond, bridge or VLAN.
+func getUplinkInterface() (string, error) {
+	conn, err := newRouteConn()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	rtm := make([]byte, syscall.SizeofRtMsg)
+	rtm[0] = syscall.AF_INET
+	rtm[1] = 32
+
+	resp, err := conn.Execute(nlRequest{
+		Type:  syscall.RTM_GETROUTE,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Data:  append(rtm, nlAttr(syscall.RTA_DST, uplinkProbeAddress.To4())...),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Route lookup for %s failed: %s", uplinkProbeAddress, err.Error())
+	}
+
+	for _, msg := range resp {
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		attrs, err := parseNlAttrs(msg.Data[syscall.SizeofRtMsg:])
+		if err != nil {
+			return "", err
+		}
+
+		for _, a := range attrs {
+			if a.Type == syscall.RTA_OIF && len(a.Data) == 4 {
+				return interfaceNameByIndex(int(nativeEndian.Uint32(a.Data)))
+			}
+		}
+	}
+
+	return "", fmt.Errorf("No route to %s", uplinkProbeAddress)
+}
+
+func defaultRouteChanged(msgs []syscall.NetlinkMessage) bool {
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE && msg.Header.Type != syscall.RTM_DELROUTE {
+			continue
+		}
+
+		// a destination prefix length of 0 makes it a default route
+		if len(msg.Data) >= syscall.SizeofRtMsg && msg.Data[1] == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeEventsLost tells whether the kernel dropped route events because they
+// weren't read fast enough
+func routeEventsLost(err error) bool {
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == syscall.ENOBUFS
+}
+
+// watchUplink follows default route changes until stop is closed. Whenever the
+// uplink moves to another interface onChange is called; the change only
+// counts as done once onChange succeeded, so a failed attempt is retried on
+// the next route event. current is empty while there is no uplink yet. When
+// route events were lost the uplink is looked up again.
+func watchUplink(current string, stop <-chan struct{}, onChange func(string) error) error {
+	mon, err := newRouteMonitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		msgs, err := mon.Receive()
+		if routeEventsLost(err) {
+			log.Warnln("Missed route events, looking up the uplink again")
+		} else if err != nil {
+			log.Errorf("Failed to receive route events: %s", err.Error())
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(uplinkRetryDelay):
+			}
+			continue
+		} else if !defaultRouteChanged(msgs) {
+			continue
+		}
+
+		uplink, err := getUplinkInterface()
+		if err != nil {
+			log.Warnf("Default route changed but no uplink is available: %s", err.Error())
+			continue
+		}
+
+		if uplink == current {
+			continue
+		}
+
+		if current == "" {
+			log.Infof("Uplink is up: %s", uplink)
+		} else {
+			log.Infof("Uplink changed: %s -> %s", current, uplink)
+		}
+		err = onChange(uplink)
+		if err != nil {
+			log.Errorf("Failed to switch to uplink %s: %s", uplink, err.Error())
+			continue
+		}
+		current = uplink
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func routeMessage(msgType uint16, dstLen uint8, attrs ...[]byte) syscall.NetlinkMessage {
+	rtm := make([]byte, syscall.SizeofRtMsg)
+	rtm[0] = syscall.AF_INET
+	rtm[1] = dstLen
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: msgType},
+		Data:   append(rtm, concatBytes(attrs...)...),
+	}
+}
+
+type mockRouteMonitor struct {
+	batches [][]syscall.NetlinkMessage
+	// errs are returned along with the batches one after another
+	errs []error
+	stop chan struct{}
+}
+
+func (m *mockRouteMonitor) Receive() ([]syscall.NetlinkMessage, error) {
+	if len(m.batches) == 0 {
+		close(m.stop)
+		return nil, nil
+	}
+
+	b := m.batches[0]
+	m.batches = m.batches[1:]
+
+	var err error
+	if len(m.errs) > 0 {
+		err = m.errs[0]
+		m.errs = m.errs[1:]
+	}
+	return b, err
+}
+
+func (m *mockRouteMonitor) Close() error {
+	return nil
+}
+
+func withMockRoutes(conn *mockNetlinkConn, names map[int]string) func() {
+	origConn, origNames := newRouteConn, interfaceNameByIndex
+	newRouteConn = func() (netlinkExecuter, error) {
+		return conn, nil
+	}
+	interfaceNameByIndex = func(index int) (string, error) {
+		return names[index], nil
+	}
+	return func() {
+		newRouteConn, interfaceNameByIndex = origConn, origNames
+	}
+}
+
+func TestGetUplinkInterface(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			routeMessage(syscall.RTM_NEWROUTE, 32, nlAttr(syscall.RTA_DST, []byte{8, 8, 8, 8}), nlAttrU32(syscall.RTA_OIF, 3)),
+		},
+	}
+	defer withMockRoutes(conn, map[int]string{3: "wwan0"})()
+
+	uplink, err := getUplinkInterface()
+	assert.Nil(t, err)
+	assert.Equal(t, "wwan0", uplink)
+
+	req := conn.Requests[0][0]
+	assert.Equal(t, uint16(syscall.RTM_GETROUTE), req.Type)
+	assert.Equal(t, byte(32), req.Data[1])
+
+	conn.Replies = nil
+	_, err = getUplinkInterface()
+	assert.NotNil(t, err)
+}
+
+func TestDefaultRouteChanged(t *testing.T) {
+	assert.False(t, defaultRouteChanged(nil))
+	assert.False(t, defaultRouteChanged([]syscall.NetlinkMessage{routeMessage(syscall.RTM_NEWROUTE, 24)}))
+	assert.False(t, defaultRouteChanged([]syscall.NetlinkMessage{routeMessage(syscall.RTM_NEWLINK, 0)}))
+	assert.True(t, defaultRouteChanged([]syscall.NetlinkMessage{routeMessage(syscall.RTM_DELROUTE, 0)}))
+}
+
+func TestWatchUplink(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			routeMessage(syscall.RTM_NEWROUTE, 32, nlAttrU32(syscall.RTA_OIF, 4)),
+		},
+	}
+	defer withMockRoutes(conn, map[int]string{2: "eth0", 4: "wwan0"})()
+
+	stop := make(chan struct{})
+	mon := &mockRouteMonitor{
+		stop: stop,
+		batches: [][]syscall.NetlinkMessage{
+			{routeMessage(syscall.RTM_NEWROUTE, 24)},
+			{routeMessage(syscall.RTM_DELROUTE, 0)},
+			{routeMessage(syscall.RTM_NEWROUTE, 0)},
+		},
+	}
+	orig := newRouteMonitor
+	defer func() { newRouteMonitor = orig }()
+	newRouteMonitor = func() (netlinkReceiver, error) {
+		return mon, nil
+	}
+
+	var changes []string
+	err := watchUplink("eth0", stop, func(uplink string) error {
+		changes = append(changes, uplink)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wwan0"}, changes, "the second default route event doesn't move the uplink again")
+	assert.Len(t, conn.Requests, 2)
+}
+
+func TestWatchUplinkReceiveErrors(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			routeMessage(syscall.RTM_NEWROUTE, 32, nlAttrU32(syscall.RTA_OIF, 4)),
+		},
+	}
+	defer withMockRoutes(conn, map[int]string{2: "eth0", 4: "wwan0"})()
+
+	// the watch goes on after an error and looks the uplink up when events
+	// were dropped
+	stop := make(chan struct{})
+	mon := &mockRouteMonitor{
+		stop:    stop,
+		batches: [][]syscall.NetlinkMessage{nil, nil},
+		errs:    []error{os.NewSyscallError("recvfrom", syscall.EIO), os.NewSyscallError("recvfrom", syscall.ENOBUFS)},
+	}
+	orig := newRouteMonitor
+	defer func() { newRouteMonitor = orig }()
+	newRouteMonitor = func() (netlinkReceiver, error) {
+		return mon, nil
+	}
+
+	var changes []string
+	err := watchUplink("eth0", stop, func(uplink string) error {
+		changes = append(changes, uplink)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wwan0"}, changes)
+	assert.Len(t, conn.Requests, 1)
+}
+
+func TestWatchUplinkWithoutUplink(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			routeMessage(syscall.RTM_NEWROUTE, 32, nlAttrU32(syscall.RTA_OIF, 4)),
+		},
+	}
+	defer withMockRoutes(conn, map[int]string{4: "wwan0"})()
+
+	stop := make(chan struct{})
+	mon := &mockRouteMonitor{
+		stop:    stop,
+		batches: [][]syscall.NetlinkMessage{{routeMessage(syscall.RTM_NEWROUTE, 0)}},
+	}
+	orig := newRouteMonitor
+	defer func() { newRouteMonitor = orig }()
+	newRouteMonitor = func() (netlinkReceiver, error) {
+		return mon, nil
+	}
+
+	var changes []string
+	err := watchUplink("", stop, func(uplink string) error {
+		changes = append(changes, uplink)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wwan0"}, changes, "the first default route is followed")
+}
+
+func TestFollowUplink(t *testing.T) {
+	conn := &mockNetlinkConn{
+		Replies: []syscall.NetlinkMessage{
+			routeMessage(syscall.RTM_NEWROUTE, 32, nlAttrU32(syscall.RTA_OIF, 4)),
+		},
+	}
+	defer withMockRoutes(conn, map[int]string{2: "eth0", 4: "wwan0"})()
+
+	stop := make(chan struct{})
+	mon := &mockRouteMonitor{
+		stop:    stop,
+		batches: [][]syscall.NetlinkMessage{{routeMessage(syscall.RTM_DELROUTE, 0)}},
+	}
+	orig := newRouteMonitor
+	defer func() { newRouteMonitor = orig }()
+	newRouteMonitor = func() (netlinkReceiver, error) {
+		return mon, nil
+	}
+
+	fw := &mockFirewall{}
+	cfg, err := followUplink(fw, testFirewallConfig(), stop)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wwan0"}, fw.Uplinks)
+	assert.Equal(t, "wwan0", cfg.Uplink)
+}
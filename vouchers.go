@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// voucherModePortal accepts vouchers on the captive portal,
+	// voucherModePSK uses them as WPA passphrases
+	voucherModePortal = "portal"
+	voucherModePSK    = "psk"
+
+	// no 0/O and 1/I, as codes are read off paper
+	voucherAlphabet   = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	voucherCodeLength = 10
+
+	voucherCheckInterval = 30 * time.Second
+)
+
+// voucher grants up to MaxDevices devices access between ValidFrom and
+// ValidUntil. Devices are the MAC addresses that used it so far.
+type voucher struct {
+	Code          string    `json:"code"`
+	ValidFrom     time.Time `json:"valid_from"`
+	ValidUntil    time.Time `json:"valid_until"`
+	BandwidthKbit int       `json:"bandwidth_kbit,omitempty"`
+	MaxDevices    int       `json:"max_devices"`
+	Devices       []string  `json:"devices,omitempty"`
+}
+
+func (v *voucher) validAt(t time.Time) bool {
+	return !t.Before(v.ValidFrom) && t.Before(v.ValidUntil)
+}
+
+func (v *voucher) hasDevice(mac string) bool {
+	for _, d := range v.Devices {
+		if d == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// readVoucherPolicy reads the optional 'vouchers' mode of a network. The
+// vouchers themselves live in its 'voucher_codes' directory, one file per code.
+func readVoucherPolicy(dir string, n *network) error {
+	mode, err := readOptionalValue(dir, "vouchers", "")
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case "":
+		return nil
+	case voucherModePortal:
+		if !n.CaptivePortal {
+			return fmt.Errorf("Portal vouchers on network '%s' need the captive portal enabled", n.Name)
+		}
+	case voucherModePSK:
+	default:
+		return fmt.Errorf("Invalid voucher mode '%s' for network '%s', expected portal or psk", mode, n.Name)
+	}
+
+	n.VoucherMode = mode
+	n.VoucherDir = path.Join(dir, "voucher_codes")
+	return nil
+}
+
+func generateVoucherCode() (string, error) {
+	code := make([]byte, voucherCodeLength)
+	max := big.NewInt(int64(len(voucherAlphabet)))
+	for i := range code {
+		r, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = voucherAlphabet[r.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeVoucherCode makes codes typed in by hand match
+func normalizeVoucherCode(code string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+}
+
+func loadVouchers(dir string) ([]voucher, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vouchers []voucher
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		v, err := loadVoucher(dir, f.Name())
+		if err != nil {
+			return nil, err
+		}
+		vouchers = append(vouchers, *v)
+	}
+
+	return vouchers, nil
+}
+
+func loadVoucher(dir string, code string) (*voucher, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, code))
+	if err != nil {
+		return nil, err
+	}
+
+	var v voucher
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid voucher %s: %s", code, err.Error())
+	}
+	v.Code = code
+
+	return &v, nil
+}
+
+func saveVoucher(dir string, v *voucher) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileCreatingDir(path.Join(dir, v.Code), data, 0600)
+}
+
+// voucherMutex serializes registering devices with vouchers, so that devices
+// redeeming a voucher at the same time can't exceed its limit or overwrite
+// each other's registration
+var voucherMutex sync.Mutex
+
+// redeemVoucher registers mac with the voucher and returns how long the
+// device may stay
+func redeemVoucher(dir string, code string, mac string, now time.Time) (*voucher, time.Duration, error) {
+	voucherMutex.Lock()
+	defer voucherMutex.Unlock()
+
+	code = normalizeVoucherCode(code)
+	if code == "" || strings.ContainsAny(code, "/.") {
+		return nil, 0, fmt.Errorf("Unknown voucher")
+	}
+
+	v, err := loadVoucher(dir, code)
+	if os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("Unknown voucher")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !v.validAt(now) {
+		return nil, 0, fmt.Errorf("The voucher is not valid at this time")
+	}
+
+	if !v.hasDevice(mac) {
+		if len(v.Devices) >= v.MaxDevices {
+			return nil, 0, fmt.Errorf("The voucher is already used by %d devices", len(v.Devices))
+		}
+
+		v.Devices = append(v.Devices, mac)
+		err = saveVoucher(dir, v)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return v, v.ValidUntil.Sub(now), nil
+}
+
+// generateVoucherPSKs renders the vouchers valid at now as wpa_psk_file
+// entries. The key ID tells us which voucher a station used.
+func generateVoucherPSKs(vouchers []voucher, now time.Time) string {
+	var buf bytes.Buffer
+	for _, v := range vouchers {
+		if v.validAt(now) {
+			fmt.Fprintf(&buf, "keyid=%s 00:00:00:00:00:00 %s\n", v.Code, v.Code)
+		}
+	}
+	return buf.String()
+}
+
+// enforceVouchers deauthenticates the stations of expired vouchers and those
+// exceeding a voucher's device limit, and removes expired vouchers. With
+// portal vouchers, revoke ends the portal sessions of expired vouchers, which
+// is needed for revoked ones. With PSK vouchers, hostapd is told to reload
+// the passphrases when they changed.
+func enforceVouchers(n network, now time.Time, revoke func(mac net.HardwareAddr) error) error {
+	voucherMutex.Lock()
+	defer voucherMutex.Unlock()
+
+	vouchers, err := loadVouchers(n.VoucherDir)
+	if err != nil {
+		return err
+	}
+
+	ctrl, err := dialHostapdCtrl(n.Name)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	stations, err := listHostapdStations(ctrl)
+	if err != nil {
+		return err
+	}
+
+	for i := range vouchers {
+		v := &vouchers[i]
+		expired := !now.Before(v.ValidUntil)
+		changed := false
+
+		for _, sta := range stations {
+			usesVoucher := v.hasDevice(sta.MAC)
+			if n.VoucherMode == voucherModePSK && sta.Attributes["keyid"] == v.Code {
+				usesVoucher = true
+				if !expired && !v.hasDevice(sta.MAC) && len(v.Devices) < v.MaxDevices {
+					v.Devices = append(v.Devices, sta.MAC)
+					changed = true
+				}
+			}
+			if !usesVoucher {
+				continue
+			}
+
+			if expired || !v.hasDevice(sta.MAC) {
+				log.Infof("Deauthenticating %s from %s, voucher %s is expired or used up", sta.MAC, n.Name, v.Code)
+				err = deauthenticateStation(ctrl, sta.MAC)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if expired && revoke != nil {
+			for _, d := range v.Devices {
+				mac, err := net.ParseMAC(d)
+				if err == nil {
+					err = revoke(mac)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if expired {
+			log.Infof("Removing expired voucher %s of %s", v.Code, n.Name)
+			err = os.Remove(path.Join(n.VoucherDir, v.Code))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if changed {
+			err = saveVoucher(n.VoucherDir, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.VoucherMode != voucherModePSK {
+		return nil
+	}
+
+	changed, err := writePSKFile(n)
+	if err != nil || !changed {
+		return err
+	}
+
+	reply, err := ctrl.Request("RELOAD_WPA_PSK")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("hostapd on %s answered '%s' to 'RELOAD_WPA_PSK'", n.Name, strings.TrimSpace(reply))
+	}
+
+	return nil
+}
+
+func deauthenticateStation(ctrl hostapdController, mac string) error {
+	reply, err := ctrl.Request("DEAUTHENTICATE " + mac)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return fmt.Errorf("hostapd answered '%s' to deauthenticating %s", strings.TrimSpace(reply), mac)
+	}
+	return nil
+}
+
+// runVoucherEnforcer checks the vouchers of a network periodically until stop
+// is closed. Failures are logged, as hostapd may just be restarting.
+func runVoucherEnforcer(n network, revoke func(mac net.HardwareAddr) error, stop <-chan struct{}) error {
+	ticker := time.NewTicker(voucherCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			err := enforceVouchers(n, time.Now(), revoke)
+			if err != nil {
+				log.Errorf("Failed to enforce the vouchers of %s: %s", n.Name, err.Error())
+			}
+		}
+	}
+}
+
+type voucherCreateCommand struct {
+	Network   string        `long:"network" default:"wl_public" description:"network the vouchers are for"`
+	Count     int           `long:"count" default:"1" description:"number of vouchers to create"`
+	Start     string        `long:"start" description:"start of the validity window (RFC 3339), defaults to now"`
+	Validity  time.Duration `long:"validity" default:"24h" description:"length of the validity window"`
+	Devices   int           `long:"devices" default:"1" description:"number of devices that may use a voucher"`
+	Bandwidth int           `long:"bandwidth" description:"bandwidth cap per device in kbit/s"`
+}
+
+type voucherListCommand struct {
+	Network string `long:"network" default:"wl_public" description:"network to list the vouchers of"`
+}
+
+type voucherRevokeCommand struct {
+	Network string `long:"network" default:"wl_public" description:"network the voucher is for"`
+	Args    struct {
+		Code string `positional-arg-name:"code" required:"true"`
+	} `positional-args:"true"`
+}
+
+// voucherNetwork returns the network the vouchers of a command are for
+func voucherNetwork(name string) (*network, error) {
+	networks, err := getNeededNetworks(opts.SKVSPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get network list: %s", err.Error())
+	}
+
+	for _, n := range networks {
+		if n.Name == name {
+			if n.VoucherMode == "" {
+				return nil, fmt.Errorf("Vouchers are not enabled on network '%s'", name)
+			}
+			return &n, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Network '%s' is not enabled", name)
+}
+
+func (c *voucherCreateCommand) Execute(args []string) error {
+	setupLogging()
+
+	n, err := voucherNetwork(c.Network)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if c.Start != "" {
+		start, err = time.Parse(time.RFC3339, c.Start)
+		if err != nil {
+			return fmt.Errorf("Invalid start '%s': %s", c.Start, err.Error())
+		}
+	}
+
+	if c.Count < 1 || c.Devices < 1 || c.Validity <= 0 || c.Bandwidth < 0 {
+		return fmt.Errorf("Count, devices and validity must be positive")
+	}
+
+	var created []voucher
+	for i := 0; i < c.Count; i++ {
+		code, err := generateVoucherCode()
+		if err != nil {
+			return err
+		}
+
+		v := voucher{
+			Code:          code,
+			ValidFrom:     start,
+			ValidUntil:    start.Add(c.Validity),
+			BandwidthKbit: c.Bandwidth,
+			MaxDevices:    c.Devices,
+		}
+		err = saveVoucher(n.VoucherDir, &v)
+		if err != nil {
+			return err
+		}
+		created = append(created, v)
+	}
+
+	return printJSON(created)
+}
+
+func (c *voucherListCommand) Execute(args []string) error {
+	setupLogging()
+
+	n, err := voucherNetwork(c.Network)
+	if err != nil {
+		return err
+	}
+
+	vouchers, err := loadVouchers(n.VoucherDir)
+	if err != nil {
+		return err
+	}
+	if vouchers == nil {
+		vouchers = []voucher{}
+	}
+
+	sort.Sort(vouchersByStart(vouchers))
+	return printJSON(vouchers)
+}
+
+func (c *voucherRevokeCommand) Execute(args []string) error {
+	setupLogging()
+
+	n, err := voucherNetwork(c.Network)
+	if err != nil {
+		return err
+	}
+
+	v, err := loadVoucher(n.VoucherDir, normalizeVoucherCode(c.Args.Code))
+	if err != nil {
+		return err
+	}
+
+	// expiring it lets the running daemon deauthenticate its devices
+	v.ValidUntil = time.Now()
+	return saveVoucher(n.VoucherDir, v)
+}
+
+type vouchersByStart []voucher
+
+func (v vouchersByStart) Len() int           { return len(v) }
+func (v vouchersByStart) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v vouchersByStart) Less(i, j int) bool { return v[i].ValidFrom.Before(v[j].ValidFrom) }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadVoucherPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := network{Name: "wl_public"}
+	err = readVoucherPolicy(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, "", n.VoucherMode)
+
+	err = ioutil.WriteFile(path.Join(dir, "vouchers"), []byte("portal\n"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readVoucherPolicy(dir, &n), "portal vouchers need the portal")
+
+	n.CaptivePortal = true
+	err = readVoucherPolicy(dir, &n)
+	assert.Nil(t, err)
+	assert.Equal(t, voucherModePortal, n.VoucherMode)
+	assert.Equal(t, path.Join(dir, "voucher_codes"), n.VoucherDir)
+
+	err = ioutil.WriteFile(path.Join(dir, "vouchers"), []byte("paper"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, readVoucherPolicy(dir, &n))
+}
+
+func TestGenerateVoucherCode(t *testing.T) {
+	code, err := generateVoucherCode()
+	assert.Nil(t, err)
+	assert.Len(t, code, voucherCodeLength)
+	assert.Equal(t, "", strings.Trim(code, voucherAlphabet))
+	assert.Equal(t, code, normalizeVoucherCode(" "+strings.ToLower(code[:5])+" "+code[5:]))
+}
+
+func TestRedeemVoucher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	err = saveVoucher(dir, &voucher{Code: "ABCDEFGHJK", ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(time.Hour), MaxDevices: 1})
+	assert.Nil(t, err)
+
+	_, remaining, err := redeemVoucher(dir, "abcde fghjk", "aa:bb:cc:dd:ee:ff", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, remaining)
+
+	_, _, err = redeemVoucher(dir, "ABCDEFGHJK", "aa:bb:cc:dd:ee:ff", now)
+	assert.Nil(t, err, "the same device may log in again")
+
+	_, _, err = redeemVoucher(dir, "ABCDEFGHJK", "11:22:33:44:55:66", now)
+	assert.NotNil(t, err, "the device limit is reached")
+
+	_, _, err = redeemVoucher(dir, "ABCDEFGHJK", "aa:bb:cc:dd:ee:ff", now.Add(2*time.Hour))
+	assert.NotNil(t, err)
+
+	_, _, err = redeemVoucher(dir, "../ABCDEFGHJK", "aa:bb:cc:dd:ee:ff", now)
+	assert.NotNil(t, err)
+
+	v, err := loadVoucher(dir, "ABCDEFGHJK")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aa:bb:cc:dd:ee:ff"}, v.Devices)
+}
+
+func TestRedeemVoucherConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	err = saveVoucher(dir, &voucher{Code: "ABCDEFGHJK", ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(time.Hour), MaxDevices: 2})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := redeemVoucher(dir, "ABCDEFGHJK", fmt.Sprintf("02:00:00:00:00:%02x", i), now)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	redeemed := 0
+	for err := range errs {
+		if err == nil {
+			redeemed++
+		}
+	}
+	assert.Equal(t, 2, redeemed)
+
+	v, err := loadVoucher(dir, "ABCDEFGHJK")
+	assert.Nil(t, err)
+	assert.Len(t, v.Devices, 2, "no registration may be lost")
+}
+
+func TestEnforcePortalVouchers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	err = saveVoucher(dir, &voucher{Code: "EXPIRED234", ValidFrom: now.Add(-2 * time.Hour), ValidUntil: now.Add(-time.Minute), MaxDevices: 2, Devices: []string{"aa:bb:cc:dd:ee:ff", "11:22:33:44:55:66"}})
+	assert.Nil(t, err)
+	err = saveVoucher(dir, &voucher{Code: "VALID23456", ValidFrom: now, ValidUntil: now.Add(time.Hour), MaxDevices: 1, Devices: []string{"22:22:22:22:22:22"}})
+	assert.Nil(t, err)
+
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{
+		"STA-FIRST":                        "aa:bb:cc:dd:ee:ff\nconnected_time=42\n",
+		"STA-NEXT aa:bb:cc:dd:ee:ff":       "22:22:22:22:22:22\nconnected_time=7\n",
+		"DEAUTHENTICATE aa:bb:cc:dd:ee:ff": "OK\n",
+	}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_public": ctrl})()
+
+	var revoked []string
+	n := network{Name: "wl_public", VoucherMode: voucherModePortal, VoucherDir: dir}
+	err = enforceVouchers(n, now, func(mac net.HardwareAddr) error {
+		revoked = append(revoked, mac.String())
+		return nil
+	})
+	assert.Nil(t, err)
+
+	assert.Contains(t, ctrl.Requests, "DEAUTHENTICATE aa:bb:cc:dd:ee:ff")
+	assert.NotContains(t, ctrl.Requests, "DEAUTHENTICATE 22:22:22:22:22:22")
+	assert.Equal(t, []string{"aa:bb:cc:dd:ee:ff", "11:22:33:44:55:66"}, revoked)
+
+	vouchers, err := loadVouchers(dir)
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 1)
+	assert.Equal(t, "VALID23456", vouchers[0].Code)
+}
+
+func TestEnforcePSKVouchers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	err = saveVoucher(path.Join(dir, "voucher_codes"), &voucher{Code: "VALID23456", ValidFrom: now, ValidUntil: now.Add(time.Hour), MaxDevices: 1})
+	assert.Nil(t, err)
+
+	ctrl := &mockHostapdCtrl{Replies: map[string]string{
+		"STA-FIRST":                        "aa:bb:cc:dd:ee:ff\nkeyid=VALID23456\n",
+		"STA-NEXT aa:bb:cc:dd:ee:ff":       "11:22:33:44:55:66\nkeyid=VALID23456\n",
+		"DEAUTHENTICATE 11:22:33:44:55:66": "OK\n",
+		"RELOAD_WPA_PSK":                   "OK\n",
+	}}
+	defer withMockHostapd(map[string]*mockHostapdCtrl{"wl_public": ctrl})()
+
+	n := network{Name: "wl_public", VoucherMode: voucherModePSK, VoucherDir: path.Join(dir, "voucher_codes"), PSKFile: path.Join(dir, "wl_public.psk")}
+	err = enforceVouchers(n, now, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"STA-FIRST",
+		"STA-NEXT aa:bb:cc:dd:ee:ff",
+		"STA-NEXT 11:22:33:44:55:66",
+		"DEAUTHENTICATE 11:22:33:44:55:66",
+		"RELOAD_WPA_PSK",
+	}, ctrl.Requests, "the second device exceeds the limit")
+
+	psks, err := ioutil.ReadFile(n.PSKFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "keyid=VALID23456 00:00:00:00:00:00 VALID23456\n", string(psks))
+
+	v, err := loadVoucher(n.VoucherDir, "VALID23456")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aa:bb:cc:dd:ee:ff"}, v.Devices)
+
+	ctrl.Requests = nil
+	err = enforceVouchers(n, now, nil)
+	assert.Nil(t, err)
+	assert.NotContains(t, ctrl.Requests, "RELOAD_WPA_PSK", "nothing changed")
+}